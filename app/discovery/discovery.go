@@ -6,10 +6,16 @@ package discovery
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,11 +27,26 @@ import (
 
 // Service implements discovery with multiple providers and url matcher
 type Service struct {
+	// Precedence defines providers order for conflicting routes, i.e. [file, docker] makes file routes
+	// override docker routes with the same server and source. Providers not listed come after the listed
+	// ones, and conflicting routes of equal precedence are all kept. Empty Precedence keeps all routes
+	Precedence []ProviderID
+	// ReadyInterval defines how often routes with ReadyURL probed till ready, and failed warmups of routes
+	// with WarmupURL retried, 1s if not set
+	ReadyInterval time.Duration
+
 	providers    []Provider
 	mappers      map[string][]URLMapper
-	mappersCache map[string][]URLMapper
+	mappersCache map[string][]URLMapper // mappers by server name matched wildcard or regex server, reset with table
+	cacheLock    sync.Mutex             // guards mappersCache updates made under the read lock
 	lock         sync.RWMutex
 	interval     time.Duration
+	groups       map[groupKey][]string // available groups per route, rebuilt with mappers
+	activeGroups map[groupKey]string   // active group per route set by SetActiveGroup, kept across reloads
+	ready        map[string]bool       // readiness urls passed the probe, kept across reloads
+	warmups      map[string]*warmup    // warmup state by url, kept across reloads
+	subs         map[*subscriber]struct{}
+	subsLock     sync.Mutex
 }
 
 // URLMapper contains all info about source and destination routes
@@ -39,14 +60,89 @@ type URLMapper struct {
 	RedirectType RedirectType
 	KeepHost     *bool
 	OnlyFromIPs  []string
+	Visibility   Visibility
+	Proto        UpstreamProto
+	Socket       string // unix socket path, used instead of destination's host:port if set
+	StickyCookie string // cookie name for sticky sessions across multiple destinations of the route
+	WebSocket    bool   // websocket route, proxied without buffering and server timeouts
+	Unbuffered   bool   // response streamed to the client as-is, flushed after each write
+	NoKeepAlive  bool   // upstream connection closed after each request, not reused
+	Builtin      string // name of reproxy's built-in handler serving the route instead of the destination
+	NonCritical  bool   // failed ping of the route doesn't fail aggregated health, route still marked dead
+	Coalesce     bool   // identical concurrent GET requests share a single upstream call
+	Raw          bool   // raw passthrough route, logging, body limit, gzip and caching middlewares skipped
+	Dispatch     bool   // destination's host is a routing key, resolved to host:port by the provider on request
+
+	RequestIDHeader string        // request id header name override for the route
+	CacheTTL        time.Duration // edge cache ttl for successful GET responses, 0 means no caching
+	CatchAll        bool          // default route, matched after all other routes including assets
+	RewriteLocation string        // upstream base url, i.e. http://172.17.0.2:8080, Location headers pointing to it rewritten
+	RewritePath     string        // fixed upstream path, i.e. /ingest, used verbatim instead of the destination's path
+	FollowRedirects bool          // upstream redirects to the same upstream followed, by default 3xx passed to the client
+	TimingHeader    bool          // X-Upstream-Time response header set with upstream time to the response headers
+	Fallback        string        // served if all destinations dead, builtin://name or url, i.e. http://maint:8080/$1
+	Listener        string        // named listener the route served on, served on all listeners if empty
+	MaxConn         int           // max concurrent requests to the route, 0 means unlimited
+	MaxConnWait     time.Duration // how long excess request waits for a free slot, rejected right away if 0
+	MaxConnPerIP    int           // max concurrent requests to the route from a single client ip, 0 means unlimited
+	RateLimit       int           // max requests per second to the route, or to all routes of RateLimitGroup. 0 means unlimited
+	RateLimitGroup  string        // shared rate limit bucket name, routes of the group limited together
+	SNI             string        // tls server name for https upstream, overrides destination host in handshake
+	SourceIP        string        // local address upstream connections made from, i.e. on multi-homed host
+	LogFile         string        // access log target of the route, logged to the main access log if empty
+	MetricName      string        // stable route id for per-route metrics, i.e. compose service. no route metrics if empty
+
+	MatchHeaders   []HeaderCondition // request headers required to match the route, in addition to server and path
+	MatchQuery     []QueryCondition  // query parameters required to match the route, checked after path matched
+	RequireHeaders []string          // request headers required to be present, requests without them rejected with 400
+	ContentTypes   []string          // allowed media types of POST and PUT requests, others rejected with 415. Any if empty
+	Group          string            // deployment group, i.e. blue or green. Only the active group of the route matched
+	MTLS           bool              // require verified client certificate, requests without it rejected with 403
+	AllowUA        *regexp.Regexp    // User-Agent required to match, requests with other or no User-Agent rejected with 403
+	MinTLS         uint16            // min tls version negotiated with the client, i.e. tls.VersionTLS13. 0 means any
+	ALPN           string            // tls protocol negotiated with the client required to match, i.e. h2 or http/1.1
+
+	ResponseRewrite []BodyRewrite   // substitutions applied to text response bodies, in order
+	StatusMap       map[int]int     // upstream response status rewrites, from -> to
+	StatusHeaders   []StatusHeader  // response headers set on upstream status, the most specific status wins
+	LogBody         int             // max request body bytes logged for debugging, 0 means disabled
+	GzipLevel       int             // gzip compression level of the route, 1-9, with gzip enabled. 0 means default level
+	GzipMin         int             // min response size compressed, smaller responses sent as-is. 0 means any size
+	SlowLog         time.Duration   // requests taking longer logged as slow, 0 means disabled
+	RetryAfter      int             // Retry-After seconds sent with 503 and 429 responses of the route, 0 means default
+	ReadyURL        string          // readiness probe url, the route not matched till it responds with 200
+	WarmupURL       string          // warmup url, requested once the route ready, the route not matched till then
+	Forwarded       ForwardedPolicy // X-Forwarded-* headers handling, set by reproxy by default
+	Timeout         time.Duration   // total upstream request timeout, including response body, 0 means no limit
+	IdleTimeout     time.Duration   // max time without data from upstream, for streams. 0 means no limit
+	HeaderTimeout   time.Duration   // max time reading request headers, requests with slower headers rejected. 0 means no limit
+	Fault           Fault           // faults injected for chaos testing, applied only with faults enabled globally
+	Breaker         Breaker         // circuit breaker of the route's destinations, disabled if threshold not set
+	JWT             JWT             // bearer token required and validated, disabled if no key source set
+	Weight          int             // relative share of requests among destinations of the route, 0 means DefaultWeight
+	TTL             time.Duration   // route dropped if not listed again by its provider within ttl, 0 means no expiry
+	LastSeen        time.Time       // time the route last listed by its provider, checked against TTL
+
+	StripReqHeaders  []string // request headers removed before proxying to destination
+	StripRespHeaders []string // response headers removed before sending to client
 
 	AssetsLocation string // local FS root location
 	AssetsWebRoot  string // web root location
 	AssetsSPA      bool   // spa mode, redirect to webroot/index.html on not found
+	AssetsOverlay  bool   // assets matched before proxy routes, i.e. local files in front of the container
 
 	dead bool
 }
 
+// RequestInfo contains request details used by Match in addition to server and path
+type RequestInfo struct {
+	Internal bool        // request received on the internal listener
+	Listener string      // name of the named listener received the request, empty for the main and internal listeners
+	Header   http.Header // request headers, checked against MatchHeaders
+	Query    url.Values  // request query parameters, checked against MatchQuery
+	ALPN     string      // protocol negotiated with the client on tls handshake, empty for plain http
+}
+
 // Matches returns result of url mapping. May have multiple routes. Lack of any routes means no match was wound
 type Matches struct {
 	MatchType MatchType
@@ -66,6 +162,19 @@ type Provider interface {
 	List() (res []URLMapper, err error)
 }
 
+// ProviderIdentifier is an optional interface for providers, Service stamps the ID on mappers
+// provided without ProviderID, to attribute every route to the originating provider
+type ProviderIdentifier interface {
+	ID() ProviderID
+}
+
+// Dispatcher is an optional interface for providers of dispatch mappers, see URLMapper.Dispatch. Dispatch
+// resolves the routing key, i.e. container name, to host:port of the destination at request time
+type Dispatcher interface {
+	ProviderIdentifier
+	Dispatch(key string) (hostPort string, ok bool)
+}
+
 // ProviderID holds provider identifier to emulate enum of them
 type ProviderID string
 
@@ -75,8 +184,30 @@ const (
 	PIStatic        ProviderID = "static"
 	PIFile          ProviderID = "file"
 	PIConsulCatalog ProviderID = "consul-catalog"
+	PIRemote        ProviderID = "remote"
+	PIEtcd          ProviderID = "etcd"
+	PINomad         ProviderID = "nomad"
+	PISQL           ProviderID = "sql"
+	PIRedis         ProviderID = "redis"
+	PIKubernetes    ProviderID = "kubernetes"
+	PIECS           ProviderID = "ecs"
+	PISnapshot      ProviderID = "snapshot"
 )
 
+// ParseProviderID converts string value to one of known provider ids
+func ParseProviderID(s string) (ProviderID, error) {
+	pid := ProviderID(strings.ToLower(strings.TrimSpace(s)))
+	switch pid {
+	case PIDocker, PIStatic, PIFile, PIConsulCatalog, PIRemote, PIEtcd, PINomad, PISQL, PIKubernetes, PIRedis, PIECS, PISnapshot:
+		return pid, nil
+	default:
+		return "", fmt.Errorf("unknown provider %q", s)
+	}
+}
+
+// DefaultWeight is the weight of destinations without Weight set
+const DefaultWeight = 100
+
 var reGroup = regexp.MustCompile(`(^.*)/\(.*\)`) // capture regex group lil (anything) from src like /blah/foo/(.*)
 
 // MatchType defines the type of mapper (rule)
@@ -99,6 +230,336 @@ func (m MatchType) String() string {
 	}
 }
 
+// Visibility defines which listeners are allowed to serve the route
+type Visibility string
+
+// enum of all visibility types
+const (
+	VisibilityPublic   Visibility = ""         // default, served on all listeners
+	VisibilityInternal Visibility = "internal" // served on the internal listener only
+)
+
+// ParseVisibility converts string value to Visibility, empty string and "public" mean VisibilityPublic
+func ParseVisibility(s string) (Visibility, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "public":
+		return VisibilityPublic, nil
+	case "internal":
+		return VisibilityInternal, nil
+	default:
+		return VisibilityPublic, fmt.Errorf("invalid visibility %q", s)
+	}
+}
+
+// ForwardedPolicy defines how X-Forwarded-* headers of the proxied request handled
+type ForwardedPolicy string
+
+// enum of all forwarded policies
+const (
+	ForwardedSet    ForwardedPolicy = ""       // default, client provided headers dropped and set by reproxy
+	ForwardedAppend ForwardedPolicy = "append" // client provided headers kept, client ip appended to X-Forwarded-For
+	ForwardedStrip  ForwardedPolicy = "strip"  // no X-Forwarded-* headers sent to upstream
+)
+
+// ParseForwardedPolicy converts string value to ForwardedPolicy, empty string and "set" mean ForwardedSet
+func ParseForwardedPolicy(s string) (ForwardedPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "set":
+		return ForwardedSet, nil
+	case "append":
+		return ForwardedAppend, nil
+	case "strip":
+		return ForwardedStrip, nil
+	default:
+		return ForwardedSet, fmt.Errorf("invalid forwarded policy %q", s)
+	}
+}
+
+// ParseTLSVersion converts tls version string, i.e. "1.2", to tls.VersionTLS12 and so on
+func ParseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimSpace(s) {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid tls version %q, should be one of 1.0, 1.1, 1.2 or 1.3", s)
+	}
+}
+
+// UpstreamProto defines protocol used to talk to upstream (destination)
+type UpstreamProto string
+
+// enum of all upstream protocols
+const (
+	UPHTTP UpstreamProto = ""    // default, http/1.1 or http/2 negotiated with tls
+	UPH2C  UpstreamProto = "h2c" // http/2 cleartext with prior knowledge, i.e. grpc without tls
+
+	UPHTTP11 UpstreamProto = "http1.1" // http/1.1 only, no http/2 even if upstream supports it
+	UPHTTP10 UpstreamProto = "http1.0" // legacy http/1.0, no chunked request body and no keep-alive
+)
+
+// ParseUpstreamProto converts string value to UpstreamProto, empty string and "http" mean UPHTTP
+func ParseUpstreamProto(s string) (UpstreamProto, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "http":
+		return UPHTTP, nil
+	case "h2c":
+		return UPH2C, nil
+	case "http1.1", "http/1.1":
+		return UPHTTP11, nil
+	case "http1.0", "http/1.0":
+		return UPHTTP10, nil
+	default:
+		return UPHTTP, fmt.Errorf("invalid proto %q", s)
+	}
+}
+
+// HeaderCondition defines request header required by the route. Empty Value means any value of the header.
+// Condition with Values is a set membership, the header should have one of the values, compared case-insensitive
+type HeaderCondition struct {
+	Name   string   `json:"name"`
+	Value  string   `json:"value,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+// ParseHeaderConditions converts comma separated list of name=value pairs to header conditions,
+// i.e. "X-Version=beta,X-Canary". Name without value requires the header to be present.
+func ParseHeaderConditions(s string) ([]HeaderCondition, error) {
+	res := []HeaderCondition{}
+	for _, elem := range strings.Split(s, ",") {
+		name, value, _ := strings.Cut(elem, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			return nil, fmt.Errorf("invalid header condition %q", elem)
+		}
+		res = append(res, HeaderCondition{Name: http.CanonicalHeaderKey(name), Value: value})
+	}
+	return res, nil
+}
+
+// ParseHeaderSetCondition converts name=value1,value2 to the set membership header condition,
+// i.e. "X-Country=DE,FR,IT" matches requests with X-Country header set to any of the listed values
+func ParseHeaderSetCondition(s string) (HeaderCondition, error) {
+	name, list, _ := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t:") {
+		return HeaderCondition{}, fmt.Errorf("invalid header set condition %q", s)
+	}
+	res := HeaderCondition{Name: http.CanonicalHeaderKey(name)}
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res.Values = append(res.Values, v)
+		}
+	}
+	if len(res.Values) == 0 {
+		return HeaderCondition{}, fmt.Errorf("invalid header set condition %q, no values", s)
+	}
+	return res, nil
+}
+
+// QueryCondition defines query parameter required by the route. Empty Value means any value of the parameter.
+// For parameter repeated in query, i.e. ?tenant=a&tenant=b, any of its values can match
+type QueryCondition struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// ParseQueryConditions converts comma separated list of name=value pairs to query conditions,
+// i.e. "tenant=foo,debug". Name without value requires the parameter to be present.
+func ParseQueryConditions(s string) ([]QueryCondition, error) {
+	res := []QueryCondition{}
+	for _, elem := range strings.Split(s, ",") {
+		name, value, _ := strings.Cut(elem, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "" || strings.ContainsAny(name, " \t&") {
+			return nil, fmt.Errorf("invalid query condition %q", elem)
+		}
+		res = append(res, QueryCondition{Name: name, Value: value})
+	}
+	return res, nil
+}
+
+// ParseStatusMap converts comma separated list of from=>to status code pairs to the map of response status rewrites,
+// i.e. "404=>200,502=>503". Both codes should be valid non-informational statuses, 200-599
+func ParseStatusMap(s string) (map[int]int, error) {
+	res := map[int]int{}
+	for _, elem := range strings.Split(s, ",") {
+		from, to, ok := strings.Cut(elem, "=>")
+		if !ok {
+			return nil, fmt.Errorf("invalid status map %q", elem)
+		}
+		fromCode, errFrom := strconv.Atoi(strings.TrimSpace(from))
+		toCode, errTo := strconv.Atoi(strings.TrimSpace(to))
+		if errFrom != nil || errTo != nil || fromCode < 200 || fromCode > 599 || toCode < 200 || toCode > 599 {
+			return nil, fmt.Errorf("invalid status map %q, codes should be in 200-599 range", elem)
+		}
+		if _, dup := res[fromCode]; dup {
+			return nil, fmt.Errorf("duplicate status map for %d", fromCode)
+		}
+		res[fromCode] = toCode
+	}
+	return res, nil
+}
+
+// StatusHeader defines response header set if upstream status is in [From, To] range, i.e. 500-599 for 5xx
+type StatusHeader struct {
+	From  int
+	To    int
+	Name  string
+	Value string
+}
+
+var reStatusHeader = regexp.MustCompile(`^\s*([1-5](?:\d\d|xx)):`)
+
+// ParseStatusHeaders converts comma separated list of status:name=value to status headers,
+// i.e. "5xx:Cache-Control=no-store,404:X-Missing=1". Status is either a code or a class, like 5xx.
+// Element not starting with status continues the value of the previous one, i.e. "5xx:Cache-Control=no-store, no-cache"
+func ParseStatusHeaders(s string) ([]StatusHeader, error) {
+	res := []StatusHeader{}
+	for _, elem := range strings.Split(s, ",") {
+		m := reStatusHeader.FindStringSubmatch(elem)
+		if m == nil {
+			if len(res) == 0 {
+				return nil, fmt.Errorf("invalid status header %q", elem)
+			}
+			res[len(res)-1].Value += "," + elem
+			continue
+		}
+		name, value, ok := strings.Cut(elem[len(m[0]):], "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t:") {
+			return nil, fmt.Errorf("invalid status header %q", elem)
+		}
+		sh := StatusHeader{Name: http.CanonicalHeaderKey(name), Value: value}
+		if strings.HasSuffix(m[1], "xx") {
+			sh.From = int(m[1][0]-'0') * 100
+			sh.To = sh.From + 99
+		} else {
+			sh.From, _ = strconv.Atoi(m[1])
+			sh.To = sh.From
+		}
+		res = append(res, sh)
+	}
+	for i := range res {
+		res[i].Value = strings.TrimSpace(res[i].Value)
+	}
+	return res, nil
+}
+
+// BodyRewrite defines a single substitution in the response body, From replaced with To
+type BodyRewrite struct {
+	From string
+	To   string
+}
+
+// ParseBodyRewrites converts comma separated list of from=>to pairs to body rewrites,
+// i.e. "http://172.17.0.2:8080=>https://example.com,internal.lan=>example.com". Empty To removes From.
+func ParseBodyRewrites(s string) ([]BodyRewrite, error) {
+	res := []BodyRewrite{}
+	for _, elem := range strings.Split(s, ",") {
+		from, to, ok := strings.Cut(elem, "=>")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" {
+			return nil, fmt.Errorf("invalid body rewrite %q", elem)
+		}
+		res = append(res, BodyRewrite{From: from, To: to})
+	}
+	return res, nil
+}
+
+// Fault defines faults injected into requests of the route for chaos testing. Faults applied only if enabled
+// globally, zero value injects nothing
+type Fault struct {
+	Delay        time.Duration // delay before proxying the request
+	DelayPercent float64       // share of delayed requests, 0-100
+	AbortStatus  int           // status code of aborted requests, not proxied
+	AbortPercent float64       // share of aborted requests, 0-100
+}
+
+// ParseFaultDelay converts delay with optional share of delayed requests, i.e. "500ms" or "500ms:25%", to delay
+// and percent. All requests delayed if share is not set
+func ParseFaultDelay(s string) (time.Duration, float64, error) {
+	v, pct, _ := strings.Cut(s, ":")
+	delay, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil || delay <= 0 {
+		return 0, 0, fmt.Errorf("invalid fault delay %q", s)
+	}
+	percent, err := parseFaultPercent(pct)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid fault delay %q: %w", s, err)
+	}
+	return delay, percent, nil
+}
+
+// ParseFaultAbort converts status with optional share of aborted requests, i.e. "503" or "503:10%", to status
+// and percent. Status should be 400-599, all requests aborted if share is not set
+func ParseFaultAbort(s string) (int, float64, error) {
+	v, pct, _ := strings.Cut(s, ":")
+	status, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || status < 400 || status > 599 {
+		return 0, 0, fmt.Errorf("invalid fault abort %q, status should be in 400-599 range", s)
+	}
+	percent, err := parseFaultPercent(pct)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid fault abort %q: %w", s, err)
+	}
+	return status, percent, nil
+}
+
+// parseFaultPercent parses share of requests, i.e. "25%" or "25", empty means 100
+func parseFaultPercent(s string) (float64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "%")
+	if s == "" {
+		return 100, nil
+	}
+	res, err := strconv.ParseFloat(s, 64)
+	if err != nil || res <= 0 || res > 100 {
+		return 0, errors.New("percent should be in (0, 100] range")
+	}
+	return res, nil
+}
+
+// Breaker defines circuit breaker of the route's destinations. Threshold consecutive failures of a destination,
+// 5xx responses or failed upstream calls, open its circuit for Open duration, and requests to it rejected till
+// then. Upstream's 503 with Retry-After opens the circuit for the hinted time instead. Zero value disables breaker
+type Breaker struct {
+	Threshold int           // consecutive failures opening the circuit
+	Open      time.Duration // how long the circuit kept open, default used if not set
+}
+
+// ParseBreaker converts failures threshold with optional open duration, i.e. "5" or "5:30s", to Breaker
+func ParseBreaker(s string) (Breaker, error) {
+	v, open, hasOpen := strings.Cut(s, ":")
+	threshold, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || threshold <= 0 {
+		return Breaker{}, fmt.Errorf("invalid breaker %q, threshold should be a positive integer", s)
+	}
+	res := Breaker{Threshold: threshold}
+	if hasOpen {
+		if res.Open, err = time.ParseDuration(strings.TrimSpace(open)); err != nil || res.Open <= 0 {
+			return Breaker{}, fmt.Errorf("invalid breaker open duration %q", s)
+		}
+	}
+	return res, nil
+}
+
+// JWT defines bearer token validation of the route. Token signature verified with HMAC Secret, for HS256, HS384
+// and HS512 tokens, or with RSA and EC keys of JWKSURL, for RS* and ES* tokens. Zero value disables validation
+type JWT struct {
+	Secret  string            // HMAC signing key
+	JWKSURL string            // json web key set url, i.e. https://auth.example.com/.well-known/jwks.json
+	Claims  map[string]string // required claims, name -> value. Array claims, i.e. aud, match any element
+	Headers map[string]string // claims forwarded to upstream as request headers, claim name -> header name
+}
+
+// Enabled checks if the key source set
+func (j JWT) Enabled() bool { return j.Secret != "" || j.JWKSURL != "" }
+
 // RedirectType defines types of redirects
 type RedirectType int
 
@@ -123,6 +584,7 @@ func (s *Service) Run(ctx context.Context) error {
 		evChs = append(evChs, p.Events(ctx))
 	}
 	ch := s.mergeEvents(ctx, evChs...)
+	go s.readinessLoop(ctx)
 	var evRecv bool
 	for {
 		select {
@@ -132,7 +594,7 @@ func (s *Service) Run(ctx context.Context) error {
 			log.Printf("[DEBUG] new update event received, %s", ev)
 			evRecv = true
 		case <-time.After(s.interval):
-			if !evRecv {
+			if !evRecv && !s.hasExpired(time.Now()) {
 				continue
 			}
 			evRecv = false
@@ -150,20 +612,33 @@ func (s *Service) Run(ctx context.Context) error {
 						m.AssetsLocation, onlyFrom)
 				}
 			}
-			s.lock.Lock()
-			s.mappers = make(map[string][]URLMapper)
-			s.mappersCache = make(map[string][]URLMapper)
-			for _, m := range lst {
-				s.mappers[m.Server] = append(s.mappers[m.Server], m)
-			}
-			s.lock.Unlock()
+			s.swapTable(lst)
+			s.publish()
 		}
 	}
 }
 
+// swapTable builds the complete routes table of mappers and swaps it in at once. The table is built without
+// the lock, so requests keep matching the old table meanwhile and never see a partially populated one
+func (s *Service) swapTable(lst []URLMapper) {
+	mappers := make(map[string][]URLMapper)
+	for _, m := range lst {
+		mappers[m.Server] = append(mappers[m.Server], m)
+	}
+	groups := routeGroups(lst)
+
+	s.lock.Lock()
+	s.mappers, s.mappersCache, s.groups = mappers, make(map[string][]URLMapper), groups
+	s.updateReady(lst)
+	s.updateWarmups(lst)
+	s.lock.Unlock()
+}
+
 // Match url to all mappers. Returns Matches with potentially multiple destinations for MTProxy.
-// For MTStatic always a single match because fail-over doesn't supported for assets
-func (s *Service) Match(srv, src string) (res Matches) {
+// For MTStatic always a single match because fail-over doesn't supported for assets.
+// Mappers not servable on the listener defined by info are skipped, i.e. internal routes never
+// matched for requests received on the public listener.
+func (s *Service) Match(srv, src string, info RequestInfo) (res Matches) {
 
 	s.lock.RLock()
 	defer s.lock.RUnlock()
@@ -172,15 +647,26 @@ func (s *Service) Match(srv, src string) (res Matches) {
 	for _, srvName := range []string{srv, "*", ""} {
 		for _, m := range findMatchingMappers(s, srvName) {
 
+			if !m.servableOn(info) || !s.groupServable(m) || !s.readyServable(m) || !s.warmServable(m) {
+				continue
+			}
+
 			// if the first match found and the next src match is not identical we can stop as src match regexes presorted
 			if len(res.Routes) > 0 && m.SrcMatch.String() != lastSrcMatch {
+				res.Routes = mostSpecific(res.Routes)
 				return res
 			}
 
 			switch m.MatchType {
 			case MTProxy:
 				dest := m.SrcMatch.ReplaceAllString(src, m.Dst)
-				if src != dest { // regex matched
+				if src != dest && m.queryMatch(info.Query) { // regex matched, query conditions checked for matched path only
+					if m.Dispatch {
+						var ok bool
+						if dest, ok = s.dispatch(m, dest); !ok {
+							continue // unknown routing key, the request may match other routes
+						}
+					}
 					lastSrcMatch = m.SrcMatch.String()
 					res.MatchType = MTProxy
 					res.Routes = append(res.Routes, MatchedRoute{Destination: dest, Alive: m.IsAlive(), Mapper: m})
@@ -190,7 +676,7 @@ func (s *Service) Match(srv, src string) (res Matches) {
 				if wr != "/" {
 					wr += "/"
 				}
-				if src == m.AssetsWebRoot || strings.HasPrefix(src, wr) {
+				if (src == m.AssetsWebRoot || strings.HasPrefix(src, wr)) && m.queryMatch(info.Query) {
 					res.MatchType = MTStatic
 					destSfx := ":norm"
 					if m.AssetsSPA {
@@ -204,15 +690,40 @@ func (s *Service) Match(srv, src string) (res Matches) {
 		}
 	}
 
+	res.Routes = mostSpecific(res.Routes)
 	return res
 }
 
+// dispatch resolves destination of dispatch mapper. Host of the destination, i.e. http://web/x for
+// http://$1$2, is the routing key resolved to host:port by the mapper's provider implementing Dispatcher
+func (s *Service) dispatch(m URLMapper, dest string) (string, bool) {
+	u, err := url.Parse(dest)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	for _, p := range s.providers {
+		d, ok := p.(Dispatcher)
+		if !ok || d.ID() != m.ProviderID {
+			continue
+		}
+		hostPort, ok := d.Dispatch(u.Host)
+		if !ok {
+			return "", false
+		}
+		return strings.Replace(dest, "//"+u.Host, "//"+hostPort, 1), true
+	}
+	return "", false
+}
+
 func findMatchingMappers(s *Service, srvName string) []URLMapper {
 	// strict match - for backward compatibility
 	if mappers, isStrictMatch := s.mappers[srvName]; isStrictMatch {
 		return mappers
 	}
 
+	// cache updated by concurrent matches holding the read lock only
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
 	if cachedMapper, isCached := s.mappersCache[srvName]; isCached {
 		return cachedMapper
 	}
@@ -223,6 +734,14 @@ func findMatchingMappers(s *Service, srvName string) []URLMapper {
 			continue
 		}
 
+		if wildcard, ok := matchWildcardServer(mapperServer, srvName); ok {
+			if wildcard {
+				s.mappersCache[srvName] = mapper
+				return mapper
+			}
+			continue
+		}
+
 		re, err := regexp.Compile(mapperServer)
 		if err != nil {
 			log.Printf("[WARN] invalid regexp %s: %s", mapperServer, err)
@@ -238,7 +757,19 @@ func findMatchingMappers(s *Service, srvName string) []URLMapper {
 	return nil
 }
 
-// ScheduleHealthCheck starts background loop with health-check
+// matchWildcardServer matches server name against wildcard pattern like *.example.com, where * is a single
+// dns label, i.e. api.example.com matched but example.com and a.b.example.com not.
+// returns ok=false if the pattern is not a wildcard
+func matchWildcardServer(pattern, srvName string) (matched, ok bool) {
+	if !strings.HasPrefix(pattern, "*.") || len(pattern) < 3 {
+		return false, false
+	}
+	label, domain, found := strings.Cut(strings.ToLower(srvName), ".")
+	return found && label != "" && domain == strings.ToLower(pattern[2:]), true
+}
+
+// ScheduleHealthCheck starts background loop with health-check. Pings spread across the interval,
+// each ping url checked with its own deterministic offset to avoid probing all upstreams at once
 func (s *Service) ScheduleHealthCheck(ctx context.Context, interval time.Duration) {
 	log.Printf("health-check scheduled every %s", interval)
 
@@ -248,20 +779,7 @@ func (s *Service) ScheduleHealthCheck(ctx context.Context, interval time.Duratio
 		for {
 			select {
 			case <-ticker.C:
-				pingErrs := s.CheckHealth()
-
-				s.lock.Lock()
-				for _, mappers := range s.mappers {
-					for i := range mappers {
-						if err, ok := pingErrs[mappers[i].PingURL]; ok {
-							mappers[i].dead = false
-							if err != nil {
-								mappers[i].dead = true
-							}
-						}
-					}
-				}
-				s.lock.Unlock()
+				s.checkHealthJittered(ctx, interval)
 			case <-ctx.Done():
 				return
 			}
@@ -269,6 +787,68 @@ func (s *Service) ScheduleHealthCheck(ctx context.Context, interval time.Duratio
 	}()
 }
 
+// checkHealthJittered pings all proxy mappers, each ping url delayed by healthJitter within the interval.
+// blocks until all pings done and marks failed mappers as dead
+func (s *Service) checkHealthJittered(ctx context.Context, interval time.Duration) {
+	s.lock.RLock()
+	targets := map[string]URLMapper{} // unique ping urls
+	for _, mappers := range s.mappers {
+		for _, m := range mappers {
+			if m.MatchType == MTProxy && m.PingURL != "" {
+				targets[m.PingURL] = m
+			}
+		}
+	}
+	s.lock.RUnlock()
+
+	const concurrent = 8
+	sema := make(chan struct{}, concurrent) // limit health check to 8 concurrent calls
+	var wg sync.WaitGroup
+	for pingURL, m := range targets {
+		wg.Add(1)
+		go func(pingURL string, m URLMapper) {
+			defer wg.Done()
+			select {
+			case <-time.After(healthJitter(pingURL, interval)):
+			case <-ctx.Done():
+				return
+			}
+			sema <- struct{}{}
+			errMsg, err := m.ping()
+			<-sema
+			if err != nil {
+				log.Printf("[DEBUG] %s", errMsg)
+			}
+			s.setHealth(pingURL, err == nil)
+		}(pingURL, m)
+	}
+	wg.Wait()
+}
+
+// healthJitter returns deterministic offset of the ping url within the interval,
+// so the same route is probed at the same point of each cycle, across reloads too
+func healthJitter(pingURL string, interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(pingURL))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// setHealth marks all mappers with the ping url as alive or dead
+func (s *Service) setHealth(pingURL string, alive bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, mappers := range s.mappers {
+		for i := range mappers {
+			if mappers[i].PingURL == pingURL {
+				mappers[i].dead = !alive
+			}
+		}
+	}
+}
+
 // Servers return list of all servers, skips "*" (catch-all/default)
 func (s *Service) Servers() (servers []string) {
 	s.lock.RLock()
@@ -363,12 +943,19 @@ func (s *Service) mergeLists() (res []URLMapper) {
 			log.Printf("[DEBUG] can't get list for %s, %v", p, err)
 			continue
 		}
+		pid, hasID := p.(ProviderIdentifier)
 		for i := range lst {
+			if hasID && lst[i].ProviderID == "" {
+				lst[i].ProviderID = pid.ID()
+			}
 			lst[i] = s.redirects(lst[i])
 			lst[i] = s.extendMapper(lst[i])
 		}
-		res = append(res, lst...)
+		res = append(res, dropExpired(lst, time.Now())...)
 	}
+	s.reportCollisions(res)
+	res = s.applyPrecedence(res)
+	alignRateLimits(res)
 
 	// sort rules to make assets last and prioritize longer rules first
 	sort.Slice(res, func(i, j int) bool {
@@ -384,14 +971,144 @@ func (s *Service) mergeLists() (res []URLMapper) {
 		return res[i].SrcMatch.String() < res[j].SrcMatch.String()
 	})
 
-	// sort to put assets down in the list
-	sort.Slice(res, func(i, j int) bool {
+	// sort to put assets down in the list and catch-all routes at the very end, overlay assets go first
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].CatchAll != res[j].CatchAll {
+			return !res[i].CatchAll
+		}
+		if res[i].AssetsOverlay != res[j].AssetsOverlay {
+			return res[i].AssetsOverlay
+		}
 		return res[i].MatchType < res[j].MatchType
 	})
 
 	return res
 }
 
+// hasExpired checks if any of active routes not seen by its provider within the route ttl.
+// Expired routes trigger the reload even without events, to drop phantom routes of missed down-events
+func (s *Service) hasExpired(now time.Time) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, srvMappers := range s.mappers {
+		for _, m := range srvMappers {
+			if m.expired(now) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dropExpired removes routes not seen within their ttl, i.e. kept by provider from the last successful list
+func dropExpired(mappers []URLMapper, now time.Time) []URLMapper {
+	res := mappers[:0]
+	for _, m := range mappers {
+		if m.expired(now) {
+			log.Printf("[WARN] route %s %s from %s expired, not seen for %v", m.Server, m.SrcMatch.String(),
+				m.ProviderID, now.Sub(m.LastSeen).Truncate(time.Second))
+			continue
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+// reportCollisions logs routes with the same server and source defined by multiple providers
+func (s *Service) reportCollisions(mappers []URLMapper) {
+	type key struct {
+		server, src string
+		mt          MatchType
+	}
+	providers := map[key][]string{}
+	var keys []key // preserve order for stable logging
+	for _, m := range mappers {
+		k := key{server: m.Server, src: m.SrcMatch.String(), mt: m.MatchType}
+		pid := string(m.ProviderID)
+		if _, ok := providers[k]; !ok {
+			keys = append(keys, k)
+		}
+		if !Contains(pid, providers[k]) {
+			providers[k] = append(providers[k], pid)
+		}
+	}
+	for _, k := range keys {
+		if len(providers[k]) > 1 {
+			log.Printf("[WARN] route %s %s (%s) defined by multiple providers: %s", k.server, k.src, k.mt,
+				strings.Join(providers[k], ", "))
+		}
+	}
+}
+
+// alignRateLimits sets the same rate limit for all routes of a rate limit group, as they share a single bucket.
+// Group members without own limit get the group's one. Conflicting limits reported, and the lowest one used
+func alignRateLimits(mappers []URLMapper) {
+	limits := map[string]int{}
+	var groups []string // preserve order for stable logging
+	for _, m := range mappers {
+		if m.RateLimitGroup == "" || m.RateLimit <= 0 {
+			continue
+		}
+		limit, ok := limits[m.RateLimitGroup]
+		if !ok {
+			groups = append(groups, m.RateLimitGroup)
+			limits[m.RateLimitGroup] = m.RateLimit
+			continue
+		}
+		if m.RateLimit != limit {
+			log.Printf("[WARN] rate limit group %s has different limits %d and %d, the lowest used",
+				m.RateLimitGroup, limit, m.RateLimit)
+			limits[m.RateLimitGroup] = min(limit, m.RateLimit)
+		}
+	}
+	if len(groups) == 0 {
+		return
+	}
+	for i := range mappers {
+		if limit, ok := limits[mappers[i].RateLimitGroup]; ok {
+			mappers[i].RateLimit = limit
+		}
+	}
+}
+
+// applyPrecedence drops routes overridden by the same server and source routes of higher precedence providers
+func (s *Service) applyPrecedence(mappers []URLMapper) []URLMapper {
+	if len(s.Precedence) == 0 {
+		return mappers
+	}
+	rank := func(pid ProviderID) int {
+		for i, p := range s.Precedence {
+			if p == pid {
+				return i
+			}
+		}
+		return len(s.Precedence)
+	}
+
+	type key struct {
+		server, src string
+		mt          MatchType
+	}
+	best := map[key]int{}
+	for _, m := range mappers {
+		k := key{server: m.Server, src: m.SrcMatch.String(), mt: m.MatchType}
+		if r, ok := best[k]; !ok || rank(m.ProviderID) < r {
+			best[k] = rank(m.ProviderID)
+		}
+	}
+
+	res := make([]URLMapper, 0, len(mappers))
+	for _, m := range mappers {
+		if rank(m.ProviderID) > best[key{server: m.Server, src: m.SrcMatch.String(), mt: m.MatchType}] {
+			log.Printf("[INFO] route %s %s -> %s from %s overridden by higher precedence provider",
+				m.Server, m.SrcMatch.String(), m.Dst, m.ProviderID)
+			continue
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
 // extendMapper from /something/blah->http://example.com/api to ^/something/blah/(.*)->http://example.com/api/$1
 // also substitutes @ in dest by $. The reason for this substitution - some providers, for example docker
 // treat $ in a special way for variable substitution and user has to escape $, like this reproxy.dest: '/$$1'
@@ -428,16 +1145,8 @@ func (s *Service) extendMapper(m URLMapper) URLMapper {
 		return m
 	}
 
-	res := URLMapper{
-		Server:         m.Server,
-		Dst:            strings.TrimSuffix(m.Dst, "/") + "/$1",
-		ProviderID:     m.ProviderID,
-		PingURL:        m.PingURL,
-		MatchType:      m.MatchType,
-		AssetsWebRoot:  m.AssetsWebRoot,
-		AssetsLocation: m.AssetsLocation,
-		AssetsSPA:      m.AssetsSPA,
-	}
+	res := m
+	res.Dst = strings.TrimSuffix(m.Dst, "/") + "/$1"
 	rx, err := regexp.Compile("^" + strings.TrimSuffix(src, "/") + "/(.*)")
 	if err != nil {
 		log.Printf("[WARN] can't extend %s, %v", m.SrcMatch.String(), err)
@@ -447,7 +1156,8 @@ func (s *Service) extendMapper(m URLMapper) URLMapper {
 	return res
 }
 
-// redirects process @code prefix and sets redirect type, i.e. "@302 /something"
+// redirects process @code prefix and sets redirect type, i.e. "@302 /something". Redirect type set by provider
+// kept for dst without prefix, i.e. for routes restored from snapshot
 func (s *Service) redirects(m URLMapper) URLMapper {
 	switch {
 	case strings.HasPrefix(m.Dst, "@301 ") && len(m.Dst) > 4:
@@ -462,8 +1172,6 @@ func (s *Service) redirects(m URLMapper) URLMapper {
 	case strings.HasPrefix(m.Dst, "@temp ") && len(m.Dst) > 5:
 		m.Dst = m.Dst[6:]
 		m.RedirectType = RTTemp
-	default:
-		m.RedirectType = RTNone
 	}
 	return m
 }
@@ -504,8 +1212,113 @@ func (m URLMapper) IsAlive() bool {
 	return !m.dead
 }
 
+// expired checks if the route with ttl was not seen by its provider within the ttl
+func (m URLMapper) expired(now time.Time) bool {
+	return m.TTL > 0 && now.Sub(m.LastSeen) > m.TTL
+}
+
+// EffectiveWeight returns weight of the mapper destination, DefaultWeight if not set
+func (m URLMapper) EffectiveWeight() int {
+	if m.Weight <= 0 {
+		return DefaultWeight
+	}
+	return m.Weight
+}
+
+// servableOn checks if mapper allowed to be served for the request received on the given listener
+func (m URLMapper) servableOn(info RequestInfo) bool {
+	if m.Listener != "" && m.Listener != info.Listener {
+		return false
+	}
+	if m.Visibility == VisibilityInternal && !info.Internal {
+		return false
+	}
+	if m.ALPN != "" && m.ALPN != info.ALPN {
+		return false
+	}
+	return m.headersMatch(info.Header)
+}
+
+// headersMatch checks if all header conditions of the mapper are satisfied by the request headers
+func (m URLMapper) headersMatch(hdr http.Header) bool {
+	for _, hc := range m.MatchHeaders {
+		values := hdr.Values(hc.Name)
+		if len(values) == 0 {
+			return false
+		}
+		if hc.Value != "" && !Contains(hc.Value, values) {
+			return false
+		}
+		if len(hc.Values) > 0 && !hc.inSet(values) {
+			return false
+		}
+	}
+	return true
+}
+
+// inSet checks if any of the header values is in the condition's set
+func (hc HeaderCondition) inSet(values []string) bool {
+	for _, v := range values {
+		for _, allowed := range hc.Values {
+			if strings.EqualFold(strings.TrimSpace(v), allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queryMatch checks if all query conditions of the mapper are satisfied by the request query
+func (m URLMapper) queryMatch(query url.Values) bool {
+	for _, qc := range m.MatchQuery {
+		values, ok := query[qc.Name]
+		if !ok {
+			return false
+		}
+		if qc.Value != "" && !Contains(qc.Value, values) {
+			return false
+		}
+	}
+	return true
+}
+
+// conditions returns number of request conditions of the mapper, header and query conditions and alpn
+func (m URLMapper) conditions() int {
+	res := len(m.MatchHeaders) + len(m.MatchQuery)
+	if m.ALPN != "" {
+		res++
+	}
+	return res
+}
+
+// mostSpecific keeps routes with the most conditions, i.e. for the same route with and without
+// X-Version=beta condition, requests with the header go to the conditioned route only
+func mostSpecific(routes []MatchedRoute) []MatchedRoute {
+	maxConditions := 0
+	for _, r := range routes {
+		if r.Mapper.conditions() > maxConditions {
+			maxConditions = r.Mapper.conditions()
+		}
+	}
+	if maxConditions == 0 {
+		return routes
+	}
+	res := make([]MatchedRoute, 0, len(routes))
+	for _, r := range routes {
+		if r.Mapper.conditions() == maxConditions {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
 func (m URLMapper) ping() (string, error) {
 	client := http.Client{Timeout: 500 * time.Millisecond}
+	if m.Socket != "" {
+		client.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", m.Socket)
+		}}
+	}
 
 	resp, err := client.Get(m.PingURL)
 	if err != nil {
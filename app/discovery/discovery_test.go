@@ -2,13 +2,18 @@ package discovery
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -75,6 +80,109 @@ func TestService_Run(t *testing.T) {
 	assert.Equal(t, 1, len(p2.ListCalls()))
 }
 
+func TestService_RunRouteTTL(t *testing.T) {
+	var lock sync.Mutex
+	var seen time.Time
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 1)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			if seen.IsZero() {
+				seen = time.Now() // stamped once, the next lists return the same stale route
+			}
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+					ProviderID: PIDocker, TTL: time.Millisecond * 100, LastSeen: seen},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/live/(.*)"), Dst: "http://127.0.0.2:8080/$1",
+					ProviderID: PIDocker, TTL: time.Millisecond * 100, LastSeen: time.Now()},
+			}, nil
+		},
+	}
+
+	svc := NewService([]Provider{p}, time.Millisecond*10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+
+	require.Eventually(t, func() bool { return len(svc.Mappers()) == 2 }, time.Second, time.Millisecond*5)
+	require.Eventually(t, func() bool { return len(svc.Mappers()) == 1 }, time.Second, time.Millisecond*5,
+		"stale route dropped without events")
+	assert.Equal(t, "^/live/(.*)", svc.Mappers()[0].SrcMatch.String())
+	assert.GreaterOrEqual(t, len(p.ListCalls()), 2, "expiry triggers reload")
+}
+
+func TestService_RunSwapTable(t *testing.T) {
+	const routes = 50
+	var gen int32
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID)
+			go func() {
+				ticker := time.NewTicker(5 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						res <- PIFile
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			g := atomic.AddInt32(&gen, 1)
+			res := make([]URLMapper, 0, routes)
+			for i := 0; i < routes; i++ {
+				server := "*"
+				if i%2 == 0 {
+					server = `^(.*)\.example\.com$`
+				}
+				res = append(res, URLMapper{Server: server, SrcMatch: *regexp.MustCompile(fmt.Sprintf("^/r%d/(.*)", i)),
+					Dst: fmt.Sprintf("http://gen%d/$1", g), ProviderID: PIFile})
+			}
+			return res, nil
+		},
+	}
+
+	svc := NewService([]Provider{p}, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	require.Eventually(t, func() bool { return len(svc.Mappers()) > 0 }, time.Second, time.Millisecond)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				mappers := svc.Mappers()
+				if !assert.Equal(t, routes, len(mappers), "partial table") {
+					return
+				}
+				for _, m := range mappers[1:] {
+					if !assert.Equal(t, mappers[0].Dst, m.Dst, "mixed tables") {
+						return
+					}
+				}
+				m := svc.Match("api.example.com", "/r0/a", RequestInfo{})
+				if !assert.Len(t, m.Routes, 1, "route of regex server") {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Greater(t, atomic.LoadInt32(&gen), int32(2), "table reloaded multiple times")
+}
+
 func TestService_Match(t *testing.T) {
 	p1 := &ProviderMock{
 		EventsFunc: func(ctx context.Context) <-chan ProviderID {
@@ -166,7 +274,7 @@ func TestService_Match(t *testing.T) {
 	for i, tt := range tbl {
 		tt := tt
 		t.Run(strconv.Itoa(i)+"-"+tt.server, func(t *testing.T) {
-			res := svc.Match(tt.server, tt.src)
+			res := svc.Match(tt.server, tt.src, RequestInfo{})
 			require.Equal(t, len(tt.res.Routes), len(res.Routes), res.Routes)
 			for i := 0; i < len(res.Routes); i++ {
 				assert.Equal(t, tt.res.Routes[i].Alive, res.Routes[i].Alive)
@@ -228,7 +336,7 @@ func TestService_MatchServerRegex(t *testing.T) {
 	for i, tt := range tbl {
 		tt := tt
 		t.Run(strconv.Itoa(i)+"-"+tt.server, func(t *testing.T) {
-			res := svc.Match(tt.server, tt.src)
+			res := svc.Match(tt.server, tt.src, RequestInfo{})
 			require.Equal(t, len(tt.res.Routes), len(res.Routes), res.Routes)
 			for i := 0; i < len(res.Routes); i++ {
 				assert.Equal(t, tt.res.Routes[i].Alive, res.Routes[i].Alive)
@@ -239,6 +347,97 @@ func TestService_MatchServerRegex(t *testing.T) {
 	}
 }
 
+func TestService_MatchCatchAll(t *testing.T) {
+	mockProvider := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 1)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/(.*)"), Dst: "http://127.0.0.9:8080/$1",
+					MatchType: MTProxy, CatchAll: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", MatchType: MTProxy},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/a/(.*)"), Dst: "http://127.0.0.2:8080/$1", MatchType: MTProxy},
+				{Server: "*", SrcMatch: *regexp.MustCompile("/static"), MatchType: MTStatic,
+					AssetsWebRoot: "/static", AssetsLocation: "/tmp/assets/"},
+			}, nil
+		},
+	}
+	svc := NewService([]Provider{mockProvider}, time.Millisecond*10)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	mappers := svc.Mappers()
+	require.Equal(t, 4, len(mappers))
+	assert.True(t, mappers[3].CatchAll, "catch-all is the last")
+
+	tbl := []struct {
+		src, dest string
+	}{
+		{"/api/something", "http://127.0.0.1:8080/something"},
+		{"/a/something", "http://127.0.0.2:8080/something"},
+		{"/static/file.txt", "/static:/tmp/assets/:norm"},
+		{"/other", "http://127.0.0.9:8080/other"},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.src, func(t *testing.T) {
+			res := svc.Match("example.com", tt.src, RequestInfo{})
+			require.Equal(t, 1, len(res.Routes), res.Routes)
+			assert.Equal(t, tt.dest, res.Routes[0].Destination)
+		})
+	}
+}
+
+func TestService_MatchServerWildcard(t *testing.T) {
+	mockProvider := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 1)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*.example.com", SrcMatch: *regexp.MustCompile("^/"),
+					Dst: "http://127.0.0.1:8080/", MatchType: MTProxy},
+				{Server: "exact.example.com", SrcMatch: *regexp.MustCompile("^/"),
+					Dst: "http://127.0.0.2:8080/", MatchType: MTProxy},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/(.*)$"),
+					Dst: "http://127.0.0.3:8080/$1", MatchType: MTProxy},
+			}, nil
+		},
+	}
+	svc := NewService([]Provider{mockProvider}, time.Millisecond*10)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	tbl := []struct {
+		server, dest string
+	}{
+		{"api.example.com", "http://127.0.0.1:8080/"},
+		{"API.Example.com", "http://127.0.0.1:8080/"},
+		{"exact.example.com", "http://127.0.0.2:8080/"}, // exact match takes priority
+		{"example.com", "http://127.0.0.3:8080/"},       // wildcard needs a label, falls to any
+		{"a.b.example.com", "http://127.0.0.3:8080/"},   // single label only
+		{"api.example.org", "http://127.0.0.3:8080/"},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.server, func(t *testing.T) {
+			res := svc.Match(tt.server, "/", RequestInfo{})
+			require.Equal(t, 1, len(res.Routes), res.Routes)
+			assert.Equal(t, tt.dest, res.Routes[0].Destination)
+		})
+	}
+}
+
 func TestService_MatchServerRegexInvalidateCache(t *testing.T) {
 	res := make(chan ProviderID)
 	serverRegex := "test-(.*)"
@@ -267,7 +466,7 @@ func TestService_MatchServerRegexInvalidateCache(t *testing.T) {
 	// wait for update
 	time.Sleep(50 * time.Millisecond)
 
-	match := svc.Match("test-server", "/")
+	match := svc.Match("test-server", "/", RequestInfo{})
 	assert.Len(t, match.Routes, 1)
 
 	serverRegex = "another-(.*)"
@@ -276,7 +475,7 @@ func TestService_MatchServerRegexInvalidateCache(t *testing.T) {
 	// wait for cache invalidation
 	time.Sleep(50 * time.Millisecond)
 
-	match = svc.Match("test-server", "/")
+	match = svc.Match("test-server", "/", RequestInfo{})
 	assert.Len(t, match.Routes, 0)
 }
 
@@ -322,7 +521,7 @@ func TestService_MatchConflictRegex(t *testing.T) {
 	for i, tt := range tbl {
 		tt := tt
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			res := svc.Match(tt.server, tt.src)
+			res := svc.Match(tt.server, tt.src, RequestInfo{})
 			require.Equal(t, len(tt.res.Routes), len(res.Routes), res.Routes)
 			for i := 0; i < len(res.Routes); i++ {
 				assert.Equal(t, tt.res.Routes[i].Alive, res.Routes[i].Alive)
@@ -333,6 +532,852 @@ func TestService_MatchConflictRegex(t *testing.T) {
 	}
 }
 
+func TestService_MatchListener(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 1)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{SrcMatch: *regexp.MustCompile("^/api/admin/(.*)"), Dst: "http://127.0.0.1:8080/admin/$1",
+					ProviderID: PIDocker, Listener: "admin"},
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1", ProviderID: PIDocker},
+			}, nil
+		},
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*100)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	tbl := []struct {
+		src, listener, dest string
+	}{
+		{"/api/admin/users", "admin", "http://127.0.0.1:8080/admin/users"},
+		{"/api/admin/users", "", "http://127.0.0.2:8080/admin/users"},
+		{"/api/admin/users", "other", "http://127.0.0.2:8080/admin/users"},
+		{"/api/something", "admin", "http://127.0.0.2:8080/something"},
+	}
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res := svc.Match("example.com", tt.src, RequestInfo{Listener: tt.listener})
+			require.Equal(t, 1, len(res.Routes), res.Routes)
+			assert.Equal(t, tt.dest, res.Routes[0].Destination)
+		})
+	}
+}
+
+func TestService_MatchVisibility(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 1)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{SrcMatch: *regexp.MustCompile("^/api/admin/(.*)"), Dst: "http://127.0.0.1:8080/admin/$1",
+					ProviderID: PIDocker, Visibility: VisibilityInternal},
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1", ProviderID: PIDocker},
+				{SrcMatch: *regexp.MustCompile("^/metrics/"), Dst: "http://127.0.0.3:8080/metrics/",
+					ProviderID: PIDocker, Visibility: VisibilityInternal},
+			}, nil
+		},
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*100)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err := svc.Run(ctx)
+	require.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 3, len(svc.Mappers()))
+
+	tbl := []struct {
+		src      string
+		info     RequestInfo
+		dest     string
+		internal bool
+	}{
+		{src: "/api/admin/users", info: RequestInfo{Internal: true}, dest: "http://127.0.0.1:8080/admin/users", internal: true},
+		{src: "/api/admin/users", info: RequestInfo{}, dest: "http://127.0.0.2:8080/admin/users"},
+		{src: "/api/something", info: RequestInfo{Internal: true}, dest: "http://127.0.0.2:8080/something"},
+		{src: "/api/something", info: RequestInfo{}, dest: "http://127.0.0.2:8080/something"},
+		{src: "/metrics/abc", info: RequestInfo{Internal: true}, dest: "http://127.0.0.3:8080/metrics/abc", internal: true},
+		{src: "/metrics/abc", info: RequestInfo{}, dest: ""},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res := svc.Match("example.com", tt.src, tt.info)
+			if tt.dest == "" {
+				assert.Empty(t, res.Routes)
+				return
+			}
+			require.Equal(t, 1, len(res.Routes), res.Routes)
+			assert.Equal(t, tt.dest, res.Routes[0].Destination)
+			assert.Equal(t, tt.internal, res.Routes[0].Mapper.Visibility == VisibilityInternal)
+		})
+	}
+}
+
+func TestService_MatchALPN(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 1)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", ProviderID: PIDocker},
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1", ProviderID: PIDocker,
+					ALPN: "h2"},
+				{SrcMatch: *regexp.MustCompile("^/grpc/(.*)"), Dst: "http://127.0.0.3:8080/$1", ProviderID: PIDocker,
+					ALPN: "h2"},
+			}, nil
+		},
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*100)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	tbl := []struct {
+		src, alpn string
+		dests     []string
+	}{
+		{"/api/users", "", []string{"http://127.0.0.1:8080/users"}},
+		{"/api/users", "http/1.1", []string{"http://127.0.0.1:8080/users"}},
+		{"/api/users", "h2", []string{"http://127.0.0.2:8080/users"}},
+		{"/grpc/svc", "h2", []string{"http://127.0.0.3:8080/svc"}},
+		{"/grpc/svc", "http/1.1", []string{}},
+	}
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res := svc.Match("example.com", tt.src, RequestInfo{ALPN: tt.alpn})
+			dests := []string{}
+			for _, r := range res.Routes {
+				dests = append(dests, r.Destination)
+			}
+			assert.Equal(t, tt.dests, dests)
+		})
+	}
+}
+
+func TestService_MatchHeaders(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 1)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", ProviderID: PIDocker},
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1", ProviderID: PIDocker,
+					MatchHeaders: []HeaderCondition{{Name: "X-Version", Value: "beta"}}},
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.3:8080/$1", ProviderID: PIDocker,
+					MatchHeaders: []HeaderCondition{{Name: "X-Version", Value: "beta"}, {Name: "X-Canary"}}},
+				{SrcMatch: *regexp.MustCompile("^/web/(.*)"), Dst: "http://127.0.0.4:8080/$1", ProviderID: PIDocker,
+					MatchHeaders: []HeaderCondition{{Name: "X-Version", Value: "beta"}}},
+			}, nil
+		},
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*100)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	tbl := []struct {
+		src   string
+		hdr   http.Header
+		dests []string
+	}{
+		{"/api/users", nil, []string{"http://127.0.0.1:8080/users"}},
+		{"/api/users", http.Header{"X-Version": {"alpha"}}, []string{"http://127.0.0.1:8080/users"}},
+		{"/api/users", http.Header{"X-Version": {"beta"}}, []string{"http://127.0.0.2:8080/users"}},
+		{"/api/users", http.Header{"X-Version": {"beta"}, "X-Canary": {"1"}}, []string{"http://127.0.0.3:8080/users"}},
+		{"/api/users", http.Header{"X-Canary": {"1"}}, []string{"http://127.0.0.1:8080/users"}},
+		{"/web/index.html", http.Header{"X-Version": {"beta"}}, []string{"http://127.0.0.4:8080/index.html"}},
+		{"/web/index.html", nil, []string{}},
+	}
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res := svc.Match("example.com", tt.src, RequestInfo{Header: tt.hdr})
+			dests := []string{}
+			for _, r := range res.Routes {
+				dests = append(dests, r.Destination)
+			}
+			assert.Equal(t, tt.dests, dests)
+		})
+	}
+}
+
+func TestService_MatchHeaderSet(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 1)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", ProviderID: PIDocker},
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1", ProviderID: PIDocker,
+					MatchHeaders: []HeaderCondition{{Name: "X-Country", Values: []string{"DE", "FR", "IT"}}}},
+				{SrcMatch: *regexp.MustCompile("^/eu/(.*)"), Dst: "http://127.0.0.3:8080/$1", ProviderID: PIDocker,
+					MatchHeaders: []HeaderCondition{{Name: "X-Country", Values: []string{"DE", "FR"}}}},
+			}, nil
+		},
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*100)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	tbl := []struct {
+		src   string
+		hdr   http.Header
+		dests []string
+	}{
+		{"/api/users", nil, []string{"http://127.0.0.1:8080/users"}},
+		{"/api/users", http.Header{"X-Country": {"US"}}, []string{"http://127.0.0.1:8080/users"}},
+		{"/api/users", http.Header{"X-Country": {"FR"}}, []string{"http://127.0.0.2:8080/users"}},
+		{"/api/users", http.Header{"X-Country": {" it "}}, []string{"http://127.0.0.2:8080/users"}},
+		{"/eu/users", http.Header{"X-Country": {"DE"}}, []string{"http://127.0.0.3:8080/users"}},
+		{"/eu/users", http.Header{"X-Country": {"IT"}}, []string{}},
+	}
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res := svc.Match("example.com", tt.src, RequestInfo{Header: tt.hdr})
+			dests := []string{}
+			for _, r := range res.Routes {
+				dests = append(dests, r.Destination)
+			}
+			assert.Equal(t, tt.dests, dests)
+		})
+	}
+}
+
+func TestParseHeaderSetCondition(t *testing.T) {
+	res, err := ParseHeaderSetCondition("x-country = DE, FR ,IT")
+	require.NoError(t, err)
+	assert.Equal(t, HeaderCondition{Name: "X-Country", Values: []string{"DE", "FR", "IT"}}, res)
+
+	for _, inp := range []string{"", "X-Country", "X-Country=", "X-Country= , ", "=DE", "X Country=DE"} {
+		_, err = ParseHeaderSetCondition(inp)
+		assert.Error(t, err, inp)
+	}
+}
+
+func TestService_MatchAssetsOverlay(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 1)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/(.*)"), Dst: "http://127.0.0.1:8080/$1", ProviderID: PIDocker},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/maint(/.*)?$"), MatchType: MTStatic, ProviderID: PIDocker,
+					AssetsWebRoot: "/maint", AssetsLocation: "/srv/maint", AssetsOverlay: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/web(/.*)?$"), MatchType: MTStatic, ProviderID: PIDocker,
+					AssetsWebRoot: "/web", AssetsLocation: "/srv/web"}, // regular assets, behind the proxy route
+			}, nil
+		},
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*100)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	tbl := []struct {
+		src       string
+		matchType MatchType
+		dest      string
+	}{
+		{"/maint", MTStatic, "/maint:/srv/maint/:norm"},
+		{"/maint/banner.html", MTStatic, "/maint:/srv/maint/:norm"},
+		{"/maintenance", MTProxy, "http://127.0.0.1:8080/maintenance"},
+		{"/web/index.html", MTProxy, "http://127.0.0.1:8080/web/index.html"},
+		{"/api/users", MTProxy, "http://127.0.0.1:8080/api/users"},
+	}
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res := svc.Match("example.com", tt.src, RequestInfo{})
+			require.Len(t, res.Routes, 1)
+			assert.Equal(t, tt.matchType, res.MatchType)
+			assert.Equal(t, tt.dest, res.Routes[0].Destination)
+		})
+	}
+}
+
+func TestParseHeaderConditions(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res []HeaderCondition
+		err bool
+	}{
+		{"X-Version=beta", []HeaderCondition{{Name: "X-Version", Value: "beta"}}, false},
+		{"x-version = beta, x-canary", []HeaderCondition{{Name: "X-Version", Value: "beta"}, {Name: "X-Canary"}}, false},
+		{"", nil, true},
+		{"=beta", nil, true},
+		{"X Version=beta", nil, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := ParseHeaderConditions(tt.inp)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestService_MatchQuery(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 1)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", ProviderID: PIDocker},
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1", ProviderID: PIDocker,
+					MatchQuery: []QueryCondition{{Name: "tenant", Value: "foo"}}},
+				{SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.3:8080/$1", ProviderID: PIDocker,
+					MatchQuery: []QueryCondition{{Name: "tenant", Value: "foo"}, {Name: "debug"}}},
+				{SrcMatch: *regexp.MustCompile("^/web/(.*)"), Dst: "http://127.0.0.4:8080/$1", ProviderID: PIDocker,
+					MatchQuery: []QueryCondition{{Name: "tenant", Value: "bar"}}},
+			}, nil
+		},
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*100)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	tbl := []struct {
+		src   string
+		query url.Values
+		dests []string
+	}{
+		{"/api/users", nil, []string{"http://127.0.0.1:8080/users"}},
+		{"/api/users", url.Values{"tenant": {"baz"}}, []string{"http://127.0.0.1:8080/users"}},
+		{"/api/users", url.Values{"tenant": {"foo"}}, []string{"http://127.0.0.2:8080/users"}},
+		{"/api/users", url.Values{"tenant": {"baz", "foo"}}, []string{"http://127.0.0.2:8080/users"}},
+		{"/api/users", url.Values{"tenant": {"foo"}, "debug": {""}}, []string{"http://127.0.0.3:8080/users"}},
+		{"/web/index.html", url.Values{"tenant": {"bar"}}, []string{"http://127.0.0.4:8080/index.html"}},
+		{"/web/index.html", url.Values{"tenant": {"foo"}}, []string{}},
+	}
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res := svc.Match("example.com", tt.src, RequestInfo{Query: tt.query})
+			dests := []string{}
+			for _, r := range res.Routes {
+				dests = append(dests, r.Destination)
+			}
+			assert.Equal(t, tt.dests, dests)
+		})
+	}
+}
+
+func TestParseQueryConditions(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res []QueryCondition
+		err bool
+	}{
+		{"tenant=foo", []QueryCondition{{Name: "tenant", Value: "foo"}}, false},
+		{"tenant = foo, debug", []QueryCondition{{Name: "tenant", Value: "foo"}, {Name: "debug"}}, false},
+		{"", nil, true},
+		{"=foo", nil, true},
+		{"a&b=foo", nil, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := ParseQueryConditions(tt.inp)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestParseBodyRewrites(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res []BodyRewrite
+		err bool
+	}{
+		{"http://172.17.0.2:8080=>https://example.com", []BodyRewrite{{From: "http://172.17.0.2:8080", To: "https://example.com"}}, false},
+		{"a.lan => b.com, secret=>", []BodyRewrite{{From: "a.lan", To: "b.com"}, {From: "secret"}}, false},
+		{"", nil, true},
+		{"=>b.com", nil, true},
+		{"a.lan=b.com", nil, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := ParseBodyRewrites(tt.inp)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestParseStatusMap(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res map[int]int
+		err bool
+	}{
+		{"404=>200", map[int]int{404: 200}, false},
+		{" 404 => 200, 502=>503", map[int]int{404: 200, 502: 503}, false},
+		{"", nil, true},
+		{"404=200", nil, true},
+		{"404=>", nil, true},
+		{"abc=>200", nil, true},
+		{"404=>600", nil, true},
+		{"101=>200", nil, true},
+		{"404=>200,404=>204", nil, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := ParseStatusMap(tt.inp)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestParseStatusHeaders(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res []StatusHeader
+		err bool
+	}{
+		{"5xx:Cache-Control=no-store", []StatusHeader{{From: 500, To: 599, Name: "Cache-Control", Value: "no-store"}}, false},
+		{" 404:x-missing = 1, 2xx:X-Ok=", []StatusHeader{{From: 404, To: 404, Name: "X-Missing", Value: "1"},
+			{From: 200, To: 299, Name: "X-Ok", Value: ""}}, false},
+		{"5xx:Cache-Control=no-store, no-cache,503:Retry-After=10", []StatusHeader{
+			{From: 500, To: 599, Name: "Cache-Control", Value: "no-store, no-cache"},
+			{From: 503, To: 503, Name: "Retry-After", Value: "10"}}, false},
+		{"", nil, true},
+		{"no-store", nil, true},
+		{"5xx:Cache-Control", nil, true},
+		{"5xx:=no-store", nil, true},
+		{"6xx:Cache-Control=no-store", nil, true},
+		{"50:Cache-Control=no-store", nil, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := ParseStatusHeaders(tt.inp)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestParseVisibility(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res Visibility
+		err bool
+	}{
+		{"", VisibilityPublic, false},
+		{"public", VisibilityPublic, false},
+		{"internal", VisibilityInternal, false},
+		{" Internal ", VisibilityInternal, false},
+		{"private", VisibilityPublic, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := ParseVisibility(tt.inp)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestParseForwardedPolicy(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res ForwardedPolicy
+		err bool
+	}{
+		{"", ForwardedSet, false},
+		{"set", ForwardedSet, false},
+		{"Append", ForwardedAppend, false},
+		{" strip ", ForwardedStrip, false},
+		{"trust", ForwardedSet, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := ParseForwardedPolicy(tt.inp)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestParseFault(t *testing.T) {
+	tbl := []struct {
+		delay, abort string
+		res          Fault
+		err          bool
+	}{
+		{"500ms", "", Fault{Delay: 500 * time.Millisecond, DelayPercent: 100}, false},
+		{" 1s : 25% ", "", Fault{Delay: time.Second, DelayPercent: 25}, false},
+		{"", "503", Fault{AbortStatus: 503, AbortPercent: 100}, false},
+		{"", "500:0.5", Fault{AbortStatus: 500, AbortPercent: 0.5}, false},
+		{"100ms:50%", "429:10%", Fault{Delay: 100 * time.Millisecond, DelayPercent: 50, AbortStatus: 429, AbortPercent: 10}, false},
+		{"blah", "", Fault{}, true},
+		{"-1s", "", Fault{}, true},
+		{"1s:0%", "", Fault{}, true},
+		{"1s:101%", "", Fault{}, true},
+		{"", "200", Fault{}, true},
+		{"", "503:x", Fault{}, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var res Fault
+			var err error
+			if tt.delay != "" {
+				res.Delay, res.DelayPercent, err = ParseFaultDelay(tt.delay)
+			}
+			if err == nil && tt.abort != "" {
+				res.AbortStatus, res.AbortPercent, err = ParseFaultAbort(tt.abort)
+			}
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestParseBreaker(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res Breaker
+		err bool
+	}{
+		{"5", Breaker{Threshold: 5}, false},
+		{" 3 : 30s ", Breaker{Threshold: 3, Open: 30 * time.Second}, false},
+		{"", Breaker{}, true},
+		{"0", Breaker{}, true},
+		{"x:10s", Breaker{}, true},
+		{"5:blah", Breaker{}, true},
+		{"5:-1s", Breaker{}, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := ParseBreaker(tt.inp)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res uint16
+		err bool
+	}{
+		{"1.0", tls.VersionTLS10, false},
+		{"1.1", tls.VersionTLS11, false},
+		{" 1.2 ", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"", 0, true},
+		{"tls1.3", 0, true},
+		{"1.4", 0, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := ParseTLSVersion(tt.inp)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestParseUpstreamProto(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res UpstreamProto
+		err bool
+	}{
+		{"", UPHTTP, false},
+		{"http", UPHTTP, false},
+		{"h2c", UPH2C, false},
+		{" H2C ", UPH2C, false},
+		{"http1.1", UPHTTP11, false},
+		{"HTTP/1.0", UPHTTP10, false},
+		{"http1.0", UPHTTP10, false},
+		{"grpc", UPHTTP, true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := ParseUpstreamProto(tt.inp)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestService_mergeListsProviderID(t *testing.T) {
+	p1 := &identifiedProvider{ProviderMock: ProviderMock{
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://127.0.0.2:8080/$1",
+					ProviderID: PIFile},
+			}, nil
+		},
+	}, id: PIDocker}
+	p2 := &ProviderMock{
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.3:8080/$1",
+					ProviderID: PIStatic},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc3/(.*)"), Dst: "http://127.0.0.4:8080/$1"},
+			}, nil
+		},
+	}
+
+	svc := NewService([]Provider{p1, p2}, time.Millisecond*10)
+	res := svc.mergeLists()
+	require.Equal(t, 4, len(res))
+	pids := map[string]ProviderID{}
+	for _, m := range res {
+		pids[m.Dst] = m.ProviderID
+	}
+	assert.Equal(t, map[string]ProviderID{
+		"http://127.0.0.1:8080/$1": PIDocker, // stamped by provider's ID
+		"http://127.0.0.2:8080/$1": PIFile,   // set by provider, kept
+		"http://127.0.0.3:8080/$1": PIStatic,
+		"http://127.0.0.4:8080/$1": "", // provider without ID
+	}, pids)
+}
+
+func Test_alignRateLimits(t *testing.T) {
+	mappers := []URLMapper{
+		{Dst: "http://10.0.0.1/$1", RateLimit: 100, RateLimitGroup: "api"},
+		{Dst: "http://10.0.0.2/$1", RateLimit: 50, RateLimitGroup: "api"},
+		{Dst: "http://10.0.0.3/$1", RateLimitGroup: "api"},
+		{Dst: "http://10.0.0.4/$1", RateLimit: 10},
+		{Dst: "http://10.0.0.5/$1", RateLimitGroup: "web"},
+	}
+	alignRateLimits(mappers)
+	res := make([]int, 0, len(mappers))
+	for _, m := range mappers {
+		res = append(res, m.RateLimit)
+	}
+	assert.Equal(t, []int{50, 50, 50, 10, 0}, res, "the lowest group limit used, group without limit unlimited")
+}
+
+func TestService_mergeListsPrecedence(t *testing.T) {
+	docker := &identifiedProvider{ProviderMock: ProviderMock{
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://127.0.0.3:8080/$1"},
+				{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/svc3/(.*)"), Dst: "http://127.0.0.4:8080/$1"},
+			}, nil
+		},
+	}, id: PIDocker}
+	file := &identifiedProvider{ProviderMock: ProviderMock{
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://10.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc3/(.*)"), Dst: "http://10.0.0.2:8080/$1"},
+			}, nil
+		},
+	}, id: PIFile}
+	static := &identifiedProvider{ProviderMock: ProviderMock{
+		ListFunc: func() ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://10.0.0.3:8080/$1"},
+			}, nil
+		},
+	}, id: PIStatic}
+
+	dests := func(res []URLMapper) (dd []string) {
+		for _, m := range res {
+			dd = append(dd, m.Dst)
+		}
+		sort.Strings(dd)
+		return dd
+	}
+
+	svc := NewService([]Provider{docker, file, static}, time.Millisecond*10)
+	assert.Equal(t, 7, len(svc.mergeLists()), "no precedence, all kept")
+
+	svc.Precedence = []ProviderID{PIFile, PIDocker}
+	assert.Equal(t, []string{
+		"http://10.0.0.1:8080/$1",  // file overrides docker
+		"http://10.0.0.2:8080/$1",  // different server, no conflict
+		"http://127.0.0.3:8080/$1", // docker overrides static, not listed
+		"http://127.0.0.4:8080/$1",
+	}, dests(svc.mergeLists()))
+
+	svc.Precedence = []ProviderID{PIDocker}
+	assert.Equal(t, []string{"http://10.0.0.2:8080/$1", "http://127.0.0.1:8080/$1", "http://127.0.0.2:8080/$1",
+		"http://127.0.0.3:8080/$1", "http://127.0.0.4:8080/$1"}, dests(svc.mergeLists()), "same provider routes kept")
+}
+
+func TestParseProviderID(t *testing.T) {
+	pid, err := ParseProviderID(" File ")
+	require.NoError(t, err)
+	assert.Equal(t, PIFile, pid)
+	pid, err = ParseProviderID("consul-catalog")
+	require.NoError(t, err)
+	assert.Equal(t, PIConsulCatalog, pid)
+	pid, err = ParseProviderID("nomad")
+	require.NoError(t, err)
+	assert.Equal(t, PINomad, pid)
+	_, err = ParseProviderID("blah")
+	require.Error(t, err)
+}
+
+// identifiedProvider is a provider with ID
+type identifiedProvider struct {
+	ProviderMock
+	id ProviderID
+}
+
+func (p *identifiedProvider) ID() ProviderID { return p.id }
+
+// dispatchProvider is a provider resolving dispatch keys with table
+type dispatchProvider struct {
+	identifiedProvider
+	table map[string]string
+}
+
+func (p *dispatchProvider) Dispatch(key string) (string, bool) {
+	res, ok := p.table[key]
+	return res, ok
+}
+
+func TestService_MatchDispatch(t *testing.T) {
+	p := &dispatchProvider{identifiedProvider: identifiedProvider{id: PIDocker}, table: map[string]string{"web": "172.17.0.3:8080"}}
+	p.ListFunc = func() ([]URLMapper, error) {
+		return []URLMapper{
+			{Server: "*", SrcMatch: *regexp.MustCompile("^/svc/([^/]+)(/.*)?$"), Dst: "http://$1$2", ProviderID: PIDocker,
+				Dispatch: true},
+			{Server: "*", SrcMatch: *regexp.MustCompile("^/(.*)"), Dst: "http://127.0.0.1:8080/$1", ProviderID: PIDocker},
+		}, nil
+	}
+	svc := NewService([]Provider{p}, time.Millisecond*10)
+	svc.swapTable(svc.mergeLists())
+
+	res := svc.Match("example.com", "/svc/web/api/1?k=v", RequestInfo{})
+	require.Len(t, res.Routes, 1)
+	assert.Equal(t, "http://172.17.0.3:8080/api/1?k=v", res.Routes[0].Destination)
+
+	res = svc.Match("example.com", "/svc/web", RequestInfo{})
+	require.Len(t, res.Routes, 1)
+	assert.Equal(t, "http://172.17.0.3:8080", res.Routes[0].Destination)
+
+	res = svc.Match("example.com", "/svc/unknown/api/1", RequestInfo{})
+	require.Len(t, res.Routes, 1)
+	assert.Equal(t, "http://127.0.0.1:8080/svc/unknown/api/1", res.Routes[0].Destination, "unknown container, next route")
+
+	p.table["unknown"] = "172.17.0.4:9090" // resolved on request, no reload needed
+	res = svc.Match("example.com", "/svc/unknown/api/1", RequestInfo{})
+	require.Len(t, res.Routes, 1)
+	assert.Equal(t, "http://172.17.0.4:9090/api/1", res.Routes[0].Destination)
+}
+
 func TestService_Servers(t *testing.T) {
 	p1 := &ProviderMock{
 		EventsFunc: func(ctx context.Context) <-chan ProviderID {
@@ -401,6 +1446,12 @@ func TestService_extendRule(t *testing.T) {
 			URLMapper{Server: "m.example.com", PingURL: "http://example.com/ping", ProviderID: "docker",
 				SrcMatch: *regexp.MustCompile("/api/blah"), Dst: "http://localhost:8080/xxx", RedirectType: RTPerm},
 		},
+		{
+			URLMapper{Server: "m.example.com", ProviderID: "docker", Visibility: VisibilityInternal,
+				OnlyFromIPs: []string{"127.0.0.1"}, SrcMatch: *regexp.MustCompile("/admin/"), Dst: "http://localhost:8080/"},
+			URLMapper{Server: "m.example.com", ProviderID: "docker", Visibility: VisibilityInternal,
+				OnlyFromIPs: []string{"127.0.0.1"}, SrcMatch: *regexp.MustCompile("^/admin/(.*)"), Dst: "http://localhost:8080/$1"},
+		},
 	}
 
 	svc := &Service{}
@@ -514,6 +1565,20 @@ func TestService_ScheduleHealthCheck(t *testing.T) {
 	assert.Equal(t, false, mappers[2].dead)
 }
 
+func Test_healthJitter(t *testing.T) {
+	interval := 10 * time.Second
+	offsets := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		pingURL := fmt.Sprintf("http://127.0.0.%d:8080/ping", i)
+		d := healthJitter(pingURL, interval)
+		assert.True(t, d >= 0 && d < interval, d)
+		assert.Equal(t, d, healthJitter(pingURL, interval), "deterministic")
+		offsets[d] = true
+	}
+	assert.Greater(t, len(offsets), 90, "spread across interval")
+	assert.Equal(t, time.Duration(0), healthJitter("http://127.0.0.1/ping", 0))
+}
+
 func Test_ping(t *testing.T) {
 	port := rand.Intn(10000) + 40000
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RouteGroups describes route served by multiple groups of mappers, i.e. blue and green deployments.
+// Only the active group of the route is matched
+type RouteGroups struct {
+	Server string   `json:"server"`
+	Route  string   `json:"route"`
+	Groups []string `json:"groups"`
+	Active string   `json:"active"`
+}
+
+// Groups returns all routes with groups and the active group of each
+func (s *Service) Groups() []RouteGroups {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	res := make([]RouteGroups, 0, len(s.groups))
+	for k, groups := range s.groups {
+		res = append(res, RouteGroups{Server: k.server, Route: k.route, Groups: groups, Active: s.activeGroup(k)})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Server != res[j].Server {
+			return res[i].Server < res[j].Server
+		}
+		return res[i].Route < res[j].Route
+	})
+	return res
+}
+
+// SetActiveGroup switches route to the given group. The choice kept across mappers reloads,
+// and if the group gone the route falls back to the default group till the group is back
+func (s *Service) SetActiveGroup(server, route, group string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	k := groupKey{server: server, route: route}
+	if !Contains(group, s.groups[k]) {
+		return fmt.Errorf("group %q not found for route %s %s", group, server, route)
+	}
+	if s.activeGroups == nil {
+		s.activeGroups = map[groupKey]string{}
+	}
+	s.activeGroups[k] = group
+	return nil
+}
+
+type groupKey struct {
+	server, route string
+}
+
+// groupServable checks if the mapper belongs to the active group of its route, mappers without group always servable.
+// should be called under lock
+func (s *Service) groupServable(m URLMapper) bool {
+	if m.Group == "" {
+		return true
+	}
+	return m.Group == s.activeGroup(groupKey{server: m.Server, route: m.SrcMatch.String()})
+}
+
+// activeGroup returns group set by SetActiveGroup if the route still has it, or the first (by name) group by default
+func (s *Service) activeGroup(k groupKey) string {
+	groups := s.groups[k]
+	if active, ok := s.activeGroups[k]; ok && Contains(active, groups) {
+		return active
+	}
+	if len(groups) == 0 {
+		return ""
+	}
+	return groups[0]
+}
+
+// routeGroups collects sorted unique groups for each route with grouped mappers
+func routeGroups(mappers []URLMapper) map[groupKey][]string {
+	res := map[groupKey][]string{}
+	for _, m := range mappers {
+		if m.Group == "" {
+			continue
+		}
+		k := groupKey{server: m.Server, route: m.SrcMatch.String()}
+		if !Contains(m.Group, res[k]) {
+			res[k] = append(res[k], m.Group)
+		}
+	}
+	for k := range res {
+		sort.Strings(res[k])
+	}
+	return res
+}
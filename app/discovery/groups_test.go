@@ -0,0 +1,73 @@
+package discovery
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Groups(t *testing.T) {
+	mappers := []URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", Group: "green"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1", Group: "blue"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.3:8080/$1", Group: "blue"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/web/(.*)"), Dst: "http://127.0.0.4:8080/$1"},
+	}
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 2)
+			res <- PIDocker
+			go func() { // reload after the active group switched
+				time.Sleep(150 * time.Millisecond)
+				res <- PIDocker
+			}()
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) { return mappers, nil },
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*20)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	require.Eventually(t, func() bool { return len(svc.Mappers()) == 4 }, time.Second, 10*time.Millisecond)
+
+	dests := func(src string) (res []string) {
+		for _, r := range svc.Match("example.com", src, RequestInfo{}).Routes {
+			res = append(res, r.Destination)
+		}
+		return res
+	}
+
+	assert.Equal(t, []RouteGroups{{Server: "*", Route: "^/api/(.*)", Groups: []string{"blue", "green"}, Active: "blue"}},
+		svc.Groups())
+	assert.Equal(t, []string{"http://127.0.0.2:8080/x", "http://127.0.0.3:8080/x"}, dests("/api/x"), "first group by default")
+	assert.Equal(t, []string{"http://127.0.0.4:8080/x"}, dests("/web/x"), "no groups")
+
+	require.Error(t, svc.SetActiveGroup("*", "^/api/(.*)", "red"))
+	require.Error(t, svc.SetActiveGroup("example.com", "^/api/(.*)", "green"))
+	require.NoError(t, svc.SetActiveGroup("*", "^/api/(.*)", "green"))
+	assert.Equal(t, []string{"http://127.0.0.1:8080/x"}, dests("/api/x"))
+	assert.Equal(t, "green", svc.Groups()[0].Active)
+
+	time.Sleep(250 * time.Millisecond) // reloaded
+	assert.Equal(t, []string{"http://127.0.0.1:8080/x"}, dests("/api/x"), "active group kept after reload")
+}
+
+func TestService_activeGroupGone(t *testing.T) {
+	svc := NewService(nil, time.Second)
+	k := groupKey{server: "*", route: "^/api/(.*)"}
+	svc.groups = map[groupKey][]string{k: {"blue", "green"}}
+	require.NoError(t, svc.SetActiveGroup("*", "^/api/(.*)", "green"))
+	assert.Equal(t, "green", svc.activeGroup(k))
+
+	svc.groups = map[groupKey][]string{k: {"blue"}} // green containers removed
+	assert.Equal(t, "blue", svc.activeGroup(k), "fall back to default")
+
+	svc.groups = map[groupKey][]string{k: {"blue", "green"}} // green is back
+	assert.Equal(t, "green", svc.activeGroup(k))
+}
@@ -53,6 +53,9 @@ func New(client ConsulClient, checkInterval time.Duration) *ConsulCatalog {
 	return cc
 }
 
+// ID returns provider id
+func (cc *ConsulCatalog) ID() discovery.ProviderID { return discovery.PIConsulCatalog }
+
 // Events gets eventsCh, which emit services list update events
 func (cc *ConsulCatalog) Events(ctx context.Context) (res <-chan discovery.ProviderID) {
 	eventsCh := make(chan discovery.ProviderID)
@@ -3,13 +3,22 @@ package provider
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -27,30 +36,180 @@ import (
 // Optional reproxy.server enforces match by server name (hostname) and reproxy.ping sets the health check url
 // Labels can be presented multiple times with a numeric suffix to provide multiple matches for a single container
 // i.e. reproxy.1.server=example.com, reproxy.1.port=12345 and so on
+// SrcTemplate and DestTemplate, if set, replace the default source and destination with the rendered templates,
+// executed with RouteTemplateData for each container and route. Explicit reproxy.route and reproxy.dest labels
+// still take precedence.
 type Docker struct {
 	DockerClient    DockerClient
 	Excludes        []string
 	AutoAPI         bool
 	APIPrefix       string
 	RefreshInterval time.Duration
+	SrcTemplate     *template.Template
+	DestTemplate    *template.Template
+	MaxRoutes       int               // max number of routes, the oldest containers win. 0 means unlimited
+	RequirePort     int               // only containers exposing this private port discovered. 0 means any
+	RequireHealthy  bool              // only containers healthy by docker healthcheck, or without one, discovered
+	Vars            map[string]string // variables for ${NAME} in reproxy.dest, take precedence over environment
+
+	// UpStatuses and DownStatuses define container states served and removed from routes. Default up is "running"
+	// and everything else is down. With DownStatuses defined, states not listed in both sets are treated as up,
+	// i.e. UpStatuses=running, DownStatuses=exited,dead keeps routes of paused containers and skips the reload
+	UpStatuses   []string
+	DownStatuses []string
+
+	// PublishedHost is the address of docker host for containers without ip on defined networks but with ports
+	// published to the host. Such containers routed to PublishedHost:public_port, and their ports, including
+	// reproxy.port label, are the published (public) ports. Empty PublishedHost disables the fallback
+	PublishedHost string
+
+	// PublishedPorts routes all containers via ports published to the docker host, i.e. for "docker run -p" setups
+	// without user-defined networks, instead of container ip and private ports. The host address is PublishedHost
+	// if set, the host of tcp Endpoint for remote docker, or detected like for host-network containers otherwise.
+	// Containers without published ports skipped
+	PublishedPorts bool
+	Endpoint       string // docker endpoint, i.e. tcp://192.168.1.10:2375 or unix:///var/run/docker.sock
+
+	// HostNetwork enables routing of containers running with host network (--network host). Such containers
+	// have no ip, and they routed to HostAddress, or to the docker host address detected if HostAddress is empty.
+	// Ports of host-network containers are not listed by docker, so they defined by reproxy.port or reproxy.ports
+	HostNetwork bool
+	HostAddress string
+
+	LabelPrefix string // prefix of labels, i.e. "dpx" for dpx.route, dpx.dest and so on. Default is "reproxy"
+
+	// InspectTTL defines how long container inspect results reused, 1 minute by default. Cached result of
+	// a container dropped earlier on its start or removal from the running containers
+	InspectTTL time.Duration
+
+	// RouteTTL defines how long routes kept without being listed again, to bound routes of containers
+	// with missed down-events. Routes stamped as seen on each List, 0 means no expiry
+	RouteTTL time.Duration
+
+	// ImageRoutes maps image glob to the source route template, i.e. "example/web:*" to "^/{{.Name}}/(.*)", with
+	// RouteTemplateData. Containers of matching images routed without any labels, by the longest matching glob.
+	// Explicit labels of the container, like reproxy.route, override the generated route
+	ImageRoutes map[string]string
+
+	// UseServiceVIP routes replicas of swarm service with virtual ip to the vip, as a single destination balanced
+	// by docker, instead of a destination per replica. VIP is the service's endpoint virtual ip on the network
+	// replica's ip selected from. Services without vip, i.e. with dnsrr endpoint mode, still routed per replica
+	UseServiceVIP bool
+
+	// DispatchPrefix enables dispatch route, a single route ^/prefix/([^/]+)(/.*)?$ proxied to the container named
+	// by the captured segment, i.e. /svc/web/x to http://172.17.0.3:8080/x for DispatchPrefix=/svc. The container
+	// resolved on each request from containers of the last List, see Dispatch, without per-container routes
+	DispatchPrefix string
+
+	// Lenient makes List skip containers with invalid labels, i.e. reproxy.dest with undefined variable, and
+	// build routes of all other containers. Errors of skipped containers available with Errors. By default
+	// (strict) such container fails the whole List
+	Lenient bool
+
+	regexes  regexCache   // compiled src regexes, reused across List calls
+	inspects inspectCache // container inspect results, shared by all users of inspect
+
+	imageOnce   sync.Once
+	imageRoutes []imageRoute // parsed ImageRoutes, the longest glob first
+
+	hostAddrOnce sync.Once
+	hostAddr     string
+	hostAddrErr  error
+
+	drainLock sync.Mutex
+	drains    map[string]time.Time // drain start by container id, for stopped containers with reproxy.drain-window
+
+	errsLock sync.Mutex
+	errs     map[string]error // errors of containers skipped by the last lenient List, by container name
+
+	dispatchLock  sync.RWMutex
+	dispatchTable map[string]string // container name -> host:port, rebuilt by each List with DispatchPrefix
 }
 
+// RouteTemplateData is the data passed to SrcTemplate and DestTemplate
+type RouteTemplateData struct {
+	ID      string
+	Name    string
+	Image   string
+	IP      string
+	Port    int // matched port, i.e. the first exposed or defined by reproxy.N.port
+	Ports   []int
+	Labels  map[string]string
+	N       int    // route index, 0..9
+	Project string // compose project, from com.docker.compose.project label
+	Service string // compose service, from com.docker.compose.service label
+}
+
+// ParseRouteTemplate parses route template for SrcTemplate or DestTemplate. Missing keys are reported as errors.
+func ParseRouteTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// reBuiltin is a name of reproxy's built-in handler
+var reBuiltin = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// reLogTarget is a name of access log target, file name without path
+var reLogTarget = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// reCookieName matches valid cookie name, i.e. http token per rfc 6265
+var reCookieName = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+\\-.^_`|~]+$")
+
 // DockerClient defines interface listing containers and subscribing to events
 type DockerClient interface {
 	ListContainers() ([]containerInfo, error)
 }
 
+// NetworkEventer is an optional DockerClient capability, streaming network connect and disconnect events.
+// Containers joined the network after start get ip only with such event, so the provider refreshes
+// on each event instead of waiting for the next periodic check
+type NetworkEventer interface {
+	NetworkEvents(ctx context.Context) (<-chan struct{}, error)
+}
+
+// StopEventer is an optional DockerClient capability, streaming ids of containers being stopped, i.e. by docker stop.
+// Stopped containers with reproxy.drain-window label are drained gradually instead of dropped on exit
+type StopEventer interface {
+	StopEvents(ctx context.Context) (<-chan string, error)
+}
+
+// ContainerInspector is an optional DockerClient capability, inspecting container details not returned by the list,
+// like environment. Inspect is a call per container, so the provider caches results for InspectTTL
+type ContainerInspector interface {
+	InspectContainer(id string) (containerDetails, error)
+}
+
+// containerDetails is simplified view of container inspect
+type containerDetails struct {
+	ID        string
+	Env       map[string]string
+	Health    string // health status, i.e. healthy, empty for containers without healthcheck
+	StartedAt time.Time
+}
+
 // containerInfo is simplified view of container metadata
 type containerInfo struct {
 	ID     string
 	Name   string
+	Image  string
 	State  string
 	Labels map[string]string
 	TS     time.Time
 	IP     string
 	Ports  []int
+
+	PublishedPorts []int  // public ports on the docker host, for exposed ports published with -p
+	NetworkMode    string // container's network mode, i.e. bridge or host
+	VIP            string // virtual ip of swarm service on the network of IP, empty if the service has no vip
+	Health         string // docker healthcheck status, healthy, unhealthy or starting. Empty if no healthcheck
 }
 
+// ID returns provider id
+func (d *Docker) ID() discovery.ProviderID { return discovery.PIDocker }
+
 // Events gets eventsCh with all containers-related docker events events
 func (d *Docker) Events(ctx context.Context) (res <-chan discovery.ProviderID) {
 	eventsCh := make(chan discovery.ProviderID)
@@ -70,9 +229,58 @@ func (d *Docker) List() ([]discovery.URLMapper, error) {
 		return nil, err
 	}
 
+	if d.MaxRoutes > 0 {
+		// sort by creation time to keep the same routes across refreshes if the cap is hit
+		sort.SliceStable(containers, func(i, j int) bool {
+			if !containers[i].TS.Equal(containers[j].TS) {
+				return containers[i].TS.Before(containers[j].TS)
+			}
+			return containers[i].Name < containers[j].Name
+		})
+	}
+
 	var res []discovery.URLMapper //nolint:prealloc // we don't know the final size
+	dropped := 0
+	errs := map[string]error{}
 	for _, c := range containers {
-		res = append(res, d.parseContainerInfo(c)...)
+		mappers, err := d.parseContainerInfo(c)
+		if err != nil {
+			if !d.Lenient {
+				return nil, fmt.Errorf("can't parse container %s: %w", c.Name, err)
+			}
+			log.Printf("[WARN] container %s skipped, %v", c.Name, err)
+			errs[c.Name] = err
+			continue
+		}
+		if share, draining := d.drainShare(c); draining {
+			if share <= 0 {
+				log.Printf("[DEBUG] container %s drained, routes removed", c.Name)
+				continue
+			}
+			for i := range mappers {
+				mappers[i].Weight = int(math.Ceil(float64(mappers[i].EffectiveWeight()) * share))
+			}
+		}
+		res = append(res, mappers...)
+	}
+	res = append(res, d.defaultRoute(containers)...)
+	res = append(res, d.subrouteDispatchers(containers)...)
+	res = append(res, d.dispatchRoute(containers)...)
+	if d.MaxRoutes > 0 && len(res) > d.MaxRoutes {
+		// container routes go first, oldest containers first, so synthetic routes are the first to drop
+		dropped = len(res) - d.MaxRoutes
+		res = res[:d.MaxRoutes]
+	}
+	d.regexes.rotate() // drop regexes not used by this list
+	d.errsLock.Lock()
+	d.errs = errs
+	d.errsLock.Unlock()
+	now := time.Now()
+	for i := range res {
+		res[i].TTL, res[i].LastSeen = d.RouteTTL, now
+	}
+	if dropped > 0 {
+		log.Printf("[WARN] docker routes limit %d reached, %d routes dropped", d.MaxRoutes, dropped)
 	}
 
 	// sort by len(SrcMatch) to have shorter matches after longer
@@ -83,8 +291,22 @@ func (d *Docker) List() ([]discovery.URLMapper, error) {
 	return res, nil
 }
 
+// Errors returns errors of containers skipped by the last List in lenient mode, by container name.
+// Empty if all containers parsed, or in strict mode, where such error fails the List
+func (d *Docker) Errors() map[string]error {
+	d.errsLock.Lock()
+	defer d.errsLock.Unlock()
+	res := make(map[string]error, len(d.errs))
+	for name, err := range d.errs {
+		res[name] = err
+	}
+	return res
+}
+
 // parseContainerInfo getting URLMappers for up to 10 routes for 0..9 N (reproxy.N.something)
-func (d *Docker) parseContainerInfo(c containerInfo) (res []discovery.URLMapper) {
+// returns error for undefined variables in reproxy.N.dest only, all other invalid labels just disable the route
+func (d *Docker) parseContainerInfo(c containerInfo) ([]discovery.URLMapper, error) {
+	var res []discovery.URLMapper
 
 	for n := 0; n <= 9; n++ {
 		enabled, explicit := false, false
@@ -94,14 +316,42 @@ func (d *Docker) parseContainerInfo(c containerInfo) (res []discovery.URLMapper)
 			srcURL = fmt.Sprintf("^/%s/%s/(.*)", prefix, c.Name) // default src with api prefix is /api-prefix/container-name/(.*)
 		}
 
-		port, err := d.matchedPort(c, n)
+		socket, err := d.socketPath(c, n)
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
+		}
+
+		// destination's host:port, for unix socket upstream container name used as a host and port is not composed
+		port, hostPort := 0, c.Name
+		if socket == "" {
+			if port, err = d.matchedPort(c, n); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+			hostPort = fmt.Sprintf("%s:%d", c.IP, port)
+		}
+
+		// upstreams listed by the label serve the route instead of the container, the first one used as host:port
+		upstreams, err := d.upstreams(c, n)
 		if err != nil {
 			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
 			continue
 		}
+		if len(upstreams) > 0 {
+			if socket != "" {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, upstreams can't be used with socket", c.Name, n)
+				continue
+			}
+			enabled, hostPort = true, upstreams[0]
+		}
 
 		// defaults
-		destURL, pingURL, server := fmt.Sprintf("http://%s:%d/$1", c.IP, port), fmt.Sprintf("http://%s:%d/ping", c.IP, port), "*"
+		destURL, pingURL, server := fmt.Sprintf("http://%s/$1", hostPort), fmt.Sprintf("http://%s/ping", hostPort), "*"
+		if srcURL, destURL, err = d.applyTemplates(c, n, port, srcURL, destURL); err != nil {
+			log.Printf("[WARN] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
+		}
 		assetsWebRoot, assetsLocation, assetsSPA := "", "", false
 		onlyFrom := []string{}
 
@@ -109,6 +359,20 @@ func (d *Docker) parseContainerInfo(c containerInfo) (res []discovery.URLMapper)
 			enabled = true
 		}
 
+		if prefix, ok := d.subroutePrefix(c); ok && n == 0 { // member of subrouting group, served on prefix/name
+			enabled = true
+			srcURL = fmt.Sprintf("^%s/%s(/.*)?$", regexp.QuoteMeta(prefix), regexp.QuoteMeta(c.Name))
+			destURL = fmt.Sprintf("http://%s$1", hostPort)
+		}
+
+		if n == 0 {
+			if src, ok, e := d.imageSource(c, port); e != nil {
+				log.Printf("[WARN] container %s image route disabled, %v", c.Name, e)
+			} else if ok {
+				enabled, srcURL = true, src
+			}
+		}
+
 		if _, ok := d.labelN(c.Labels, n, "enabled"); ok {
 			enabled, explicit = true, true
 		}
@@ -120,31 +384,44 @@ func (d *Docker) parseContainerInfo(c containerInfo) (res []discovery.URLMapper)
 
 		if v, ok := d.labelN(c.Labels, n, "dest"); ok {
 			enabled, explicit = true, true
+			if v, err = d.expandVars(v); err != nil {
+				return nil, fmt.Errorf("route %d, %w", n, err)
+			}
 			if strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") || strings.HasPrefix(v, "@") {
 				destURL = v // proxy to http:// and https://, or redirect - destinations as-is, don't add host and port
 			} else {
-				destURL = fmt.Sprintf("http://%s:%d%s", c.IP, port, v)
+				destURL = fmt.Sprintf("http://%s%s", hostPort, v)
 			}
 		}
 
 		if v, ok := d.labelN(c.Labels, n, "server"); ok {
-			enabled = true
+			// reproxy.server used by reproxy.routes as well, doesn't enable the default route in this case
+			_, compound := d.label(c.Labels, "routes")
+			if _, own := d.label(c.Labels, fmt.Sprintf("%d.server", n)); own || !compound {
+				enabled = true
+			}
 			server = v
-		} else if v, ok = c.Labels["reproxy.server"]; ok { // fallback if no reproxy.N.server
+		} else if v, ok = d.label(c.Labels, "server"); ok { // fallback if no reproxy.N.server
 			server = v
 		}
 
+		readyURL := ""
+		if v, ok := d.labelN(c.Labels, n, "ready"); ok {
+			readyURL = probeURL(v, hostPort)
+		}
+
+		warmupURL := ""
+		if v, ok := d.labelN(c.Labels, n, "warmup"); ok {
+			warmupURL = probeURL(v, hostPort)
+		}
+
 		if v, ok := d.labelN(c.Labels, n, "remote"); ok {
 			onlyFrom = discovery.ParseOnlyFrom(v)
 		}
 
 		if v, ok := d.labelN(c.Labels, n, "ping"); ok {
 			enabled = true
-			if strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
-				pingURL = v // if ping is full url with http:// or https:// use it as-is
-			} else {
-				pingURL = fmt.Sprintf("http://%s:%d%s", c.IP, port, v)
-			}
+			pingURL = probeURL(v, hostPort)
 		}
 
 		if v, ok := d.labelN(c.Labels, n, "assets"); ok {
@@ -154,6 +431,14 @@ func (d *Docker) parseContainerInfo(c containerInfo) (res []discovery.URLMapper)
 			}
 		}
 
+		var static [][2]string // web root and location pairs served in front of the route
+		if v, ok := d.labelN(c.Labels, n, "static"); ok {
+			if static, err = d.staticOverlays(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
+
 		if _, ok := d.labelN(c.Labels, n, "spa"); ok {
 			assetsSPA = true
 		}
@@ -163,219 +448,1669 @@ func (d *Docker) parseContainerInfo(c containerInfo) (res []discovery.URLMapper)
 			enabled = true
 		}
 
-		keepHost := d.getKeepHostValue(c.Labels, n)
+		// handled on socketPath level, just use to enable implicitly
+		if socket != "" {
+			enabled = true
+		}
 
-		if !enabled {
-			continue
+		builtin, _ := d.labelN(c.Labels, n, "builtin")
+		if builtin = strings.TrimSpace(builtin); builtin != "" {
+			if !reBuiltin.MatchString(builtin) {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid builtin %q", c.Name, n, builtin)
+				continue
+			}
+			enabled, explicit = true, true
+			destURL = "builtin://" + builtin // served by reproxy, not proxied to the container
+			if _, ok := d.labelN(c.Labels, n, "ping"); !ok {
+				pingURL = "" // nothing to ping by default
+			}
 		}
 
-		srcRegex, err := regexp.Compile(srcURL)
-		if err != nil {
-			log.Printf("[DEBUG] container %s (route: %d) disabled, invalid src regex: %v", c.Name, n, err)
+		if len(upstreams) > 1 && !strings.HasPrefix(destURL, "http://"+hostPort) {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, upstreams can't be used with dest %s", c.Name, n, destURL)
 			continue
 		}
 
-		// docker server label may have multiple, comma separated servers
-		for _, srv := range strings.Split(server, ",") {
-			mp := discovery.URLMapper{Server: strings.TrimSpace(srv), SrcMatch: *srcRegex, Dst: destURL,
-				PingURL: pingURL, ProviderID: discovery.PIDocker, MatchType: discovery.MTProxy,
-				KeepHost: keepHost, OnlyFromIPs: onlyFrom}
-
-			// for assets we add the second proxy mapping only if explicitly requested
-			if assetsWebRoot != "" && explicit {
-				mp.MatchType = discovery.MTProxy
-				res = append(res, mp)
+		fallback, _ := d.labelN(c.Labels, n, "fallback")
+		if fallback = strings.TrimSpace(fallback); fallback != "" {
+			if fallback, err = d.fallback(fallback); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
 			}
+		}
 
-			if assetsWebRoot != "" {
-				mp.MatchType = discovery.MTStatic
-				mp.AssetsWebRoot = assetsWebRoot
-				mp.AssetsLocation = assetsLocation
-				mp.AssetsSPA = assetsSPA
+		keepHost := d.getKeepHostValue(c.Labels, n)
+
+		if !enabled {
+			continue
+		}
+
+		visibility := discovery.VisibilityPublic
+		if v, ok := d.labelN(c.Labels, n, "visibility"); ok {
+			if visibility, err = discovery.ParseVisibility(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
 			}
-			res = append(res, mp)
 		}
-	}
 
-	return res
-}
+		proto := discovery.UPHTTP
+		v, ok := d.labelN(c.Labels, n, "proto")
+		if !ok {
+			v, ok = d.labelN(c.Labels, n, "upstream-proto") // alias of proto
+		}
+		if ok {
+			if proto, err = discovery.ParseUpstreamProto(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
 
-// matchedPort gets port for route match, default the first exposed port
-// if reproxy.N.port label found, returns this port but only if it is one of exposed by the container
-func (d *Docker) matchedPort(c containerInfo, n int) (port int, err error) {
-	port = c.Ports[0] // by default use the first exposed port
+		sticky, _ := d.labelN(c.Labels, n, "sticky")
+		if sticky != "" && !reCookieName.MatchString(sticky) {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, invalid sticky cookie name %q", c.Name, n, sticky)
+			continue
+		}
 
-	if portLabel, ok := d.labelN(c.Labels, n, "port"); ok {
-		rp, err := strconv.Atoi(portLabel)
+		webSocket, err := d.boolLabelN(c.Labels, n, "websocket", false)
 		if err != nil {
-			return 0, fmt.Errorf("invalid reproxy port %s: %w", portLabel, err)
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
 		}
-		for _, p := range c.Ports {
-			// set port to reproxy.N.port if matched with one of exposed
-			if p == rp {
-				return rp, nil
+
+		unbuffered := false
+		if v, ok := d.labelN(c.Labels, n, "buffer"); ok {
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "on":
+			case "off":
+				unbuffered = true
+			default:
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid buffer value %q", c.Name, n, v)
+				continue
 			}
 		}
-		return 0, fmt.Errorf("reproxy port %s not exposed", portLabel)
-	}
-	return port, nil
-}
 
-// labelN returns label value from reproxy.N.suffix, i.e. reproxy.1.server
-func (d *Docker) labelN(labels map[string]string, n int, suffix string) (result string, ok bool) {
-	switch n {
-	case 0:
-		result, ok = labels["reproxy.0."+suffix]
-		if !ok {
-			result, ok = labels["reproxy."+suffix]
+		healthCritical, err := d.boolLabelN(c.Labels, n, "health-critical", true)
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
 		}
-	default:
-		result, ok = labels[fmt.Sprintf("reproxy.%d.%s", n, suffix)]
-	}
-	return result, ok
-}
-
-// events starts monitoring changes in running containers and sends refresh
-// notification to eventsCh when change(s) are detected. Blocks caller
-func (d *Docker) events(ctx context.Context, eventsCh chan<- discovery.ProviderID) error {
-	ticker := time.NewTicker(d.RefreshInterval)
-	defer ticker.Stop()
 
-	// Keep track of running containers
-	saved := make(map[string]containerInfo)
+		coalesce, err := d.boolLabelN(c.Labels, n, "coalesce", false)
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
+		}
 
-	update := func() {
-		containers, err := d.listContainers(false)
+		followRedirects, err := d.boolLabelN(c.Labels, n, "follow-redirects", false)
 		if err != nil {
-			log.Printf("[ERROR] failed to fetch running containers: %s", err)
-			return
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
 		}
 
-		refresh := false
-		seen := make(map[string]bool)
+		timingHeader, err := d.boolLabelN(c.Labels, n, "timing-header", false)
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
+		}
 
-		for _, c := range containers {
-			old, exists := saved[c.ID]
+		raw, err := d.boolLabelN(c.Labels, n, "raw", false)
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
+		}
 
-			if !exists || c.IP != old.IP || c.State != old.State || !c.TS.Equal(old.TS) {
-				refresh = true
+		noKeepAlive := false
+		if v, ok := d.labelN(c.Labels, n, "keepalive"); ok {
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "on":
+			case "off":
+				noKeepAlive = true
+			default:
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid keepalive value %q", c.Name, n, v)
+				continue
 			}
+		}
 
-			seen[c.ID] = true
+		mtls, err := d.boolLabelN(c.Labels, n, "mtls", false)
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
 		}
 
-		if len(saved) != len(seen) || refresh {
-			log.Printf("[INFO] changes in running containers detected: refreshing routes")
-			for k := range saved {
-				delete(saved, k)
+		var requireHeaders []string
+		if v, ok := d.labelN(c.Labels, n, "require-header"); ok {
+			requireHeaders = d.headersList(v)
+		}
+
+		var contentTypes []string
+		if v, ok := d.labelN(c.Labels, n, "content-type"); ok {
+			if contentTypes, err = d.contentTypes(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
 			}
-			for _, c := range containers {
-				saved[c.ID] = c
+		}
+
+		var allowUA *regexp.Regexp
+		if v, ok := d.labelN(c.Labels, n, "allow-ua"); ok {
+			if allowUA, err = d.regexes.compile(strings.TrimSpace(v)); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid allow-ua regex %q: %v", c.Name, n, v, err)
+				continue
 			}
-			eventsCh <- discovery.PIDocker
 		}
-	}
 
-	update() // Refresh immediately
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-			update()
+		var minTLS uint16
+		if v, ok := d.labelN(c.Labels, n, "min-tls"); ok {
+			if minTLS, err = discovery.ParseTLSVersion(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
 		}
-	}
-}
 
-func (d *Docker) listContainers(allowLogging bool) (res []containerInfo, err error) {
-	containers, err := d.DockerClient.ListContainers()
-	if err != nil {
-		return nil, fmt.Errorf("can't list containers: %w", err)
-	}
+		alpn, _ := d.labelN(c.Labels, n, "alpn")
+		if alpn = strings.ToLower(strings.TrimSpace(alpn)); alpn != "" && alpn != "h2" && alpn != "http/1.1" {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, invalid alpn %q, should be h2 or http/1.1", c.Name, n, alpn)
+			continue
+		}
 
-	if allowLogging {
-		log.Printf("[DEBUG] total containers = %d", len(containers))
-	}
+		requestIDHeader, _ := d.labelN(c.Labels, n, "requestid-header")
+		listener, _ := d.labelN(c.Labels, n, "listener")
+		group, _ := d.labelN(c.Labels, n, "group")
 
-	for _, c := range containers {
-		if c.State != "running" {
-			if allowLogging {
-				log.Printf("[DEBUG] skip container %s due to state %s", c.Name, c.State)
-			}
+		maxConn, maxConnWait, err := d.maxConn(c, n)
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
 			continue
 		}
 
-		if discovery.Contains(c.Name, d.Excludes) || strings.EqualFold(c.Name, "reproxy") {
-			if allowLogging {
-				log.Printf("[DEBUG] container %s excluded", c.Name)
+		maxConnPerIP := 0
+		if v, ok := d.labelN(c.Labels, n, "max-conn-per-ip"); ok {
+			if maxConnPerIP, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || maxConnPerIP <= 0 {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid max-conn-per-ip %q", c.Name, n, v)
+				continue
 			}
-			continue
 		}
 
-		if v, ok := c.Labels["reproxy.enabled"]; ok {
-			if strings.EqualFold(v, "false") || strings.EqualFold(v, "no") || v == "0" {
-				if allowLogging {
-					log.Printf("[DEBUG] skip container %s due to reproxy.enabled=%s", c.Name, v)
-				}
+		var cacheTTL time.Duration
+		if v, ok := d.labelN(c.Labels, n, "cache"); ok {
+			if cacheTTL, err = time.ParseDuration(v); err != nil || cacheTTL < 0 {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid cache ttl %q", c.Name, n, v)
 				continue
 			}
 		}
 
-		if c.IP == "" {
-			if allowLogging {
-				log.Printf("[DEBUG] skip container %s, no ip on defined networks", c.Name)
-			}
+		passthrough, err := d.boolLabelN(c.Labels, n, "passthrough", false)
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
+		}
+		if _, hasDest := d.labelN(c.Labels, n, "dest"); passthrough && hasDest {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, passthrough can't be used with dest", c.Name, n)
 			continue
 		}
+		if passthrough {
+			destURL = fmt.Sprintf("http://%s$0", hostPort) // $0 is the whole match, i.e. the original path as-is
+		}
 
-		if len(c.Ports) == 0 {
-			if allowLogging {
-				log.Printf("[DEBUG] skip container %s, no exposed ports", c.Name)
+		rewritePath, _ := d.labelN(c.Labels, n, "rewrite-path")
+		if rewritePath = strings.TrimSpace(rewritePath); rewritePath != "" {
+			if !strings.HasPrefix(rewritePath, "/") {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid rewrite-path %q, should start with /",
+					c.Name, n, rewritePath)
+				continue
+			}
+			if _, hasDest := d.labelN(c.Labels, n, "dest"); !hasDest {
+				destURL = fmt.Sprintf("http://%s%s", hostPort, rewritePath) // captured groups not used
 			}
+		}
+
+		rewrite, err := d.boolLabelN(c.Labels, n, "rewrite-location", false)
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
 			continue
 		}
+		rewriteLocation := ""
+		if rewrite {
+			rewriteLocation = "http://" + hostPort
+		}
 
-		if allowLogging {
-			log.Printf("[DEBUG] running container added, %+v", c)
+		sni, _ := d.labelN(c.Labels, n, "sni")
+		if sni = strings.TrimSpace(sni); sni != "" && !strings.HasPrefix(destURL, "https://") {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, sni %q requires https destination", c.Name, n, sni)
+			continue
 		}
-		res = append(res, c)
-	}
-	if allowLogging {
-		log.Print("[DEBUG] completed list")
-	}
-	return res, nil
-}
 
-type dockerClient struct {
-	client  http.Client
-	network string // network for IP selection
+		sourceIP, _ := d.labelN(c.Labels, n, "source-ip")
+		if sourceIP = strings.TrimSpace(sourceIP); sourceIP != "" {
+			ip := net.ParseIP(sourceIP)
+			if ip == nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid source-ip %q", c.Name, n, sourceIP)
+				continue
+			}
+			sourceIP = ip.String()
+		}
+
+		logFile, _ := d.labelN(c.Labels, n, "logfile")
+		if logFile = strings.TrimSpace(logFile); logFile != "" && !reLogTarget.MatchString(logFile) {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, invalid logfile %q", c.Name, n, logFile)
+			continue
+		}
+
+		metricName := d.metricName(c, n)
+
+		var matchHeaders []discovery.HeaderCondition
+		if v, ok := d.labelN(c.Labels, n, "match-header"); ok {
+			if matchHeaders, err = discovery.ParseHeaderConditions(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
+		if v, ok := d.labelN(c.Labels, n, "match-geo"); ok {
+			var geo discovery.HeaderCondition
+			if geo, err = discovery.ParseHeaderSetCondition(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+			matchHeaders = append(matchHeaders, geo)
+		}
+
+		forwarded := discovery.ForwardedSet
+		if v, ok := d.labelN(c.Labels, n, "forwarded"); ok {
+			if forwarded, err = discovery.ParseForwardedPolicy(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
+
+		var matchQuery []discovery.QueryCondition
+		if v, ok := d.labelN(c.Labels, n, "match-query"); ok {
+			if matchQuery, err = discovery.ParseQueryConditions(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
+
+		var respRewrite []discovery.BodyRewrite
+		if v, ok := d.labelN(c.Labels, n, "response-rewrite"); ok {
+			if respRewrite, err = discovery.ParseBodyRewrites(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
+
+		var statusMap map[int]int
+		if v, ok := d.labelN(c.Labels, n, "status-map"); ok {
+			if statusMap, err = discovery.ParseStatusMap(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
+
+		var statusHeaders []discovery.StatusHeader
+		if v, ok := d.labelN(c.Labels, n, "resp-header-on"); ok {
+			if statusHeaders, err = discovery.ParseStatusHeaders(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
+
+		var slowLog time.Duration
+		if v, ok := d.labelN(c.Labels, n, "slowlog"); ok {
+			if slowLog, err = time.ParseDuration(strings.TrimSpace(v)); err != nil || slowLog <= 0 {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid slowlog %q", c.Name, n, v)
+				continue
+			}
+		}
+
+		var timeout, idleTimeout time.Duration
+		if v, ok := d.labelN(c.Labels, n, "timeout"); ok {
+			if timeout, err = time.ParseDuration(strings.TrimSpace(v)); err != nil || timeout <= 0 {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid timeout %q", c.Name, n, v)
+				continue
+			}
+		}
+		if v, ok := d.labelN(c.Labels, n, "idle-timeout"); ok {
+			if idleTimeout, err = time.ParseDuration(strings.TrimSpace(v)); err != nil || idleTimeout <= 0 {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid idle-timeout %q", c.Name, n, v)
+				continue
+			}
+		}
+		var fault discovery.Fault
+		if v, ok := d.labelN(c.Labels, n, "fault-delay"); ok {
+			if fault.Delay, fault.DelayPercent, err = discovery.ParseFaultDelay(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
+		if v, ok := d.labelN(c.Labels, n, "fault-abort"); ok {
+			if fault.AbortStatus, fault.AbortPercent, err = discovery.ParseFaultAbort(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
+
+		var breaker discovery.Breaker
+		if v, ok := d.labelN(c.Labels, n, "breaker"); ok {
+			if breaker, err = discovery.ParseBreaker(v); err != nil {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+				continue
+			}
+		}
+
+		jwtKey, _ := d.labelN(c.Labels, n, "jwt")
+		if jwtKey, err = d.expandVars(jwtKey); err != nil { // secret usually referenced as ${NAME}, not set in label
+			return nil, fmt.Errorf("route %d, %w", n, err)
+		}
+		jwtClaims, _ := d.labelN(c.Labels, n, "jwt-claims")
+		jwtHeaders, _ := d.labelN(c.Labels, n, "jwt-headers")
+		var jwt discovery.JWT
+		if jwt, err = d.jwt(jwtKey, jwtClaims, jwtHeaders); err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
+		}
+
+		var headerTimeout time.Duration
+		if v, ok := d.labelN(c.Labels, n, "header-timeout"); ok {
+			if headerTimeout, err = time.ParseDuration(strings.TrimSpace(v)); err != nil || headerTimeout <= 0 {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid header-timeout %q", c.Name, n, v)
+				continue
+			}
+		}
+
+		retryAfter := 0
+		if v, ok := d.labelN(c.Labels, n, "retry-after"); ok {
+			if retryAfter, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || retryAfter < 0 {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid retry-after %q", c.Name, n, v)
+				continue
+			}
+		}
+
+		weight := 0
+		if v, ok := d.labelN(c.Labels, n, "weight"); ok {
+			if weight, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || weight <= 0 {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid weight %q", c.Name, n, v)
+				continue
+			}
+		}
+
+		rateLimit := 0
+		if v, ok := d.labelN(c.Labels, n, "ratelimit"); ok {
+			if rateLimit, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || rateLimit <= 0 {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid ratelimit %q", c.Name, n, v)
+				continue
+			}
+		}
+		rateLimitGroup, _ := d.labelN(c.Labels, n, "ratelimit-group")
+
+		logBody, err := d.sizeLabel(c, n, "logbody")
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
+		}
+
+		gzipLevel := 0
+		if v, ok := d.labelN(c.Labels, n, "gzip-level"); ok {
+			if gzipLevel, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || gzipLevel < 1 || gzipLevel > 9 {
+				log.Printf("[DEBUG] container %s (route: %d) disabled, invalid gzip-level %q, should be 1-9", c.Name, n, v)
+				continue
+			}
+		}
+		gzipMin, err := d.sizeLabel(c, n, "gzip-min")
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
+		}
+
+		var stripReqHeaders, stripRespHeaders []string
+		if v, ok := d.labelN(c.Labels, n, "strip-req-headers"); ok {
+			stripReqHeaders = d.headersList(v)
+		}
+		if v, ok := d.labelN(c.Labels, n, "strip-resp-headers"); ok {
+			stripRespHeaders = d.headersList(v)
+		}
+
+		srcRegex, err := d.regexes.compile(srcURL)
+		if err != nil {
+			log.Printf("[DEBUG] container %s (route: %d) disabled, invalid src regex: %v", c.Name, n, err)
+			continue
+		}
+
+		// docker server label may have multiple, comma separated servers
+		for _, srv := range strings.Split(server, ",") {
+			mp := discovery.URLMapper{Server: strings.TrimSpace(srv), SrcMatch: *srcRegex, Dst: destURL,
+				PingURL: pingURL, ProviderID: d.ID(), MatchType: discovery.MTProxy,
+				KeepHost: keepHost, OnlyFromIPs: onlyFrom, Visibility: visibility, Proto: proto,
+				Socket: socket, StickyCookie: sticky, StripReqHeaders: stripReqHeaders, StripRespHeaders: stripRespHeaders,
+				WebSocket: webSocket, Unbuffered: unbuffered, RequestIDHeader: strings.TrimSpace(requestIDHeader),
+				CacheTTL: cacheTTL, RewriteLocation: rewriteLocation, Listener: strings.TrimSpace(listener),
+				MaxConn: maxConn, MaxConnWait: maxConnWait, SNI: sni, MetricName: metricName,
+				MatchHeaders: matchHeaders, MatchQuery: matchQuery, Group: strings.TrimSpace(group), MTLS: mtls, ALPN: alpn,
+				ResponseRewrite: respRewrite, LogBody: logBody, NoKeepAlive: noKeepAlive,
+				SlowLog: slowLog, RetryAfter: retryAfter, ReadyURL: readyURL,
+				Forwarded: forwarded, Timeout: timeout, IdleTimeout: idleTimeout, Weight: weight,
+				RequireHeaders: requireHeaders, StatusMap: statusMap, SourceIP: sourceIP,
+				LogFile: logFile, MinTLS: minTLS, RateLimit: rateLimit, RateLimitGroup: strings.TrimSpace(rateLimitGroup),
+				NonCritical: !healthCritical, Builtin: builtin, HeaderTimeout: headerTimeout, Coalesce: coalesce, AllowUA: allowUA,
+				Fault: fault, StatusHeaders: statusHeaders, GzipLevel: gzipLevel, GzipMin: gzipMin,
+				FollowRedirects: followRedirects, Raw: raw, MaxConnPerIP: maxConnPerIP,
+				RewritePath: rewritePath, ContentTypes: contentTypes, Fallback: fallback,
+				Breaker: breaker, TimingHeader: timingHeader, JWT: jwt, WarmupURL: warmupURL}
+
+			// for assets we add the second proxy mapping only if explicitly requested
+			if assetsWebRoot != "" && explicit {
+				mp.MatchType = discovery.MTProxy
+				res = append(res, mp)
+			}
+
+			if assetsWebRoot != "" {
+				mp.MatchType = discovery.MTStatic
+				mp.AssetsWebRoot = assetsWebRoot
+				mp.AssetsLocation = assetsLocation
+				mp.AssetsSPA = assetsSPA
+			}
+			res = append(res, mp)
+			if mp.MatchType == discovery.MTProxy && len(upstreams) > 1 {
+				for _, up := range upstreams[1:] { // the same route for each upstream, balanced by proxy
+					res = append(res, withUpstream(mp, hostPort, up))
+				}
+			}
+
+			for _, st := range static { // source regex made for reporting only, static matched by web root
+				src := regexp.MustCompile("^" + regexp.QuoteMeta(st[0]) + "(/.*)?$")
+				res = append(res, discovery.URLMapper{Server: mp.Server, SrcMatch: *src, Dst: st[1], ProviderID: d.ID(),
+					MatchType: discovery.MTStatic, AssetsWebRoot: st[0], AssetsLocation: st[1], AssetsOverlay: true,
+					OnlyFromIPs: onlyFrom, Visibility: visibility, Listener: mp.Listener})
+			}
+		}
+	}
+
+	return append(res, d.compoundRoutes(c)...), nil
+}
+
+// staticOverlays parses comma separated list of web-root:location pairs, i.e. /robots.txt:/srv/robots,/maint:/srv/maint
+func (d *Docker) staticOverlays(v string) (res [][2]string, err error) {
+	for _, elem := range strings.Split(v, ",") {
+		webRoot, location, ok := strings.Cut(strings.TrimSpace(elem), ":")
+		if !ok || !strings.HasPrefix(webRoot, "/") || location == "" {
+			return nil, fmt.Errorf("invalid static %q, should be web-root:location", elem)
+		}
+		res = append(res, [2]string{webRoot, location})
+	}
+	return res, nil
+}
+
+// defaultRoute makes catch-all ^/(.*) mappers for the container with reproxy.default=true label.
+// the oldest container wins if multiple containers claim default, others logged and ignored
+func (d *Docker) defaultRoute(containers []containerInfo) []discovery.URLMapper {
+	var candidates []containerInfo
+	for _, c := range containers {
+		v, ok := d.label(c.Labels, "default")
+		if !ok {
+			continue
+		}
+		isDefault, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("[DEBUG] container %s default route disabled, invalid default value %q", c.Name, v)
+			continue
+		}
+		if isDefault {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if !candidates[i].TS.Equal(candidates[j].TS) {
+			return candidates[i].TS.Before(candidates[j].TS)
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	for _, c := range candidates[1:] {
+		log.Printf("[WARN] container %s ignored as default route, already defined by %s", c.Name, candidates[0].Name)
+	}
+
+	c := candidates[0]
+	port, err := d.matchedPort(c, 0)
+	if err != nil {
+		log.Printf("[WARN] container %s default route disabled, %v", c.Name, err)
+		return nil
+	}
+	srcRegex, err := d.regexes.compile("^/(.*)")
+	if err != nil {
+		return nil
+	}
+
+	server := "*"
+	if v, ok := d.label(c.Labels, "server"); ok {
+		server = v
+	}
+	hostPort := fmt.Sprintf("%s:%d", c.IP, port)
+	res := []discovery.URLMapper{}
+	for _, srv := range strings.Split(server, ",") {
+		res = append(res, discovery.URLMapper{Server: strings.TrimSpace(srv), SrcMatch: *srcRegex,
+			Dst: fmt.Sprintf("http://%s/$1", hostPort), PingURL: fmt.Sprintf("http://%s/ping", hostPort),
+			ProviderID: d.ID(), MatchType: discovery.MTProxy, CatchAll: true})
+	}
+	return res
+}
+
+// dispatchRoute makes the dispatch route of DispatchPrefix and rebuilds the containers table it resolved with.
+// The table rebuilt on each List, i.e. on container events and periodic refresh, so it follows the same containers
+// as the regular routes. Containers with unix socket upstream or without exposed port not dispatched
+func (d *Docker) dispatchRoute(containers []containerInfo) []discovery.URLMapper {
+	prefix := strings.Trim(d.DispatchPrefix, "/")
+	if prefix == "" {
+		return nil
+	}
+	table := map[string]string{}
+	for _, c := range containers {
+		if d.hasSocket(c) {
+			continue
+		}
+		port, err := d.matchedPort(c, 0)
+		if err != nil {
+			log.Printf("[DEBUG] container %s not dispatched, %v", c.Name, err)
+			continue
+		}
+		table[c.Name] = fmt.Sprintf("%s:%d", c.IP, port)
+	}
+	d.dispatchLock.Lock()
+	d.dispatchTable = table
+	d.dispatchLock.Unlock()
+
+	srcRegex, err := d.regexes.compile(fmt.Sprintf("^/%s/([^/]+)(/.*)?$", regexp.QuoteMeta(prefix)))
+	if err != nil {
+		log.Printf("[WARN] dispatch route disabled, %v", err)
+		return nil
+	}
+	return []discovery.URLMapper{{Server: "*", SrcMatch: *srcRegex, Dst: "http://$1$2", ProviderID: d.ID(),
+		MatchType: discovery.MTProxy, Dispatch: true}}
+}
+
+// Dispatch resolves container name to its host:port, for the dispatch route. Implements discovery.Dispatcher
+func (d *Docker) Dispatch(name string) (string, bool) {
+	d.dispatchLock.RLock()
+	defer d.dispatchLock.RUnlock()
+	hostPort, ok := d.dispatchTable[name]
+	return hostPort, ok
+}
+
+// compoundRoutes makes mappers from reproxy.routes label with comma separated src->port pairs,
+// i.e. reproxy.routes=^/api/(.*)->8080,^/admin/(.*)->9090. Each pair proxied to http://ip:port/$1 of the container,
+// server taken from reproxy.server label. Invalid pairs logged and skipped
+func (d *Docker) compoundRoutes(c containerInfo) (res []discovery.URLMapper) {
+	v, ok := d.label(c.Labels, "routes")
+	if !ok {
+		return nil
+	}
+
+	server := "*"
+	if srv, ok := d.label(c.Labels, "server"); ok {
+		server = srv
+	}
+
+	for _, pair := range splitRoutePairs(v) {
+		src, portLabel, ok := strings.Cut(pair, "->")
+		if !ok {
+			log.Printf("[DEBUG] container %s route %q disabled, expected src->port", c.Name, pair)
+			continue
+		}
+		src, portLabel = strings.TrimSpace(src), strings.TrimSpace(portLabel)
+		port, err := d.exposedPort(c, portLabel)
+		if err != nil {
+			log.Printf("[DEBUG] container %s route %q disabled, %v", c.Name, pair, err)
+			continue
+		}
+		srcRegex, err := d.regexes.compile(src)
+		if err != nil {
+			log.Printf("[DEBUG] container %s route %q disabled, invalid src regex: %v", c.Name, pair, err)
+			continue
+		}
+
+		hostPort := fmt.Sprintf("%s:%d", c.IP, port)
+		for _, srv := range strings.Split(server, ",") {
+			res = append(res, discovery.URLMapper{Server: strings.TrimSpace(srv), SrcMatch: *srcRegex,
+				Dst: fmt.Sprintf("http://%s/$1", hostPort), PingURL: fmt.Sprintf("http://%s/ping", hostPort),
+				ProviderID: d.ID(), MatchType: discovery.MTProxy})
+		}
+	}
+	return res
+}
+
+// splitRoutePairs splits src->port pairs on commas following the port only, as src regex may have commas, i.e. {1,3}
+func splitRoutePairs(v string) (res []string) {
+	for strings.TrimSpace(v) != "" {
+		pos := strings.Index(v, "->")
+		if pos < 0 {
+			return append(res, strings.TrimSpace(v)) // no port, reported by caller
+		}
+		end := strings.Index(v[pos:], ",")
+		if end < 0 {
+			return append(res, strings.TrimSpace(v))
+		}
+		res = append(res, strings.TrimSpace(v[:pos+end]))
+		v = v[pos+end+1:]
+	}
+	return res
+}
+
+// metricName returns route id for per-route metrics, reproxy.N.metric-name label or container's compose service,
+// i.e. project/service, stable across container restarts and replicas. Container name used for non-compose containers
+func (d *Docker) metricName(c containerInfo, n int) string {
+	if v, ok := d.labelN(c.Labels, n, "metric-name"); ok && strings.TrimSpace(v) != "" {
+		return strings.TrimSpace(v)
+	}
+	if svc := c.Labels["com.docker.compose.service"]; svc != "" {
+		if prj := c.Labels["com.docker.compose.project"]; prj != "" {
+			return prj + "/" + svc
+		}
+		return svc
+	}
+	return c.Name
+}
+
+// maxConn parses reproxy.N.maxconn label, max concurrent requests as a positive integer with optional
+// queue wait after comma, i.e. reproxy.maxconn=10,5s. Without wait excess requests rejected right away
+func (d *Docker) maxConn(c containerInfo, n int) (limit int, wait time.Duration, err error) {
+	v, ok := d.labelN(c.Labels, n, "maxconn")
+	if !ok {
+		return 0, 0, nil
+	}
+	limitStr, waitStr, hasWait := strings.Cut(v, ",")
+	if limit, err = strconv.Atoi(strings.TrimSpace(limitStr)); err != nil || limit <= 0 {
+		return 0, 0, fmt.Errorf("invalid maxconn %q, should be a positive integer", v)
+	}
+	if hasWait {
+		if wait, err = time.ParseDuration(strings.TrimSpace(waitStr)); err != nil || wait < 0 {
+			return 0, 0, fmt.Errorf("invalid maxconn wait %q", v)
+		}
+	}
+	return limit, wait, nil
+}
+
+// subroutePrefix returns path prefix of the subrouting group the container is a member of, from
+// reproxy.subroute-key label, i.e. /api. Members of the group with the same prefix and server served on
+// prefix/container-name, and requests to prefix with unknown name responded with 404
+func (d *Docker) subroutePrefix(c containerInfo) (string, bool) {
+	v, ok := d.label(c.Labels, "subroute-key")
+	if !ok {
+		return "", false
+	}
+	prefix := "/" + strings.Trim(strings.TrimSpace(v), "/")
+	if prefix == "/" {
+		log.Printf("[DEBUG] container %s subroute disabled, invalid subroute-key %q", c.Name, v)
+		return "", false
+	}
+	return prefix, true
+}
+
+// subrouteDispatchers makes a route for each subrouting group, matching the group prefix after all member
+// routes, and responding with 404 for the unknown member. Groups made by prefix and server of members
+func (d *Docker) subrouteDispatchers(containers []containerInfo) []discovery.URLMapper {
+	groups := map[string]bool{} // server and prefix
+	res := []discovery.URLMapper{}
+	for _, c := range containers {
+		prefix, ok := d.subroutePrefix(c)
+		if !ok {
+			continue
+		}
+		server := "*"
+		if v, ok := d.label(c.Labels, "server"); ok {
+			server = v
+		}
+		for _, srv := range strings.Split(server, ",") {
+			srv = strings.TrimSpace(srv)
+			if groups[srv+prefix] {
+				continue
+			}
+			groups[srv+prefix] = true
+			srcRegex, err := d.regexes.compile(fmt.Sprintf("^%s/(.*)", regexp.QuoteMeta(prefix)))
+			if err != nil {
+				continue
+			}
+			res = append(res, discovery.URLMapper{Server: srv, SrcMatch: *srcRegex, Dst: "builtin://notfound",
+				Builtin: "notfound", ProviderID: d.ID(), MatchType: discovery.MTProxy})
+		}
+	}
+	return res
+}
+
+// sizeLabel returns size from the label, i.e. 512, 4k or 1m for logbody. 0 if not set
+func (d *Docker) sizeLabel(c containerInfo, n int, name string) (int, error) {
+	v, ok := d.labelN(c.Labels, n, name)
+	if !ok {
+		return 0, nil
+	}
+	sizeStr, mult := strings.ToLower(strings.TrimSpace(v)), 1
+	switch {
+	case strings.HasSuffix(sizeStr, "k"):
+		sizeStr, mult = strings.TrimSuffix(sizeStr, "k"), 1024
+	case strings.HasSuffix(sizeStr, "m"):
+		sizeStr, mult = strings.TrimSuffix(sizeStr, "m"), 1024*1024
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, should be a positive size, i.e. 4k", name, v)
+	}
+	return size * mult, nil
+}
+
+// applyTemplates renders SrcTemplate and DestTemplate for the container route, if defined.
+// returns src and dest as-is for undefined templates
+func (d *Docker) applyTemplates(c containerInfo, n, port int, src, dest string) (rsrc, rdest string, err error) {
+	if d.SrcTemplate == nil && d.DestTemplate == nil {
+		return src, dest, nil
+	}
+
+	data := d.templateData(c, n, port)
+	execute := func(tmpl *template.Template, def string) (string, error) {
+		if tmpl == nil {
+			return def, nil
+		}
+		var buf strings.Builder
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("can't execute %s template: %w", tmpl.Name(), err)
+		}
+		return strings.TrimSpace(buf.String()), nil
+	}
+
+	if rsrc, err = execute(d.SrcTemplate, src); err != nil {
+		return "", "", err
+	}
+	if _, err = d.regexes.compile(rsrc); err != nil {
+		return "", "", fmt.Errorf("invalid src regex %q from template: %w", rsrc, err)
+	}
+	if rdest, err = execute(d.DestTemplate, dest); err != nil {
+		return "", "", err
+	}
+	return rsrc, rdest, nil
+}
+
+func (d *Docker) templateData(c containerInfo, n, port int) RouteTemplateData {
+	return RouteTemplateData{ID: c.ID, Name: c.Name, Image: c.Image, IP: c.IP, Port: port, Ports: c.Ports, Labels: c.Labels,
+		N: n, Project: c.Labels["com.docker.compose.project"], Service: c.Labels["com.docker.compose.service"]}
+}
+
+// imageRoute is a parsed ImageRoutes element
+type imageRoute struct {
+	glob string
+	tmpl *template.Template
+}
+
+// imageSource returns source route generated for the container by the longest ImageRoutes glob matching its image.
+// ok is false if no glob matched
+func (d *Docker) imageSource(c containerInfo, port int) (src string, ok bool, err error) {
+	d.imageOnce.Do(func() {
+		for glob, text := range d.ImageRoutes {
+			tmpl, e := ParseRouteTemplate("image "+glob, text)
+			if e != nil {
+				log.Printf("[WARN] image route %s ignored, %v", glob, e)
+				continue
+			}
+			d.imageRoutes = append(d.imageRoutes, imageRoute{glob: glob, tmpl: tmpl})
+		}
+		sort.Slice(d.imageRoutes, func(i, j int) bool {
+			if len(d.imageRoutes[i].glob) != len(d.imageRoutes[j].glob) {
+				return len(d.imageRoutes[i].glob) > len(d.imageRoutes[j].glob)
+			}
+			return d.imageRoutes[i].glob < d.imageRoutes[j].glob
+		})
+	})
+	if c.Image == "" {
+		return "", false, nil
+	}
+	for _, ir := range d.imageRoutes {
+		if matched, _ := path.Match(ir.glob, c.Image); !matched {
+			continue
+		}
+		var buf strings.Builder
+		if err = ir.tmpl.Execute(&buf, d.templateData(c, 0, port)); err != nil {
+			return "", false, fmt.Errorf("can't execute %s template: %w", ir.tmpl.Name(), err)
+		}
+		return strings.TrimSpace(buf.String()), true, nil
+	}
+	return "", false, nil
+}
+
+// socketPath gets unix socket path from reproxy.N.socket label, empty if not defined.
+// the path should be absolute, i.e. pointing to the socket in a volume shared with reproxy
+func (d *Docker) socketPath(c containerInfo, n int) (string, error) {
+	v, ok := d.labelN(c.Labels, n, "socket")
+	if !ok {
+		return "", nil
+	}
+	if !filepath.IsAbs(v) {
+		return "", fmt.Errorf("reproxy socket %s is not absolute path", v)
+	}
+	return filepath.Clean(v), nil
+}
+
+// hasSocket checks if any of container's routes defined with reproxy.N.socket label
+func (d *Docker) hasSocket(c containerInfo) bool {
+	for n := 0; n <= 9; n++ {
+		if _, ok := d.labelN(c.Labels, n, "socket"); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchedPort gets port for route match, default the first exposed port
+// if reproxy.N.port label found, returns this port but only if it is one of exposed by the container
+func (d *Docker) matchedPort(c containerInfo, n int) (port int, err error) {
+	if len(c.Ports) == 0 {
+		return 0, fmt.Errorf("no exposed ports")
+	}
+	port = c.Ports[0] // by default use the first exposed port
+
+	if portLabel, ok := d.labelN(c.Labels, n, "port"); ok {
+		return d.exposedPort(c, portLabel)
+	}
+	return port, nil
+}
+
+// exposedPort resolves port number or name defined in reproxy.ports. Port number should be exposed by the container
+func (d *Docker) exposedPort(c containerInfo, portLabel string) (int, error) {
+	rp, err := strconv.Atoi(portLabel)
+	if err != nil {
+		// not a number, should be a name defined in reproxy.ports
+		return d.namedPort(c, portLabel)
+	}
+	for _, p := range c.Ports {
+		// set port to reproxy.N.port if matched with one of exposed
+		if p == rp {
+			return rp, nil
+		}
+	}
+	return 0, fmt.Errorf("reproxy port %s not exposed", portLabel)
+}
+
+// reVar matches ${NAME} and ${NAME:-default} variables
+var reVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?}`)
+
+// expandVars substitutes ${NAME} variables from Vars or, if not defined there, from the environment.
+// ${NAME:-default} uses default for undefined variable, undefined variable without default is an error.
+// regex groups like $1 are not variables and kept as-is
+func (d *Docker) expandVars(v string) (string, error) {
+	var undefined []string
+	res := reVar.ReplaceAllStringFunc(v, func(s string) string {
+		elems := reVar.FindStringSubmatch(s)
+		if val, ok := d.Vars[elems[1]]; ok {
+			return val
+		}
+		if val, ok := os.LookupEnv(elems[1]); ok {
+			return val
+		}
+		if elems[2] != "" { // default syntax used
+			return elems[3]
+		}
+		undefined = append(undefined, elems[1])
+		return s
+	})
+	if len(undefined) > 0 {
+		return "", fmt.Errorf("undefined variables %s", strings.Join(undefined, ", "))
+	}
+	return res, nil
+}
+
+// headersList splits comma-separated list of header names, empty elements ignored
+func (d *Docker) headersList(v string) (res []string) {
+	for _, h := range strings.Split(v, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+// upstreams returns host:port targets from reproxy.N.upstreams label, i.e. 10.0.0.1:8080,10.0.0.2:8080
+func (d *Docker) upstreams(c containerInfo, n int) (res []string, err error) {
+	v, ok := d.labelN(c.Labels, n, "upstreams")
+	if !ok {
+		return nil, nil
+	}
+	for _, elem := range strings.Split(v, ",") {
+		if elem = strings.TrimSpace(elem); elem == "" {
+			continue
+		}
+		host, p, err := net.SplitHostPort(elem)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid upstream %q, should be host:port", elem)
+		}
+		if port, err := strconv.Atoi(p); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid upstream port %q in %q", p, elem)
+		}
+		res = append(res, elem)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("empty upstreams %q", v)
+	}
+	return res, nil
+}
+
+// withUpstream returns copy of the mapper with urls of the from host:port pointed to the upstream
+func withUpstream(mp discovery.URLMapper, from, upstream string) discovery.URLMapper {
+	replace := func(u string) string {
+		return strings.Replace(u, "//"+from, "//"+upstream, 1)
+	}
+	mp.Dst, mp.PingURL, mp.ReadyURL = replace(mp.Dst), replace(mp.PingURL), replace(mp.ReadyURL)
+	mp.RewriteLocation, mp.WarmupURL = replace(mp.RewriteLocation), replace(mp.WarmupURL)
+	return mp
+}
+
+// fallback returns fallback destination of the route from reproxy.N.fallback label, either builtin name,
+// i.e. builtin:maintenance, or http(s) url, i.e. http://maint:8080/$1
+func (d *Docker) fallback(v string) (string, error) {
+	if name, ok := strings.CutPrefix(v, "builtin:"); ok {
+		if !reBuiltin.MatchString(name) {
+			return "", fmt.Errorf("invalid fallback builtin %q", name)
+		}
+		return "builtin://" + name, nil
+	}
+	if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid fallback %q, should be builtin:name or http(s) url", v)
+	}
+	return v, nil
+}
+
+// jwt parses bearer token validation of the route from the key source, secret:value or jwks url, required
+// claims, i.e. iss=https://auth.example.com,aud=api, and forwarded claims, i.e. sub:X-User-Id,email:X-Email
+func (d *Docker) jwt(key, claims, headers string) (res discovery.JWT, err error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		if strings.TrimSpace(claims) != "" || strings.TrimSpace(headers) != "" {
+			return discovery.JWT{}, errors.New("jwt-claims and jwt-headers require jwt")
+		}
+		return discovery.JWT{}, nil
+	}
+	if secret, ok := strings.CutPrefix(key, "secret:"); ok {
+		if res.Secret = secret; secret == "" {
+			return discovery.JWT{}, errors.New("empty jwt secret")
+		}
+	} else {
+		if u, err := url.Parse(key); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return discovery.JWT{}, fmt.Errorf("invalid jwt %q, should be secret:value or jwks url", key)
+		}
+		res.JWKSURL = key
+	}
+	if res.Claims, err = d.pairs(claims, "="); err != nil {
+		return discovery.JWT{}, fmt.Errorf("invalid jwt-claims: %w", err)
+	}
+	if res.Headers, err = d.pairs(headers, ":"); err != nil {
+		return discovery.JWT{}, fmt.Errorf("invalid jwt-headers: %w", err)
+	}
+	for claim, hdr := range res.Headers {
+		res.Headers[claim] = http.CanonicalHeaderKey(hdr)
+	}
+	return res, nil
+}
+
+// pairs parses comma separated list of name and value pairs with separator, nil for empty list
+func (d *Docker) pairs(v, sep string) (map[string]string, error) {
+	var res map[string]string
+	for _, elem := range strings.Split(v, ",") {
+		if elem = strings.TrimSpace(elem); elem == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(elem, sep)
+		if name, val = strings.TrimSpace(name), strings.TrimSpace(val); !ok || name == "" || val == "" {
+			return nil, fmt.Errorf("invalid pair %q", elem)
+		}
+		if res == nil {
+			res = map[string]string{}
+		}
+		res[name] = val
+	}
+	return res, nil
+}
+
+// contentTypes parses comma separated list of media types, i.e. application/json,text/plain. Parameters dropped
+func (d *Docker) contentTypes(v string) (res []string, err error) {
+	for _, elem := range strings.Split(v, ",") {
+		if elem = strings.TrimSpace(elem); elem == "" {
+			continue
+		}
+		mediaType, _, err := mime.ParseMediaType(elem)
+		if err != nil || !strings.Contains(mediaType, "/") {
+			return nil, fmt.Errorf("invalid content-type %q", elem)
+		}
+		res = append(res, mediaType)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("empty content-type %q", v)
+	}
+	return res, nil
+}
+
+// namedPort resolves port name with reproxy.ports label, i.e. reproxy.ports=web=8080,admin=9090.
+// named ports defined explicitly by user and not required to be exposed by the container
+func (d *Docker) namedPort(c containerInfo, name string) (int, error) {
+	ports, ok := d.label(c.Labels, "ports")
+	if !ok {
+		return 0, fmt.Errorf("invalid reproxy port %s, not a number and no reproxy.ports defined", name)
+	}
+	for _, elem := range strings.Split(ports, ",") {
+		kv := strings.SplitN(strings.TrimSpace(elem), "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != name {
+			continue
+		}
+		port, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || port <= 0 || port > 65535 {
+			return 0, fmt.Errorf("invalid reproxy port %s=%s in reproxy.ports", name, kv[1])
+		}
+		return port, nil
+	}
+	return 0, fmt.Errorf("unknown reproxy port name %s, not defined in reproxy.ports=%s", name, ports)
+}
+
+// labelN returns label value from reproxy.N.suffix, i.e. reproxy.1.server
+func (d *Docker) labelN(labels map[string]string, n int, suffix string) (result string, ok bool) {
+	switch n {
+	case 0:
+		result, ok = d.label(labels, "0."+suffix)
+		if !ok {
+			result, ok = d.label(labels, suffix)
+		}
+	default:
+		result, ok = d.label(labels, fmt.Sprintf("%d.%s", n, suffix))
+	}
+	return result, ok
+}
+
+// boolLabelN returns bool value of reproxy.N.suffix label, dflt if the label not set
+func (d *Docker) boolLabelN(labels map[string]string, n int, suffix string, dflt bool) (bool, error) {
+	v, ok := d.labelN(labels, n, suffix)
+	if !ok {
+		return dflt, nil
+	}
+	res, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value %q", suffix, v)
+	}
+	return res, nil
+}
+
+// probeURL makes url of ping, ready and warmup probes. Full url with http:// or https:// used as-is,
+// path requested from the container's host and port
+func probeURL(v, hostPort string) string {
+	if strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
+		return v
+	}
+	return fmt.Sprintf("http://%s%s", hostPort, v)
+}
+
+// label gets label value by name without prefix, i.e. "route" for reproxy.route with default prefix
+func (d *Docker) label(labels map[string]string, name string) (string, bool) {
+	prefix := strings.TrimSuffix(d.LabelPrefix, ".")
+	if prefix == "" {
+		prefix = "reproxy"
+	}
+	v, ok := labels[prefix+"."+name]
+	return v, ok
+}
+
+// events starts monitoring changes in running containers and sends refresh
+// notification to eventsCh when change(s) are detected. Blocks caller
+func (d *Docker) events(ctx context.Context, eventsCh chan<- discovery.ProviderID) error {
+	ticker := time.NewTicker(d.RefreshInterval)
+	defer ticker.Stop()
+
+	// Keep track of running containers
+	saved := make(map[string]containerInfo)
+
+	update := func() {
+		containers, err := d.listContainers(false)
+		if err != nil {
+			log.Printf("[ERROR] failed to fetch running containers: %s", err)
+			return
+		}
+
+		refresh := false
+		seen := make(map[string]bool)
+
+		for _, c := range containers {
+			old, exists := saved[c.ID]
+
+			// state not compared, all listed containers are up and switching between up states doesn't need reload
+			if !exists || c.IP != old.IP || !c.TS.Equal(old.TS) {
+				refresh = true
+				d.inspects.invalidate(c.ID) // started or changed, previous inspect is stale
+			}
+
+			seen[c.ID] = true
+		}
+		for id := range saved {
+			if !seen[id] {
+				d.inspects.invalidate(id) // down
+			}
+		}
+		draining := d.pruneDrains(seen) > 0
+
+		if len(saved) != len(seen) || refresh {
+			log.Printf("[INFO] changes in running containers detected: refreshing routes")
+			for k := range saved {
+				delete(saved, k)
+			}
+			for _, c := range containers {
+				saved[c.ID] = c
+			}
+			eventsCh <- discovery.PIDocker
+			return
+		}
+		if draining { // weights of draining containers recalculated on each refresh
+			eventsCh <- discovery.PIDocker
+		}
+	}
+
+	// network and stop events subscribed once, and re-subscribed on the next tick if the stream ended
+	var netEvents <-chan struct{}
+	var stopEvents <-chan string
+	subscribe := func() {
+		if ne, ok := d.DockerClient.(NetworkEventer); ok && netEvents == nil {
+			ch, err := ne.NetworkEvents(ctx)
+			if err != nil {
+				log.Printf("[DEBUG] can't subscribe to docker network events, %v", err)
+			}
+			netEvents = ch
+		}
+		if se, ok := d.DockerClient.(StopEventer); ok && stopEvents == nil {
+			ch, err := se.StopEvents(ctx)
+			if err != nil {
+				log.Printf("[DEBUG] can't subscribe to docker stop events, %v", err)
+			}
+			stopEvents = ch
+		}
+	}
+
+	subscribe()
+	update() // Refresh immediately
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			subscribe()
+			update()
+		case _, ok := <-netEvents:
+			if !ok {
+				log.Printf("[DEBUG] docker network events stream closed")
+				netEvents = nil
+				continue
+			}
+			update()
+		case id, ok := <-stopEvents:
+			if !ok {
+				log.Printf("[DEBUG] docker stop events stream closed")
+				stopEvents = nil
+				continue
+			}
+			d.inspects.invalidate(id)
+			if c, found := saved[id]; found && d.startDrain(c) {
+				eventsCh <- discovery.PIDocker
+			}
+		}
+	}
+}
+
+// startDrain records drain start for the stopped container with reproxy.drain-window label. Returns true
+// if the container started draining, repeated stop events keep the original start.
+// Drains tracked by container id in memory, started by stop events only and dropped once the container
+// is not listed anymore, so a container stopped before reproxy started or restarted isn't drained
+func (d *Docker) startDrain(c containerInfo) bool {
+	if _, ok := d.label(c.Labels, "drain-window"); !ok {
+		return false
+	}
+	window, err := d.drainWindow(c)
+	if err != nil {
+		log.Printf("[WARN] container %s not drained, %v", c.Name, err)
+		return false
+	}
+	d.drainLock.Lock()
+	defer d.drainLock.Unlock()
+	if d.drains == nil {
+		d.drains = map[string]time.Time{}
+	}
+	if _, ok := d.drains[c.ID]; ok {
+		return false
+	}
+	d.drains[c.ID] = time.Now()
+	log.Printf("[INFO] container %s stopping, draining for %v", c.Name, window)
+	return true
+}
+
+// drainShare returns share of the route weights left for the draining container, from 1 at drain start
+// down to 0 at the end of drain window. draining is false for containers not stopped
+func (d *Docker) drainShare(c containerInfo) (share float64, draining bool) {
+	d.drainLock.Lock()
+	start, ok := d.drains[c.ID]
+	d.drainLock.Unlock()
+	if !ok {
+		return 0, false
+	}
+	window, err := d.drainWindow(c)
+	if err != nil {
+		return 0, true
+	}
+	left := window - time.Since(start)
+	if left <= 0 {
+		return 0, true
+	}
+	return float64(left) / float64(window), true
+}
+
+// drainWindow returns duration of reproxy.drain-window label
+func (d *Docker) drainWindow(c containerInfo) (time.Duration, error) {
+	v, _ := d.label(c.Labels, "drain-window")
+	window, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid drain-window %q", v)
+	}
+	return window, nil
+}
+
+// pruneDrains drops drains of containers not listed anymore, returns the number of containers still draining
+func (d *Docker) pruneDrains(seen map[string]bool) int {
+	d.drainLock.Lock()
+	defer d.drainLock.Unlock()
+	for id := range d.drains {
+		if !seen[id] {
+			delete(d.drains, id)
+		}
+	}
+	return len(d.drains)
+}
+
+// isUp checks if the container state is one of UpStatuses, "running" by default,
+// or, if DownStatuses defined, not one of DownStatuses
+func (d *Docker) isUp(state string) bool {
+	upStatuses := d.UpStatuses
+	if len(upStatuses) == 0 {
+		upStatuses = []string{"running"}
+	}
+	if discovery.Contains(state, upStatuses) {
+		return true
+	}
+	return len(d.DownStatuses) > 0 && !discovery.Contains(state, d.DownStatuses)
+}
+
+func (d *Docker) listContainers(allowLogging bool) (res []containerInfo, err error) {
+	containers, err := d.DockerClient.ListContainers()
+	if err != nil {
+		return nil, fmt.Errorf("can't list containers: %w", err)
+	}
+
+	if allowLogging {
+		log.Printf("[DEBUG] total containers = %d", len(containers))
+	}
+
+	vips := map[string]bool{} // services routed to vip already, by name
+	for _, c := range containers {
+		if !d.isUp(c.State) {
+			if allowLogging {
+				log.Printf("[DEBUG] skip container %s due to state %s", c.Name, c.State)
+			}
+			continue
+		}
+
+		if discovery.Contains(c.Name, d.Excludes) || strings.EqualFold(c.Name, "reproxy") {
+			if allowLogging {
+				log.Printf("[DEBUG] container %s excluded", c.Name)
+			}
+			continue
+		}
+
+		if v, ok := d.label(c.Labels, "enabled"); ok {
+			if strings.EqualFold(v, "false") || strings.EqualFold(v, "no") || v == "0" {
+				if allowLogging {
+					log.Printf("[DEBUG] skip container %s due to reproxy.enabled=%s", c.Name, v)
+				}
+				continue
+			}
+		}
+
+		if d.RequireHealthy && c.Health != "" && c.Health != "healthy" {
+			if allowLogging {
+				log.Printf("[DEBUG] skip container %s, healthcheck status %s", c.Name, c.Health)
+			}
+			continue
+		}
+
+		// host-network containers reachable on the docker host, if enabled
+		if c.IP == "" && c.NetworkMode == "host" && d.HostNetwork && !d.hasSocket(c) {
+			addr, err := d.hostAddress()
+			if err != nil {
+				if allowLogging {
+					log.Printf("[WARN] skip host-network container %s, can't determine docker host address, %v", c.Name, err)
+				}
+				continue
+			}
+			c.IP = addr
+			if len(c.Ports) == 0 {
+				c.Ports = d.labeledPorts(c)
+			}
+			if allowLogging {
+				log.Printf("[DEBUG] host-network container %s routed to %s, ports %v", c.Name, c.IP, c.Ports)
+			}
+		}
+
+		if d.RequirePort > 0 && !containsPort(c.Ports, d.RequirePort) {
+			if allowLogging {
+				log.Printf("[DEBUG] skip container %s, port %d required, exposed ports %v", c.Name, d.RequirePort, c.Ports)
+			}
+			continue
+		}
+
+		// all containers routed via published ports in published ports mode, but host-network ones routed above
+		if d.PublishedPorts && !d.hasSocket(c) && (c.NetworkMode != "host" || !d.HostNetwork) {
+			if len(c.PublishedPorts) == 0 {
+				if allowLogging {
+					log.Printf("[INFO] skip container %s, no ports published to the docker host", c.Name)
+				}
+				continue
+			}
+			addr, err := d.publishedAddress()
+			if err != nil {
+				if allowLogging {
+					log.Printf("[WARN] skip container %s, can't determine docker host address, %v", c.Name, err)
+				}
+				continue
+			}
+			c.IP, c.Ports = addr, c.PublishedPorts
+		}
+
+		// containers without ip on defined networks reachable via published ports, if enabled
+		if c.IP == "" && !d.hasSocket(c) && d.PublishedHost != "" && len(c.PublishedPorts) > 0 {
+			if allowLogging {
+				log.Printf("[INFO] container %s has no ip on defined networks, routed via published ports %v on %s",
+					c.Name, c.PublishedPorts, d.PublishedHost)
+			}
+			c.IP, c.Ports = d.PublishedHost, c.PublishedPorts
+		}
+
+		// containers with unix socket upstream don't need ip and ports
+		if c.IP == "" && !d.hasSocket(c) {
+			if allowLogging {
+				log.Printf("[DEBUG] skip container %s, no ip on defined networks", c.Name)
+			}
+			continue
+		}
+
+		if len(c.Ports) == 0 && !d.hasSocket(c) {
+			if allowLogging {
+				log.Printf("[DEBUG] skip container %s, no exposed ports", c.Name)
+			}
+			continue
+		}
+
+		// replicas of swarm service with virtual ip routed once, to the vip
+		if d.UseServiceVIP && c.VIP != "" {
+			if vips[c.Name] {
+				continue
+			}
+			vips[c.Name] = true
+			c.IP = c.VIP
+		}
+
+		if allowLogging {
+			log.Printf("[DEBUG] running container added, %+v", c)
+		}
+		res = append(res, c)
+	}
+	if allowLogging {
+		log.Print("[DEBUG] completed list")
+	}
+	return res, nil
+}
+
+// inspect returns container details, cached for InspectTTL. Fails if the client can't inspect containers
+func (d *Docker) inspect(id string) (containerDetails, error) {
+	ci, ok := d.DockerClient.(ContainerInspector)
+	if !ok {
+		return containerDetails{}, fmt.Errorf("docker client doesn't support container inspect")
+	}
+	ttl := d.InspectTTL
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return d.inspects.get(id, ttl, func() (containerDetails, error) { return ci.InspectContainer(id) })
+}
+
+// hostAddress returns HostAddress or the detected docker host address, detected once
+func (d *Docker) hostAddress() (string, error) {
+	if d.HostAddress != "" {
+		return d.HostAddress, nil
+	}
+	return d.detectedHostAddress()
+}
+
+// publishedAddress returns address of the docker host for published ports. PublishedHost if set, the host
+// of tcp docker endpoint, or detected docker host address for local docker
+func (d *Docker) publishedAddress() (string, error) {
+	if d.PublishedHost != "" {
+		return d.PublishedHost, nil
+	}
+	if addr, ok := strings.CutPrefix(d.Endpoint, "tcp://"); ok {
+		if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+			return host, nil
+		}
+		return "", fmt.Errorf("can't get host of docker endpoint %s", d.Endpoint)
+	}
+	return d.detectedHostAddress()
+}
+
+func (d *Docker) detectedHostAddress() (string, error) {
+	d.hostAddrOnce.Do(func() {
+		d.hostAddr, d.hostAddrErr = detectHostAddress("/.dockerenv", "/proc/net/route")
+		if d.hostAddrErr == nil {
+			log.Printf("[INFO] docker host address detected as %s", d.hostAddr)
+		}
+	})
+	return d.hostAddr, d.hostAddrErr
+}
+
+// detectHostAddress returns address of the docker host. Outside of docker it is the local host, and inside
+// of a container it is the default gateway, i.e. docker bridge address of the host, read from routes table
+func detectHostAddress(dockerEnvFile, routesFile string) (string, error) {
+	if _, err := os.Stat(dockerEnvFile); err != nil {
+		return "127.0.0.1", nil // not in docker
+	}
+	data, err := os.ReadFile(routesFile) // nolint
+	if err != nil {
+		return "", fmt.Errorf("can't read routes: %w", err)
+	}
+	// Iface Destination Gateway Flags ..., addresses are little-endian hex, default route has 00000000 destination
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+		return net.IPv4(byte(gw), byte(gw>>8), byte(gw>>16), byte(gw>>24)).String(), nil
+	}
+	return "", fmt.Errorf("no default gateway in %s", routesFile)
+}
+
+// labeledPorts returns numeric ports defined by reproxy.N.port and reproxy.ports labels
+func (d *Docker) labeledPorts(c containerInfo) (res []int) {
+	add := func(v string) {
+		if p, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && p > 0 && p <= 65535 && !containsPort(res, p) {
+			res = append(res, p)
+		}
+	}
+	for n := 0; n <= 9; n++ {
+		if v, ok := d.labelN(c.Labels, n, "port"); ok {
+			add(v)
+		}
+	}
+	if ports, ok := d.label(c.Labels, "ports"); ok {
+		for _, elem := range strings.Split(ports, ",") {
+			if _, v, found := strings.Cut(elem, "="); found {
+				add(v)
+			}
+		}
+	}
+	return res
+}
+
+type dockerClient struct {
+	client  http.Client
+	network string // network for IP selection
+	version string // api version, path prefix of requests, i.e. v1.24
 }
 
+// Minimum API version that returns attached networks and the first one with swarm mode, used by default
+// docs.docker.com/engine/api/version-history/#v124-api-changes
+const defaultDockerAPIVersion = "v1.24"
+
 // NewDockerClient constructs docker client for given host and network
 func NewDockerClient(host, network string) DockerClient {
+	return &dockerClient{client: dockerHTTPClient(host, 0), network: network, version: defaultDockerAPIVersion}
+}
+
+// NewDockerClientVersion constructs docker client pinned to the api version, i.e. 1.41. The daemon asked for
+// supported versions, and error returned if it doesn't support the version. Empty version means default one.
+// With positive dnsTTL address of tcp host name resolved once and reused for the ttl, see cachedDialer
+func NewDockerClientVersion(host, network, version string, dnsTTL time.Duration) (DockerClient, error) {
+	client := dockerHTTPClient(host, dnsTTL)
+	ver, err := checkDockerVersion(client, host, version)
+	if err != nil {
+		return nil, err
+	}
+	return &dockerClient{client: client, network: network, version: ver}, nil
+}
+
+var reDockerVersion = regexp.MustCompile(`^v?1\.(\d+)$`)
+
+// checkDockerVersion checks the api version is supported by the daemon, returns the version as request path
+// prefix, i.e. v1.41. Default version returned as-is for empty version, without the check
+func checkDockerVersion(client http.Client, host, version string) (string, error) {
+	if version == "" {
+		return defaultDockerAPIVersion, nil
+	}
+	m := reDockerVersion.FindStringSubmatch(strings.TrimSpace(version))
+	if m == nil {
+		return "", fmt.Errorf("invalid docker api version %q, should be like 1.41", version)
+	}
+	resp, err := client.Get("http://localhost/version") // unversioned, served by any daemon
+	if err != nil {
+		return "", fmt.Errorf("can't get docker daemon version from %s: %w", host, err)
+	}
+	defer resp.Body.Close() // nolint
+	var dv struct {
+		Version       string
+		APIVersion    string `json:"ApiVersion"`
+		MinAPIVersion string `json:"MinAPIVersion"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("can't get docker daemon version from %s, status %d", host, resp.StatusCode)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&dv); err != nil {
+		return "", fmt.Errorf("can't parse docker daemon version from %s: %w", host, err)
+	}
+
+	minor := func(v string) int {
+		vm := reDockerVersion.FindStringSubmatch(v)
+		if vm == nil {
+			return -1
+		}
+		n, _ := strconv.Atoi(vm[1])
+		return n
+	}
+	want, maxVer, minVer := minor(m[0]), minor(dv.APIVersion), minor(dv.MinAPIVersion)
+	if minVer < 0 {
+		minVer = 12 // daemons before 1.25 don't report min version
+	}
+	if maxVer < 0 || want > maxVer || want < minVer {
+		return "", fmt.Errorf("docker daemon %s on %s supports api versions %s-%s, client version %s not supported",
+			dv.Version, host, dv.MinAPIVersion, dv.APIVersion, version)
+	}
+	log.Printf("[INFO] docker api version %s, daemon %s supports %s-%s", version, dv.Version, dv.MinAPIVersion, dv.APIVersion)
+	return "v1." + m[1], nil
+}
+
+// dockerHTTPClient makes http client talking to docker host, i.e. unix:///var/run/docker.sock or tcp://127.0.0.1:2375
+func dockerHTTPClient(host string, dnsTTL time.Duration) http.Client {
 	var schemaRegex = regexp.MustCompile("^(?:([a-z0-9]+)://)?(.*)$")
 	parts := schemaRegex.FindStringSubmatch(host)
 	proto, addr := parts[1], parts[2]
 	log.Printf("[DEBUG] configuring docker client to talk to %s via %s", addr, proto)
 
-	client := http.Client{
-		Transport: &http.Transport{
-			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-				return net.Dial(proto, addr)
-			},
-		},
-		Timeout: time.Second * 5,
+	dial := func(_ context.Context, _, _ string) (net.Conn, error) {
+		return net.Dial(proto, addr)
+	}
+	if hostName, port, err := net.SplitHostPort(addr); err == nil && proto == "tcp" && dnsTTL > 0 &&
+		net.ParseIP(hostName) == nil {
+		log.Printf("[DEBUG] docker host %s address cached for %v", hostName, dnsTTL)
+		dial = newCachedDialer(hostName, port, dnsTTL).DialContext
 	}
 
-	return &dockerClient{client, network}
+	return http.Client{
+		Transport: &http.Transport{DialContext: dial},
+		Timeout:   time.Second * 5,
+	}
 }
 
-func (d *dockerClient) ListContainers() ([]containerInfo, error) {
-	// Minimum API version that returns attached networks
-	// docs.docker.com/engine/api/version-history/#v122-api-changes
-	const APIVersion = "v1.24"
+// cachedDialer dials tcp docker host by its address resolved once and reused for ttl, for remote daemon with slow
+// or flaky name resolution. Cached address dropped on connection failure, and the next dial resolves the host
+// again. If resolution fails, the last known address used. Changes of the resolved address logged
+type cachedDialer struct {
+	host, port string
+	ttl        time.Duration
+	lookup     func(ctx context.Context, host string) ([]string, error)
+
+	lock    sync.Mutex
+	addr    string    // the last resolved address
+	expires time.Time // zero if the address dropped
+}
+
+func newCachedDialer(host, port string, ttl time.Duration) *cachedDialer {
+	return &cachedDialer{host: host, port: port, ttl: ttl, lookup: net.DefaultResolver.LookupHost}
+}
+
+// DialContext connects to the cached address of the host, resolved if expired
+func (c *cachedDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	addr, err := c.address(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr, c.port))
+	if err != nil {
+		c.lock.Lock()
+		c.expires = time.Time{} // resolve again on the next dial, the address may have changed
+		c.lock.Unlock()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *cachedDialer) address(ctx context.Context) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.addr != "" && time.Now().Before(c.expires) {
+		return c.addr, nil
+	}
+	addrs, err := c.lookup(ctx, c.host)
+	if err != nil || len(addrs) == 0 {
+		if c.addr != "" {
+			log.Printf("[WARN] can't resolve docker host %s, using the last address %s, %v", c.host, c.addr, err)
+			return c.addr, nil
+		}
+		return "", fmt.Errorf("can't resolve docker host %s: %w", c.host, err)
+	}
+	if c.addr != "" && c.addr != addrs[0] {
+		log.Printf("[INFO] docker host %s address changed from %s to %s", c.host, c.addr, addrs[0])
+	}
+	c.addr, c.expires = addrs[0], time.Now().Add(c.ttl)
+	return c.addr, nil
+}
 
-	resp, err := d.client.Get(fmt.Sprintf("http://localhost/%s/containers/json", APIVersion))
+func (d *dockerClient) ListContainers() ([]containerInfo, error) {
+	resp, err := d.client.Get(fmt.Sprintf("http://localhost/%s/containers/json", d.version))
 	if err != nil {
 		return nil, fmt.Errorf("failed connection to docker socket: %w", err)
 	}
@@ -397,7 +2132,9 @@ func (d *dockerClient) ListContainers() ([]containerInfo, error) {
 	var response []struct {
 		ID              string `json:"Id"`
 		Name            string
+		Image           string
 		State           string
+		Status          string // i.e. Up 2 hours (healthy)
 		Labels          map[string]string
 		Created         int64
 		NetworkSettings struct {
@@ -405,8 +2142,14 @@ func (d *dockerClient) ListContainers() ([]containerInfo, error) {
 				IPAddress string
 			}
 		}
+		HostConfig struct {
+			NetworkMode string
+		}
 		Names []string
-		Ports []struct{ PrivatePort int } `json:"Ports"`
+		Ports []struct {
+			PrivatePort int
+			PublicPort  int
+		} `json:"Ports"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
@@ -420,9 +2163,12 @@ func (d *dockerClient) ListContainers() ([]containerInfo, error) {
 
 		c.ID = resp.ID
 		c.Name = strings.TrimPrefix(resp.Names[0], "/")
+		c.Image = resp.Image
 		c.State = resp.State
+		c.Health = healthStatus(resp.Status)
 		c.Labels = resp.Labels
 		c.TS = time.Unix(resp.Created, 0)
+		c.NetworkMode = resp.HostConfig.NetworkMode
 
 		for k, v := range resp.NetworkSettings.Networks {
 			if d.network == "" || k == d.network { // match on network name if defined
@@ -432,7 +2178,13 @@ func (d *dockerClient) ListContainers() ([]containerInfo, error) {
 		}
 
 		for _, p := range resp.Ports {
-			c.Ports = append(c.Ports, p.PrivatePort)
+			// the same port published for ipv4 and ipv6 listed twice
+			if !containsPort(c.Ports, p.PrivatePort) {
+				c.Ports = append(c.Ports, p.PrivatePort)
+			}
+			if p.PublicPort > 0 && !containsPort(c.PublishedPorts, p.PublicPort) {
+				c.PublishedPorts = append(c.PublishedPorts, p.PublicPort)
+			}
 		}
 
 		containers[i] = c
@@ -441,6 +2193,180 @@ func (d *dockerClient) ListContainers() ([]containerInfo, error) {
 	return containers, nil
 }
 
+// InspectContainer returns details of the container by id
+func (d *dockerClient) InspectContainer(id string) (containerDetails, error) {
+	resp, err := d.client.Get(fmt.Sprintf("http://localhost/%s/containers/%s/json", d.version, url.PathEscape(id)))
+	if err != nil {
+		return containerDetails{}, fmt.Errorf("failed connection to docker socket: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+
+	if resp.StatusCode != http.StatusOK {
+		e := struct {
+			Message string `json:"message"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+			return containerDetails{}, fmt.Errorf("failed to parse error from docker daemon: %w", err)
+		}
+		return containerDetails{}, fmt.Errorf("unexpected error from docker daemon: %s", e.Message)
+	}
+
+	var response struct {
+		ID    string `json:"Id"`
+		State struct {
+			StartedAt time.Time
+			Health    *struct {
+				Status string
+			}
+		}
+		Config struct {
+			Env []string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return containerDetails{}, fmt.Errorf("failed to parse response from docker daemon: %w", err)
+	}
+
+	res := containerDetails{ID: response.ID, StartedAt: response.State.StartedAt, Env: map[string]string{}}
+	if response.State.Health != nil {
+		res.Health = response.State.Health.Status
+	}
+	for _, kv := range response.Config.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			res.Env[k] = v
+		}
+	}
+	return res, nil
+}
+
+// NetworkEvents streams connect and disconnect events of the client's network, all networks if not defined.
+// The channel closed when the stream ended or ctx canceled
+func (d *dockerClient) NetworkEvents(ctx context.Context) (<-chan struct{}, error) {
+	filters := map[string][]string{"type": {"network"}, "event": {"connect", "disconnect"}}
+	if d.network != "" {
+		filters["network"] = []string{d.network}
+	}
+	events, err := d.streamEvents(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(chan struct{})
+	go func() {
+		defer close(res)
+		for ev := range events {
+			log.Printf("[DEBUG] docker network %s event for container %s", ev.Action, ev.Actor.Attributes["container"])
+			select {
+			case res <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res, nil
+}
+
+// StopEvents streams ids of containers being stopped, i.e. got kill event with the stop signal on docker stop.
+// Kill events with signals used for reload, like SIGHUP, ignored. The channel closed when the stream ended or ctx canceled
+func (d *dockerClient) StopEvents(ctx context.Context) (<-chan string, error) {
+	events, err := d.streamEvents(ctx, map[string][]string{"type": {"container"}, "event": {"kill"}})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(chan string)
+	go func() {
+		defer close(res)
+		for ev := range events {
+			switch ev.Actor.Attributes["signal"] {
+			case "1", "10", "12", "28": // SIGHUP, SIGUSR1, SIGUSR2 and SIGWINCH don't stop the container
+				continue
+			}
+			log.Printf("[DEBUG] docker kill event for container %s, signal %s", ev.Actor.ID, ev.Actor.Attributes["signal"])
+			select {
+			case res <- ev.Actor.ID:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res, nil
+}
+
+// dockerEvent is simplified view of docker event from the events stream
+type dockerEvent struct {
+	Action string
+	Actor  struct {
+		ID         string
+		Attributes map[string]string
+	}
+}
+
+// streamEvents opens docker events stream with the given filters. The channel closed when the stream ended or ctx canceled
+func (d *dockerClient) streamEvents(ctx context.Context, filters map[string][]string) (<-chan dockerEvent, error) {
+	fb, err := json.Marshal(filters)
+	if err != nil {
+		return nil, fmt.Errorf("can't make events filter: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://localhost/"+d.version+"/events?filters="+url.QueryEscape(string(fb)), http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("can't make events request: %w", err)
+	}
+	client := d.client
+	client.Timeout = 0          // events stream kept open
+	resp, err := client.Do(req) // nolint:bodyclose // body closed by the reader goroutine
+	if err != nil {
+		return nil, fmt.Errorf("failed connection to docker socket: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status from docker daemon events: %d", resp.StatusCode)
+	}
+
+	res := make(chan dockerEvent)
+	go func() {
+		defer close(res)
+		defer resp.Body.Close() // nolint
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev dockerEvent
+			if err := dec.Decode(&ev); err != nil {
+				return
+			}
+			select {
+			case res <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res, nil
+}
+
+// healthStatus returns healthcheck status from container status, i.e. Up 2 hours (healthy) or
+// Up 5 seconds (health: starting). Empty for container without healthcheck
+func healthStatus(status string) string {
+	switch {
+	case strings.HasSuffix(status, "(healthy)"):
+		return "healthy"
+	case strings.HasSuffix(status, "(unhealthy)"):
+		return "unhealthy"
+	case strings.HasSuffix(status, "(health: starting)"):
+		return "starting"
+	}
+	return ""
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Docker) getKeepHostValue(labels map[string]string, n int) *bool {
 	v, ok := d.labelN(labels, n, "keep-host")
 	if !ok {
@@ -460,3 +2386,82 @@ func (d *Docker) getKeepHostValue(labels map[string]string, n int) *bool {
 	log.Printf("[WARN] keep-host label value %s is not valid, ignoring", v)
 	return nil
 }
+
+// regexCache keeps compiled regexes keyed by pattern. Regexes used since the last rotate are kept in next,
+// the rest dropped on rotate, this way the cache doesn't grow with patterns of long gone containers.
+type regexCache struct {
+	mu   sync.Mutex
+	cur  map[string]*regexp.Regexp
+	next map[string]*regexp.Regexp
+}
+
+// compile returns cached regex for the pattern or compiles and caches a new one
+func (c *regexCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.next == nil {
+		c.next = make(map[string]*regexp.Regexp)
+	}
+	if rx, ok := c.next[pattern]; ok {
+		return rx, nil
+	}
+	if rx, ok := c.cur[pattern]; ok {
+		c.next[pattern] = rx
+		return rx, nil
+	}
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.next[pattern] = rx
+	return rx, nil
+}
+
+// rotate makes regexes used since the previous rotate the current set
+func (c *regexCache) rotate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cur, c.next = c.next, make(map[string]*regexp.Regexp, len(c.next))
+}
+
+// inspectCache keeps container inspect results by container id for ttl. Concurrent gets of the same
+// container not deduplicated, the cache is about repeated inspects across refreshes
+type inspectCache struct {
+	mu      sync.Mutex
+	entries map[string]inspectEntry
+}
+
+type inspectEntry struct {
+	details containerDetails
+	ts      time.Time
+}
+
+// get returns cached details of the container, or fetches and caches them if missing or older than ttl.
+// Errors not cached
+func (c *inspectCache) get(id string, ttl time.Duration, fetch func() (containerDetails, error)) (containerDetails, error) {
+	c.mu.Lock()
+	e, ok := c.entries[id]
+	c.mu.Unlock()
+	if ok && time.Since(e.ts) < ttl {
+		return e.details, nil
+	}
+
+	details, err := fetch()
+	if err != nil {
+		return containerDetails{}, fmt.Errorf("can't inspect container %s: %w", id, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]inspectEntry)
+	}
+	c.entries[id] = inspectEntry{details: details, ts: time.Now()}
+	return details, nil
+}
+
+// invalidate drops cached details of the container
+func (c *inspectCache) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
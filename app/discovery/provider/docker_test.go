@@ -2,13 +2,19 @@ package provider
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -309,6 +315,2212 @@ func TestDocker_ListPriority(t *testing.T) {
 	assert.Equal(t, discovery.MTStatic, res[1].MatchType)
 }
 
+func TestDocker_ListVisibility(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/admin/(.*)", "reproxy.visibility": "internal",
+						"reproxy.1.route": "^/api/pub/(.*)", "reproxy.1.visibility": "public"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.enabled": "y"},
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12347},
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.visibility": "bad"}, // invalid visibility
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+
+	assert.Equal(t, "^/api/admin/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, discovery.VisibilityInternal, res[0].Visibility)
+
+	assert.Equal(t, "^/api/pub/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, discovery.VisibilityPublic, res[1].Visibility)
+
+	assert.Equal(t, "^/c2/(.*)", res[2].SrcMatch.String())
+	assert.Equal(t, discovery.VisibilityPublic, res[2].Visibility)
+}
+
+func TestDocker_ListProto(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/grpc/(.*)", "reproxy.proto": "h2c",
+						"reproxy.1.route": "^/web/(.*)", "reproxy.1.proto": "http"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.proto": "spdy"}, // invalid proto
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+
+	assert.Equal(t, "^/grpc/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, discovery.UPH2C, res[0].Proto)
+
+	assert.Equal(t, "^/web/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, discovery.UPHTTP, res[1].Proto)
+}
+
+func TestDocker_ListSocket(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", // no ip and ports, socket only
+					Labels: map[string]string{"reproxy.socket": "/var/run/c1/app.sock", "reproxy.route": "^/c1/(.*)",
+						"reproxy.dest": "/api/$1", "reproxy.ping": "/health"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.socket": "/tmp/../tmp/c2.sock", "reproxy.1.route": "^/c2-tcp/(.*)"},
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12347},
+					Labels: map[string]string{"reproxy.socket": "run/c3.sock"}, // not absolute
+				},
+				{
+					Name: "c4", State: "running", // no ip and ports, no socket label
+					Labels: map[string]string{"reproxy.enabled": "y"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+
+	assert.Equal(t, "^/c2-tcp/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.3:12346/$1", res[0].Dst)
+	assert.Equal(t, "", res[0].Socket)
+
+	sort.Slice(res[1:], func(i, j int) bool { return res[1+i].Dst < res[1+j].Dst })
+	assert.Equal(t, "^/c1/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://c1/api/$1", res[1].Dst)
+	assert.Equal(t, "http://c1/health", res[1].PingURL)
+	assert.Equal(t, "/var/run/c1/app.sock", res[1].Socket)
+
+	assert.Equal(t, "^/c2/(.*)", res[2].SrcMatch.String())
+	assert.Equal(t, "http://c2/$1", res[2].Dst)
+	assert.Equal(t, "/tmp/c2.sock", res[2].Socket)
+}
+
+func TestDocker_ListSticky(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.sticky": "srv_id"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.sticky": "srv_id"},
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12347},
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.sticky": "bad name;"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	for _, m := range res {
+		assert.Equal(t, "^/api/(.*)", m.SrcMatch.String())
+		assert.Equal(t, "srv_id", m.StickyCookie)
+	}
+}
+
+func TestDocker_ListHeaders(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.strip-req-headers": "X-Internal, Cookie,",
+						"reproxy.strip-resp-headers": "Server", "reproxy.requestid-header": "X-Trace-Id"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, []string{"X-Internal", "Cookie"}, res[0].StripReqHeaders)
+	assert.Equal(t, []string{"Server"}, res[0].StripRespHeaders)
+	assert.Equal(t, "X-Trace-Id", res[0].RequestIDHeader)
+}
+
+func TestDocker_ListWebSocket(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/ws/(.*)", "reproxy.websocket": "true",
+						"reproxy.1.route": "^/api/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.websocket": "maybe"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.False(t, res[0].WebSocket)
+	assert.Equal(t, "^/ws/(.*)", res[1].SrcMatch.String())
+	assert.True(t, res[1].WebSocket)
+}
+
+func TestDocker_ListCache(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.cache": "30s",
+						"reproxy.1.route": "^/raw/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.cache": "blah"}, // invalid
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12347},
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.cache": "-1s"}, // negative
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, 30*time.Second, res[0].CacheTTL)
+	assert.Equal(t, "^/raw/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, time.Duration(0), res[1].CacheTTL)
+}
+
+func TestDocker_ListCompoundRoutes(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{8080, 9090},
+					Labels: map[string]string{"reproxy.server": "example.com",
+						"reproxy.routes": "^/api/(.*)->8080, ^/admin/(.*)->9090,^/v[0-9]{1,3}/(.*)->8080,^/bad(->8080," +
+							"^/no-port/(.*)->7070,^/web/(.*)->web,^/no-arrow",
+						"reproxy.ports": "web=8081"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 4, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+
+	assert.Equal(t, "^/admin/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:9090/$1", res[0].Dst)
+	assert.Equal(t, "http://127.0.0.2:9090/ping", res[0].PingURL)
+	assert.Equal(t, "example.com", res[0].Server)
+	assert.Equal(t, discovery.PIDocker, res[0].ProviderID)
+
+	assert.Equal(t, "^/api/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:8080/$1", res[1].Dst)
+
+	assert.Equal(t, "^/v[0-9]{1,3}/(.*)", res[2].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:8080/$1", res[2].Dst)
+
+	assert.Equal(t, "^/web/(.*)", res[3].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:8081/$1", res[3].Dst)
+}
+
+func TestDocker_ListDefault(t *testing.T) {
+	ts := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345}, TS: ts.Add(time.Minute),
+					Labels: map[string]string{"reproxy.default": "true"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346, 12347}, TS: ts,
+					Labels: map[string]string{"reproxy.default": "true", "reproxy.port": "12347", "reproxy.route": "^/api/(.*)"},
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12348}, TS: ts.Add(-time.Hour),
+					Labels: map[string]string{"reproxy.default": "blah"}, // invalid, ignored
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+
+	assert.Equal(t, "^/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.3:12347/$1", res[0].Dst, "c2 is the oldest")
+	assert.Equal(t, "http://127.0.0.3:12347/ping", res[0].PingURL)
+	assert.Equal(t, "*", res[0].Server)
+	assert.True(t, res[0].CatchAll)
+
+	assert.Equal(t, "^/api/(.*)", res[1].SrcMatch.String())
+	assert.False(t, res[1].CatchAll)
+}
+
+func TestDocker_ListRewriteLocation(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.rewrite-location": "true",
+						"reproxy.1.route": "^/raw/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.rewrite-location": "blah"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:12345", res[0].RewriteLocation)
+	assert.Equal(t, "^/raw/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "", res[1].RewriteLocation)
+}
+
+func TestDocker_ListPassthrough(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/v1/(.*)", "reproxy.passthrough": "true"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/c2/(.*)", "reproxy.passthrough": "true", "reproxy.dest": "/$1"},
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12347},
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.passthrough": "blah"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "^/api/v1/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:12345$0", res[0].Dst)
+	assert.Equal(t, "http://127.0.0.2:12345/api/v1/users/1?x=y",
+		res[0].SrcMatch.ReplaceAllString("/api/v1/users/1?x=y", res[0].Dst))
+}
+
+func TestDocker_ListListener(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/admin/(.*)", "reproxy.listener": "admin",
+						"reproxy.1.route": "^/api/(.*)"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/admin/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "admin", res[0].Listener)
+	assert.Equal(t, "^/api/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "", res[1].Listener)
+}
+
+func TestDocker_ListBuffer(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/files/(.*)", "reproxy.buffer": "off",
+						"reproxy.1.route": "^/api/(.*)", "reproxy.1.buffer": "on", "reproxy.2.route": "^/web/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.buffer": "blah"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.False(t, res[0].Unbuffered)
+	assert.Equal(t, "^/files/(.*)", res[1].SrcMatch.String())
+	assert.True(t, res[1].Unbuffered)
+	assert.Equal(t, "^/web/(.*)", res[2].SrcMatch.String())
+	assert.False(t, res[2].Unbuffered)
+}
+
+func TestDocker_ListMaxConn(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.maxconn": "10",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.maxconn": "5, 3s", "reproxy.2.route": "^/c/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.maxconn": "0", // invalid
+						"reproxy.1.route": "^/e/(.*)", "reproxy.1.maxconn": "blah",
+						"reproxy.2.route": "^/f/(.*)", "reproxy.2.maxconn": "10,bad"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/a/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, 10, res[0].MaxConn)
+	assert.Equal(t, time.Duration(0), res[0].MaxConnWait)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, 5, res[1].MaxConn)
+	assert.Equal(t, 3*time.Second, res[1].MaxConnWait)
+	assert.Equal(t, "^/c/(.*)", res[2].SrcMatch.String())
+	assert.Equal(t, 0, res[2].MaxConn)
+}
+
+func TestDocker_ListPublishedHost(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", Ports: []int{8080}, PublishedPorts: []int{18080},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", Ports: []int{8080}, // not published
+					Labels: map[string]string{"reproxy.route": "^/b/(.*)"},
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.3", Ports: []int{8080}, PublishedPorts: []int{18081},
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "fallback disabled")
+	assert.Equal(t, "http://127.0.0.3:8080/$1", res[0].Dst)
+
+	d = Docker{DockerClient: dclient, PublishedHost: "192.168.1.10"}
+	res, err = d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/a/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://192.168.1.10:18080/$1", res[0].Dst)
+	assert.Equal(t, "http://192.168.1.10:18080/ping", res[0].PingURL)
+	assert.Equal(t, "^/c/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.3:8080/$1", res[1].Dst, "ip on network preferred")
+}
+
+func TestDocker_ListSNI(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.dest": "https://10.0.0.1:8443/$1",
+						"reproxy.sni": "svc.internal", "reproxy.1.route": "^/b/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)", "reproxy.sni": "svc.internal"}, // http dest
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/a/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "svc.internal", res[0].SNI)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "", res[1].SNI)
+}
+
+func TestDocker_ListMetricName(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "shop-api-1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.1.route": "^/b/(.*)",
+						"reproxy.1.metric-name": "api-b", "com.docker.compose.project": "shop",
+						"com.docker.compose.service": "api"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "shop/api", res[0].MetricName)
+	assert.Equal(t, "api-b", res[1].MetricName)
+	assert.Equal(t, "c2", res[2].MetricName)
+}
+
+func TestDocker_ListLabelPrefix(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345, 12346},
+					Labels: map[string]string{"dpx.route": "^/a/(.*)", "dpx.server": "example.com",
+						"dpx.1.route": "^/b/(.*)", "dpx.1.port": "12346", "reproxy.2.route": "^/c/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12347},
+					Labels: map[string]string{"dpx.route": "^/d/(.*)", "dpx.enabled": "no"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient, LabelPrefix: "dpx"}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/a/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "example.com", res[0].Server)
+	assert.Equal(t, "http://127.0.0.2:12345/$1", res[0].Dst)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:12346/$1", res[1].Dst)
+
+	d = Docker{DockerClient: dclient}
+	res, err = d.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "default prefix")
+	assert.Equal(t, "^/c/(.*)", res[0].SrcMatch.String())
+}
+
+func TestDocker_ListMatchHeader(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.match-header": "X-Version=beta",
+						"reproxy.1.route": "^/b/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)", "reproxy.match-header": "=beta"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, []discovery.HeaderCondition{{Name: "X-Version", Value: "beta"}}, res[0].MatchHeaders)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Empty(t, res[1].MatchHeaders)
+}
+
+func TestDocker_ListMatchQuery(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.match-query": "tenant=foo",
+						"reproxy.1.route": "^/b/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)", "reproxy.match-query": "=foo"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, []discovery.QueryCondition{{Name: "tenant", Value: "foo"}}, res[0].MatchQuery)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Empty(t, res[1].MatchQuery)
+}
+
+func TestDocker_ListRequireHeader(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.require-header": "X-Api-Key, x-tenant,",
+						"reproxy.1.route": "^/b/(.*)"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, []string{"X-Api-Key", "x-tenant"}, res[0].RequireHeaders)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Empty(t, res[1].RequireHeaders)
+}
+
+func TestDocker_ListStatusMap(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.status-map": "404=>200, 502=>503",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.status-map": "404=>999"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid status map disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, map[int]int{404: 200, 502: 503}, res[0].StatusMap)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Empty(t, res[1].StatusMap)
+}
+
+func TestDocker_ListRespHeaderOn(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.resp-header-on": "5xx:Cache-Control=no-store",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.resp-header-on": "no-store"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid status headers disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, []discovery.StatusHeader{{From: 500, To: 599, Name: "Cache-Control", Value: "no-store"}}, res[0].StatusHeaders)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Empty(t, res[1].StatusHeaders)
+}
+
+func TestDocker_ListSourceIP(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.source-ip": " 10.0.0.5 ",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.source-ip": "2001:db8::0:1",
+						"reproxy.2.route": "^/c/(.*)", "reproxy.2.source-ip": "10.0.0"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid source ip disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "10.0.0.5", res[0].SourceIP)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "2001:db8::1", res[1].SourceIP)
+}
+
+func TestDocker_ListRouteTTL(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)"}},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient, RouteTTL: time.Minute}
+	before := time.Now()
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, time.Minute, res[0].TTL)
+	assert.False(t, res[0].LastSeen.Before(before), "last seen stamped on list")
+
+	time.Sleep(time.Millisecond * 5)
+	res2, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res2))
+	assert.True(t, res2[0].LastSeen.After(res[0].LastSeen), "last seen updated on each list")
+}
+
+func TestDocker_ListLogFile(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.logfile": " tenant-1 ",
+						"reproxy.1.route": "^/b/(.*)",
+						"reproxy.2.route": "^/c/(.*)", "reproxy.2.logfile": "../etc/passwd"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid logfile disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "tenant-1", res[0].LogFile)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "", res[1].LogFile)
+}
+
+func TestDocker_ListMinTLS(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.min-tls": "1.3",
+						"reproxy.1.route": "^/b/(.*)",
+						"reproxy.2.route": "^/c/(.*)", "reproxy.2.min-tls": "tls13"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid min-tls disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, uint16(tls.VersionTLS13), res[0].MinTLS)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, uint16(0), res[1].MinTLS)
+}
+
+func TestDocker_ListRateLimit(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.ratelimit": "100",
+						"reproxy.ratelimit-group": " api ", "reproxy.1.route": "^/b/(.*)", "reproxy.1.ratelimit": "-1"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.ratelimit-group": "api"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid ratelimit disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].Dst < res[j].Dst })
+	assert.Equal(t, 100, res[0].RateLimit)
+	assert.Equal(t, "api", res[0].RateLimitGroup)
+	assert.Equal(t, 0, res[1].RateLimit, "group limit aligned by discovery")
+	assert.Equal(t, "api", res[1].RateLimitGroup)
+}
+
+func TestDocker_ListHealthCritical(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.health-critical": "false",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.health-critical": "maybe"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid health-critical disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.True(t, res[0].NonCritical)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.False(t, res[1].NonCritical, "critical by default")
+}
+
+func TestDocker_ListBuiltin(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.builtin": "status", "reproxy.1.route": "^/b/(.*)",
+						"reproxy.1.builtin": "ping", "reproxy.1.ping": "/health", "reproxy.2.route": "^/c/(.*)",
+						"reproxy.2.builtin": "Bad Name"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid builtin disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/b/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "ping", res[0].Builtin)
+	assert.Equal(t, "builtin://ping", res[0].Dst)
+	assert.Equal(t, "http://127.0.0.2:12345/health", res[0].PingURL)
+	assert.Equal(t, "^/c1/(.*)", res[1].SrcMatch.String(), "builtin enables the default route")
+	assert.Equal(t, "status", res[1].Builtin)
+	assert.Equal(t, "", res[1].PingURL, "no default ping")
+}
+
+func TestDocker_ListHeaderTimeout(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.header-timeout": " 2s ",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.header-timeout": "-1s"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid header-timeout disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, 2*time.Second, res[0].HeaderTimeout)
+	assert.Equal(t, time.Duration(0), res[1].HeaderTimeout)
+}
+
+func TestDocker_ListCoalesce(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.coalesce": "true",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.coalesce": "sometimes"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid coalesce disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.True(t, res[0].Coalesce)
+	assert.False(t, res[1].Coalesce)
+}
+
+func TestDocker_ListAllowUA(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.allow-ua": " ^billing-svc/[0-9.]+$ ",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.allow-ua": "^(bad"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid allow-ua disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	require.NotNil(t, res[0].AllowUA)
+	assert.Equal(t, "^billing-svc/[0-9.]+$", res[0].AllowUA.String())
+	assert.Nil(t, res[1].AllowUA)
+}
+
+func TestDocker_ListFault(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.fault-delay": "200ms:50%",
+						"reproxy.fault-abort": "503:10%", "reproxy.1.route": "^/b/(.*)",
+						"reproxy.2.route": "^/c/(.*)", "reproxy.2.fault-abort": "200"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid fault disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, discovery.Fault{Delay: 200 * time.Millisecond, DelayPercent: 50, AbortStatus: 503, AbortPercent: 10}, res[0].Fault)
+	assert.Equal(t, discovery.Fault{}, res[1].Fault)
+}
+
+func TestDocker_ListMatchGeo(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.match-geo": "X-Country=DE,FR",
+						"reproxy.match-header": "X-Version=beta", "reproxy.1.route": "^/b/(.*)",
+						"reproxy.1.match-geo": "X-Asn=13335", "reproxy.2.route": "^/c/(.*)", "reproxy.2.match-geo": "X-Country="},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid match-geo disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, []discovery.HeaderCondition{{Name: "X-Version", Value: "beta"},
+		{Name: "X-Country", Values: []string{"DE", "FR"}}}, res[0].MatchHeaders)
+	assert.Equal(t, []discovery.HeaderCondition{{Name: "X-Asn", Values: []string{"13335"}}}, res[1].MatchHeaders)
+}
+
+func TestDocker_ListRequirePort(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{Name: "web1", State: "running", IP: "127.0.0.2", Ports: []int{8080}, Labels: map[string]string{"reproxy.route": "^/a/(.*)"}},
+				{Name: "web2", State: "running", IP: "127.0.0.3", Ports: []int{9090, 8080}, Labels: map[string]string{"reproxy.route": "^/b/(.*)"}},
+				{Name: "db", State: "running", IP: "127.0.0.4", Ports: []int{5432}, Labels: map[string]string{"reproxy.route": "^/c/(.*)"}},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient, RequirePort: 8080}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "container without required port skipped")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "http://127.0.0.2:8080/$1", res[0].Dst)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+
+	d = Docker{DockerClient: dclient}
+	res, err = d.List()
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(res), "no port requirement")
+}
+
+func TestDocker_ListGzip(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.gzip-level": "1", "reproxy.gzip-min": "4k",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.gzip-level": "10",
+						"reproxy.3.route": "^/d/(.*)", "reproxy.3.gzip-min": "big"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "routes with invalid gzip level or min size disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, 1, res[0].GzipLevel)
+	assert.Equal(t, 4096, res[0].GzipMin)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, 0, res[1].GzipLevel)
+	assert.Equal(t, 0, res[1].GzipMin)
+}
+
+func TestDocker_ListImageRoutes(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{Name: "web1", Image: "example/web:1.2", State: "running", IP: "127.0.0.2", Ports: []int{8080}},
+				{Name: "web2", Image: "example/web:beta", State: "running", IP: "127.0.0.3", Ports: []int{8080}},
+				{Name: "web3", Image: "example/web:1.2", State: "running", IP: "127.0.0.4", Ports: []int{8080},
+					Labels: map[string]string{"reproxy.route": "^/custom/(.*)"}},
+				{Name: "db", Image: "postgres:16", State: "running", IP: "127.0.0.5", Ports: []int{5432}},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient, ImageRoutes: map[string]string{
+		"example/web:*":    "^/{{.Name}}/(.*)",
+		"example/web:beta": "^/beta/{{.Name}}/(.*)",
+	}}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res), "container of other image not routed")
+	sort.Slice(res, func(i, j int) bool { return res[i].Dst < res[j].Dst })
+	assert.Equal(t, "^/web1/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:8080/$1", res[0].Dst)
+	assert.Equal(t, "^/beta/web2/(.*)", res[1].SrcMatch.String(), "the longest glob wins")
+	assert.Equal(t, "^/custom/(.*)", res[2].SrcMatch.String(), "label overrides image route")
+}
+
+func TestDocker_ListFollowRedirects(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.follow-redirects": "true",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.follow-redirects": "false",
+						"reproxy.2.route": "^/c/(.*)", "reproxy.2.follow-redirects": "sometimes"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid follow-redirects disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.True(t, res[0].FollowRedirects)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.False(t, res[1].FollowRedirects, "redirects passed through")
+}
+
+func TestDocker_ListSubroute(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{Name: "users", State: "running", IP: "127.0.0.2", Ports: []int{8080},
+					Labels: map[string]string{"reproxy.subroute-key": "/api"}},
+				{Name: "orders", State: "running", IP: "127.0.0.3", Ports: []int{9090},
+					Labels: map[string]string{"reproxy.subroute-key": "api/"}},
+				{Name: "bad", State: "running", IP: "127.0.0.4", Ports: []int{8080},
+					Labels: map[string]string{"reproxy.subroute-key": "/"}},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res), "two members and single dispatcher, invalid key ignored")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "notfound", res[0].Builtin)
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "^/api/orders(/.*)?$", res[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.3:9090$1", res[1].Dst)
+	assert.Equal(t, "^/api/users(/.*)?$", res[2].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:8080$1", res[2].Dst)
+}
+
+func TestDocker_ListUpstreams(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "gw", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.upstreams": "10.0.0.1:8080, 10.0.0.2:9090",
+						"reproxy.ping": "/health", "reproxy.1.route": "^/b/(.*)", "reproxy.1.upstreams": "10.0.0.1",
+						"reproxy.2.route": "^/c/(.*)", "reproxy.2.upstreams": "10.0.0.1:8080,10.0.0.2:8080",
+						"reproxy.2.dest": "https://example.com/$1"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "routes with invalid upstream or absolute dest disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].Dst < res[j].Dst })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.1:8080/$1", res[0].Dst)
+	assert.Equal(t, "http://10.0.0.1:8080/health", res[0].PingURL)
+	assert.Equal(t, "^/api/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.2:9090/$1", res[1].Dst)
+	assert.Equal(t, "http://10.0.0.2:9090/health", res[1].PingURL)
+}
+
+func TestDocker_ListRaw(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/ws/(.*)", "reproxy.raw": "true",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.raw": "maybe"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid raw disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/b/(.*)", res[0].SrcMatch.String())
+	assert.False(t, res[0].Raw)
+	assert.Equal(t, "^/ws/(.*)", res[1].SrcMatch.String())
+	assert.True(t, res[1].Raw)
+}
+
+func TestDocker_ListMaxConnPerIP(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.max-conn-per-ip": "5",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.max-conn-per-ip": "0"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid max-conn-per-ip disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, 5, res[0].MaxConnPerIP)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, 0, res[1].MaxConnPerIP)
+}
+
+func TestDocker_ListRewritePath(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/webhook/(.*)", "reproxy.rewrite-path": "/ingest",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.dest": "https://example.com/$1", "reproxy.1.rewrite-path": "/x",
+						"reproxy.2.route": "^/c/(.*)", "reproxy.2.rewrite-path": "ingest"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid rewrite-path disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/b/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "https://example.com/$1", res[0].Dst, "explicit dest kept")
+	assert.Equal(t, "/x", res[0].RewritePath)
+	assert.Equal(t, "^/webhook/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:12345/ingest", res[1].Dst)
+	assert.Equal(t, "/ingest", res[1].RewritePath)
+}
+
+func TestDocker_ListRequireHealthy(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{Name: "c1", State: "running", Health: "healthy", IP: "127.0.0.2", Ports: []int{8080},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)"}},
+				{Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{8080}, Labels: map[string]string{"reproxy.route": "^/b/(.*)"}},
+				{Name: "c3", State: "running", Health: "unhealthy", IP: "127.0.0.4", Ports: []int{8080},
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)"}},
+				{Name: "c4", State: "running", Health: "starting", IP: "127.0.0.5", Ports: []int{8080},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)"}},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient, RequireHealthy: true}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "unhealthy and starting containers skipped")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/a/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String(), "container without healthcheck kept")
+
+	d = Docker{DockerClient: dclient}
+	res, err = d.List()
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(res), "health not required")
+}
+
+func TestDocker_ListContentType(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{
+						"reproxy.route": "^/api/(.*)", "reproxy.content-type": "Application/JSON; charset=utf-8, text/plain",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.content-type": "json"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid content-type disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, []string{"application/json", "text/plain"}, res[0].ContentTypes)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Empty(t, res[1].ContentTypes)
+}
+
+func TestDocker_ListFallback(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{
+						"reproxy.route": "^/api/(.*)", "reproxy.fallback": "builtin:maintenance",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.fallback": "http://maint:8080/$1",
+						"reproxy.2.route": "^/c/(.*)", "reproxy.2.fallback": "maint:8080",
+						"reproxy.3.route": "^/d/(.*)", "reproxy.3.fallback": "builtin:Bad Name"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "routes with invalid fallback disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "builtin://maintenance", res[0].Fallback)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://maint:8080/$1", res[1].Fallback)
+}
+
+func TestDocker_ListBreaker(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.breaker": "5:1m",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.breaker": "many"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid breaker disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, discovery.Breaker{Threshold: 5, Open: time.Minute}, res[0].Breaker)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, discovery.Breaker{}, res[1].Breaker)
+}
+
+func TestDocker_ListTimingHeader(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.timing-header": "true",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.2.route": "^/c/(.*)", "reproxy.2.timing-header": "yes"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "route with invalid timing-header disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.True(t, res[0].TimingHeader)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.False(t, res[1].TimingHeader)
+}
+
+func TestDocker_ListJWT(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.jwt": "secret:${JWT_SECRET}",
+						"reproxy.jwt-claims": "iss=auth, aud=api", "reproxy.jwt-headers": "sub:x-user-id",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.jwt": "https://auth.example.com/jwks.json",
+						"reproxy.2.route": "^/c/(.*)", "reproxy.2.jwt": "secret:s", "reproxy.2.jwt-claims": "iss",
+						"reproxy.3.route": "^/d/(.*)", "reproxy.3.jwt": "jwks.json",
+						"reproxy.4.route": "^/e/(.*)"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient, Vars: map[string]string{"JWT_SECRET": "topsecret"}}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res), "routes with invalid jwt disabled")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, discovery.JWT{Secret: "topsecret", Claims: map[string]string{"iss": "auth", "aud": "api"},
+		Headers: map[string]string{"sub": "X-User-Id"}}, res[0].JWT)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, discovery.JWT{JWKSURL: "https://auth.example.com/jwks.json"}, res[1].JWT)
+	assert.Equal(t, "^/e/(.*)", res[2].SrcMatch.String())
+	assert.False(t, res[2].JWT.Enabled())
+
+	d = Docker{DockerClient: dclient}
+	_, err = d.List()
+	require.EqualError(t, err, "can't parse container c1: route 0, undefined variables JWT_SECRET")
+}
+
+func TestDocker_ListDispatch(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{Name: "web", State: "running", IP: "127.0.0.2", Ports: []int{8080, 9090}, Labels: map[string]string{"reproxy.port": "9090"}},
+				{Name: "api", State: "running", IP: "127.0.0.3", Ports: []int{8081}},
+				{Name: "sock", State: "running", Labels: map[string]string{"reproxy.socket": "/tmp/sock.sock"}},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient, DispatchPrefix: "/svc/"}
+	res, err := d.List()
+	require.NoError(t, err)
+	var dispatch []discovery.URLMapper
+	for _, m := range res {
+		if m.Dispatch {
+			dispatch = append(dispatch, m)
+		}
+	}
+	require.Equal(t, 1, len(dispatch), "single dispatch route")
+	assert.Equal(t, "^/svc/([^/]+)(/.*)?$", dispatch[0].SrcMatch.String())
+	assert.Equal(t, "http://$1$2", dispatch[0].Dst)
+	assert.Equal(t, discovery.PIDocker, dispatch[0].ProviderID)
+
+	hostPort, ok := d.Dispatch("web")
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.2:9090", hostPort, "port of the default route")
+	hostPort, ok = d.Dispatch("api")
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.3:8081", hostPort)
+	_, ok = d.Dispatch("sock")
+	assert.False(t, ok, "socket upstream not dispatched")
+	_, ok = d.Dispatch("unknown")
+	assert.False(t, ok)
+
+	d = Docker{DockerClient: dclient}
+	res, err = d.List()
+	require.NoError(t, err)
+	for _, m := range res {
+		assert.False(t, m.Dispatch, "no dispatch route without prefix")
+	}
+}
+
+func TestDocker_ListGroup(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "api-blue", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.group": "blue"},
+				},
+				{
+					Name: "api-green", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/api/(.*)", "reproxy.group": " green "},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].Group < res[j].Group })
+	assert.Equal(t, "blue", res[0].Group)
+	assert.Equal(t, "http://127.0.0.2:12345/$1", res[0].Dst)
+	assert.Equal(t, "green", res[1].Group)
+	assert.Equal(t, "http://127.0.0.3:12346/$1", res[1].Dst)
+}
+
+func TestDocker_ListMTLS(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.mtls": "true",
+						"reproxy.1.route": "^/b/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)", "reproxy.mtls": "blah"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/a/(.*)", res[0].SrcMatch.String())
+	assert.True(t, res[0].MTLS)
+	assert.Equal(t, "^/b/(.*)", res[1].SrcMatch.String())
+	assert.False(t, res[1].MTLS)
+}
+
+func TestDocker_ListALPN(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.alpn": "H2",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.alpn": "http/1.1", "reproxy.2.route": "^/c/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.alpn": "spdy/3"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "h2", res[0].ALPN)
+	assert.Equal(t, "http/1.1", res[1].ALPN)
+	assert.Equal(t, "", res[2].ALPN)
+}
+
+func TestDocker_ListResponseRewrite(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)",
+						"reproxy.response-rewrite": "http://127.0.0.2:12345=>https://example.com, internal.lan=>example.com",
+						"reproxy.1.route":          "^/b/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)", "reproxy.response-rewrite": "no-arrow"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, []discovery.BodyRewrite{{From: "http://127.0.0.2:12345", To: "https://example.com"},
+		{From: "internal.lan", To: "example.com"}}, res[0].ResponseRewrite)
+	assert.Empty(t, res[1].ResponseRewrite)
+}
+
+func TestDocker_ListLogBody(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.logbody": "4k",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.logbody": "512", "reproxy.2.route": "^/c/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.logbody": "lots"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, 4096, res[0].LogBody)
+	assert.Equal(t, 512, res[1].LogBody)
+	assert.Equal(t, 0, res[2].LogBody)
+}
+
+func TestDocker_ListKeepAlive(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.keepalive": "off",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.keepalive": "on", "reproxy.2.route": "^/c/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.keepalive": "sometimes"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.True(t, res[0].NoKeepAlive)
+	assert.False(t, res[1].NoKeepAlive)
+	assert.False(t, res[2].NoKeepAlive)
+}
+
+func TestDocker_ListUpstreamProto(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.upstream-proto": "http1.0",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.proto": "http1.1", "reproxy.2.route": "^/c/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.upstream-proto": "http0.9"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, discovery.UPHTTP10, res[0].Proto)
+	assert.Equal(t, discovery.UPHTTP11, res[1].Proto)
+	assert.Equal(t, discovery.UPHTTP, res[2].Proto)
+}
+
+func TestDocker_ListSlowLog(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.slowlog": "500ms",
+						"reproxy.1.route": "^/b/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.slowlog": "slow"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, 500*time.Millisecond, res[0].SlowLog)
+	assert.Equal(t, time.Duration(0), res[1].SlowLog)
+}
+
+func TestDocker_ListHostNetwork(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", NetworkMode: "host",
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.port": "8080"},
+				},
+				{
+					Name: "c2", State: "running", NetworkMode: "host",
+					Labels: map[string]string{"reproxy.route": "^/b/(.*)", "reproxy.port": "web", "reproxy.ports": "web=9090"},
+				},
+				{
+					Name: "c3", State: "running", NetworkMode: "bridge", // not on the network
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)", "reproxy.port": "8080"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	assert.Empty(t, res, "host network not enabled")
+
+	d = Docker{DockerClient: dclient, HostNetwork: true, HostAddress: "192.168.1.10"}
+	res, err = d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "http://192.168.1.10:8080/$1", res[0].Dst)
+	assert.Equal(t, "http://192.168.1.10:9090/$1", res[1].Dst)
+}
+
+func TestDocker_ListPublishedPorts(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{Name: "c1", State: "running", IP: "172.17.0.2", Ports: []int{8080}, PublishedPorts: []int{18080},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)"}},
+				{Name: "c2", State: "running", IP: "172.17.0.3", Ports: []int{8080}, // not published, skipped
+					Labels: map[string]string{"reproxy.route": "^/b/(.*)"}},
+				{Name: "c3", State: "running", Ports: []int{9090}, PublishedPorts: []int{19090},
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)"}},
+				{Name: "c4", State: "running", NetworkMode: "host",
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.port": "7070"}},
+			}, nil
+		},
+	}
+
+	tbl := []struct {
+		name, publishedHost, endpoint string
+		host                          string
+		err                           bool
+	}{
+		{name: "published host", publishedHost: "192.168.1.10", endpoint: "tcp://10.0.0.1:2375", host: "192.168.1.10"},
+		{name: "tcp endpoint", endpoint: "tcp://10.0.0.1:2375", host: "10.0.0.1"},
+		{name: "tcp endpoint name", endpoint: "tcp://docker.example.com:2375", host: "docker.example.com"},
+		{name: "bad endpoint", endpoint: "tcp://docker.example.com", err: true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Docker{DockerClient: dclient, PublishedPorts: true, PublishedHost: tt.publishedHost, Endpoint: tt.endpoint,
+				HostNetwork: true, HostAddress: "127.0.0.1"}
+			res, err := d.List()
+			require.NoError(t, err)
+			sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+			if tt.err {
+				require.Equal(t, 1, len(res), "only host-network container routed")
+				assert.Equal(t, "http://127.0.0.1:7070/$1", res[0].Dst)
+				return
+			}
+			require.Equal(t, 3, len(res), "container without published ports skipped")
+			assert.Equal(t, "http://"+tt.host+":18080/$1", res[0].Dst)
+			assert.Equal(t, "http://"+tt.host+":19090/$1", res[1].Dst)
+			assert.Equal(t, "http://127.0.0.1:7070/$1", res[2].Dst, "host-network container routed to host address")
+		})
+	}
+
+	d := Docker{DockerClient: dclient, PublishedPorts: true, Endpoint: "unix:///var/run/docker.sock"}
+	d.hostAddrOnce.Do(func() { d.hostAddr = "172.17.0.1" }) // detected address of the local docker host
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "host-network container without host network enabled skipped")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "http://172.17.0.1:18080/$1", res[0].Dst)
+	assert.Equal(t, "http://172.17.0.1:19090/$1", res[1].Dst)
+}
+
+func TestDocker_detectHostAddress(t *testing.T) {
+	dir := t.TempDir()
+	addr, err := detectHostAddress(filepath.Join(dir, ".dockerenv"), filepath.Join(dir, "route"))
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", addr, "not in docker")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".dockerenv"), nil, 0o600))
+	_, err = detectHostAddress(filepath.Join(dir, ".dockerenv"), filepath.Join(dir, "route"))
+	assert.Error(t, err, "no routes")
+
+	routes := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t000011AC\t00000000\t0001\t0\t0\t0\t0000FFFF\t0\t0\t0\n" +
+		"eth0\t00000000\t010011AC\t0003\t0\t0\t0\t00000000\t0\t0\t0\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "route"), []byte(routes), 0o600))
+	addr, err = detectHostAddress(filepath.Join(dir, ".dockerenv"), filepath.Join(dir, "route"))
+	require.NoError(t, err)
+	assert.Equal(t, "172.17.0.1", addr)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "route"), []byte(strings.Split(routes, "\n")[0]+"\n"), 0o600))
+	_, err = detectHostAddress(filepath.Join(dir, ".dockerenv"), filepath.Join(dir, "route"))
+	assert.EqualError(t, err, "no default gateway in "+filepath.Join(dir, "route"))
+}
+
+func TestDocker_ListRetryAfter(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.retry-after": "30",
+						"reproxy.1.route": "^/b/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.retry-after": "-1"}, // invalid
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12347},
+					Labels: map[string]string{"reproxy.route": "^/e/(.*)", "reproxy.retry-after": "soon"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, 30, res[0].RetryAfter)
+	assert.Equal(t, 0, res[1].RetryAfter)
+}
+
+func TestDocker_ListWarmup(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.warmup": "/warmup?full=1",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.warmup": "http://127.0.0.2:8081/warmup",
+						"reproxy.2.route": "^/c/(.*)"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "http://127.0.0.2:12345/warmup?full=1", res[0].WarmupURL)
+	assert.Equal(t, "http://127.0.0.2:8081/warmup", res[1].WarmupURL)
+	assert.Equal(t, "", res[2].WarmupURL)
+}
+
+func TestDocker_ListReady(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.ready": "/ready",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.ready": "http://127.0.0.2:8081/ready"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "http://127.0.0.2:12345/ready", res[0].ReadyURL)
+	assert.Equal(t, "http://127.0.0.2:8081/ready", res[1].ReadyURL)
+	assert.Equal(t, "", res[2].ReadyURL)
+}
+
+func TestDocker_ListForwarded(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.forwarded": "append",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.forwarded": "strip", "reproxy.2.route": "^/c/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.forwarded": "trust"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, discovery.ForwardedAppend, res[0].Forwarded)
+	assert.Equal(t, discovery.ForwardedStrip, res[1].Forwarded)
+	assert.Equal(t, discovery.ForwardedSet, res[2].Forwarded)
+}
+
+func TestDocker_ListTimeouts(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.timeout": "30s",
+						"reproxy.1.route": "^/b/(.*)", "reproxy.1.idle-timeout": "1m", "reproxy.2.route": "^/c/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.timeout": "-1s"}, // invalid
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12347},
+					Labels: map[string]string{"reproxy.route": "^/e/(.*)", "reproxy.idle-timeout": "long"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, 30*time.Second, res[0].Timeout)
+	assert.Equal(t, time.Duration(0), res[0].IdleTimeout)
+	assert.Equal(t, time.Duration(0), res[1].Timeout)
+	assert.Equal(t, time.Minute, res[1].IdleTimeout)
+	assert.Equal(t, time.Duration(0), res[2].Timeout)
+	assert.Equal(t, time.Duration(0), res[2].IdleTimeout)
+}
+
+func TestDocker_ListStatic(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/(.*)", "reproxy.server": "example.com,example.org",
+						"reproxy.static": "/robots.txt:/srv/robots, /maint:/srv/maint"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/d/(.*)", "reproxy.static": "/srv/static"}, // invalid
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 6, len(res), "proxy and two static mappers per server")
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Server != res[j].Server {
+			return res[i].Server < res[j].Server
+		}
+		return res[i].SrcMatch.String() < res[j].SrcMatch.String()
+	})
+	assert.Equal(t, "^/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, discovery.MTProxy, res[0].MatchType)
+	assert.False(t, res[0].AssetsOverlay)
+
+	assert.Equal(t, discovery.MTStatic, res[1].MatchType)
+	assert.Equal(t, "/maint", res[1].AssetsWebRoot)
+	assert.Equal(t, "/srv/maint", res[1].AssetsLocation)
+	assert.True(t, res[1].AssetsOverlay)
+	assert.Equal(t, "example.com", res[1].Server)
+
+	assert.Equal(t, "/robots.txt", res[2].AssetsWebRoot)
+	assert.Equal(t, "/srv/robots", res[2].AssetsLocation)
+	assert.True(t, res[2].AssetsOverlay)
+	assert.Equal(t, "example.org", res[5].Server)
+}
+
+func TestDocker_ListDrain(t *testing.T) {
+	labels := map[string]string{"reproxy.drain-window": "1h", "reproxy.route": "^/api/(.*)", "reproxy.dest": "/$1"}
+	d := Docker{DockerClient: &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{ID: "1", Name: "c1", State: "running", IP: "127.0.0.1", Ports: []int{12345}, Labels: labels},
+				{ID: "2", Name: "c2", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.drain-window": "1h", "reproxy.route": "^/api/(.*)", "reproxy.dest": "/$1",
+						"reproxy.weight": "40"}},
+				{ID: "3", Name: "c3", State: "running", IP: "127.0.0.3", Ports: []int{12345}, Labels: labels},
+				{ID: "4", Name: "c4", State: "running", IP: "127.0.0.4", Ports: []int{12345}, Labels: labels},
+			}, nil
+		},
+	}}
+	d.drains = map[string]time.Time{
+		"1": time.Now().Add(-45 * time.Minute), // quarter of the window left
+		"2": time.Now().Add(-30 * time.Minute), // half of the window left, from weight 40
+		"4": time.Now().Add(-2 * time.Hour),    // drained
+	}
+
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res), "drained container removed")
+	sort.Slice(res, func(i, j int) bool { return res[i].Dst < res[j].Dst })
+	assert.Equal(t, "http://127.0.0.1:12345/$1", res[0].Dst)
+	assert.Equal(t, 25, res[0].Weight)
+	assert.Equal(t, "http://127.0.0.2:12345/$1", res[1].Dst)
+	assert.Equal(t, 20, res[1].Weight)
+	assert.Equal(t, "http://127.0.0.3:12345/$1", res[2].Dst)
+	assert.Equal(t, 0, res[2].Weight, "not draining, default weight")
+}
+
+func TestDocker_ListWeight(t *testing.T) {
+	d := Docker{DockerClient: &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{Name: "c1", State: "running", IP: "127.0.0.1", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/a/(.*)", "reproxy.weight": "25"}},
+				{Name: "c2", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/b/(.*)", "reproxy.weight": "0"}},
+				{Name: "c3", State: "running", IP: "127.0.0.3", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.route": "^/c/(.*)", "reproxy.weight": "heavy"}},
+			}, nil
+		},
+	}}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "routes with invalid weight disabled")
+	assert.Equal(t, "^/a/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, 25, res[0].Weight)
+}
+
+func TestDocker_ListMaxRoutes(t *testing.T) {
+	ts := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12347}, TS: ts.Add(time.Minute),
+					Labels: map[string]string{"reproxy.enabled": "y", "reproxy.default": "true"},
+				},
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345}, TS: ts,
+					Labels: map[string]string{"reproxy.route": "^/a1/(.*)", "reproxy.1.route": "^/a2/(.*)"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346}, TS: ts,
+					Labels: map[string]string{"reproxy.route": "^/b1/(.*)", "reproxy.1.route": "^/b2/(.*)"},
+				},
+			}, nil
+		},
+	}
+
+	for i := 0; i < 3; i++ { // same routes on every refresh
+		d := Docker{DockerClient: dclient, MaxRoutes: 3}
+		res, err := d.List()
+		require.NoError(t, err)
+		require.Equal(t, 3, len(res))
+		routes := []string{}
+		for _, m := range res {
+			routes = append(routes, m.SrcMatch.String())
+		}
+		sort.Strings(routes)
+		assert.Equal(t, []string{"^/a1/(.*)", "^/a2/(.*)", "^/b1/(.*)"}, routes)
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	assert.Equal(t, 6, len(res), "unlimited, with default route")
+
+	d = Docker{DockerClient: dclient, MaxRoutes: 5}
+	res, err = d.List()
+	require.NoError(t, err)
+	require.Equal(t, 5, len(res), "default route counted by the limit")
+	for _, m := range res {
+		assert.NotEqual(t, "^/(.*)", m.SrcMatch.String(), "default route dropped")
+	}
+}
+
+func TestDocker_ListWithVars(t *testing.T) {
+	t.Setenv("REPROXY_TEST_PREFIX", "/env-prefix")
+	containers := []containerInfo{
+		{
+			Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+			Labels: map[string]string{"reproxy.route": "^/a1/(.*)", "reproxy.dest": "${UPSTREAM_PREFIX}/$1",
+				"reproxy.1.route": "^/a2/(.*)", "reproxy.1.dest": "http://${UPSTREAM_HOST:-example.com}${REPROXY_TEST_PREFIX}/$1"},
+		},
+	}
+	dclient := &DockerClientMock{ListContainersFunc: func() ([]containerInfo, error) { return containers, nil }}
+
+	d := Docker{DockerClient: dclient, Vars: map[string]string{"UPSTREAM_PREFIX": "/api/v2"}}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "http://127.0.0.2:12345/api/v2/$1", res[0].Dst)
+	assert.Equal(t, "http://example.com/env-prefix/$1", res[1].Dst)
+
+	d = Docker{DockerClient: dclient} // UPSTREAM_PREFIX not defined
+	_, err = d.List()
+	require.EqualError(t, err, "can't parse container c1: route 0, undefined variables UPSTREAM_PREFIX")
+}
+
+func TestDocker_ListLenient(t *testing.T) {
+	containers := []containerInfo{
+		{Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+			Labels: map[string]string{"reproxy.route": "^/a1/(.*)", "reproxy.dest": "${UPSTREAM_PREFIX}/$1"}},
+		{Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+			Labels: map[string]string{"reproxy.route": "^/a2/(.*)"}},
+	}
+	dclient := &DockerClientMock{ListContainersFunc: func() ([]containerInfo, error) { return containers, nil }}
+
+	d := Docker{DockerClient: dclient}
+	_, err := d.List()
+	require.Error(t, err, "strict by default")
+	assert.Empty(t, d.Errors())
+
+	d = Docker{DockerClient: dclient, Lenient: true}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "invalid container skipped")
+	assert.Equal(t, "^/a2/(.*)", res[0].SrcMatch.String())
+	errs := d.Errors()
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs["c1"], "route 0, undefined variables UPSTREAM_PREFIX")
+
+	d.Vars = map[string]string{"UPSTREAM_PREFIX": "/api"} // fixed, errors cleared on the next list
+	res, err = d.List()
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Empty(t, d.Errors())
+}
+
+func TestDocker_ListNamedPorts(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{80},
+					Labels: map[string]string{"reproxy.ports": "web=8080, admin=9090", "reproxy.port": "web",
+						"reproxy.1.route": "^/admin/(.*)", "reproxy.1.port": "admin",
+						"reproxy.2.route": "^/other/(.*)", "reproxy.2.port": "other"}, // unknown name
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.port": "web"}, // no reproxy.ports
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12347},
+					Labels: map[string]string{"reproxy.ports": "web=bad", "reproxy.port": "web"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "^/admin/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:9090/$1", res[0].Dst)
+	assert.Equal(t, "^/c1/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:8080/$1", res[1].Dst)
+	assert.Equal(t, "http://127.0.0.2:8080/ping", res[1].PingURL)
+}
+
+func TestDocker_namedPort(t *testing.T) {
+	d := Docker{}
+	c := containerInfo{Labels: map[string]string{"reproxy.ports": "web=8080,admin=9090"}}
+	port, err := d.namedPort(c, "admin")
+	require.NoError(t, err)
+	assert.Equal(t, 9090, port)
+
+	_, err = d.namedPort(c, "other")
+	assert.EqualError(t, err, "unknown reproxy port name other, not defined in reproxy.ports=web=8080,admin=9090")
+
+	_, err = d.namedPort(containerInfo{}, "web")
+	assert.EqualError(t, err, "invalid reproxy port web, not a number and no reproxy.ports defined")
+}
+
+func TestDocker_ListWithTemplates(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{
+					Name: "c1", State: "running", IP: "127.0.0.2", Ports: []int{12345},
+					Labels: map[string]string{"reproxy.enabled": "y", "com.docker.compose.project": "prj",
+						"com.docker.compose.service": "svc1"},
+				},
+				{
+					Name: "c2", State: "running", IP: "127.0.0.3", Ports: []int{12346},
+					Labels: map[string]string{"reproxy.route": "^/explicit/(.*)", "com.docker.compose.project": "prj",
+						"com.docker.compose.service": "svc2"},
+				},
+				{
+					Name: "c3", State: "running", IP: "127.0.0.4", Ports: []int{12347},
+					Labels: map[string]string{"reproxy.enabled": "y"}, // no compose labels, src renders invalid regex
+				},
+			}, nil
+		},
+	}
+
+	srcTmpl, err := ParseRouteTemplate("src", `^/{{.Project}}/{{.Service}}/(.*){{if not .Project}}(bad{{end}}`)
+	require.NoError(t, err)
+	destTmpl, err := ParseRouteTemplate("dest", "http://{{.IP}}:{{.Port}}/{{.Name}}/$1")
+	require.NoError(t, err)
+
+	d := Docker{DockerClient: dclient, SrcTemplate: srcTmpl, DestTemplate: destTmpl}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+
+	assert.Equal(t, "^/prj/svc1/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:12345/c1/$1", res[0].Dst)
+
+	assert.Equal(t, "^/explicit/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.3:12346/c2/$1", res[1].Dst)
+
+	_, err = ParseRouteTemplate("src", "{{.Name")
+	assert.Error(t, err)
+
+	badTmpl, err := ParseRouteTemplate("dest", "{{.Unknown}}")
+	require.NoError(t, err)
+	d = Docker{DockerClient: dclient, DestTemplate: badTmpl}
+	res, err = d.List()
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res), "execution errors disable routes")
+}
+
 func TestDocker_refresh(t *testing.T) {
 	containers := make(chan []containerInfo)
 
@@ -367,6 +2579,275 @@ func TestDocker_refresh(t *testing.T) {
 	assert.Empty(t, events, "unexpect refresh notification from events channel")
 }
 
+// networkEventsClient is DockerClientMock with network events capability
+type networkEventsClient struct {
+	*DockerClientMock
+	events chan struct{}
+}
+
+func (c networkEventsClient) NetworkEvents(context.Context) (<-chan struct{}, error) {
+	return c.events, nil
+}
+
+func TestDocker_refreshNetworkEvents(t *testing.T) {
+	var listed int32
+	containers := []containerInfo{{ID: "1", Name: "1", State: "running", Ports: []int{12345}}} // no ip yet
+	client := networkEventsClient{events: make(chan struct{}), DockerClientMock: &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			if atomic.AddInt32(&listed, 1) > 1 { // joined the network
+				return []containerInfo{{ID: "1", Name: "1", State: "running", IP: "127.0.0.2", Ports: []int{12345}}}, nil
+			}
+			return containers, nil
+		},
+	}}
+	d := Docker{DockerClient: client, RefreshInterval: time.Hour} // no periodic refresh during the test
+
+	events := make(chan discovery.ProviderID)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		if err := d.events(ctx, events); err != context.Canceled {
+			log.Fatal(err)
+		}
+	}()
+
+	client.events <- struct{}{} // network connect
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("No refresh notification on network event")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&listed))
+}
+
+// stopEventsClient is DockerClientMock with stop events capability
+type stopEventsClient struct {
+	*DockerClientMock
+	events chan string
+}
+
+func (c stopEventsClient) StopEvents(context.Context) (<-chan string, error) {
+	return c.events, nil
+}
+
+func TestDocker_refreshStopEvents(t *testing.T) {
+	var stopped int32
+	labels := map[string]string{"reproxy.drain-window": "1h"}
+	client := stopEventsClient{events: make(chan string), DockerClientMock: &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			if atomic.LoadInt32(&stopped) > 0 { // container 1 exited
+				return []containerInfo{{ID: "2", Name: "2", State: "running", IP: "127.0.0.2", Ports: []int{12345}}}, nil
+			}
+			return []containerInfo{
+				{ID: "1", Name: "1", State: "running", IP: "127.0.0.1", Ports: []int{12345}, Labels: labels},
+				{ID: "2", Name: "2", State: "running", IP: "127.0.0.2", Ports: []int{12345}},
+			}, nil
+		},
+	}}
+	d := Docker{DockerClient: client, RefreshInterval: 10 * time.Millisecond}
+
+	events := make(chan discovery.ProviderID)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		if err := d.events(ctx, events); err != context.Canceled {
+			log.Fatal(err)
+		}
+	}()
+	recv := func(msg string) {
+		select {
+		case <-events:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal(msg)
+		}
+	}
+	draining := func() int {
+		d.drainLock.Lock()
+		defer d.drainLock.Unlock()
+		return len(d.drains)
+	}
+
+	recv("initial refresh")
+	client.events <- "2" // no drain-window label
+	client.events <- "3" // unknown container
+	assert.Equal(t, 0, draining())
+
+	client.events <- "1"
+	recv("refresh on stop event")
+	assert.Equal(t, 1, draining())
+	recv("refresh on tick while draining")
+	recv("refresh on tick while draining")
+
+	atomic.StoreInt32(&stopped, 1)
+	recv("refresh on container exit")
+	assert.Equal(t, 0, draining(), "drain dropped for not listed container")
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, events, "no refresh after drain done")
+}
+
+// inspectClient is DockerClientMock with inspect capability, counting inspects
+type inspectClient struct {
+	*DockerClientMock
+	inspects *int32
+}
+
+func (c inspectClient) InspectContainer(id string) (containerDetails, error) {
+	atomic.AddInt32(c.inspects, 1)
+	if id == "bad" {
+		return containerDetails{}, errors.New("failed")
+	}
+	return containerDetails{ID: id}, nil
+}
+
+func TestDocker_inspect(t *testing.T) {
+	var inspects int32
+	d := Docker{DockerClient: inspectClient{DockerClientMock: &DockerClientMock{}, inspects: &inspects},
+		InspectTTL: 50 * time.Millisecond}
+
+	res, err := d.inspect("c1")
+	require.NoError(t, err)
+	assert.Equal(t, "c1", res.ID)
+	_, err = d.inspect("c1")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&inspects), "reused within ttl")
+
+	_, err = d.inspect("c2")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&inspects), "cached per container")
+
+	d.inspects.invalidate("c1")
+	_, err = d.inspect("c1")
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&inspects), "inspected again after invalidate")
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = d.inspect("c1")
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&inspects), "inspected again after ttl")
+
+	_, err = d.inspect("bad")
+	assert.EqualError(t, err, "can't inspect container bad: failed")
+	_, err = d.inspect("bad")
+	assert.Error(t, err)
+	assert.Equal(t, int32(6), atomic.LoadInt32(&inspects), "errors not cached")
+
+	_, err = (&Docker{DockerClient: &DockerClientMock{}}).inspect("c1")
+	assert.EqualError(t, err, "docker client doesn't support container inspect")
+}
+
+func TestDocker_refreshInvalidatesInspects(t *testing.T) {
+	containers := make(chan []containerInfo)
+	d := Docker{DockerClient: &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) { return <-containers, nil },
+	}, RefreshInterval: time.Nanosecond}
+	cached := func(id string) bool {
+		d.inspects.mu.Lock()
+		defer d.inspects.mu.Unlock()
+		_, ok := d.inspects.entries[id]
+		return ok
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		_, err := d.inspects.get(id, time.Hour, func() (containerDetails, error) { return containerDetails{ID: id}, nil })
+		require.NoError(t, err)
+	}
+
+	events := make(chan discovery.ProviderID)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		if err := d.events(ctx, events); err != context.Canceled {
+			log.Fatal(err)
+		}
+	}()
+	stub := func(id string, ts time.Time) containerInfo {
+		return containerInfo{ID: id, Name: id, State: "running", IP: "127.0.0." + id, Ports: []int{12345}, TS: ts}
+	}
+
+	ts := time.Now()
+	containers <- []containerInfo{stub("1", ts), stub("2", ts)}
+	<-events
+	assert.False(t, cached("1"), "started")
+	assert.False(t, cached("2"), "started")
+	assert.True(t, cached("3"), "not seen yet")
+
+	_, _ = d.inspects.get("1", time.Hour, func() (containerDetails, error) { return containerDetails{ID: "1"}, nil })
+	_, _ = d.inspects.get("2", time.Hour, func() (containerDetails, error) { return containerDetails{ID: "2"}, nil })
+	containers <- []containerInfo{stub("1", ts)}
+	<-events
+	containers <- []containerInfo{stub("1", ts)} // wait for the previous update to complete
+	assert.True(t, cached("1"), "unchanged")
+	assert.False(t, cached("2"), "down")
+}
+
+func TestDocker_refreshStatuses(t *testing.T) {
+	containers := make(chan []containerInfo)
+
+	d := Docker{
+		DockerClient: &DockerClientMock{
+			ListContainersFunc: func() ([]containerInfo, error) {
+				return <-containers, nil
+			},
+		},
+		RefreshInterval: time.Nanosecond,
+		UpStatuses:      []string{"running"},
+		DownStatuses:    []string{"exited", "dead"},
+	}
+
+	events := make(chan discovery.ProviderID)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	stub := func(id, state string) containerInfo {
+		return containerInfo{ID: id, Name: id, State: state, IP: "127.0.0." + id, Ports: []int{12345}}
+	}
+
+	go func() {
+		if err := d.events(ctx, events); err != context.Canceled {
+			log.Fatal(err)
+		}
+	}()
+
+	containers <- []containerInfo{stub("1", "running"), stub("2", "running")}
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("No refresh notification was received after 1s")
+	}
+
+	// paused is neither up nor down, treated as up with no reload
+	containers <- []containerInfo{stub("1", "paused"), stub("2", "running")}
+	time.Sleep(time.Millisecond)
+	assert.Empty(t, events, "unexpected refresh notification")
+
+	// exited is down
+	containers <- []containerInfo{stub("1", "paused"), stub("2", "exited")}
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("No refresh notification was received after 1s")
+	}
+}
+
+func TestDocker_isUp(t *testing.T) {
+	tbl := []struct {
+		up, down []string
+		state    string
+		res      bool
+	}{
+		{nil, nil, "running", true},
+		{nil, nil, "paused", false},
+		{nil, nil, "exited", false},
+		{[]string{"running", "paused"}, nil, "paused", true},
+		{[]string{"running"}, []string{"exited", "dead"}, "paused", true},
+		{[]string{"running"}, []string{"exited", "dead"}, "exited", false},
+		{nil, []string{"exited"}, "running", true},
+	}
+	for i, tt := range tbl {
+		d := Docker{UpStatuses: tt.up, DownStatuses: tt.down}
+		assert.Equal(t, tt.res, d.isUp(tt.state), "case %d", i)
+	}
+}
+
 func TestDockerClient(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		require.Equal(t, `/v1.24/containers/json`, r.URL.Path)
@@ -388,13 +2869,172 @@ func TestDockerClient(t *testing.T) {
 
 	assert.NotEmpty(t, c[0].ID)
 	assert.Equal(t, "nginx", c[0].Name)
+	assert.Equal(t, "nginx", c[0].Image)
 	assert.Equal(t, "running", c[0].State)
 	assert.Equal(t, "172.17.0.3", c[0].IP)
 	assert.Equal(t, "y", c[0].Labels["reproxy.enabled"])
 	assert.Equal(t, []int{80}, c[0].Ports)
 	assert.Equal(t, time.Unix(1618417435, 0), c[0].TS)
 
+	assert.Empty(t, c[0].PublishedPorts)
+	assert.Equal(t, "default", c[0].NetworkMode)
+
 	assert.Empty(t, c[1].IP)
+	assert.Equal(t, "weather:latest", c[1].Image)
+	assert.Equal(t, []int{8000}, c[1].Ports)
+	assert.Equal(t, []int{18000}, c[1].PublishedPorts)
+
+	assert.Empty(t, c[0].Health, "no healthcheck")
+	assert.Equal(t, "healthy", c[1].Health)
+}
+
+func TestDockerClientVersion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/version":
+			w.Write([]byte(`{"Version":"24.0.7","ApiVersion":"1.43","MinAPIVersion":"1.12"}`))
+		case "/v1.41/containers/json":
+			resp, err := os.ReadFile("testdata/containers.json")
+			require.NoError(t, err)
+			w.Write(resp)
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+	addr := fmt.Sprintf("tcp://%s", strings.TrimPrefix(srv.URL, "http://"))
+
+	client, err := NewDockerClientVersion(addr, "bridge", "1.41", 0)
+	require.NoError(t, err)
+	c, err := client.ListContainers()
+	require.NoError(t, err)
+	assert.Len(t, c, 2)
+
+	_, err = NewDockerClientVersion(addr, "bridge", "1.44", 0)
+	require.EqualError(t, err, fmt.Sprintf("docker daemon 24.0.7 on %s supports api versions 1.12-1.43, "+
+		"client version 1.44 not supported", addr))
+	_, err = NewSwarmClientVersion(addr, "bridge", "v1.5", 0)
+	require.Error(t, err)
+	_, err = NewDockerClientVersion(addr, "bridge", "latest", 0)
+	require.EqualError(t, err, `invalid docker api version "latest", should be like 1.41`)
+
+	client, err = NewDockerClientVersion("tcp://127.0.0.1:1", "bridge", "", 0)
+	require.NoError(t, err, "default version not checked")
+	assert.Equal(t, "v1.24", client.(*dockerClient).version)
+}
+
+func TestCachedDialer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, err)
+
+	var lookups int32
+	resolved := "127.0.0.1"
+	d := newCachedDialer("docker.example.com", port, time.Hour)
+	d.lookup = func(_ context.Context, host string) ([]string, error) {
+		assert.Equal(t, "docker.example.com", host)
+		atomic.AddInt32(&lookups, 1)
+		if resolved == "" {
+			return nil, errors.New("no such host")
+		}
+		return []string{resolved}, nil
+	}
+	client := http.Client{Transport: &http.Transport{DialContext: d.DialContext, DisableKeepAlives: true}}
+	get := func() error {
+		resp, err := client.Get("http://docker.example.com/version")
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	require.NoError(t, get())
+	require.NoError(t, get())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lookups), "address cached")
+
+	resolved = "127.0.0.2" // unreachable, connection refused
+	d.expires = time.Now()
+	require.Error(t, get())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&lookups), "expired address resolved again")
+	assert.True(t, d.expires.IsZero(), "failed address dropped")
+
+	resolved = ""
+	d.addr = "127.0.0.1"
+	require.NoError(t, get(), "last known address used if host can't be resolved")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&lookups))
+
+	d = newCachedDialer("docker.example.com", port, time.Hour)
+	d.lookup = func(context.Context, string) ([]string, error) { return nil, errors.New("no such host") }
+	_, err = d.DialContext(context.Background(), "tcp", "")
+	require.EqualError(t, err, "can't resolve docker host docker.example.com: no such host")
+}
+
+func TestDockerClient_NetworkEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, `/v1.24/events`, r.URL.Path)
+		assert.Equal(t, `{"event":["connect","disconnect"],"network":["bridge"],"type":["network"]}`, r.URL.Query().Get("filters"))
+		w.Write([]byte(`{"Type":"network","Action":"connect","Actor":{"ID":"n1","Attributes":{"container":"c1","name":"bridge"}}}` + "\n"))
+		w.Write([]byte(`{"Type":"network","Action":"disconnect","Actor":{"ID":"n1","Attributes":{"container":"c1","name":"bridge"}}}` + "\n"))
+	}))
+	defer srv.Close()
+	addr := fmt.Sprintf("tcp://%s", strings.TrimPrefix(srv.URL, "http://"))
+
+	client := NewDockerClient(addr, "bridge").(NetworkEventer)
+	ch, err := client.NetworkEvents(context.Background())
+	require.NoError(t, err)
+	count := 0
+	for range ch {
+		count++
+	}
+	assert.Equal(t, 2, count, "both events received, channel closed with the stream")
+}
+
+func TestDockerClient_StopEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, `/v1.24/events`, r.URL.Path)
+		assert.Equal(t, `{"event":["kill"],"type":["container"]}`, r.URL.Query().Get("filters"))
+		w.Write([]byte(`{"Type":"container","Action":"kill","Actor":{"ID":"c1","Attributes":{"signal":"1"}}}` + "\n"))
+		w.Write([]byte(`{"Type":"container","Action":"kill","Actor":{"ID":"c2","Attributes":{"signal":"15"}}}` + "\n"))
+	}))
+	defer srv.Close()
+	addr := fmt.Sprintf("tcp://%s", strings.TrimPrefix(srv.URL, "http://"))
+
+	client := NewDockerClient(addr, "bridge").(StopEventer)
+	ch, err := client.StopEvents(context.Background())
+	require.NoError(t, err)
+	var ids []string
+	for id := range ch {
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []string{"c2"}, ids, "reload signal ignored, channel closed with the stream")
+}
+
+func TestDockerClient_InspectContainer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != `/v1.24/containers/c1/json` {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "no such container"}`))
+			return
+		}
+		w.Write([]byte(`{"Id":"c1","State":{"StartedAt":"2024-01-02T03:04:05Z","Health":{"Status":"healthy"}},
+			"Config":{"Env":["A=1","B=x=y","BAD"]}}`))
+	}))
+	defer srv.Close()
+	addr := fmt.Sprintf("tcp://%s", strings.TrimPrefix(srv.URL, "http://"))
+
+	client := NewDockerClient(addr, "bridge").(ContainerInspector)
+	res, err := client.InspectContainer("c1")
+	require.NoError(t, err)
+	assert.Equal(t, "c1", res.ID)
+	assert.Equal(t, "healthy", res.Health)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), res.StartedAt.UTC())
+	assert.Equal(t, map[string]string{"A": "1", "B": "x=y"}, res.Env)
+
+	_, err = client.InspectContainer("c2")
+	assert.EqualError(t, err, "unexpected error from docker daemon: no such container")
 }
 
 func TestDockerClient_error(t *testing.T) {
@@ -410,6 +3050,64 @@ func TestDockerClient_error(t *testing.T) {
 	require.EqualError(t, err, "unexpected error from docker daemon: bruh")
 }
 
+func TestDocker_regexCache(t *testing.T) {
+	var c regexCache
+	rx1, err := c.compile("^/api/(.*)")
+	require.NoError(t, err)
+	rx2, err := c.compile("^/api/(.*)")
+	require.NoError(t, err)
+	assert.True(t, rx1 == rx2, "same compiled regex reused")
+
+	_, err = c.compile("^/bad/(.*")
+	assert.Error(t, err)
+
+	c.rotate()
+	rx3, err := c.compile("^/api/(.*)")
+	require.NoError(t, err)
+	assert.True(t, rx1 == rx3, "reused after rotate")
+
+	c.rotate()
+	c.rotate() // not used since the previous rotate, dropped
+	rx4, err := c.compile("^/api/(.*)")
+	require.NoError(t, err)
+	assert.False(t, rx1 == rx4, "recompiled")
+}
+
+func BenchmarkDocker_List(b *testing.B) {
+	const containers = 500
+	cc := make([]containerInfo, containers)
+	for i := range cc {
+		cc[i] = containerInfo{Name: fmt.Sprintf("c%d", i), State: "running", IP: fmt.Sprintf("10.0.%d.%d", i/250, i%250+1),
+			Ports: []int{8080}, Labels: map[string]string{
+				"reproxy.route": fmt.Sprintf("^/api/c%d/v[12]/(.*)", i), "reproxy.server": "example.com",
+				"reproxy.1.route": fmt.Sprintf("^/admin/c%d/(.*)", i), "reproxy.1.port": "8080",
+			}}
+	}
+	dclient := &DockerClientMock{ListContainersFunc: func() ([]containerInfo, error) { return cc, nil }}
+
+	b.Run("cached", func(b *testing.B) {
+		d := Docker{DockerClient: dclient}
+		_, _ = d.List() // warm up the cache, as on refresh with unchanged containers
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := d.List(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cold", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			d := Docker{DockerClient: dclient} // new provider every time, nothing cached
+			if _, err := d.List(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
 func TestDocker_labelN(t *testing.T) {
 
 	tbl := []struct {
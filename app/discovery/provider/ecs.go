@@ -0,0 +1,470 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// ECS implements provider reading routes from running tasks of aws ecs cluster. Each container of a task handled
+// as a docker container labeled with docker labels of its container definition, so all reproxy.* labels work
+// the same way as with the docker provider, and all tasks of a service make a single route with multiple
+// destinations. Only RUNNING tasks with HEALTHY health status routed, tasks without health checks (UNKNOWN)
+// are not. Destination is the task's ENI address, i.e. awsvpc network mode, with ports of container port mappings.
+// Events poll the task list every PollInterval and send update if routable tasks changed. List keeps
+// the last good routes on api errors, including access and credential errors, which are logged with a hint
+type ECS struct {
+	Cluster  string // cluster name or arn
+	Region   string // aws region, i.e. us-east-1
+	Endpoint string // ecs api endpoint, https://ecs.<region>.amazonaws.com by default
+
+	// static credentials, used if AccessKey set. Otherwise credentials fetched from CredentialsURL,
+	// i.e. ecs container credentials endpoint, with CredentialsToken sent as Authorization if set
+	AccessKey        string
+	SecretKey        string
+	SessionToken     string
+	CredentialsURL   string
+	CredentialsToken string
+
+	PollInterval time.Duration // tasks polling interval, 30s by default
+	Timeout      time.Duration // api request timeout, 10s by default
+	Client       *http.Client
+
+	dockerOnce sync.Once
+	docker     *Docker // docker provider with ecs tasks client, makes routes from labels
+
+	lock     sync.Mutex
+	lastGood []discovery.URLMapper
+	creds    ecsCredentials        // cached credentials from CredentialsURL
+	taskDefs map[string]ecsTaskDef // task definitions by arn, immutable
+}
+
+type ecsTask struct {
+	TaskArn           string  `json:"taskArn"`
+	TaskDefinitionArn string  `json:"taskDefinitionArn"`
+	LastStatus        string  `json:"lastStatus"`
+	HealthStatus      string  `json:"healthStatus"`
+	StartedAt         float64 `json:"startedAt"` // unix time, seconds
+	Containers        []struct {
+		Name              string `json:"name"`
+		NetworkInterfaces []struct {
+			PrivateIPv4Address string `json:"privateIpv4Address"`
+		} `json:"networkInterfaces"`
+	} `json:"containers"`
+}
+
+type ecsTaskDef struct {
+	TaskDefinitionArn    string `json:"taskDefinitionArn"`
+	ContainerDefinitions []struct {
+		Name         string            `json:"name"`
+		DockerLabels map[string]string `json:"dockerLabels"`
+		PortMappings []struct {
+			ContainerPort int `json:"containerPort"`
+		} `json:"portMappings"`
+	} `json:"containerDefinitions"`
+}
+
+type ecsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// ecsError is an error response of ecs api
+type ecsError struct {
+	Status  int
+	Type    string
+	Message string
+}
+
+func (e *ecsError) Error() string {
+	return fmt.Sprintf("ecs api error %d %s: %s", e.Status, e.Type, e.Message)
+}
+
+// authFailure checks if the error caused by credentials or missing iam permissions
+func (e *ecsError) authFailure() bool {
+	switch e.Type {
+	case "AccessDeniedException", "UnrecognizedClientException", "InvalidSignatureException", "ExpiredTokenException",
+		"IncompleteSignature", "MissingAuthenticationTokenException", "InvalidClientTokenId":
+		return true
+	}
+	return e.Status == http.StatusForbidden
+}
+
+// ID returns provider id
+func (e *ECS) ID() discovery.ProviderID { return discovery.PIECS }
+
+// Events returns channel updating on changes of routable tasks, checked every PollInterval
+func (e *ECS) Events(ctx context.Context) <-chan discovery.ProviderID {
+	res := make(chan discovery.ProviderID)
+	interval := e.PollInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	go func() {
+		defer close(res)
+		var last string
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for first := true; ; first = false {
+			if !first {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+			tasks, err := e.routableTasks()
+			if err != nil && !first {
+				log.Printf("[WARN] can't poll ecs tasks of %s, %v", e.Cluster, err)
+				continue
+			}
+			fp := ecsFingerprint(tasks)
+			if !first && fp == last {
+				continue
+			}
+			last = fp
+			select {
+			case res <- discovery.PIECS:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// List returns mappers for containers of routable tasks. Keeps the last good routes on api errors
+func (e *ECS) List() ([]discovery.URLMapper, error) {
+	e.dockerOnce.Do(func() {
+		e.docker = &Docker{DockerClient: &ecsClient{ecs: e}}
+	})
+	res, err := e.docker.List()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err != nil {
+		var apiErr *ecsError
+		if errors.As(err, &apiErr) && apiErr.authFailure() {
+			e.creds = ecsCredentials{} // refetch on the next call, credentials could be rotated
+			log.Printf("[ERROR] ecs access denied, check credentials and iam permissions for ecs:ListTasks, "+
+				"ecs:DescribeTasks and ecs:DescribeTaskDefinition, %v", err)
+		}
+		if e.lastGood == nil {
+			return nil, err
+		}
+		log.Printf("[WARN] can't list ecs tasks, keep %d last good routes: %v", len(e.lastGood), err)
+		return e.lastGood, nil
+	}
+	for i := range res {
+		res[i].ProviderID = discovery.PIECS
+	}
+	e.lastGood = res
+	return res, nil
+}
+
+// ecsClient implements DockerClient listing containers of routable ecs tasks
+type ecsClient struct {
+	ecs *ECS
+}
+
+// ListContainers returns containers of routable tasks with ENI address, labeled with docker labels of container
+func (c *ecsClient) ListContainers() ([]containerInfo, error) {
+	tasks, err := c.ecs.routableTasks()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	res := []containerInfo{}
+	for _, t := range tasks {
+		def, err := c.ecs.taskDefinition(t.TaskDefinitionArn)
+		if err != nil {
+			return nil, err
+		}
+		seen[t.TaskDefinitionArn] = true
+		taskID := t.TaskArn[strings.LastIndex(t.TaskArn, "/")+1:]
+		for _, tc := range t.Containers {
+			if len(tc.NetworkInterfaces) == 0 || tc.NetworkInterfaces[0].PrivateIPv4Address == "" {
+				log.Printf("[DEBUG] ecs task %s, container %s skipped, no eni address", taskID, tc.Name)
+				continue
+			}
+			ci := containerInfo{ID: taskID + "/" + tc.Name, Name: tc.Name, State: "running",
+				IP: tc.NetworkInterfaces[0].PrivateIPv4Address, TS: time.Unix(int64(t.StartedAt), 0)}
+			for _, cd := range def.ContainerDefinitions {
+				if cd.Name != tc.Name {
+					continue
+				}
+				ci.Labels = cd.DockerLabels
+				for _, pm := range cd.PortMappings {
+					ci.Ports = append(ci.Ports, pm.ContainerPort)
+				}
+			}
+			res = append(res, ci)
+		}
+	}
+	c.ecs.pruneTaskDefs(seen)
+	return res, nil
+}
+
+// routableTasks returns RUNNING and HEALTHY tasks of the cluster
+func (e *ECS) routableTasks() ([]ecsTask, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout())
+	defer cancel()
+
+	var arns []string
+	for token := ""; ; {
+		req := map[string]interface{}{"cluster": e.Cluster, "desiredStatus": "RUNNING", "maxResults": 100}
+		if token != "" {
+			req["nextToken"] = token
+		}
+		var resp struct {
+			TaskArns  []string `json:"taskArns"`
+			NextToken string   `json:"nextToken"`
+		}
+		if err := e.call(ctx, "ListTasks", req, &resp); err != nil {
+			return nil, err
+		}
+		arns = append(arns, resp.TaskArns...)
+		if token = resp.NextToken; token == "" {
+			break
+		}
+	}
+
+	res := []ecsTask{}
+	for i := 0; i < len(arns); i += 100 { // describe is limited to 100 tasks
+		var resp struct {
+			Tasks []ecsTask `json:"tasks"`
+		}
+		req := map[string]interface{}{"cluster": e.Cluster, "tasks": arns[i:min(i+100, len(arns))]}
+		if err := e.call(ctx, "DescribeTasks", req, &resp); err != nil {
+			return nil, err
+		}
+		for _, t := range resp.Tasks {
+			if t.LastStatus != "RUNNING" || t.HealthStatus != "HEALTHY" {
+				log.Printf("[DEBUG] ecs task %s skipped, status %s, health %s", t.TaskArn, t.LastStatus, t.HealthStatus)
+				continue
+			}
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+// taskDefinition returns task definition by arn, cached as task definition revisions are immutable
+func (e *ECS) taskDefinition(arn string) (ecsTaskDef, error) {
+	e.lock.Lock()
+	def, ok := e.taskDefs[arn]
+	e.lock.Unlock()
+	if ok {
+		return def, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout())
+	defer cancel()
+	var resp struct {
+		TaskDefinition ecsTaskDef `json:"taskDefinition"`
+	}
+	if err := e.call(ctx, "DescribeTaskDefinition", map[string]interface{}{"taskDefinition": arn}, &resp); err != nil {
+		return ecsTaskDef{}, err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.taskDefs == nil {
+		e.taskDefs = map[string]ecsTaskDef{}
+	}
+	e.taskDefs[arn] = resp.TaskDefinition
+	return resp.TaskDefinition, nil
+}
+
+// pruneTaskDefs drops cached task definitions not used by any routable task
+func (e *ECS) pruneTaskDefs(used map[string]bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for arn := range e.taskDefs {
+		if !used[arn] {
+			delete(e.taskDefs, arn)
+		}
+	}
+}
+
+// call makes signed request to ecs api action and decodes json response to res
+func (e *ECS) call(ctx context.Context, action string, req, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("can't marshal ecs %s request: %w", action, err)
+	}
+	creds, err := e.credentials(ctx)
+	if err != nil {
+		return err
+	}
+	endpoint := e.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ecs.%s.amazonaws.com", e.Region)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("can't make ecs %s request: %w", action, err)
+	}
+	hreq.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	hreq.Header.Set("X-Amz-Target", "AmazonEC2ContainerServiceV20141113."+action)
+	signV4(hreq, body, creds, e.Region, "ecs", time.Now())
+
+	resp, err := e.client().Do(hreq)
+	if err != nil {
+		return fmt.Errorf("ecs %s request failed: %w", action, err)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &ecsError{Status: resp.StatusCode}
+		var errResp struct {
+			Type     string `json:"__type"`
+			Message  string `json:"message"`
+			MessageU string `json:"Message"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&errResp); err == nil {
+			apiErr.Type = errResp.Type[strings.LastIndex(errResp.Type, "#")+1:] // i.e. com.amazon.coral.service#AccessDeniedException
+			apiErr.Message = errResp.Message + errResp.MessageU
+		}
+		return fmt.Errorf("ecs %s: %w", action, apiErr)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("can't parse ecs %s response: %w", action, err)
+	}
+	return nil
+}
+
+// credentials returns static credentials, or credentials from CredentialsURL cached till 5 minutes before expiration
+func (e *ECS) credentials(ctx context.Context) (ecsCredentials, error) {
+	if e.AccessKey != "" {
+		return ecsCredentials{AccessKeyID: e.AccessKey, SecretAccessKey: e.SecretKey, Token: e.SessionToken}, nil
+	}
+	if e.CredentialsURL == "" {
+		return ecsCredentials{}, errors.New("no aws credentials for ecs provider")
+	}
+
+	e.lock.Lock()
+	creds := e.creds
+	e.lock.Unlock()
+	if creds.AccessKeyID != "" && time.Until(creds.Expiration) > 5*time.Minute {
+		return creds, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.CredentialsURL, http.NoBody)
+	if err != nil {
+		return ecsCredentials{}, fmt.Errorf("can't make aws credentials request: %w", err)
+	}
+	if e.CredentialsToken != "" {
+		req.Header.Set("Authorization", e.CredentialsToken)
+	}
+	resp, err := e.client().Do(req)
+	if err != nil {
+		return ecsCredentials{}, fmt.Errorf("can't get aws credentials: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return ecsCredentials{}, fmt.Errorf("can't get aws credentials, unexpected status %s", resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return ecsCredentials{}, fmt.Errorf("can't parse aws credentials: %w", err)
+	}
+	e.lock.Lock()
+	e.creds = creds
+	e.lock.Unlock()
+	return creds, nil
+}
+
+func (e *ECS) client() *http.Client {
+	if e.Client == nil {
+		return &http.Client{}
+	}
+	return e.Client
+}
+
+func (e *ECS) timeout() time.Duration {
+	if e.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return e.Timeout
+}
+
+// ecsFingerprint makes a stable string of routable tasks, changed on any task start, stop or health change
+func ecsFingerprint(tasks []ecsTask) string {
+	res := make([]string, 0, len(tasks))
+	for _, t := range tasks {
+		res = append(res, t.TaskArn+":"+t.TaskDefinitionArn)
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+// signV4 signs request with aws signature version 4, all headers set before the call signed along with host
+func signV4(req *http.Request, body []byte, creds ecsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonReq := strings.Join([]string{req.Method, path, canonicalQuery(req.URL.Query()), canonHeaders.String(),
+		signedHeaders, hex.EncodeToString(bodyHash[:])}, "\n")
+	canonHash := sha256.Sum256([]byte(canonReq))
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query with keys sorted and spaces as %20, as sigv4 requires
+func canonicalQuery(q url.Values) string {
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = io.WriteString(h, data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,210 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// fakeECS emulates ecs ListTasks, DescribeTasks and DescribeTaskDefinition actions
+type fakeECS struct {
+	sync.Mutex
+	tasks    []ecsTask
+	defs     map[string]ecsTaskDef
+	denied   bool
+	calls    map[string]int
+	lastAuth string
+}
+
+func (f *fakeECS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonEC2ContainerServiceV20141113.")
+	f.calls[action]++
+	f.lastAuth = r.Header.Get("Authorization")
+	if f.denied {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"__type":"com.amazon.coral.service#AccessDeniedException","message":"not authorized to perform ecs:ListTasks"}`))
+		return
+	}
+	var req struct {
+		Cluster        string   `json:"cluster"`
+		Tasks          []string `json:"tasks"`
+		TaskDefinition string   `json:"taskDefinition"`
+		NextToken      string   `json:"nextToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch action {
+	case "ListTasks":
+		// two pages, one task per page
+		resp := map[string]interface{}{}
+		arns := []string{}
+		for _, t := range f.tasks {
+			arns = append(arns, t.TaskArn)
+		}
+		if req.NextToken == "" && len(arns) > 1 {
+			resp["taskArns"], resp["nextToken"] = arns[:1], "page2"
+		} else if req.NextToken == "page2" {
+			resp["taskArns"] = arns[1:]
+		} else {
+			resp["taskArns"] = arns
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	case "DescribeTasks":
+		res := []ecsTask{}
+		for _, t := range f.tasks {
+			for _, arn := range req.Tasks {
+				if t.TaskArn == arn {
+					res = append(res, t)
+				}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"tasks": res})
+	case "DescribeTaskDefinition":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"taskDefinition": f.defs[req.TaskDefinition]})
+	default:
+		http.Error(w, "unknown action "+action, http.StatusBadRequest)
+	}
+}
+
+func newECSTask(id, status, health, def, ip string) ecsTask {
+	t := ecsTask{TaskArn: "arn:aws:ecs:us-east-1:123:task/default/" + id, TaskDefinitionArn: def,
+		LastStatus: status, HealthStatus: health, StartedAt: 1620000000}
+	t.Containers = append(t.Containers, struct {
+		Name              string `json:"name"`
+		NetworkInterfaces []struct {
+			PrivateIPv4Address string `json:"privateIpv4Address"`
+		} `json:"networkInterfaces"`
+	}{Name: "api"})
+	if ip != "" {
+		t.Containers[0].NetworkInterfaces = append(t.Containers[0].NetworkInterfaces, struct {
+			PrivateIPv4Address string `json:"privateIpv4Address"`
+		}{PrivateIPv4Address: ip})
+	}
+	return t
+}
+
+func newFakeECS(t *testing.T) (*fakeECS, *httptest.Server) {
+	var def ecsTaskDef
+	err := json.Unmarshal([]byte(`{"taskDefinitionArn": "api:1", "containerDefinitions": [{"name": "api",
+		"dockerLabels": {"reproxy.route": "^/api/(.*)", "reproxy.dest": "/$1"},
+		"portMappings": [{"containerPort": 8080}]}]}`), &def)
+	require.NoError(t, err)
+	f := &fakeECS{defs: map[string]ecsTaskDef{"api:1": def}, tasks: []ecsTask{
+		newECSTask("t1", "RUNNING", "HEALTHY", "api:1", "10.0.1.1"),
+		newECSTask("t2", "RUNNING", "HEALTHY", "api:1", "10.0.1.2"),
+		newECSTask("t3", "RUNNING", "UNHEALTHY", "api:1", "10.0.1.3"),
+		newECSTask("t4", "PENDING", "UNKNOWN", "api:1", "10.0.1.4"),
+		newECSTask("t5", "RUNNING", "UNKNOWN", "api:1", "10.0.1.5"),
+		newECSTask("t6", "RUNNING", "HEALTHY", "api:1", ""),
+	}}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	return f, ts
+}
+
+func TestECS_List(t *testing.T) {
+	f, ts := newFakeECS(t)
+	e := &ECS{Cluster: "default", Region: "us-east-1", Endpoint: ts.URL, AccessKey: "AKID", SecretKey: "secret"}
+	res, err := e.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "only running and healthy tasks with eni")
+
+	dests := []string{res[0].Dst, res[1].Dst}
+	assert.ElementsMatch(t, []string{"http://10.0.1.1:8080/$1", "http://10.0.1.2:8080/$1"}, dests)
+	for _, m := range res {
+		assert.Equal(t, "^/api/(.*)", m.SrcMatch.String())
+		assert.Equal(t, discovery.PIECS, m.ProviderID)
+		assert.Equal(t, "api", m.MetricName)
+	}
+	f.Lock()
+	assert.Equal(t, 2, f.calls["ListTasks"], "paginated")
+	assert.Equal(t, 1, f.calls["DescribeTaskDefinition"], "task definition cached")
+	assert.True(t, strings.HasPrefix(f.lastAuth, "AWS4-HMAC-SHA256 Credential=AKID/"), f.lastAuth)
+	f.denied = true
+	f.Unlock()
+
+	res, err = e.List()
+	require.NoError(t, err, "last good kept on access error")
+	assert.Equal(t, 2, len(res))
+
+	e = &ECS{Cluster: "default", Region: "us-east-1", Endpoint: ts.URL, AccessKey: "AKID", SecretKey: "secret"}
+	_, err = e.List()
+	require.Error(t, err, "no last good")
+	assert.Contains(t, err.Error(), "AccessDeniedException")
+}
+
+func TestECS_ListCredentialsEndpoint(t *testing.T) {
+	_, ts := newFakeECS(t)
+	credCalls := 0
+	credSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credCalls++
+		assert.Equal(t, "token123", r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(`{"AccessKeyId": "ASIA1", "SecretAccessKey": "s1", "Token": "session1",
+			"Expiration": "` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`))
+	}))
+	defer credSrv.Close()
+
+	e := &ECS{Cluster: "default", Region: "us-east-1", Endpoint: ts.URL, CredentialsURL: credSrv.URL, CredentialsToken: "token123"}
+	_, err := e.List()
+	require.NoError(t, err)
+	_, err = e.List()
+	require.NoError(t, err)
+	assert.Equal(t, 1, credCalls, "credentials cached till expiration")
+
+	e = &ECS{Cluster: "default", Region: "us-east-1", Endpoint: ts.URL}
+	_, err = e.List()
+	require.EqualError(t, err, "can't list containers: no aws credentials for ecs provider")
+}
+
+func TestECS_Events(t *testing.T) {
+	f, ts := newFakeECS(t)
+	e := &ECS{Cluster: "default", Region: "us-east-1", Endpoint: ts.URL, AccessKey: "AKID", SecretKey: "secret",
+		PollInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ch := e.Events(ctx)
+	assert.Equal(t, discovery.PIECS, <-ch, "initial")
+
+	select {
+	case <-ch:
+		t.Fatal("no update expected without changes")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	f.Lock()
+	f.tasks[2].HealthStatus = "HEALTHY"
+	f.Unlock()
+	assert.Equal(t, discovery.PIECS, <-ch, "task became healthy")
+	cancel()
+	for range ch { // closed on context cancel
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	// get-vanilla case of aws sigv4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", http.NoBody)
+	require.NoError(t, err)
+	creds := ecsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signV4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
@@ -0,0 +1,233 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// Etcd implements provider reading rules from etcd v3 keys with the given Prefix, using etcd's json gateway.
+// Each key is <prefix><server>/<name>, and the value is a json rule, the same as a single file provider's rule,
+// i.e. /reproxy/example.com/api -> {"route": "^/api/(.*)", "dest": "http://127.0.0.1:8080/$1"}.
+// "default" server means any server (*). Events watch the prefix and send update on any change.
+// Broken watch, including compacted revision, re-established after RetryInterval with a forced reload
+type Etcd struct {
+	Endpoint      string        // etcd client url, i.e. http://127.0.0.1:2379
+	Prefix        string        // keys prefix, i.e. /reproxy/
+	Timeout       time.Duration // range request timeout, watch is not limited
+	RetryInterval time.Duration // delay before re-watching after watch error
+	Client        *http.Client
+}
+
+type etcdKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	Kvs    []etcdKV   `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Header          etcdHeader `json:"header"`
+		Created         bool       `json:"created"`
+		Canceled        bool       `json:"canceled"`
+		CompactRevision int64      `json:"compact_revision,string"`
+		CancelReason    string     `json:"cancel_reason"`
+		Events          []struct {
+			Type string `json:"type"`
+			KV   etcdKV `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// ID returns provider id
+func (e *Etcd) ID() discovery.ProviderID { return discovery.PIEtcd }
+
+// Events returns channel updating on any change of keys with the prefix
+func (e *Etcd) Events(ctx context.Context) <-chan discovery.ProviderID {
+	res := make(chan discovery.ProviderID)
+	go func() {
+		defer close(res)
+		for {
+			// re-list on every (re)connection, changes could be missed while the watch was down
+			select {
+			case res <- discovery.PIEtcd:
+			case <-ctx.Done():
+				return
+			}
+			rev, err := e.revision(ctx)
+			if err == nil {
+				err = e.watch(ctx, rev+1, res)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("[WARN] etcd watch for %s%s interrupted, retry in %s: %v", e.Endpoint, e.Prefix, e.RetryInterval, err)
+			select {
+			case <-time.After(e.RetryInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// List returns mappers for all keys with the prefix
+func (e *Etcd) List() (res []discovery.URLMapper, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout())
+	defer cancel()
+	resp, err := e.rangeRequest(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := map[string][]ruleConf{}
+	for _, kv := range resp.Kvs {
+		srv := e.server(string(kv.Key))
+		var rule ruleConf
+		if err = json.Unmarshal(kv.Value, &rule); err != nil {
+			log.Printf("[WARN] etcd key %s skipped, can't parse rule: %v", kv.Key, err)
+			continue
+		}
+		conf[srv] = append(conf[srv], rule)
+	}
+	return rulesToMappers(conf, discovery.PIEtcd)
+}
+
+// server extracts server from key, i.e. example.com for /reproxy/example.com/api. Keys without server are default
+func (e *Etcd) server(key string) string {
+	srv, _, found := strings.Cut(strings.TrimPrefix(key, e.Prefix), "/")
+	if !found || srv == "" {
+		return "default"
+	}
+	return srv
+}
+
+// revision returns current revision of the store
+func (e *Etcd) revision(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout())
+	defer cancel()
+	resp, err := e.rangeRequest(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+// watch blocks on the watch stream starting from rev and sends update on each change.
+// returns error if the stream was broken or canceled by etcd, i.e. because the revision compacted
+func (e *Etcd) watch(ctx context.Context, rev int64, res chan<- discovery.ProviderID) error {
+	body := map[string]interface{}{"create_request": map[string]interface{}{
+		"key": []byte(e.Prefix), "range_end": prefixRangeEnd(e.Prefix), "start_revision": rev}}
+	resp, err := e.post(ctx, "/v3/watch", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var wr etcdWatchResponse
+		if err = dec.Decode(&wr); err != nil {
+			return fmt.Errorf("watch stream: %w", err)
+		}
+		if wr.Error != nil {
+			return fmt.Errorf("watch error: %s", wr.Error.Message)
+		}
+		if wr.Result.CompactRevision > 0 {
+			return fmt.Errorf("revision %d compacted, compact revision %d", rev, wr.Result.CompactRevision)
+		}
+		if wr.Result.Canceled {
+			return fmt.Errorf("watch canceled: %s", wr.Result.CancelReason)
+		}
+		if len(wr.Result.Events) == 0 {
+			continue // created or progress notification
+		}
+		log.Printf("[DEBUG] etcd keys changed, %d events, revision %d", len(wr.Result.Events), wr.Result.Header.Revision)
+		select {
+		case res <- discovery.PIEtcd:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (e *Etcd) rangeRequest(ctx context.Context, countOnly bool) (*etcdRangeResponse, error) {
+	body := map[string]interface{}{"key": []byte(e.Prefix), "range_end": prefixRangeEnd(e.Prefix), "count_only": countOnly}
+	resp, err := e.post(ctx, "/v3/kv/range", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint
+
+	res := etcdRangeResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("can't parse etcd range response: %w", err)
+	}
+	return &res, nil
+}
+
+// post sends json request to etcd gateway, []byte fields encoded as base64 as expected by etcd
+func (e *Etcd) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal etcd request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(e.Endpoint, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("can't make etcd request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := e.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("etcd request %s failed: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("etcd request %s failed, unexpected status %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (e *Etcd) timeout() time.Duration {
+	if e.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return e.Timeout
+}
+
+// prefixRangeEnd returns range end for the prefix, i.e. the prefix with the last byte incremented
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0} // prefix of all 0xff, means all keys
+}
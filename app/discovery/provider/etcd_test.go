@@ -0,0 +1,140 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// fakeEtcd emulates etcd json gateway with range and watch requests
+type fakeEtcd struct {
+	sync.Mutex
+	kvs      map[string]string
+	revision int64
+	changes  chan struct{}
+	watches  int32
+	compact  bool // respond with compacted revision on the first watch
+}
+
+func (f *fakeEtcd) put(key, value string) {
+	f.Lock()
+	f.kvs[key] = value
+	f.revision++
+	f.Unlock()
+	f.changes <- struct{}{}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		req := struct {
+			Key       []byte `json:"key"`
+			RangeEnd  []byte `json:"range_end"`
+			CountOnly bool   `json:"count_only"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.Lock()
+		defer f.Unlock()
+		kvs := []etcdKV{}
+		for k, v := range f.kvs {
+			if k >= string(req.Key) && k < string(req.RangeEnd) && !req.CountOnly {
+				kvs = append(kvs, etcdKV{Key: []byte(k), Value: []byte(v)})
+			}
+		}
+		sort.Slice(kvs, func(i, j int) bool { return string(kvs[i].Key) < string(kvs[j].Key) })
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"header": map[string]string{"revision": fmt.Sprintf("%d", f.revision)}, "kvs": kvs})
+	case "/v3/watch":
+		if atomic.AddInt32(&f.watches, 1) == 1 && f.compact {
+			fmt.Fprint(w, `{"result":{"header":{"revision":"10"},"compact_revision":"5","canceled":true}}`)
+			return
+		}
+		fmt.Fprint(w, `{"result":{"header":{"revision":"1"},"created":true}}`)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-f.changes:
+				fmt.Fprint(w, `{"result":{"header":{"revision":"2"},"events":[{"type":"PUT","kv":{"key":"a2V5"}}]}}`)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEtcd_List(t *testing.T) {
+	f := &fakeEtcd{kvs: map[string]string{
+		"/reproxy/default/api":   `{"route": "^/api/(.*)", "dest": "http://127.0.0.1:8080/$1", "ping": "http://127.0.0.1:8080/ping"}`,
+		"/reproxy/example.com/w": `{"route": "/web", "dest": "/var/www", "assets": true}`,
+		"/reproxy/bad":           `{bad json`,
+		"/other/default/api":     `{"route": "^/other/(.*)", "dest": "http://127.0.0.1:8080/$1"}`,
+	}}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	e := Etcd{Endpoint: ts.URL, Prefix: "/reproxy/"}
+	res, err := e.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].Server < res[j].Server })
+
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.1:8080/$1", res[0].Dst)
+	assert.Equal(t, "http://127.0.0.1:8080/ping", res[0].PingURL)
+	assert.Equal(t, discovery.PIEtcd, res[0].ProviderID)
+	assert.Equal(t, discovery.MTProxy, res[0].MatchType)
+
+	assert.Equal(t, "example.com", res[1].Server)
+	assert.Equal(t, "/web", res[1].SrcMatch.String())
+	assert.Equal(t, discovery.MTStatic, res[1].MatchType)
+
+	e = Etcd{Endpoint: "http://127.0.0.1:1", Prefix: "/reproxy/", Timeout: 100 * time.Millisecond}
+	_, err = e.List()
+	require.Error(t, err)
+}
+
+func TestEtcd_Events(t *testing.T) {
+	f := &fakeEtcd{kvs: map[string]string{}, changes: make(chan struct{}), compact: true}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	e := Etcd{Endpoint: ts.URL, Prefix: "/reproxy/", RetryInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	ch := e.Events(ctx)
+
+	assert.Equal(t, discovery.PIEtcd, <-ch, "initial list")
+	assert.Equal(t, discovery.PIEtcd, <-ch, "re-list after compacted watch")
+	go f.put("/reproxy/default/api", `{"route": "^/api/(.*)", "dest": "http://127.0.0.1:8080/$1"}`)
+	assert.Equal(t, discovery.PIEtcd, <-ch, "key changed")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&f.watches))
+
+	cancel()
+	for range ch { // closed on context cancel
+	}
+}
+
+func Test_prefixRangeEnd(t *testing.T) {
+	assert.Equal(t, []byte("/reproxy0"), prefixRangeEnd("/reproxy/"))
+	assert.Equal(t, []byte("b"), prefixRangeEnd("a\xff"))
+	assert.Equal(t, []byte{0}, prefixRangeEnd("\xff"))
+}
@@ -21,6 +21,9 @@ type File struct {
 	Delay         time.Duration
 }
 
+// ID returns provider id
+func (d *File) ID() discovery.ProviderID { return discovery.PIFile }
+
 // Events returns channel updating on file change only
 func (d *File) Events(ctx context.Context) <-chan discovery.ProviderID {
 	res := make(chan discovery.ProviderID)
@@ -78,15 +81,7 @@ func (d *File) Events(ctx context.Context) <-chan discovery.ProviderID {
 // List all src dst pairs
 func (d *File) List() (res []discovery.URLMapper, err error) {
 
-	var fileConf map[string][]struct {
-		SourceRoute   string `yaml:"route"`
-		Dest          string `yaml:"dest"`
-		Ping          string `yaml:"ping"`
-		AssetsEnabled bool   `yaml:"assets"`
-		AssetsSPA     bool   `yaml:"spa"`
-		KeepHost      *bool  `yaml:"keep-host,omitempty"`
-		OnlyFrom      string `yaml:"remote"`
-	}
+	var fileConf map[string][]ruleConf
 	fh, err := os.Open(d.FileName)
 	if err != nil {
 		return nil, fmt.Errorf("can't open %s: %w", d.FileName, err)
@@ -98,7 +93,28 @@ func (d *File) List() (res []discovery.URLMapper, err error) {
 	}
 	log.Printf("[DEBUG] file provider %+v", res)
 
-	for srv, fl := range fileConf {
+	if res, err = rulesToMappers(fileConf, discovery.PIFile); err != nil {
+		return nil, err
+	}
+
+	err = fh.Close()
+	return res, err
+}
+
+// ruleConf is a single rule definition, shared by file (yaml) and remote (json) providers
+type ruleConf struct {
+	SourceRoute   string `yaml:"route" json:"route"`
+	Dest          string `yaml:"dest" json:"dest"`
+	Ping          string `yaml:"ping" json:"ping"`
+	AssetsEnabled bool   `yaml:"assets" json:"assets"`
+	AssetsSPA     bool   `yaml:"spa" json:"spa"`
+	KeepHost      *bool  `yaml:"keep-host,omitempty" json:"keep-host,omitempty"`
+	OnlyFrom      string `yaml:"remote" json:"remote"`
+}
+
+// rulesToMappers makes mappers from rules grouped by server, "default" server means any (*)
+func rulesToMappers(conf map[string][]ruleConf, pid discovery.ProviderID) (res []discovery.URLMapper, err error) {
+	for srv, fl := range conf {
 		for _, f := range fl {
 			rx, e := regexp.Compile(f.SourceRoute)
 			if e != nil {
@@ -113,7 +129,7 @@ func (d *File) List() (res []discovery.URLMapper, err error) {
 				Dst:         f.Dest,
 				PingURL:     f.Ping,
 				KeepHost:    f.KeepHost,
-				ProviderID:  discovery.PIFile,
+				ProviderID:  pid,
 				MatchType:   discovery.MTProxy,
 				OnlyFromIPs: discovery.ParseOnlyFrom(f.OnlyFrom),
 			}
@@ -127,7 +143,5 @@ func (d *File) List() (res []discovery.URLMapper, err error) {
 	sort.Slice(res, func(i, j int) bool {
 		return len(res[i].Server) > len(res[j].Server)
 	})
-
-	err = fh.Close()
-	return res, err
+	return res, nil
 }
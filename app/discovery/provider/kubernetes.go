@@ -0,0 +1,554 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// Kubernetes implements provider reading routes from kubernetes services with reproxy.* annotations, mapped
+// with the same rules as docker labels, i.e. reproxy.route=^/api/(.*) and reproxy.dest=/$1 annotations.
+// Each ready endpoint of the service makes a destination of the same route, or, with ClusterIP, the service
+// cluster ip does. With Ingress, rules of ingresses routed to cluster ips of their backend services as well.
+// Events use watches of services, endpoints and ingresses, and also send update on each watch end (resync).
+// List keeps the last good routes on api errors, so a transient failure doesn't drop all kubernetes routes
+type Kubernetes struct {
+	Endpoint      string        // api server address, i.e. https://kubernetes.default.svc
+	Token         string        // bearer token, used if TokenFile is not set
+	TokenFile     string        // bearer token file, read on each request as service account tokens rotated
+	Namespace     string        // namespace of services, all namespaces if empty
+	ClusterIP     bool          // route to service cluster ip instead of ready endpoints
+	Ingress       bool          // route ingress rules in addition to annotated services
+	Timeout       time.Duration // regular request timeout, watches limited by WatchTimeout
+	WatchTimeout  time.Duration // max duration of watch, routes reloaded on each watch end
+	RetryInterval time.Duration // delay before the next watch after error
+	RouteTTL      time.Duration // last good routes kept on list errors for ttl only, 0 means no expiry
+	Client        *http.Client
+
+	lock     sync.Mutex
+	lastGood []discovery.URLMapper
+}
+
+type k8sMeta struct {
+	Name            string
+	Namespace       string
+	ResourceVersion string
+	Annotations     map[string]string
+}
+
+type k8sService struct {
+	Metadata k8sMeta
+	Spec     struct {
+		ClusterIP string
+		Ports     []struct {
+			Name string
+			Port int
+		}
+	}
+}
+
+type k8sEndpoints struct {
+	Metadata k8sMeta
+	Subsets  []struct {
+		Addresses []struct { // ready addresses only, not ready ones listed in NotReadyAddresses
+			IP string
+		}
+		Ports []struct {
+			Name string
+			Port int
+		}
+	}
+}
+
+type k8sIngress struct {
+	Metadata k8sMeta
+	Spec     struct {
+		Rules []struct {
+			Host string
+			HTTP *struct {
+				Paths []struct {
+					Path     string
+					PathType string
+					Backend  struct {
+						Service *struct {
+							Name string
+							Port struct {
+								Name   string
+								Number int
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// k8sStatusError is an error response of kubernetes api, i.e. 403 for missing RBAC permissions
+type k8sStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *k8sStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d, %s", e.Code, e.Message)
+}
+
+// ID returns provider id
+func (k *Kubernetes) ID() discovery.ProviderID { return discovery.PIKubernetes }
+
+// Events returns channel updating on changes of services, endpoints and, with Ingress, ingresses
+func (k *Kubernetes) Events(ctx context.Context) <-chan discovery.ProviderID {
+	res := make(chan discovery.ProviderID)
+	changed := make(chan struct{}, 1) // changes of all watches coalesced
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	for _, r := range k.resources() {
+		go k.watch(ctx, r, notify)
+	}
+
+	go func() {
+		defer close(res)
+		for {
+			select {
+			case res <- discovery.PIKubernetes:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// List returns mappers for all annotated services and, with Ingress, for ingress rules.
+// On api error returns the last good mappers, if any
+func (k *Kubernetes) List() ([]discovery.URLMapper, error) {
+	res, err := k.list()
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if err != nil {
+		if k.lastGood == nil {
+			return nil, err
+		}
+		log.Printf("[WARN] can't list kubernetes routes, keep %d last good routes: %v", len(k.lastGood), err)
+		return k.lastGood, nil
+	}
+	now := time.Now()
+	for i := range res {
+		res[i].TTL, res[i].LastSeen = k.RouteTTL, now
+	}
+	k.lastGood = res
+	return res, nil
+}
+
+func (k *Kubernetes) list() (res []discovery.URLMapper, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), k.timeout())
+	defer cancel()
+
+	var services struct{ Items []k8sService }
+	if err = k.get(ctx, k.path("/api/v1", "services"), nil, &services); err != nil {
+		return nil, err
+	}
+	var endpoints struct{ Items []k8sEndpoints }
+	if !k.ClusterIP {
+		if err = k.get(ctx, k.path("/api/v1", "endpoints"), nil, &endpoints); err != nil {
+			return nil, err
+		}
+	}
+	endpointsByName := map[string]k8sEndpoints{}
+	for _, ep := range endpoints.Items {
+		endpointsByName[ep.Metadata.Namespace+"/"+ep.Metadata.Name] = ep
+	}
+	servicesByName := map[string]k8sService{}
+	for _, svc := range services.Items {
+		servicesByName[svc.Metadata.Namespace+"/"+svc.Metadata.Name] = svc
+		if !hasReproxyAnnotation(svc.Metadata.Annotations) {
+			continue
+		}
+		res = append(res, k.serviceMappers(svc, endpointsByName[svc.Metadata.Namespace+"/"+svc.Metadata.Name])...)
+	}
+
+	if k.Ingress {
+		var ingresses struct{ Items []k8sIngress }
+		if err = k.get(ctx, k.path("/apis/networking.k8s.io/v1", "ingresses"), nil, &ingresses); err != nil {
+			return nil, err
+		}
+		for _, ing := range ingresses.Items {
+			res = append(res, k.ingressMappers(ing, servicesByName)...)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return len(res[i].SrcMatch.String()) > len(res[j].SrcMatch.String())
+	})
+	return res, nil
+}
+
+// serviceMappers makes mappers for the annotated service, a destination per ready endpoint or the cluster ip.
+// Nothing if src route is invalid or the service has no port defined by reproxy.port annotation
+func (k *Kubernetes) serviceMappers(svc k8sService, ep k8sEndpoints) (res []discovery.URLMapper) {
+	labels := svc.Metadata.Annotations
+	name := svc.Metadata.Namespace + "/" + svc.Metadata.Name
+
+	portIdx := 0 // the first port by default
+	if v, ok := labels["reproxy.port"]; ok {
+		portIdx = -1
+		for i, p := range svc.Spec.Ports {
+			if p.Name == v || strconv.Itoa(p.Port) == v {
+				portIdx = i
+				break
+			}
+		}
+	}
+	if portIdx < 0 || portIdx >= len(svc.Spec.Ports) {
+		log.Printf("[DEBUG] kubernetes service %s disabled, no port %q", name, labels["reproxy.port"])
+		return nil
+	}
+	portName := svc.Spec.Ports[portIdx].Name
+
+	type hostPort struct {
+		host string
+		port int
+	}
+	var dests []hostPort
+	if k.ClusterIP {
+		if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == "None" {
+			log.Printf("[DEBUG] kubernetes service %s disabled, no cluster ip", name)
+			return nil
+		}
+		dests = append(dests, hostPort{svc.Spec.ClusterIP, svc.Spec.Ports[portIdx].Port})
+	}
+	if !k.ClusterIP {
+		for _, subset := range ep.Subsets {
+			port := 0
+			for _, p := range subset.Ports {
+				if p.Name == portName {
+					port = p.Port
+					break
+				}
+			}
+			if port == 0 {
+				continue
+			}
+			for _, addr := range subset.Addresses {
+				dests = append(dests, hostPort{addr.IP, port})
+			}
+		}
+	}
+	if len(dests) == 0 {
+		log.Printf("[DEBUG] kubernetes service %s skipped, no ready endpoints", name)
+		return nil
+	}
+
+	srcURL := "^/(.*)"
+	if v, ok := labels["reproxy.route"]; ok {
+		srcURL = v
+	}
+	srcRegex, err := regexp.Compile(srcURL)
+	if err != nil {
+		log.Printf("[DEBUG] kubernetes service %s disabled, invalid src regex: %v", name, err)
+		return nil
+	}
+	server := "*"
+	if v, ok := labels["reproxy.server"]; ok {
+		server = v
+	}
+	var keepHost *bool
+	if v, ok := labels["reproxy.keep-host"]; ok {
+		switch v {
+		case "true", "yes", "1":
+			t := true
+			keepHost = &t
+		case "false", "no", "0":
+			f := false
+			keepHost = &f
+		default:
+			log.Printf("[WARN] kubernetes service %s, invalid value for reproxy.keep-host: %s", name, v)
+		}
+	}
+	onlyFrom := []string{}
+	if v, ok := labels["reproxy.remote"]; ok {
+		onlyFrom = discovery.ParseOnlyFrom(v)
+	}
+
+	for _, d := range dests {
+		destURL := fmt.Sprintf("http://%s:%d/$1", d.host, d.port)
+		if v, ok := labels["reproxy.dest"]; ok {
+			destURL = fmt.Sprintf("http://%s:%d%s", d.host, d.port, v)
+		}
+		pingURL := ""
+		if v, ok := labels["reproxy.ping"]; ok {
+			pingURL = fmt.Sprintf("http://%s:%d%s", d.host, d.port, v)
+		}
+		for _, srv := range strings.Split(server, ",") {
+			res = append(res, discovery.URLMapper{Server: strings.TrimSpace(srv), SrcMatch: *srcRegex, Dst: destURL,
+				PingURL: pingURL, ProviderID: discovery.PIKubernetes, MatchType: discovery.MTProxy, KeepHost: keepHost,
+				OnlyFromIPs: onlyFrom, MetricName: name})
+		}
+	}
+	return res
+}
+
+// ingressMappers makes mappers for http rules of the ingress, routed to cluster ips of backend services with
+// the original path. Prefix and ImplementationSpecific paths matched by path elements, Exact as is
+func (k *Kubernetes) ingressMappers(ing k8sIngress, services map[string]k8sService) (res []discovery.URLMapper) {
+	name := ing.Metadata.Namespace + "/" + ing.Metadata.Name
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		server := rule.Host
+		if server == "" {
+			server = "*"
+		}
+		for _, p := range rule.HTTP.Paths {
+			backend := p.Backend.Service
+			if backend == nil {
+				continue
+			}
+			svc, ok := services[ing.Metadata.Namespace+"/"+backend.Name]
+			if !ok || svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == "None" {
+				log.Printf("[DEBUG] kubernetes ingress %s, path %s skipped, no cluster ip of service %s", name, p.Path, backend.Name)
+				continue
+			}
+			port := backend.Port.Number
+			for _, sp := range svc.Spec.Ports {
+				if backend.Port.Name != "" && sp.Name == backend.Port.Name {
+					port = sp.Port
+				}
+			}
+			if port == 0 {
+				log.Printf("[DEBUG] kubernetes ingress %s, path %s skipped, no port %q of service %s",
+					name, p.Path, backend.Port.Name, backend.Name)
+				continue
+			}
+
+			path := p.Path
+			if path == "" {
+				path = "/"
+			}
+			var src string
+			switch prefix := strings.TrimSuffix(path, "/"); {
+			case p.PathType == "Exact":
+				src = "^(" + regexp.QuoteMeta(path) + ")$"
+			case prefix == "":
+				src = "^(/.*)$"
+			default:
+				src = "^(" + regexp.QuoteMeta(prefix) + "(?:/.*)?)$"
+			}
+			res = append(res, discovery.URLMapper{Server: server, SrcMatch: *regexp.MustCompile(src),
+				Dst: fmt.Sprintf("http://%s:%d$1", svc.Spec.ClusterIP, port), ProviderID: discovery.PIKubernetes,
+				MatchType: discovery.MTProxy, OnlyFromIPs: []string{}, MetricName: name})
+		}
+	}
+	return res
+}
+
+// watch watches the resource and calls notify on each change and on each watch end. Blocks till ctx canceled.
+// Resource version taken from the list, and re-listed if the watch reports it expired
+func (k *Kubernetes) watch(ctx context.Context, resource string, notify func()) {
+	version := ""
+	for ctx.Err() == nil {
+		var err error
+		if version == "" {
+			if version, err = k.resourceVersion(ctx, resource); err == nil {
+				notify() // changes could be missed before the list
+			}
+		}
+		if err == nil {
+			version, err = k.watchOnce(ctx, resource, version, notify)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			notify() // watch ended, resync
+			continue
+		}
+
+		var se *k8sStatusError
+		if errors.As(err, &se) && (se.Code == http.StatusForbidden || se.Code == http.StatusUnauthorized) {
+			log.Printf("[WARN] kubernetes watch of %s not allowed, check token and RBAC permissions (list and watch): %v",
+				resource, err)
+		} else {
+			log.Printf("[WARN] kubernetes watch of %s failed, retry in %s: %v", resource, k.RetryInterval, err)
+		}
+		version = ""
+		select {
+		case <-time.After(k.RetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchOnce makes a single watch request from the resource version, calls notify on changes.
+// Returns the last seen resource version, empty if the version is expired (410 Gone) and the resource should be re-listed
+func (k *Kubernetes) watchOnce(ctx context.Context, resource, version string, notify func()) (string, error) {
+	wait := k.WatchTimeout
+	if wait <= 0 {
+		wait = 5 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait+k.timeout())
+	defer cancel()
+
+	params := url.Values{"watch": {"1"}, "resourceVersion": {version}, "allowWatchBookmarks": {"true"},
+		"timeoutSeconds": {strconv.Itoa(int(wait.Seconds()))}}
+	resp, err := k.do(ctx, resource, params)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close() // nolint
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			Type   string
+			Object struct {
+				Metadata k8sMeta
+				Code     int // status code of ERROR event
+				Message  string
+			}
+		}
+		if err := dec.Decode(&ev); err != nil {
+			return version, nil // stream ended, by watch timeout or connection close
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			log.Printf("[DEBUG] kubernetes %s %s/%s %s", resource, ev.Object.Metadata.Namespace, ev.Object.Metadata.Name,
+				strings.ToLower(ev.Type))
+			version = ev.Object.Metadata.ResourceVersion
+			notify()
+		case "BOOKMARK":
+			version = ev.Object.Metadata.ResourceVersion
+		case "ERROR":
+			if ev.Object.Code == http.StatusGone {
+				log.Printf("[DEBUG] kubernetes %s resource version %s expired, re-list", resource, version)
+				return "", nil
+			}
+			return "", &k8sStatusError{Code: ev.Object.Code, Message: ev.Object.Message}
+		}
+	}
+}
+
+// resourceVersion returns current resource version of the resource list
+func (k *Kubernetes) resourceVersion(ctx context.Context, resource string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, k.timeout())
+	defer cancel()
+	var list struct{ Metadata k8sMeta }
+	if err := k.get(ctx, resource, url.Values{"limit": {"1"}}, &list); err != nil {
+		return "", err
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// resources returns api paths of watched resources
+func (k *Kubernetes) resources() []string {
+	res := []string{k.path("/api/v1", "services")}
+	if !k.ClusterIP {
+		res = append(res, k.path("/api/v1", "endpoints"))
+	}
+	if k.Ingress {
+		res = append(res, k.path("/apis/networking.k8s.io/v1", "ingresses"))
+	}
+	return res
+}
+
+// path makes api path of the resource in the namespace, or in all namespaces if not set
+func (k *Kubernetes) path(api, resource string) string {
+	if k.Namespace == "" {
+		return api + "/" + resource
+	}
+	return api + "/namespaces/" + url.PathEscape(k.Namespace) + "/" + resource
+}
+
+// get makes request to kubernetes api and decodes json response to res
+func (k *Kubernetes) get(ctx context.Context, path string, params url.Values, res interface{}) error {
+	resp, err := k.do(ctx, path, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("can't parse kubernetes response for %s: %w", path, err)
+	}
+	return nil
+}
+
+// do makes request to kubernetes api, returns error for non-200 responses
+func (k *Kubernetes) do(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	u := strings.TrimSuffix(k.Endpoint, "/") + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("can't make kubernetes request: %w", err)
+	}
+	token := k.Token
+	if k.TokenFile != "" {
+		data, err := os.ReadFile(k.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read kubernetes token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := k.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+	resp, err := client.Do(req) // nolint:bodyclose // closed by caller
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes request %s failed: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close() // nolint
+		status := struct{ Message string }{}
+		_ = json.NewDecoder(resp.Body).Decode(&status)
+		return nil, fmt.Errorf("kubernetes request %s failed: %w", path, &k8sStatusError{Code: resp.StatusCode, Message: status.Message})
+	}
+	return resp, nil
+}
+
+func (k *Kubernetes) timeout() time.Duration {
+	if k.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return k.Timeout
+}
+
+func hasReproxyAnnotation(annotations map[string]string) bool {
+	for k := range annotations {
+		if strings.HasPrefix(k, "reproxy.") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// fakeK8s emulates kubernetes api lists and watches of services, endpoints and ingresses
+type fakeK8s struct {
+	sync.Mutex
+	lists   map[string]string      // path -> list json
+	events  map[string]chan string // path -> watch events json
+	status  int                    // response status for all requests if set
+	token   string                 // required bearer token if set
+	timeout time.Duration          // watch duration
+}
+
+func newFakeK8s() *fakeK8s {
+	return &fakeK8s{timeout: 100 * time.Millisecond, lists: map[string]string{}, events: map[string]chan string{
+		"/api/v1/services": make(chan string, 10), "/api/v1/endpoints": make(chan string, 10),
+		"/apis/networking.k8s.io/v1/ingresses": make(chan string, 10)}}
+}
+
+func (f *fakeK8s) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	status, list := f.status, f.lists[r.URL.Path]
+	f.Unlock()
+	if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token {
+		status = http.StatusUnauthorized
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintf(w, `{"kind":"Status","code":%d,"message":"not allowed"}`, status)
+		return
+	}
+	if r.URL.Query().Get("watch") == "" {
+		if list == "" {
+			list = `{"items":[]}`
+		}
+		_, _ = w.Write([]byte(list))
+		return
+	}
+	events := f.events[r.URL.Path]
+	expired := time.After(f.timeout)
+	for {
+		select {
+		case ev := <-events:
+			_, _ = w.Write([]byte(ev + "\n"))
+			w.(http.Flusher).Flush()
+			if strings.Contains(ev, `"ERROR"`) { // watch closed after error
+				return
+			}
+		case <-expired:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+const testK8sServices = `{"metadata":{"resourceVersion":"10"},"items":[
+ {"metadata":{"name":"api","namespace":"default","annotations":{"reproxy.route":"^/api/(.*)","reproxy.dest":"/$1",
+   "reproxy.server":"example.com,api.example.com","reproxy.ping":"/ping","reproxy.keep-host":"yes","reproxy.port":"http"}},
+  "spec":{"clusterIP":"10.0.0.1","ports":[{"name":"metrics","port":9090},{"name":"http","port":80}]}},
+ {"metadata":{"name":"web","namespace":"default","annotations":{"reproxy.route":"^/web/(.*)"}},
+  "spec":{"clusterIP":"10.0.0.2","ports":[{"port":8080}]}},
+ {"metadata":{"name":"bad","namespace":"default","annotations":{"reproxy.route":"^/bad/(.*"}},
+  "spec":{"clusterIP":"10.0.0.3","ports":[{"port":8080}]}},
+ {"metadata":{"name":"noport","namespace":"default","annotations":{"reproxy.port":"grpc"}},
+  "spec":{"clusterIP":"10.0.0.4","ports":[{"port":8080}]}},
+ {"metadata":{"name":"other","namespace":"default"},"spec":{"clusterIP":"10.0.0.5","ports":[{"port":8080}]}},
+ {"metadata":{"name":"site","namespace":"default"},"spec":{"clusterIP":"10.0.0.6","ports":[{"name":"http","port":80}]}}
+]}`
+
+const testK8sEndpoints = `{"metadata":{"resourceVersion":"11"},"items":[
+ {"metadata":{"name":"api","namespace":"default"},"subsets":[
+  {"addresses":[{"ip":"172.16.0.1"},{"ip":"172.16.0.2"}],"notReadyAddresses":[{"ip":"172.16.0.3"}],
+   "ports":[{"name":"metrics","port":9091},{"name":"http","port":8080}]}]},
+ {"metadata":{"name":"web","namespace":"default"},"subsets":[
+  {"notReadyAddresses":[{"ip":"172.16.1.1"}],"ports":[{"port":8080}]}]},
+ {"metadata":{"name":"bad","namespace":"default"},"subsets":[{"addresses":[{"ip":"172.16.2.1"}],"ports":[{"port":8080}]}]}
+]}`
+
+const testK8sIngresses = `{"metadata":{"resourceVersion":"12"},"items":[
+ {"metadata":{"name":"site","namespace":"default"},"spec":{"rules":[
+  {"host":"site.example.com","http":{"paths":[
+   {"path":"/app/","pathType":"Prefix","backend":{"service":{"name":"site","port":{"name":"http"}}}},
+   {"path":"/health","pathType":"Exact","backend":{"service":{"name":"site","port":{"number":80}}}},
+   {"path":"/missing","pathType":"Prefix","backend":{"service":{"name":"missing","port":{"number":80}}}}]}},
+  {"http":{"paths":[{"path":"/","pathType":"Prefix","backend":{"service":{"name":"web","port":{"number":8080}}}}]}}
+ ]}}
+]}`
+
+func TestKubernetes_List(t *testing.T) {
+	f := newFakeK8s()
+	f.token = "secret"
+	f.lists["/api/v1/services"] = testK8sServices
+	f.lists["/api/v1/endpoints"] = testK8sEndpoints
+	f.lists["/apis/networking.k8s.io/v1/ingresses"] = testK8sIngresses
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	k := Kubernetes{Endpoint: ts.URL, Token: "secret", Ingress: true}
+	res, err := k.List()
+	require.NoError(t, err)
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Server != res[j].Server {
+			return res[i].Server < res[j].Server
+		}
+		if res[i].SrcMatch.String() != res[j].SrcMatch.String() {
+			return res[i].SrcMatch.String() < res[j].SrcMatch.String()
+		}
+		return res[i].Dst < res[j].Dst
+	})
+	require.Equal(t, 7, len(res), "ready endpoints of api, ingress routes")
+
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "^(/.*)$", res[0].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.2:8080$1", res[0].Dst)
+
+	assert.Equal(t, "api.example.com", res[1].Server)
+	assert.Equal(t, "^/api/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://172.16.0.1:8080/$1", res[1].Dst)
+	assert.Equal(t, "http://172.16.0.1:8080/ping", res[1].PingURL)
+	assert.Equal(t, "http://172.16.0.2:8080/$1", res[2].Dst)
+	assert.Equal(t, "example.com", res[3].Server)
+	assert.Equal(t, "http://172.16.0.1:8080/$1", res[3].Dst)
+	require.NotNil(t, res[3].KeepHost)
+	assert.True(t, *res[3].KeepHost)
+	assert.Equal(t, "default/api", res[3].MetricName)
+	assert.Equal(t, "http://172.16.0.2:8080/$1", res[4].Dst)
+
+	assert.Equal(t, "site.example.com", res[5].Server)
+	assert.Equal(t, "^(/app(?:/.*)?)$", res[5].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.6:80$1", res[5].Dst)
+	assert.Equal(t, "^(/health)$", res[6].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.6:80$1", res[6].Dst)
+	assert.True(t, res[5].SrcMatch.MatchString("/app/foo"))
+	assert.True(t, res[5].SrcMatch.MatchString("/app"))
+	assert.False(t, res[5].SrcMatch.MatchString("/application"))
+
+	for _, m := range res {
+		assert.Equal(t, discovery.PIKubernetes, m.ProviderID)
+	}
+	assert.Equal(t, discovery.PIKubernetes, k.ID())
+}
+
+func TestKubernetes_ListClusterIP(t *testing.T) {
+	f := newFakeK8s()
+	f.lists["/api/v1/namespaces/default/services"] = testK8sServices
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	k := Kubernetes{Endpoint: ts.URL, Namespace: "default", ClusterIP: true}
+	res, err := k.List()
+	require.NoError(t, err)
+	sort.Slice(res, func(i, j int) bool { return res[i].Server+res[i].Dst < res[j].Server+res[j].Dst })
+	require.Equal(t, 3, len(res))
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "http://10.0.0.2:8080/$1", res[0].Dst, "not ready endpoints ignored with cluster ip")
+	assert.Equal(t, "api.example.com", res[1].Server)
+	assert.Equal(t, "http://10.0.0.1:80/$1", res[1].Dst, "service port")
+	assert.Equal(t, "example.com", res[2].Server)
+}
+
+func TestKubernetes_ListErrors(t *testing.T) {
+	f := newFakeK8s()
+	f.lists["/api/v1/services"] = testK8sServices
+	f.lists["/api/v1/endpoints"] = testK8sEndpoints
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	f.token = "secret"
+	k := Kubernetes{Endpoint: ts.URL, TokenFile: tokenFile}
+	_, err := k.List()
+	assert.ErrorContains(t, err, "can't read kubernetes token")
+
+	require.NoError(t, os.WriteFile(tokenFile, []byte("bad\n"), 0o600))
+	_, err = k.List()
+	assert.ErrorContains(t, err, "unexpected status 401, not allowed", "no last good routes yet")
+
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+	res, err := k.List()
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(res))
+
+	f.Lock()
+	f.status = http.StatusForbidden
+	f.Unlock()
+	res, err = k.List()
+	require.NoError(t, err, "last good routes kept")
+	assert.Equal(t, 4, len(res))
+}
+
+func TestKubernetes_Events(t *testing.T) {
+	f := newFakeK8s()
+	f.timeout = 5 * time.Second // no watch ends during the test
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	k := Kubernetes{Endpoint: ts.URL, RetryInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ch := k.Events(ctx)
+
+	recv := func(msg string) {
+		select {
+		case pid := <-ch:
+			assert.Equal(t, discovery.PIKubernetes, pid)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal(msg)
+		}
+	}
+	drain := func() { // skip notifications of lists and watch ends
+		for {
+			select {
+			case <-ch:
+			case <-time.After(150 * time.Millisecond):
+				return
+			}
+		}
+	}
+	event := func(path, typ, version string) {
+		ev, err := json.Marshal(map[string]interface{}{"type": typ,
+			"object": map[string]interface{}{"metadata": map[string]string{"name": "api", "namespace": "default",
+				"resourceVersion": version}}})
+		require.NoError(t, err)
+		f.events[path] <- string(ev)
+	}
+
+	recv("initial update")
+	drain()
+	event("/api/v1/endpoints", "MODIFIED", "12")
+	recv("endpoints changed")
+	event("/api/v1/services", "DELETED", "13")
+	recv("service deleted")
+}
+
+func TestKubernetes_watchRecover(t *testing.T) {
+	f := newFakeK8s()
+	f.status = http.StatusForbidden
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	k := Kubernetes{Endpoint: ts.URL, RetryInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	notified := make(chan struct{}, 10)
+	go k.watch(ctx, "/api/v1/services", func() { notified <- struct{}{} })
+
+	select {
+	case <-notified:
+		t.Fatal("no updates while watch is not allowed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	f.Lock()
+	f.status = 0
+	f.Unlock()
+	select {
+	case <-notified:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("no update after watch recovered")
+	}
+}
+
+func TestKubernetes_watchOnce(t *testing.T) {
+	f := newFakeK8s()
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	k := Kubernetes{Endpoint: ts.URL}
+
+	notified := 0
+	f.events["/api/v1/services"] <- `{"type":"ADDED","object":{"metadata":{"name":"a","resourceVersion":"5"}}}`
+	f.events["/api/v1/services"] <- `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"7"}}}`
+	version, err := k.watchOnce(context.Background(), "/api/v1/services", "1", func() { notified++ })
+	require.NoError(t, err)
+	assert.Equal(t, "7", version)
+	assert.Equal(t, 1, notified, "bookmark doesn't notify")
+
+	f.events["/api/v1/services"] <- `{"type":"ERROR","object":{"kind":"Status","code":410,"message":"too old"}}`
+	version, err = k.watchOnce(context.Background(), "/api/v1/services", "1", func() { notified++ })
+	require.NoError(t, err)
+	assert.Equal(t, "", version, "expired version, re-list")
+
+	f.events["/api/v1/services"] <- `{"type":"ERROR","object":{"kind":"Status","code":500,"message":"internal"}}`
+	_, err = k.watchOnce(context.Background(), "/api/v1/services", "1", func() { notified++ })
+	assert.EqualError(t, err, "unexpected status 500, internal")
+}
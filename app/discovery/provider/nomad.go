@@ -0,0 +1,314 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// Nomad implements provider reading routes from nomad native service discovery. Services with reproxy.* tags
+// mapped with the same rules as docker labels, i.e. reproxy.route=^/api/(.*) and reproxy.dest=/$1 tags.
+// Each allocation registering the service makes a destination, so scaling the job adds or removes destinations
+// of the same route. Only running allocations routed, and allocations tracked by a deployment should be healthy.
+// Events use blocking queries on the services list and also send update every WaitTime, as allocation health
+// changes are not reflected in the services list index
+type Nomad struct {
+	Endpoint      string        // nomad http api address, i.e. http://127.0.0.1:4646
+	Token         string        // acl token, sent as X-Nomad-Token if set
+	Namespace     string        // namespace of services, "*" for all. Default is "default"
+	Timeout       time.Duration // regular request timeout, blocking queries limited by WaitTime
+	WaitTime      time.Duration // max wait of blocking query
+	RetryInterval time.Duration // delay before the next blocking query after error
+	Client        *http.Client
+}
+
+type nomadServiceStub struct {
+	Namespace string
+	Services  []struct {
+		ServiceName string
+		Tags        []string
+	}
+}
+
+type nomadRegistration struct {
+	ID          string
+	ServiceName string
+	Namespace   string
+	AllocID     string
+	Address     string
+	Port        int
+	Tags        []string
+}
+
+type nomadAllocation struct {
+	ID               string
+	ClientStatus     string
+	DeploymentStatus *struct {
+		Healthy *bool
+	}
+}
+
+// ID returns provider id
+func (n *Nomad) ID() discovery.ProviderID { return discovery.PINomad }
+
+// Events returns channel updating on changes of nomad services
+func (n *Nomad) Events(ctx context.Context) <-chan discovery.ProviderID {
+	res := make(chan discovery.ProviderID)
+	go func() {
+		defer close(res)
+		send := func() bool {
+			select {
+			case res <- discovery.PINomad:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if !send() {
+			return
+		}
+		var index uint64 // zero index query only gets the current index, without update
+		for {
+			newIndex, err := n.waitServices(ctx, index)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("[WARN] nomad services query to %s failed, retry in %s: %v", n.Endpoint, n.RetryInterval, err)
+				select {
+				case <-time.After(n.RetryInterval):
+				case <-ctx.Done():
+					return
+				}
+				index = 0
+				if !send() { // changes could be missed while nomad was unavailable
+					return
+				}
+				continue
+			}
+			if index == 0 {
+				index = newIndex
+				continue
+			}
+			if newIndex != index {
+				log.Printf("[DEBUG] nomad services changed, index %d", newIndex)
+			}
+			index = newIndex
+			if !send() { // on change and on wait expiry, both reload routes
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// List returns mappers for all nomad services with reproxy tags
+func (n *Nomad) List() (res []discovery.URLMapper, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout())
+	defer cancel()
+
+	var stubs []nomadServiceStub
+	if _, err = n.get(ctx, "/v1/services", url.Values{"namespace": {n.namespace()}}, &stubs); err != nil {
+		return nil, err
+	}
+
+	allocs := map[string]bool{} // alloc id -> routed, allocations usually register multiple services
+	for _, stub := range stubs {
+		for _, svc := range stub.Services {
+			if !hasReproxyTag(svc.Tags) {
+				continue
+			}
+			var regs []nomadRegistration
+			path := "/v1/service/" + url.PathEscape(svc.ServiceName)
+			if _, err = n.get(ctx, path, url.Values{"namespace": {stub.Namespace}}, &regs); err != nil {
+				return nil, err
+			}
+			for _, reg := range regs {
+				routed, ok := allocs[reg.AllocID]
+				if !ok {
+					if routed, err = n.allocRouted(ctx, reg.AllocID, stub.Namespace); err != nil {
+						return nil, err
+					}
+					allocs[reg.AllocID] = routed
+				}
+				if !routed {
+					log.Printf("[DEBUG] nomad service %s, allocation %s skipped, not running or unhealthy", reg.ServiceName, reg.AllocID)
+					continue
+				}
+				res = append(res, n.mappers(reg)...)
+			}
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return len(res[i].SrcMatch.String()) > len(res[j].SrcMatch.String())
+	})
+	return res, nil
+}
+
+// mappers makes mappers for the service registration, nothing if not enabled by tags or src route is invalid
+func (n *Nomad) mappers(reg nomadRegistration) (res []discovery.URLMapper) {
+	labels := tagsToLabels(reg.Tags)
+	enabled := false
+	srcURL := "^/(.*)"
+	destURL := fmt.Sprintf("http://%s:%d/$1", reg.Address, reg.Port)
+	pingURL := fmt.Sprintf("http://%s:%d/ping", reg.Address, reg.Port)
+	server := "*"
+	onlyFrom := []string{}
+	var keepHost *bool
+
+	if v, ok := labels["reproxy.enabled"]; ok && (v == "true" || v == "yes" || v == "1") {
+		enabled = true
+	}
+	if v, ok := labels["reproxy.route"]; ok {
+		enabled, srcURL = true, v
+	}
+	if v, ok := labels["reproxy.dest"]; ok {
+		enabled, destURL = true, fmt.Sprintf("http://%s:%d%s", reg.Address, reg.Port, v)
+	}
+	if v, ok := labels["reproxy.server"]; ok {
+		enabled, server = true, v
+	}
+	if v, ok := labels["reproxy.ping"]; ok {
+		enabled, pingURL = true, fmt.Sprintf("http://%s:%d%s", reg.Address, reg.Port, v)
+	}
+	if v, ok := labels["reproxy.remote"]; ok {
+		onlyFrom = discovery.ParseOnlyFrom(v)
+	}
+	if v, ok := labels["reproxy.keep-host"]; ok {
+		switch v {
+		case "true", "yes", "1":
+			t := true
+			keepHost = &t
+		case "false", "no", "0":
+			f := false
+			keepHost = &f
+		default:
+			log.Printf("[WARN] nomad service %s, invalid value for reproxy.keep-host: %s", reg.ServiceName, v)
+		}
+	}
+	if !enabled {
+		log.Printf("[DEBUG] nomad service %s (%s) disabled", reg.ServiceName, reg.ID)
+		return nil
+	}
+
+	srcRegex, err := regexp.Compile(srcURL)
+	if err != nil {
+		log.Printf("[DEBUG] nomad service %s (%s) disabled, invalid src regex: %v", reg.ServiceName, reg.ID, err)
+		return nil
+	}
+	for _, srv := range strings.Split(server, ",") {
+		res = append(res, discovery.URLMapper{Server: strings.TrimSpace(srv), SrcMatch: *srcRegex, Dst: destURL,
+			PingURL: pingURL, ProviderID: discovery.PINomad, MatchType: discovery.MTProxy, KeepHost: keepHost,
+			OnlyFromIPs: onlyFrom, MetricName: reg.ServiceName})
+	}
+	return res
+}
+
+// allocRouted checks if allocation is running, and healthy if tracked by a deployment
+func (n *Nomad) allocRouted(ctx context.Context, id, namespace string) (bool, error) {
+	var alloc nomadAllocation
+	if _, err := n.get(ctx, "/v1/allocation/"+url.PathEscape(id), url.Values{"namespace": {namespace}}, &alloc); err != nil {
+		return false, err
+	}
+	if alloc.ClientStatus != "running" {
+		return false, nil
+	}
+	if alloc.DeploymentStatus == nil {
+		return true, nil // not tracked by a deployment
+	}
+	// health not reported yet for the deployment means not healthy
+	return alloc.DeploymentStatus.Healthy != nil && *alloc.DeploymentStatus.Healthy, nil
+}
+
+// waitServices makes blocking query on services list, returns when the list index changed from index or on wait
+// expiry. Zero index returns right away
+func (n *Nomad) waitServices(ctx context.Context, index uint64) (uint64, error) {
+	wait := n.WaitTime
+	if wait <= 0 {
+		wait = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait+n.timeout()) // nomad adds up to wait/16 jitter
+	defer cancel()
+	params := url.Values{"namespace": {n.namespace()}, "index": {strconv.FormatUint(index, 10)},
+		"wait": {fmt.Sprintf("%dms", wait.Milliseconds())}}
+	var stubs []nomadServiceStub
+	return n.get(ctx, "/v1/services", params, &stubs)
+}
+
+// get makes request to nomad api and decodes json response to res, returns X-Nomad-Index of the response
+func (n *Nomad) get(ctx context.Context, path string, params url.Values, res interface{}) (uint64, error) {
+	u := strings.TrimSuffix(n.Endpoint, "/") + path + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+	if err != nil {
+		return 0, fmt.Errorf("can't make nomad request: %w", err)
+	}
+	if n.Token != "" {
+		req.Header.Set("X-Nomad-Token", n.Token)
+	}
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("nomad request %s failed: %w", path, err)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("nomad request %s failed, unexpected status %s", path, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return 0, fmt.Errorf("can't parse nomad response for %s: %w", path, err)
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Nomad-Index"), 10, 64)
+	return index, nil
+}
+
+func (n *Nomad) namespace() string {
+	if n.Namespace == "" {
+		return "default"
+	}
+	return n.Namespace
+}
+
+func (n *Nomad) timeout() time.Duration {
+	if n.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return n.Timeout
+}
+
+// tagsToLabels converts reproxy.name=value tags to labels, tag without value makes label with empty value
+func tagsToLabels(tags []string) map[string]string {
+	res := map[string]string{}
+	for _, t := range tags {
+		if !strings.HasPrefix(t, "reproxy.") {
+			continue
+		}
+		k, v, _ := strings.Cut(t, "=")
+		res[k] = v
+	}
+	return res
+}
+
+func hasReproxyTag(tags []string) bool {
+	for _, t := range tags {
+		if strings.HasPrefix(t, "reproxy.") {
+			return true
+		}
+	}
+	return false
+}
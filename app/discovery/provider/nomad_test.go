@@ -0,0 +1,199 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// fakeNomad emulates nomad services and allocations api, with blocking queries on services list
+type fakeNomad struct {
+	sync.Mutex
+	regs    map[string][]nomadRegistration // service name -> registrations
+	allocs  map[string]nomadAllocation
+	index   uint64
+	changed chan struct{}
+	token   string
+}
+
+func (f *fakeNomad) register(reg nomadRegistration) {
+	f.Lock()
+	f.regs[reg.ServiceName] = append(f.regs[reg.ServiceName], reg)
+	f.index++
+	f.Unlock()
+	f.changed <- struct{}{}
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Nomad-Token") != f.token {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	if r.URL.Path == "/v1/services" && r.URL.Query().Get("index") != "" {
+		f.Lock()
+		idx := f.index
+		f.Unlock()
+		if reqIdx, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); reqIdx == idx && reqIdx > 0 {
+			select {
+			case <-f.changed:
+			case <-time.After(50 * time.Millisecond): // wait expired
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(f.index, 10))
+	switch {
+	case r.URL.Path == "/v1/services":
+		stub := nomadServiceStub{Namespace: "default"}
+		names := []string{}
+		for name := range f.regs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			stub.Services = append(stub.Services, struct {
+				ServiceName string
+				Tags        []string
+			}{ServiceName: name, Tags: f.regs[name][0].Tags})
+		}
+		_ = json.NewEncoder(w).Encode([]nomadServiceStub{stub})
+	case len(r.URL.Path) > len("/v1/service/") && r.URL.Path[:len("/v1/service/")] == "/v1/service/":
+		_ = json.NewEncoder(w).Encode(f.regs[r.URL.Path[len("/v1/service/"):]])
+	case len(r.URL.Path) > len("/v1/allocation/") && r.URL.Path[:len("/v1/allocation/")] == "/v1/allocation/":
+		alloc, ok := f.allocs[r.URL.Path[len("/v1/allocation/"):]]
+		if !ok {
+			http.Error(w, "alloc not found", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(alloc)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func newFakeNomad() *fakeNomad {
+	healthy, unhealthy := true, false
+	api := []string{"reproxy.route=^/api/(.*)", "reproxy.dest=/$1", "reproxy.server=example.com,example.org"}
+	return &fakeNomad{
+		token:   "secret",
+		changed: make(chan struct{}, 10),
+		index:   1,
+		regs: map[string][]nomadRegistration{
+			"api": {
+				{ID: "r1", ServiceName: "api", AllocID: "a1", Address: "10.0.0.1", Port: 8080, Tags: api},
+				{ID: "r2", ServiceName: "api", AllocID: "a2", Address: "10.0.0.2", Port: 8080, Tags: api},
+				{ID: "r3", ServiceName: "api", AllocID: "a3", Address: "10.0.0.3", Port: 8080, Tags: api},
+				{ID: "r4", ServiceName: "api", AllocID: "a4", Address: "10.0.0.4", Port: 8080, Tags: api},
+			},
+			"web": {{ID: "r5", ServiceName: "web", AllocID: "a1", Address: "10.0.0.1", Port: 9090,
+				Tags: []string{"reproxy.enabled=true", "reproxy.keep-host=yes"}}},
+			"db": {{ID: "r6", ServiceName: "db", AllocID: "a1", Address: "10.0.0.1", Port: 5432, Tags: []string{"postgres"}}},
+		},
+		allocs: map[string]nomadAllocation{
+			"a1": {ID: "a1", ClientStatus: "running"},
+			"a2": {ID: "a2", ClientStatus: "running", DeploymentStatus: &struct{ Healthy *bool }{Healthy: &healthy}},
+			"a3": {ID: "a3", ClientStatus: "running", DeploymentStatus: &struct{ Healthy *bool }{Healthy: &unhealthy}},
+			"a4": {ID: "a4", ClientStatus: "pending"},
+			"a5": {ID: "a5", ClientStatus: "running"},
+		},
+	}
+}
+
+func TestNomad_List(t *testing.T) {
+	fn := newFakeNomad()
+	ts := httptest.NewServer(fn)
+	defer ts.Close()
+
+	n := Nomad{Endpoint: ts.URL, Token: "secret"}
+	res, err := n.List()
+	require.NoError(t, err)
+	require.Equal(t, 5, len(res), "2 healthy api allocations on 2 servers and web")
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Server != res[j].Server {
+			return res[i].Server < res[j].Server
+		}
+		return res[i].Dst < res[j].Dst
+	})
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "^/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.1:9090/$1", res[0].Dst)
+	assert.Equal(t, "http://10.0.0.1:9090/ping", res[0].PingURL)
+	require.NotNil(t, res[0].KeepHost)
+	assert.True(t, *res[0].KeepHost)
+
+	assert.Equal(t, "example.com", res[1].Server)
+	assert.Equal(t, "^/api/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.1:8080/$1", res[1].Dst)
+	assert.Equal(t, "example.com", res[2].Server)
+	assert.Equal(t, "http://10.0.0.2:8080/$1", res[2].Dst)
+	assert.Equal(t, "example.org", res[3].Server)
+	assert.Equal(t, "example.org", res[4].Server)
+	for _, m := range res {
+		assert.Equal(t, discovery.PINomad, m.ProviderID)
+		assert.Equal(t, discovery.MTProxy, m.MatchType)
+	}
+	assert.Equal(t, discovery.PINomad, n.ID())
+}
+
+func TestNomad_ListErrors(t *testing.T) {
+	fn := newFakeNomad()
+	ts := httptest.NewServer(fn)
+	defer ts.Close()
+
+	n := Nomad{Endpoint: ts.URL, Token: "bad"}
+	_, err := n.List()
+	assert.ErrorContains(t, err, "403")
+
+	fn.regs["api"] = append(fn.regs["api"], nomadRegistration{ID: "r7", ServiceName: "api", AllocID: "gone",
+		Tags: []string{"reproxy.enabled=true"}})
+	n = Nomad{Endpoint: ts.URL, Token: "secret"}
+	_, err = n.List()
+	assert.ErrorContains(t, err, "404")
+}
+
+func TestNomad_Events(t *testing.T) {
+	fn := newFakeNomad()
+	ts := httptest.NewServer(fn)
+	defer ts.Close()
+
+	n := Nomad{Endpoint: ts.URL, Token: "secret", WaitTime: time.Minute, RetryInterval: time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ch := n.Events(ctx)
+
+	recv := func(msg string) {
+		select {
+		case pid := <-ch:
+			assert.Equal(t, discovery.PINomad, pid)
+		case <-time.After(time.Second):
+			t.Fatal(msg)
+		}
+	}
+	recv("initial update")
+
+	// scale up, new allocation registered with the same service
+	fn.register(nomadRegistration{ID: "r8", ServiceName: "api", AllocID: "a5", Address: "10.0.0.5", Port: 8080,
+		Tags: fn.regs["api"][0].Tags})
+	recv("update on registration")
+	res, err := n.List()
+	require.NoError(t, err)
+	assert.Equal(t, 7, len(res), "3 api allocations on 2 servers and web")
+
+	recv("update on wait expiry") // fake nomad wait expires after 50ms
+}
@@ -0,0 +1,275 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// Redis implements provider reading rules from a redis hash. Each hash field is <server>/<name>, and the value is
+// a json rule, the same as a single file provider's rule, i.e. HSET reproxy:routes example.com/api
+// '{"route": "^/api/(.*)", "dest": "http://127.0.0.1:8080/$1"}'. "default" server means any server (*).
+// Events subscribe to keyspace notifications of the hash, so redis should have them enabled for hash commands,
+// i.e. notify-keyspace-events Kh. Lost connection re-established after RetryInterval with a forced reload,
+// and List keeps the last good rules while redis is not available
+type Redis struct {
+	Address       string        // redis address, host:port
+	Password      string        // AUTH password, no auth if empty
+	DB            int           // database number, SELECT'ed on connect
+	Key           string        // hash with rules
+	Timeout       time.Duration // connect and request timeout, subscription is not limited
+	RetryInterval time.Duration // delay before re-subscribing after connection error
+
+	lock     sync.Mutex
+	lastGood []discovery.URLMapper
+}
+
+// ID returns provider id
+func (r *Redis) ID() discovery.ProviderID { return discovery.PIRedis }
+
+// Events returns channel updating on any change of the rules hash
+func (r *Redis) Events(ctx context.Context) <-chan discovery.ProviderID {
+	res := make(chan discovery.ProviderID)
+	go func() {
+		defer close(res)
+		for {
+			// re-list on every (re)connection, changes could be missed while the subscription was down
+			select {
+			case res <- discovery.PIRedis:
+			case <-ctx.Done():
+				return
+			}
+			err := r.subscribe(ctx, res)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("[WARN] redis subscription for %s on %s interrupted, retry in %s: %v", r.Key, r.Address, r.RetryInterval, err)
+			select {
+			case <-time.After(r.RetryInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// List returns mappers for all fields of the rules hash. Keeps the last good rules on redis errors
+func (r *Redis) List() ([]discovery.URLMapper, error) {
+	res, err := r.list()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		if r.lastGood == nil {
+			return nil, err
+		}
+		log.Printf("[WARN] can't list redis rules, keep %d last good routes: %v", len(r.lastGood), err)
+		return r.lastGood, nil
+	}
+	r.lastGood = res
+	return res, nil
+}
+
+func (r *Redis) list() ([]discovery.URLMapper, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout())
+	defer cancel()
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // nolint
+
+	fields, err := conn.do("HGETALL", r.Key)
+	if err != nil {
+		return nil, fmt.Errorf("can't get redis hash %s: %w", r.Key, err)
+	}
+	items, ok := fields.([]interface{})
+	if !ok || len(items)%2 != 0 {
+		return nil, fmt.Errorf("unexpected redis reply to HGETALL %s: %v", r.Key, fields)
+	}
+
+	conf := map[string][]ruleConf{}
+	for i := 0; i < len(items); i += 2 {
+		field, _ := items[i].(string)
+		value, _ := items[i+1].(string)
+		var rule ruleConf
+		if err = json.Unmarshal([]byte(value), &rule); err != nil {
+			log.Printf("[WARN] redis field %s skipped, can't parse rule: %v", field, err)
+			continue
+		}
+		srv := redisServer(field)
+		conf[srv] = append(conf[srv], rule)
+	}
+	return rulesToMappers(conf, discovery.PIRedis)
+}
+
+// subscribe blocks on keyspace notifications of the rules hash and sends update on each change.
+// returns error if the connection was broken
+func (r *Redis) subscribe(ctx context.Context, res chan<- discovery.ProviderID) error {
+	dialCtx, cancel := context.WithTimeout(ctx, r.timeout())
+	conn, err := r.dial(dialCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close() // unblock read on cancel
+		case <-done:
+		}
+	}()
+
+	channel := fmt.Sprintf("__keyspace@%d__:%s", r.DB, r.Key)
+	if _, err = conn.do("SUBSCRIBE", channel); err != nil {
+		return fmt.Errorf("can't subscribe to %s: %w", channel, err)
+	}
+	_ = conn.conn.SetDeadline(time.Time{}) // subscription waits for messages with no limit
+	for {
+		msg, err := conn.read()
+		if err != nil {
+			return fmt.Errorf("subscription: %w", err)
+		}
+		items, ok := msg.([]interface{})
+		if !ok || len(items) != 3 || items[0] != "message" {
+			continue
+		}
+		log.Printf("[DEBUG] redis hash %s changed, %v", r.Key, items[2])
+		select {
+		case res <- discovery.PIRedis:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// dial connects to redis, authenticates and selects the db
+func (r *Redis) dial(ctx context.Context) (*redisConn, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", r.Address)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to redis %s: %w", r.Address, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	rc := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+	if r.Password != "" {
+		if _, err = rc.do("AUTH", r.Password); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("redis auth failed: %w", err)
+		}
+	}
+	if r.DB != 0 {
+		if _, err = rc.do("SELECT", strconv.Itoa(r.DB)); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("can't select redis db %d: %w", r.DB, err)
+		}
+	}
+	return rc, nil
+}
+
+func (r *Redis) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return r.Timeout
+}
+
+// redisServer extracts server from hash field, i.e. example.com for example.com/api. Fields without server are default
+func redisServer(field string) string {
+	srv, _, found := strings.Cut(field, "/")
+	if !found || srv == "" {
+		return "default"
+	}
+	return srv
+}
+
+// redisConn is a minimal RESP client, enough for commands used by the provider
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// do sends command and reads the reply. Error replies returned as errors
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, sb.String()); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read reads a single reply: simple string, error, integer, bulk string (nil if missing) or array of replies
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2) // with trailing \r\n
+		if _, err = io.ReadFull(c.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		res := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, item)
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
+
+// Close closes the connection
+func (c *redisConn) Close() error { return c.conn.Close() }
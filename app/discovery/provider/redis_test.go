@@ -0,0 +1,224 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// fakeRedis implements RESP server with AUTH, SELECT, HGETALL and SUBSCRIBE, enough for the redis provider
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	lock  sync.Mutex
+	hash  map[string]map[string]string // key (with db) -> fields
+	subs  map[string][]net.Conn        // channel -> subscribed connections
+	conns []net.Conn
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeRedis{ln: ln, password: password, hash: map[string]map[string]string{}, subs: map[string][]net.Conn{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.lock.Lock()
+			f.conns = append(f.conns, conn)
+			f.lock.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(f.close)
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed, db := f.password == "", 0
+	for {
+		args, err := f.readCommand(rd)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "AUTH":
+			if len(args) != 2 || args[1] != f.password {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authed:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case cmd == "SELECT":
+			_, _ = fmt.Sscanf(args[1], "%d", &db)
+			fmt.Fprint(conn, "+OK\r\n")
+		case cmd == "HGETALL":
+			f.lock.Lock()
+			fields := f.hash[fmt.Sprintf("%d:%s", db, args[1])]
+			names := make([]string, 0, len(fields))
+			for name := range fields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			fmt.Fprintf(conn, "*%d\r\n", len(fields)*2)
+			for _, name := range names {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(name), name, len(fields[name]), fields[name])
+			}
+			f.lock.Unlock()
+		case cmd == "SUBSCRIBE":
+			f.lock.Lock()
+			f.subs[args[1]] = append(f.subs[args[1]], conn)
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+			f.lock.Unlock()
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+func (f *fakeRedis) readCommand(rd *bufio.Reader) ([]string, error) {
+	readLen := func(prefix string) (int, error) {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, prefix), "\r\n"))
+	}
+	n, err := readLen("*")
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readLen("$")
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// hset sets the field and notifies keyspace subscribers, like redis with notify-keyspace-events Kh
+func (f *fakeRedis) hset(db int, key, field, value string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	k := fmt.Sprintf("%d:%s", db, key)
+	if f.hash[k] == nil {
+		f.hash[k] = map[string]string{}
+	}
+	f.hash[k][field] = value
+	channel := fmt.Sprintf("__keyspace@%d__:%s", db, key)
+	for _, conn := range f.subs[channel] {
+		fmt.Fprintf(conn, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$4\r\nhset\r\n", len(channel), channel)
+	}
+}
+
+// dropConns closes all client connections, like redis restart
+func (f *fakeRedis) dropConns() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, conn := range f.conns {
+		_ = conn.Close()
+	}
+	f.conns = nil
+	f.subs = map[string][]net.Conn{}
+}
+
+func (f *fakeRedis) close() {
+	_ = f.ln.Close()
+	f.dropConns()
+}
+
+func TestRedis_List(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	f.hset(2, "reproxy:routes", "default/api", `{"route": "^/api/(.*)", "dest": "http://127.0.0.1:8080/$1", "ping": "http://127.0.0.1:8080/ping"}`)
+	f.hset(2, "reproxy:routes", "example.com/w", `{"route": "/web", "dest": "/var/www", "assets": true}`)
+	f.hset(2, "reproxy:routes", "bad", `{bad json`)
+	f.hset(0, "reproxy:routes", "default/other", `{"route": "^/other/(.*)", "dest": "http://127.0.0.1:8080/$1"}`)
+
+	r := Redis{Address: f.ln.Addr().String(), Password: "secret", DB: 2, Key: "reproxy:routes"}
+	res, err := r.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].Server < res[j].Server })
+
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.1:8080/$1", res[0].Dst)
+	assert.Equal(t, "http://127.0.0.1:8080/ping", res[0].PingURL)
+	assert.Equal(t, discovery.PIRedis, res[0].ProviderID)
+	assert.Equal(t, discovery.MTProxy, res[0].MatchType)
+
+	assert.Equal(t, "example.com", res[1].Server)
+	assert.Equal(t, "/web", res[1].SrcMatch.String())
+	assert.Equal(t, discovery.MTStatic, res[1].MatchType)
+
+	f.close()
+	res, err = r.List()
+	require.NoError(t, err, "last good kept on connection loss")
+	assert.Equal(t, 2, len(res))
+
+	r = Redis{Address: f.ln.Addr().String(), Key: "reproxy:routes", Timeout: 100 * time.Millisecond}
+	_, err = r.List()
+	require.Error(t, err, "no last good")
+
+	f = newFakeRedis(t, "secret")
+	r = Redis{Address: f.ln.Addr().String(), Password: "bad", Key: "reproxy:routes"}
+	_, err = r.List()
+	require.EqualError(t, err, "redis auth failed: WRONGPASS invalid password")
+}
+
+func TestRedis_Events(t *testing.T) {
+	f := newFakeRedis(t, "")
+	r := Redis{Address: f.ln.Addr().String(), DB: 1, Key: "reproxy:routes", RetryInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ch := r.Events(ctx)
+
+	subscribed := func() bool {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		return len(f.subs["__keyspace@1__:reproxy:routes"]) == 1
+	}
+
+	assert.Equal(t, discovery.PIRedis, <-ch, "initial list")
+	require.Eventually(t, subscribed, time.Second, 5*time.Millisecond)
+	f.hset(1, "reproxy:routes", "default/api", `{"route": "^/api/(.*)", "dest": "http://127.0.0.1:8080/$1"}`)
+	assert.Equal(t, discovery.PIRedis, <-ch, "hash changed")
+
+	f.dropConns()
+	assert.Equal(t, discovery.PIRedis, <-ch, "re-list after reconnect")
+	require.Eventually(t, subscribed, time.Second, 5*time.Millisecond)
+	f.hset(1, "reproxy:routes", "default/api2", `{"route": "^/api2/(.*)", "dest": "http://127.0.0.1:8080/$1"}`)
+	assert.Equal(t, discovery.PIRedis, <-ch, "hash changed after reconnect")
+
+	cancel()
+	for range ch { // closed on context cancel
+	}
+}
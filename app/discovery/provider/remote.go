@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// Remote implements provider pulling rules from a remote http endpoint. The endpoint returns json with the same
+// structure as file provider's yaml, i.e. {"default": [{"route": "^/api/(.*)", "dest": "http://127.0.0.1:8080/$1"}]}
+// Endpoint polled every CheckInterval with ETag and Last-Modified validators, rules reloaded on change only.
+// Failed requests, non-200 responses and malformed payloads logged and the last good rules kept.
+type Remote struct {
+	URL           string
+	CheckInterval time.Duration
+	Client        *http.Client
+
+	lock         sync.RWMutex
+	mappers      []discovery.URLMapper
+	etag         string
+	lastModified string
+}
+
+// ID returns provider id
+func (r *Remote) ID() discovery.ProviderID { return discovery.PIRemote }
+
+// Events returns channel updating on remote rules change only
+func (r *Remote) Events(ctx context.Context) <-chan discovery.ProviderID {
+	res := make(chan discovery.ProviderID)
+	go func() {
+		tk := time.NewTicker(r.CheckInterval)
+		defer tk.Stop()
+		for {
+			changed, err := r.fetch(ctx)
+			if err != nil {
+				log.Printf("[WARN] can't get remote rules from %s, keep the last good rules: %v", r.URL, err)
+			}
+			if changed {
+				select {
+				case res <- discovery.PIRemote:
+				case <-ctx.Done():
+				}
+			}
+
+			select {
+			case <-tk.C:
+			case <-ctx.Done():
+				close(res)
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// List returns the last good rules
+func (r *Remote) List() (res []discovery.URLMapper, err error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	res = make([]discovery.URLMapper, len(r.mappers))
+	copy(res, r.mappers)
+	return res, nil
+}
+
+// fetch gets rules from the remote endpoint, returns true if rules updated
+func (r *Remote) fetch(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL, http.NoBody)
+	if err != nil {
+		return false, fmt.Errorf("can't make request: %w", err)
+	}
+	r.lock.RLock()
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	if r.lastModified != "" {
+		req.Header.Set("If-Modified-Since", r.lastModified)
+	}
+	r.lock.RUnlock()
+
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var conf map[string][]ruleConf
+	if err = json.NewDecoder(resp.Body).Decode(&conf); err != nil {
+		return false, fmt.Errorf("can't parse rules: %w", err)
+	}
+	mappers, err := rulesToMappers(conf, discovery.PIRemote)
+	if err != nil {
+		return false, err
+	}
+
+	r.lock.Lock()
+	r.mappers = mappers
+	r.etag, r.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	r.lock.Unlock()
+	log.Printf("[DEBUG] remote rules from %s updated, %d rules", r.URL, len(mappers))
+	return true, nil
+}
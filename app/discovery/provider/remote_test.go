@@ -0,0 +1,95 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestRemote_Events(t *testing.T) {
+	var version, calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		etag := `"v` + strconv.Itoa(int(atomic.LoadInt32(&version))) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(`{"default": [{"route": "^/api/(.*)", "dest": "http://127.0.0.1:8080/$1"}]}`))
+	}))
+	defer ts.Close()
+
+	r := Remote{URL: ts.URL, CheckInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	ch := r.Events(ctx)
+
+	events := 0
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		atomic.AddInt32(&version, 1) // change the rules
+	}()
+	for range ch {
+		events++
+	}
+	assert.Equal(t, 2, events, "initial load and a single change")
+	assert.Greater(t, atomic.LoadInt32(&calls), int32(10))
+}
+
+func TestRemote_List(t *testing.T) {
+	var status int32 = http.StatusOK
+	var body atomic.Value
+	body.Store(`{"default": [{"route": "^/api/(.*)", "dest": "http://127.0.0.1:8080/$1", "ping": "http://127.0.0.1:8080/ping"}],
+		"example.com": [{"route": "/web", "dest": "/var/www", "assets": true}]}`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer ts.Close()
+
+	r := Remote{URL: ts.URL, Client: ts.Client()}
+	changed, err := r.fetch(context.Background())
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	check := func() {
+		res, err := r.List()
+		require.NoError(t, err)
+		require.Equal(t, 2, len(res))
+		assert.Equal(t, "example.com", res[0].Server)
+		assert.Equal(t, "/web", res[0].SrcMatch.String())
+		assert.Equal(t, discovery.MTStatic, res[0].MatchType)
+		assert.Equal(t, "*", res[1].Server)
+		assert.Equal(t, "^/api/(.*)", res[1].SrcMatch.String())
+		assert.Equal(t, "http://127.0.0.1:8080/$1", res[1].Dst)
+		assert.Equal(t, "http://127.0.0.1:8080/ping", res[1].PingURL)
+		assert.Equal(t, discovery.PIRemote, res[1].ProviderID)
+	}
+	check()
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	_, err = r.fetch(context.Background())
+	assert.Error(t, err)
+	check() // last good rules kept
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	body.Store(`{"default": [{"route": "^/api/(.*)"`)
+	_, err = r.fetch(context.Background())
+	assert.Error(t, err)
+	check()
+
+	body.Store(`{"default": [{"route": "^/api/(.*", "dest": "http://127.0.0.1:8080/$1"}]}`) // bad regex
+	_, err = r.fetch(context.Background())
+	assert.Error(t, err)
+	check()
+}
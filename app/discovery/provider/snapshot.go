@@ -0,0 +1,48 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// Snapshot provider serves the frozen routes table from snapshot file written by discovery.WriteSnapshot,
+// bypassing live discovery. Routes keep the providers they were discovered by, and never expire
+type Snapshot struct {
+	FileName string
+}
+
+// ID returns provider id
+func (s *Snapshot) ID() discovery.ProviderID { return discovery.PISnapshot }
+
+// Events returns channel updating once, snapshot doesn't change
+func (s *Snapshot) Events(_ context.Context) <-chan discovery.ProviderID {
+	res := make(chan discovery.ProviderID, 1)
+	res <- discovery.PISnapshot
+	return res
+}
+
+// List returns all mappers of the snapshot
+func (s *Snapshot) List() ([]discovery.URLMapper, error) {
+	fh, err := os.Open(s.FileName)
+	if err != nil {
+		return nil, fmt.Errorf("can't open snapshot %s: %w", s.FileName, err)
+	}
+	defer fh.Close() // nolint
+
+	snap, err := discovery.ReadSnapshot(fh)
+	if err != nil {
+		return nil, fmt.Errorf("can't load snapshot %s: %w", s.FileName, err)
+	}
+	for i := range snap.Mappers {
+		snap.Mappers[i].TTL, snap.Mappers[i].LastSeen = 0, time.Time{} // frozen routes, nothing to refresh them
+	}
+	log.Printf("[INFO] loaded %d routes from snapshot %s, created %s", len(snap.Mappers), s.FileName,
+		snap.Created.Format(time.RFC3339))
+	return snap.Mappers, nil
+}
@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestSnapshot_List(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "routes.json")
+	fh, err := os.Create(fname)
+	require.NoError(t, err)
+	err = discovery.WriteSnapshot(fh, []discovery.URLMapper{
+		{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+			ProviderID: discovery.PIDocker, MatchType: discovery.MTProxy, MaxConn: 10,
+			TTL: time.Minute, LastSeen: time.Now().Add(-time.Hour)},
+	})
+	require.NoError(t, err)
+	require.NoError(t, fh.Close())
+
+	s := Snapshot{FileName: fname}
+	assert.Equal(t, discovery.PISnapshot, <-s.Events(context.Background()))
+	res, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, discovery.PIDocker, res[0].ProviderID, "original provider kept")
+	assert.Equal(t, 10, res[0].MaxConn)
+	assert.Equal(t, time.Duration(0), res[0].TTL, "snapshot routes never expire")
+
+	s = Snapshot{FileName: "/no-such-file.json"}
+	_, err = s.List()
+	require.Error(t, err)
+}
@@ -0,0 +1,238 @@
+package provider
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// SQL implements provider reading routes from a database table, i.e. sqlite. Works with any database/sql driver
+// registered in the binary. Each row makes a route, with the same fields as file provider rules:
+//
+//	server TEXT, route TEXT, dest TEXT, updated_at - required. "default" or empty server means any (*)
+//	ping TEXT, assets BOOL, spa BOOL, keep_host BOOL, remote TEXT - optional, used if the column exists
+//
+// Changes detected by polling rows count and max(updated_at), so updating a row should update its updated_at.
+// Malformed rows skipped with a warning, the rest of the table still routed
+type SQL struct {
+	DB            *sql.DB
+	Table         string        // routes table, "routes" by default
+	CheckInterval time.Duration // how often the table checked for changes
+	Timeout       time.Duration // query timeout
+}
+
+var (
+	reSQLName       = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	sqlRequiredCols = []string{"server", "route", "dest", "updated_at"}
+	sqlOptionalCols = []string{"ping", "assets", "spa", "keep_host", "remote"}
+)
+
+// ID returns provider id
+func (s *SQL) ID() discovery.ProviderID { return discovery.PISQL }
+
+// Events returns channel updating on table changes, the first check always sends update
+func (s *SQL) Events(ctx context.Context) <-chan discovery.ProviderID {
+	res := make(chan discovery.ProviderID)
+	go func() {
+		defer close(res)
+		interval := s.CheckInterval
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		tk := time.NewTicker(interval)
+		defer tk.Stop()
+
+		lastState := ""
+		for {
+			state, err := s.state(ctx)
+			switch {
+			case err != nil:
+				log.Printf("[WARN] can't check routes table %s, %v", s.table(), err)
+			case state != lastState:
+				log.Printf("[DEBUG] routes table %s changed, %s -> %s", s.table(), lastState, state)
+				select {
+				case res <- discovery.PISQL:
+					lastState = state
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-tk.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// List returns mappers for all valid rows of the routes table
+func (s *SQL) List() (res []discovery.URLMapper, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout())
+	defer cancel()
+
+	cols, err := s.columns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// column names validated and table name checked by columns, safe to build the query
+	rows, err := s.DB.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", strings.Join(cols, ", "), s.table())) // nolint gosec
+	if err != nil {
+		return nil, fmt.Errorf("can't query routes table %s: %w", s.table(), err)
+	}
+	defer rows.Close() // nolint
+
+	for n := 1; rows.Next(); n++ {
+		vals := make([]sql.NullString, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range vals {
+			dest[i] = &vals[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			log.Printf("[WARN] routes table %s, row %d skipped, %v", s.table(), n, err)
+			continue
+		}
+		row := map[string]sql.NullString{}
+		for i, c := range cols {
+			row[c] = vals[i]
+		}
+		m, err := s.mapper(row)
+		if err != nil {
+			log.Printf("[WARN] routes table %s, row %d skipped, %v", s.table(), n, err)
+			continue
+		}
+		res = append(res, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("can't read routes table %s: %w", s.table(), err)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return len(res[i].Server) > len(res[j].Server)
+	})
+	return res, nil
+}
+
+// mapper makes mapper from the row values by column names
+func (s *SQL) mapper(row map[string]sql.NullString) (discovery.URLMapper, error) {
+	if row["route"].String == "" || row["dest"].String == "" {
+		return discovery.URLMapper{}, fmt.Errorf("empty route or dest")
+	}
+	rx, err := regexp.Compile(row["route"].String)
+	if err != nil {
+		return discovery.URLMapper{}, fmt.Errorf("can't parse regex %s: %w", row["route"].String, err)
+	}
+	server := strings.TrimSpace(row["server"].String)
+	if server == "" || server == "default" {
+		server = "*"
+	}
+	assets, err := sqlBool(row["assets"])
+	if err != nil {
+		return discovery.URLMapper{}, fmt.Errorf("invalid assets: %w", err)
+	}
+	spa, err := sqlBool(row["spa"])
+	if err != nil {
+		return discovery.URLMapper{}, fmt.Errorf("invalid spa: %w", err)
+	}
+
+	m := discovery.URLMapper{Server: server, SrcMatch: *rx, Dst: row["dest"].String, PingURL: row["ping"].String,
+		ProviderID: discovery.PISQL, MatchType: discovery.MTProxy, OnlyFromIPs: discovery.ParseOnlyFrom(row["remote"].String)}
+	if v := row["keep_host"]; v.Valid { // null keep_host means the global keep-host setting
+		keepHost, err := sqlBool(v)
+		if err != nil {
+			return discovery.URLMapper{}, fmt.Errorf("invalid keep_host: %w", err)
+		}
+		m.KeepHost = &keepHost
+	}
+	if assets || spa {
+		m.MatchType = discovery.MTStatic
+		m.AssetsSPA = spa
+	}
+	return m, nil
+}
+
+// columns returns columns of the routes table to select, required and existing optional ones.
+// Fails if the table has no required columns
+func (s *SQL) columns(ctx context.Context) ([]string, error) {
+	if !reSQLName.MatchString(s.table()) {
+		return nil, fmt.Errorf("invalid routes table name %q", s.table())
+	}
+	rows, err := s.DB.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s LIMIT 0", s.table())) // nolint gosec
+	if err != nil {
+		return nil, fmt.Errorf("can't query routes table %s: %w", s.table(), err)
+	}
+	defer rows.Close() // nolint
+	tableCols, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("can't get columns of routes table %s: %w", s.table(), err)
+	}
+	exists := map[string]bool{}
+	for _, c := range tableCols {
+		exists[strings.ToLower(c)] = true
+	}
+
+	res := make([]string, 0, len(sqlRequiredCols)+len(sqlOptionalCols))
+	for _, c := range sqlRequiredCols {
+		if !exists[c] {
+			return nil, fmt.Errorf("routes table %s has no required column %s", s.table(), c)
+		}
+		res = append(res, c)
+	}
+	for _, c := range sqlOptionalCols {
+		if exists[c] {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+// state returns rows count and max updated_at of the routes table, changed on any insert, delete or update
+func (s *SQL) state(ctx context.Context) (string, error) {
+	if !reSQLName.MatchString(s.table()) {
+		return "", fmt.Errorf("invalid routes table name %q", s.table())
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout())
+	defer cancel()
+	var count int64
+	var updated sql.NullString
+	q := fmt.Sprintf("SELECT COUNT(*), MAX(updated_at) FROM %s", s.table()) // nolint gosec
+	if err := s.DB.QueryRowContext(ctx, q).Scan(&count, &updated); err != nil {
+		return "", fmt.Errorf("can't query routes table state: %w", err)
+	}
+	return fmt.Sprintf("%d:%s", count, updated.String), nil
+}
+
+func (s *SQL) table() string {
+	if s.Table == "" {
+		return "routes"
+	}
+	return s.Table
+}
+
+func (s *SQL) timeout() time.Duration {
+	if s.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return s.Timeout
+}
+
+// sqlBool converts nullable column value to bool, null and empty value mean false
+func sqlBool(v sql.NullString) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(v.String)) {
+	case "", "0", "false", "no", "f":
+		return false, nil
+	case "1", "true", "yes", "t":
+		return true, nil
+	default:
+		return false, fmt.Errorf("not a bool value %q", v.String)
+	}
+}
@@ -0,0 +1,281 @@
+package provider
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestSQL_List(t *testing.T) {
+	db, _ := newFakeDB(t, "routes", []string{"server", "route", "dest", "ping", "keep_host", "assets", "updated_at"},
+		[][]driver.Value{
+			{"example.com", "^/api/(.*)", "http://127.0.0.1:8080/$1", "http://127.0.0.1:8080/ping", nil, nil, int64(1)},
+			{"default", "^/web/(.*)", "http://127.0.0.2:8080/$1", "", "true", "0", int64(2)},
+			{"", "/static", "/srv/static", "", "0", "1", int64(3)},
+			{"example.com", "^/bad/(.*", "http://127.0.0.3:8080/$1", "", nil, nil, int64(4)}, // invalid regex
+			{"example.com", "^/nodest/(.*)", "", "", nil, nil, int64(5)},                     // no dest
+			{"example.com", "^/badbool/(.*)", "http://127.0.0.4:8080/$1", "", "maybe", nil, int64(6)},
+		})
+
+	p := SQL{DB: db}
+	res, err := p.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res), "malformed rows skipped")
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+
+	assert.Equal(t, "/static", res[0].SrcMatch.String())
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, discovery.MTStatic, res[0].MatchType)
+	require.NotNil(t, res[0].KeepHost)
+	assert.False(t, *res[0].KeepHost)
+
+	assert.Equal(t, "^/api/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "example.com", res[1].Server)
+	assert.Equal(t, "http://127.0.0.1:8080/$1", res[1].Dst)
+	assert.Equal(t, "http://127.0.0.1:8080/ping", res[1].PingURL)
+	assert.Equal(t, discovery.MTProxy, res[1].MatchType)
+	assert.Nil(t, res[1].KeepHost, "null keep_host")
+
+	assert.Equal(t, "^/web/(.*)", res[2].SrcMatch.String())
+	assert.Equal(t, "*", res[2].Server)
+	require.NotNil(t, res[2].KeepHost)
+	assert.True(t, *res[2].KeepHost)
+	for _, m := range res {
+		assert.Equal(t, discovery.PISQL, m.ProviderID)
+	}
+	assert.Equal(t, discovery.PISQL, p.ID())
+}
+
+func TestSQL_ListSchema(t *testing.T) {
+	db, _ := newFakeDB(t, "rules", []string{"server", "route", "dest", "updated_at"},
+		[][]driver.Value{{"*", "^/api/(.*)", "http://127.0.0.1:8080/$1", "2024-01-01 10:00:00"}})
+	res, err := (&SQL{DB: db, Table: "rules"}).List()
+	require.NoError(t, err, "optional columns skipped")
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "http://127.0.0.1:8080/$1", res[0].Dst)
+
+	_, err = (&SQL{DB: db}).List()
+	assert.ErrorContains(t, err, "no such table routes")
+
+	_, err = (&SQL{DB: db, Table: "rules; DROP TABLE rules"}).List()
+	assert.ErrorContains(t, err, "invalid routes table name")
+
+	db, _ = newFakeDB(t, "routes", []string{"server", "route", "updated_at"}, nil)
+	_, err = (&SQL{DB: db}).List()
+	assert.ErrorContains(t, err, "has no required column dest")
+}
+
+func TestSQL_Events(t *testing.T) {
+	db, tbl := newFakeDB(t, "routes", []string{"server", "route", "dest", "updated_at"},
+		[][]driver.Value{{"*", "^/api/(.*)", "http://127.0.0.1:8080/$1", int64(1)}})
+	p := SQL{DB: db, CheckInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ch := p.Events(ctx)
+
+	recv := func(msg string) {
+		select {
+		case pid := <-ch:
+			assert.Equal(t, discovery.PISQL, pid)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal(msg)
+		}
+	}
+	noRecv := func(msg string) {
+		select {
+		case <-ch:
+			t.Fatal(msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	recv("initial update")
+	noRecv("no changes")
+
+	fakeDBs.Lock()
+	tbl.rows[0][3] = int64(2)
+	fakeDBs.Unlock()
+	recv("row updated")
+	noRecv("no changes after update")
+
+	fakeDBs.Lock()
+	tbl.rows = nil
+	fakeDBs.Unlock()
+	recv("row deleted")
+}
+
+func TestSQL_Sqlite(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "routes.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE routes (
+		server TEXT NOT NULL DEFAULT '*', route TEXT NOT NULL, dest TEXT NOT NULL, ping TEXT,
+		assets BOOLEAN, spa BOOLEAN, keep_host BOOLEAN, remote TEXT,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO routes (server, route, dest, ping, keep_host) VALUES
+		('example.com', '^/api/(.*)', 'http://127.0.0.1:8080/$1', 'http://127.0.0.1:8080/ping', true),
+		('default', '^/web/(.*)', 'http://127.0.0.2:8080/$1', NULL, NULL)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO routes (route, dest, assets) VALUES ('/static', '/srv/static', 1)`)
+	require.NoError(t, err)
+
+	p := SQL{DB: db, CheckInterval: 10 * time.Millisecond}
+	res, err := p.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].SrcMatch.String() < res[j].SrcMatch.String() })
+	assert.Equal(t, "/static", res[0].SrcMatch.String())
+	assert.Equal(t, discovery.MTStatic, res[0].MatchType)
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "^/api/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.1:8080/ping", res[1].PingURL)
+	require.NotNil(t, res[1].KeepHost)
+	assert.True(t, *res[1].KeepHost)
+	assert.Equal(t, "*", res[2].Server)
+	assert.Nil(t, res[2].KeepHost)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ch := p.Events(ctx)
+	recv := func(msg string) {
+		select {
+		case <-ch:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal(msg)
+		}
+	}
+	recv("initial update")
+	_, err = db.Exec(`DELETE FROM routes WHERE route = '/static'`)
+	require.NoError(t, err)
+	recv("row deleted")
+}
+
+// fake database/sql driver with a single table per dsn, supports only queries made by SQL provider
+
+type fakeTable struct {
+	name string
+	cols []string
+	rows [][]driver.Value
+}
+
+type fakeStore struct {
+	sync.Mutex
+	tables map[string]*fakeTable // dsn -> table
+}
+
+var fakeDBs = &fakeStore{tables: map[string]*fakeTable{}}
+
+func init() { sql.Register("reproxy-fake", fakeDriver{}) }
+
+// newFakeDB makes db with the given table, the table can be changed under fakeDBs lock
+func newFakeDB(t *testing.T, name string, cols []string, rows [][]driver.Value) (*sql.DB, *fakeTable) {
+	dsn := fmt.Sprintf("%s-%s-%d", t.Name(), name, time.Now().UnixNano())
+	tbl := &fakeTable{name: name, cols: cols, rows: rows}
+	fakeDBs.Lock()
+	fakeDBs.tables[dsn] = tbl
+	fakeDBs.Unlock()
+	db, err := sql.Open("reproxy-fake", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db, tbl
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) { return &fakeConn{dsn: dsn}, nil }
+
+type fakeConn struct{ dsn string }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{dsn: c.dsn, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakeStmt struct{ dsn, query string }
+
+var reFakeSelect = regexp.MustCompile(`^SELECT (.+) FROM (\S+)( LIMIT 0)?$`)
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+	m := reFakeSelect.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("unsupported query %q", s.query)
+	}
+	tbl := fakeDBs.tables[s.dsn]
+	if tbl == nil || tbl.name != m[2] {
+		return nil, fmt.Errorf("no such table %s", m[2])
+	}
+	colIdx := map[string]int{}
+	for i, c := range tbl.cols {
+		colIdx[c] = i
+	}
+
+	switch {
+	case m[1] == "*": // columns only, LIMIT 0
+		return &fakeRows{cols: tbl.cols}, nil
+	case m[1] == "COUNT(*), MAX(updated_at)":
+		var maxUpd driver.Value
+		for _, r := range tbl.rows {
+			if v := r[colIdx["updated_at"]]; maxUpd == nil || fmt.Sprint(v) > fmt.Sprint(maxUpd) {
+				maxUpd = v
+			}
+		}
+		return &fakeRows{cols: []string{"count", "max"}, rows: [][]driver.Value{{int64(len(tbl.rows)), maxUpd}}}, nil
+	}
+
+	cols := strings.Split(m[1], ", ")
+	res := &fakeRows{cols: cols}
+	for _, r := range tbl.rows {
+		row := make([]driver.Value, len(cols))
+		for i, c := range cols {
+			idx, ok := colIdx[c]
+			if !ok {
+				return nil, fmt.Errorf("no such column %s", c)
+			}
+			row[i] = r[idx]
+		}
+		res.rows = append(res.rows, row)
+	}
+	return res, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -14,6 +14,9 @@ type Static struct {
 	Rules []string // each rule is 4 elements comma separated - server,source_url,destination,ping
 }
 
+// ID returns provider id
+func (s *Static) ID() discovery.ProviderID { return discovery.PIStatic }
+
 // Events returns channel updating once
 func (s *Static) Events(_ context.Context) <-chan discovery.ProviderID {
 	res := make(chan discovery.ProviderID, 1)
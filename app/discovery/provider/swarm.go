@@ -0,0 +1,147 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// swarmClient implements DockerClient for docker swarm mode. Each running task of a service reported as a container
+// named after the service and labeled with service labels. This way all replicas of the service make the same routes
+// with different destinations, and scaling the service adds destinations to the same logical route.
+type swarmClient struct {
+	client  http.Client
+	network string // network for IP selection
+	version string // api version, path prefix of requests, i.e. v1.24
+}
+
+// NewSwarmClient constructs docker client listing running swarm tasks for given host and network
+func NewSwarmClient(host, network string) DockerClient {
+	return &swarmClient{client: dockerHTTPClient(host, 0), network: network, version: defaultDockerAPIVersion}
+}
+
+// NewSwarmClientVersion constructs swarm client pinned to the api version, see NewDockerClientVersion
+func NewSwarmClientVersion(host, network, version string, dnsTTL time.Duration) (DockerClient, error) {
+	client := dockerHTTPClient(host, dnsTTL)
+	ver, err := checkDockerVersion(client, host, version)
+	if err != nil {
+		return nil, err
+	}
+	return &swarmClient{client: client, network: network, version: ver}, nil
+}
+
+type swarmService struct {
+	ID   string
+	Spec struct {
+		Name         string
+		Labels       map[string]string
+		EndpointSpec struct {
+			Ports []struct{ TargetPort int }
+		}
+	}
+	Endpoint struct {
+		VirtualIPs []struct { // set for services with vip endpoint mode, one for each attached network
+			NetworkID string
+			Addr      string
+		}
+	}
+}
+
+type swarmTask struct {
+	ID        string
+	ServiceID string
+	CreatedAt time.Time
+	Status    struct {
+		State string
+	}
+	NetworksAttachments []struct {
+		Network struct {
+			ID   string
+			Spec struct{ Name string }
+		}
+		Addresses []string
+	}
+}
+
+// ListContainers returns running tasks of all services as containers
+func (s *swarmClient) ListContainers() ([]containerInfo, error) {
+	var services []swarmService
+	if err := s.get("/services", nil, &services); err != nil {
+		return nil, err
+	}
+	byID := make(map[string]swarmService, len(services))
+	for _, svc := range services {
+		byID[svc.ID] = svc
+	}
+
+	var tasks []swarmTask
+	filters := url.Values{"filters": []string{`{"desired-state":["running"]}`}}
+	if err := s.get("/tasks", filters, &tasks); err != nil {
+		return nil, err
+	}
+
+	res := make([]containerInfo, 0, len(tasks))
+	for _, t := range tasks {
+		svc, ok := byID[t.ServiceID]
+		if !ok || t.Status.State != "running" {
+			continue
+		}
+		c := containerInfo{ID: t.ID, Name: svc.Spec.Name, State: t.Status.State, Labels: svc.Spec.Labels, TS: t.CreatedAt}
+		for _, na := range t.NetworksAttachments {
+			if len(na.Addresses) == 0 || (s.network != "" && na.Network.Spec.Name != s.network) {
+				continue
+			}
+			c.IP = strings.Split(na.Addresses[0], "/")[0] // address has cidr suffix, i.e. 10.0.1.5/24
+			c.VIP = s.serviceVIP(svc, na.Network.ID)
+			break
+		}
+		for _, p := range svc.Spec.EndpointSpec.Ports {
+			c.Ports = append(c.Ports, p.TargetPort)
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// serviceVIP returns virtual ip of the service on the network, empty if the service has no vip on it
+func (s *swarmClient) serviceVIP(svc swarmService, networkID string) string {
+	if networkID == "" {
+		return ""
+	}
+	for _, vip := range svc.Endpoint.VirtualIPs {
+		if vip.NetworkID == networkID {
+			return strings.Split(vip.Addr, "/")[0]
+		}
+	}
+	return ""
+}
+
+func (s *swarmClient) get(path string, query url.Values, res interface{}) error {
+	u := fmt.Sprintf("http://localhost/%s%s", s.version, path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	resp, err := s.client.Get(u)
+	if err != nil {
+		return fmt.Errorf("failed connection to docker socket: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+
+	if resp.StatusCode != http.StatusOK {
+		e := struct {
+			Message string `json:"message"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+			return fmt.Errorf("failed to parse error from docker daemon: %w", err)
+		}
+		return fmt.Errorf("unexpected error from docker daemon: %s", e.Message)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("failed to parse %s response from docker daemon: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarmClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.24/services":
+			resp, err := os.ReadFile("testdata/swarm_services.json")
+			require.NoError(t, err)
+			_, _ = w.Write(resp)
+		case "/v1.24/tasks":
+			assert.Equal(t, `{"desired-state":["running"]}`, r.URL.Query().Get("filters"))
+			resp, err := os.ReadFile("testdata/swarm_tasks.json")
+			require.NoError(t, err)
+			_, _ = w.Write(resp)
+		default:
+			t.Fatalf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+	addr := fmt.Sprintf("tcp://%s", strings.TrimPrefix(srv.URL, "http://"))
+
+	client := NewSwarmClient(addr, "backend")
+	c, err := client.ListContainers()
+	require.NoError(t, err)
+	require.Len(t, c, 3, "starting task skipped")
+
+	assert.Equal(t, "0kzzo1i0y4jz6027t0k7aezc7", c[0].ID)
+	assert.Equal(t, "api", c[0].Name)
+	assert.Equal(t, "running", c[0].State)
+	assert.Equal(t, "10.0.1.5", c[0].IP, "backend network address")
+	assert.Equal(t, "10.0.1.2", c[0].VIP, "service vip on backend network")
+	assert.Equal(t, []int{8080}, c[0].Ports)
+	assert.Equal(t, "^/api/(.*)", c[0].Labels["reproxy.route"])
+	assert.Equal(t, time.Date(2021, 5, 1, 10, 0, 1, 0, time.UTC), c[0].TS)
+
+	assert.Equal(t, "api", c[1].Name)
+	assert.Equal(t, "10.0.1.6", c[1].IP)
+
+	assert.Equal(t, "worker", c[2].Name)
+	assert.Empty(t, c[2].IP)
+
+	// replicas make a single logical route with multiple destinations
+	d := Docker{DockerClient: client}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	sort.Slice(res, func(i, j int) bool { return res[i].Dst < res[j].Dst })
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://10.0.1.5:8080/$1", res[0].Dst)
+	assert.Equal(t, "^/api/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://10.0.1.6:8080/$1", res[1].Dst)
+
+	// with service vip replicas routed once, to the vip
+	d = Docker{DockerClient: client, UseServiceVIP: true}
+	res, err = d.List()
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://10.0.1.2:8080/$1", res[0].Dst)
+}
+
+func TestDocker_ListServiceVIP(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				{ID: "t1", Name: "api", State: "running", IP: "10.0.1.5", VIP: "10.0.1.2", Ports: []int{8080}},
+				{ID: "t2", Name: "api", State: "running", IP: "10.0.1.6", VIP: "10.0.1.2", Ports: []int{8080}},
+				{ID: "t3", Name: "web", State: "running", IP: "10.0.1.7", Ports: []int{8080}},
+				{ID: "t4", Name: "web", State: "running", IP: "10.0.1.8", Ports: []int{8080}},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient, AutoAPI: true, UseServiceVIP: true}
+	res, err := d.List()
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	sort.Slice(res, func(i, j int) bool { return res[i].Dst < res[j].Dst })
+	assert.Equal(t, "http://10.0.1.2:8080/$1", res[0].Dst, "vip instead of replicas")
+	assert.Equal(t, "http://10.0.1.7:8080/$1", res[1].Dst, "no vip, per replica")
+	assert.Equal(t, "http://10.0.1.8:8080/$1", res[2].Dst)
+}
+
+func TestSwarmClient_error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "This node is not a swarm manager."}`, http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	addr := fmt.Sprintf("tcp://%s", strings.TrimPrefix(srv.URL, "http://"))
+
+	client := NewSwarmClient(addr, "")
+	_, err := client.ListContainers()
+	require.EqualError(t, err, "unexpected error from docker daemon: This node is not a swarm manager.")
+}
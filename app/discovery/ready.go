@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// readyServable checks if the mapper passed its readiness probe, mappers without ReadyURL always servable.
+// should be called under lock
+func (s *Service) readyServable(m URLMapper) bool {
+	return m.ReadyURL == "" || s.ready[m.ReadyURL]
+}
+
+// updateReady drops readiness of urls not used by mappers anymore, so the recreated container has to pass
+// the probe again. should be called under lock
+func (s *Service) updateReady(mappers []URLMapper) {
+	urls := map[string]bool{}
+	for _, m := range mappers {
+		if m.ReadyURL != "" {
+			urls[m.ReadyURL] = true
+		}
+	}
+	for u := range s.ready {
+		if !urls[u] {
+			delete(s.ready, u)
+		}
+	}
+}
+
+// readinessLoop probes not yet ready mappers and warms up ready ones every ReadyInterval, 1s by default
+func (s *Service) readinessLoop(ctx context.Context) {
+	interval := s.ReadyInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkReadiness()
+			s.checkWarmups(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkReadiness probes readiness urls of mappers not ready yet. Once passed, the url stays ready while
+// mappers with it exist, liveness of ready mappers is up to the health check
+func (s *Service) checkReadiness() {
+	s.lock.RLock()
+	targets := map[string]URLMapper{} // unique readiness urls
+	for _, mappers := range s.mappers {
+		for _, m := range mappers {
+			if m.ReadyURL != "" && !s.ready[m.ReadyURL] {
+				targets[m.ReadyURL] = m
+			}
+		}
+	}
+	s.lock.RUnlock()
+
+	const concurrent = 8
+	sema := make(chan struct{}, concurrent)
+	var wg sync.WaitGroup
+	for readyURL, m := range targets {
+		wg.Add(1)
+		go func(readyURL string, m URLMapper) {
+			defer wg.Done()
+			sema <- struct{}{}
+			m.PingURL = readyURL // readiness probe made the same way as ping, 200 expected
+			errMsg, err := m.ping()
+			<-sema
+			if err != nil {
+				log.Printf("[DEBUG] not ready yet, %s", errMsg)
+				return
+			}
+			log.Printf("[INFO] route %s %s -> %s ready, %s", m.Server, m.SrcMatch.String(), m.Dst, readyURL)
+			s.lock.Lock()
+			if s.ready == nil {
+				s.ready = map[string]bool{}
+			}
+			s.ready[readyURL] = true
+			s.lock.Unlock()
+		}(readyURL, m)
+	}
+	wg.Wait()
+}
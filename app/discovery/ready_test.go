@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Readiness(t *testing.T) {
+	var ready int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	mappers := []URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", ReadyURL: ts.URL + "/ready"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/web/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+	}
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 2)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) { return mappers, nil },
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*20)
+	svc.ReadyInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	require.Eventually(t, func() bool { return len(svc.Mappers()) == 2 }, time.Second, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond) // a few failed probes
+	assert.Empty(t, svc.Match("example.com", "/api/x", RequestInfo{}).Routes, "not ready, withheld")
+	assert.Len(t, svc.Match("example.com", "/web/x", RequestInfo{}).Routes, 1, "no readiness probe")
+
+	atomic.StoreInt32(&ready, 1)
+	require.Eventually(t, func() bool {
+		return len(svc.Match("example.com", "/api/x", RequestInfo{}).Routes) == 1
+	}, time.Second, 10*time.Millisecond, "ready, served")
+
+	atomic.StoreInt32(&ready, 0)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, svc.Match("example.com", "/api/x", RequestInfo{}).Routes, 1, "stays ready")
+
+	svc.lock.Lock()
+	svc.updateReady(mappers[1:]) // route gone
+	svc.lock.Unlock()
+	svc.lock.RLock()
+	assert.Empty(t, svc.ready, "readiness dropped with the route")
+	svc.lock.RUnlock()
+}
+
+func TestService_Warmup(t *testing.T) {
+	var ready, warmups, failures int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ready":
+			if atomic.LoadInt32(&ready) == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/warmup":
+			assert.Equal(t, "GET", r.Method)
+			atomic.AddInt32(&warmups, 1)
+		case "/broken":
+			atomic.AddInt32(&failures, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	mappers := []URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+			ReadyURL: ts.URL + "/ready", WarmupURL: ts.URL + "/warmup"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/web/(.*)"), Dst: "http://127.0.0.2:8080/$1", WarmupURL: ts.URL + "/broken"},
+	}
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID {
+			res := make(chan ProviderID, 2)
+			res <- PIDocker
+			return res
+		},
+		ListFunc: func() ([]URLMapper, error) { return mappers, nil },
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*20)
+	svc.ReadyInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	require.Eventually(t, func() bool { return len(svc.Mappers()) == 2 }, time.Second, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, svc.Match("example.com", "/api/x", RequestInfo{}).Routes, "not ready, withheld")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&warmups), "no warmup before ready")
+
+	atomic.StoreInt32(&ready, 1)
+	require.Eventually(t, func() bool {
+		return len(svc.Match("example.com", "/api/x", RequestInfo{}).Routes) == 1
+	}, time.Second, 10*time.Millisecond, "ready and warmed up, served")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&warmups))
+
+	require.Eventually(t, func() bool {
+		return len(svc.Match("example.com", "/web/x", RequestInfo{}).Routes) == 1
+	}, time.Second, 10*time.Millisecond, "served after failed warmup attempts")
+	assert.Equal(t, int32(warmupAttempts), atomic.LoadInt32(&failures))
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&warmups), "warmed up once")
+
+	svc.lock.Lock()
+	svc.updateWarmups(mappers[1:]) // route gone
+	_, ok := svc.warmups[ts.URL+"/warmup"]
+	svc.lock.Unlock()
+	assert.False(t, ok, "warmup dropped with the route")
+}
@@ -0,0 +1,102 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// SnapshotVersion is the version of snapshot format written by WriteSnapshot
+const SnapshotVersion = 1
+
+// Snapshot is a frozen routes table, i.e. Service.Mappers() saved to a file and loaded back by the snapshot provider
+// instead of live discovery. Mappers keep all label-derived metadata and the provider each route came from.
+// Dispatch mappers are not saved, as resolved by the live provider only, and JWT HMAC secrets are not saved either
+type Snapshot struct {
+	Version int
+	Created time.Time
+	Mappers []URLMapper
+}
+
+// snapshotMapper is a serialized mapper, compiled regexes stored as their source strings.
+// SrcMatch and AllowUA shadow the fields of embedded mapper. JWTSecret set instead of redacted JWT.Secret
+type snapshotMapper struct {
+	URLMapper
+	SrcMatch  string `json:"SrcMatch"`
+	AllowUA   string `json:"AllowUA,omitempty"`
+	JWTSecret bool   `json:"JWTSecret,omitempty"`
+}
+
+type snapshotJSON struct {
+	Version int              `json:"version"`
+	Created time.Time        `json:"created"`
+	Mappers []snapshotMapper `json:"mappers"`
+}
+
+// WriteSnapshot writes mappers as json snapshot. Health of mappers is not saved, restored routes are alive.
+// Dispatch mappers skipped, and JWT secrets redacted, see ReadSnapshot
+func WriteSnapshot(w io.Writer, mappers []URLMapper) error {
+	res := snapshotJSON{Version: SnapshotVersion, Created: time.Now(), Mappers: make([]snapshotMapper, 0, len(mappers))}
+	for _, m := range mappers {
+		if m.Dispatch {
+			continue // routing key resolved by the live provider, nothing to resolve it from snapshot
+		}
+		sm := snapshotMapper{URLMapper: m, SrcMatch: m.SrcMatch.String()}
+		if m.AllowUA != nil {
+			sm.AllowUA = m.AllowUA.String()
+		}
+		if m.JWT.Secret != "" {
+			sm.JWTSecret, sm.URLMapper.JWT.Secret = true, ""
+		}
+		res.Mappers = append(res.Mappers, sm)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		return fmt.Errorf("can't encode snapshot: %w", err)
+	}
+	return nil
+}
+
+// ReadSnapshot reads snapshot written by WriteSnapshot and compiles regexes of its mappers. Dispatch mappers
+// skipped. Mapper with redacted JWT secret gets a random one, i.e. keeps rejecting requests with HMAC tokens
+// instead of serving them with validation disabled
+func ReadSnapshot(r io.Reader) (Snapshot, error) {
+	var sj snapshotJSON
+	if err := json.NewDecoder(r).Decode(&sj); err != nil {
+		return Snapshot{}, fmt.Errorf("can't decode snapshot: %w", err)
+	}
+	if sj.Version != SnapshotVersion {
+		return Snapshot{}, fmt.Errorf("unsupported snapshot version %d", sj.Version)
+	}
+	res := Snapshot{Version: sj.Version, Created: sj.Created, Mappers: make([]URLMapper, 0, len(sj.Mappers))}
+	for i, sm := range sj.Mappers {
+		m := sm.URLMapper
+		if m.Dispatch {
+			continue
+		}
+		if sm.JWTSecret {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return Snapshot{}, fmt.Errorf("can't make jwt secret of mapper %d: %w", i, err)
+			}
+			m.JWT.Secret = hex.EncodeToString(secret)
+		}
+		rx, err := regexp.Compile(sm.SrcMatch)
+		if err != nil {
+			return Snapshot{}, fmt.Errorf("can't compile source %q of mapper %d: %w", sm.SrcMatch, i, err)
+		}
+		m.SrcMatch = *rx
+		if sm.AllowUA != "" {
+			if m.AllowUA, err = regexp.Compile(sm.AllowUA); err != nil {
+				return Snapshot{}, fmt.Errorf("can't compile allowed user agent %q of mapper %d: %w", sm.AllowUA, i, err)
+			}
+		}
+		res.Mappers = append(res.Mappers, m)
+	}
+	return res, nil
+}
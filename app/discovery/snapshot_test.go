@@ -0,0 +1,103 @@
+package discovery
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	keepHost := true
+	mappers := []URLMapper{
+		{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+			ProviderID: PIDocker, PingURL: "http://127.0.0.1:8080/ping", MatchType: MTProxy, KeepHost: &keepHost,
+			OnlyFromIPs: []string{"192.168.1.0/24"}, Visibility: VisibilityInternal, Group: "green",
+			AllowUA: regexp.MustCompile("^curl/"), MatchHeaders: []HeaderCondition{{Name: "X-Country", Values: []string{"DE", "FR"}}},
+			MatchQuery: []QueryCondition{{Name: "tenant", Value: "foo"}}, StatusMap: map[int]int{404: 200},
+			CacheTTL: time.Minute, Fault: Fault{Delay: time.Second, DelayPercent: 25}, MetricName: "api",
+			TTL: time.Hour, LastSeen: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), dead: true},
+		{Server: "*", SrcMatch: *regexp.MustCompile("/web/"), Dst: "/var/www/", ProviderID: PIFile,
+			MatchType: MTStatic, AssetsWebRoot: "/web", AssetsLocation: "/var/www/", AssetsSPA: true},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/old/(.*)"), Dst: "/new/$1", ProviderID: PIStatic,
+			RedirectType: RTPerm},
+	}
+
+	buf := bytes.Buffer{}
+	require.NoError(t, WriteSnapshot(&buf, mappers))
+	assert.Contains(t, buf.String(), `"SrcMatch": "^/api/(.*)"`)
+	assert.Contains(t, buf.String(), `"AllowUA": "^curl/"`)
+
+	snap, err := ReadSnapshot(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, SnapshotVersion, snap.Version)
+	assert.WithinDuration(t, time.Now(), snap.Created, time.Minute)
+	require.Len(t, snap.Mappers, 3)
+
+	mappers[0].dead = false // health is not saved
+	for i := range mappers {
+		assert.Equal(t, mappers[i].SrcMatch.String(), snap.Mappers[i].SrcMatch.String())
+		assert.True(t, sameMapper(mappers[i], snap.Mappers[i]), "mapper %d", i)
+	}
+	assert.Equal(t, "^curl/", snap.Mappers[0].AllowUA.String())
+	assert.Nil(t, snap.Mappers[1].AllowUA)
+	assert.True(t, *snap.Mappers[0].KeepHost)
+	assert.Equal(t, map[int]int{404: 200}, snap.Mappers[0].StatusMap)
+	assert.Equal(t, mappers[0].LastSeen, snap.Mappers[0].LastSeen.UTC())
+	assert.Equal(t, RTPerm, snap.Mappers[2].RedirectType)
+	assert.True(t, snap.Mappers[0].IsAlive())
+}
+
+func TestSnapshot_ReadErrors(t *testing.T) {
+	tbl := []struct {
+		inp string
+		err string
+	}{
+		{`{bad`, "can't decode snapshot"},
+		{`{"version": 2, "mappers": []}`, "unsupported snapshot version 2"},
+		{`{"version": 1, "mappers": [{"SrcMatch": "^/api/(.*"}]}`, `can't compile source "^/api/(.*" of mapper 0`},
+		{`{"version": 1, "mappers": [{"SrcMatch": "/", "AllowUA": "[a"}]}`, `can't compile allowed user agent "[a" of mapper 0`},
+	}
+	for i, tt := range tbl {
+		_, err := ReadSnapshot(strings.NewReader(tt.inp))
+		require.Error(t, err, "case %d", i)
+		assert.Contains(t, err.Error(), tt.err, "case %d", i)
+	}
+}
+
+func TestSnapshot_DispatchAndJWT(t *testing.T) {
+	mappers := []URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/svc/([^/]+)(/.*)?$"), Dst: "http://$1$2", ProviderID: PIDocker,
+			MatchType: MTProxy, Dispatch: true},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", ProviderID: PIDocker,
+			MatchType: MTProxy, JWT: JWT{Secret: "top-secret", Claims: map[string]string{"aud": "api"}}},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/jwks/(.*)"), Dst: "http://127.0.0.1:8081/$1", ProviderID: PIDocker,
+			MatchType: MTProxy, JWT: JWT{JWKSURL: "https://auth.example.com/jwks.json"}},
+	}
+
+	buf := bytes.Buffer{}
+	require.NoError(t, WriteSnapshot(&buf, mappers))
+	assert.NotContains(t, buf.String(), "top-secret", "jwt secret redacted")
+	assert.NotContains(t, buf.String(), "http://$1$2", "dispatch mapper not saved")
+
+	snap, err := ReadSnapshot(&buf)
+	require.NoError(t, err)
+	require.Len(t, snap.Mappers, 2)
+	assert.Equal(t, "^/api/(.*)", snap.Mappers[0].SrcMatch.String())
+	assert.True(t, snap.Mappers[0].JWT.Enabled(), "route with redacted secret still requires token")
+	assert.NotEqual(t, "top-secret", snap.Mappers[0].JWT.Secret)
+	assert.Len(t, snap.Mappers[0].JWT.Secret, 64)
+	assert.Equal(t, map[string]string{"aud": "api"}, snap.Mappers[0].JWT.Claims)
+	assert.Equal(t, JWT{JWKSURL: "https://auth.example.com/jwks.json"}, snap.Mappers[1].JWT, "jwks route kept as is")
+
+	// dispatch mapper of snapshot written before they were skipped
+	snap, err = ReadSnapshot(strings.NewReader(`{"version": 1, "mappers": [` +
+		`{"SrcMatch": "^/svc/([^/]+)(/.*)?$", "Dst": "http://$1$2", "Dispatch": true}, {"SrcMatch": "^/web/", "Dst": "/var/www/"}]}`))
+	require.NoError(t, err)
+	require.Len(t, snap.Mappers, 1)
+	assert.Equal(t, "/var/www/", snap.Mappers[0].Dst)
+}
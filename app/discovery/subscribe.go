@@ -0,0 +1,137 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// RouteUpdate is a change of the routes table sent to subscribers. The first update of a subscription
+// is the full table with all mappers in Added, the next ones are deltas. Changed mapper sent as removed
+// old one and added new one
+type RouteUpdate struct {
+	Full    bool
+	Added   []URLMapper
+	Removed []URLMapper
+}
+
+type subscriber struct {
+	notify chan struct{} // signals table change, buffered so publish never blocks
+}
+
+// Subscribe returns channel with routes table updates, closed on ctx done. Slow subscriber doesn't block
+// discovery, changes made while it didn't read the channel are coalesced into a single delta
+func (s *Service) Subscribe(ctx context.Context) <-chan RouteUpdate {
+	res := make(chan RouteUpdate)
+	sub := &subscriber{notify: make(chan struct{}, 1)}
+	sub.notify <- struct{}{} // full table right away
+
+	s.subsLock.Lock()
+	if s.subs == nil {
+		s.subs = map[*subscriber]struct{}{}
+	}
+	s.subs[sub] = struct{}{}
+	s.subsLock.Unlock()
+
+	go func() {
+		defer func() {
+			s.subsLock.Lock()
+			delete(s.subs, sub)
+			s.subsLock.Unlock()
+			close(res)
+		}()
+
+		var sent map[string]URLMapper // table as seen by the subscriber, nil till the full update sent
+		for {
+			select {
+			case <-sub.notify:
+			case <-ctx.Done():
+				return
+			}
+			current := keyedMappers(s.Mappers())
+			upd := tableDelta(sent, current)
+			if !upd.Full && len(upd.Added) == 0 && len(upd.Removed) == 0 {
+				continue
+			}
+			select {
+			case res <- upd:
+				sent = current
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// publish notifies all subscribers about table change, never blocks
+func (s *Service) publish() {
+	s.subsLock.Lock()
+	defer s.subsLock.Unlock()
+	for sub := range s.subs {
+		select {
+		case sub.notify <- struct{}{}:
+		default: // already notified, not read yet
+		}
+	}
+}
+
+// tableDelta makes update from the table sent before to the current one, full update if nothing sent yet
+func tableDelta(sent, current map[string]URLMapper) RouteUpdate {
+	res := RouteUpdate{Full: sent == nil}
+	for k, m := range current {
+		if prev, ok := sent[k]; !ok || !sameMapper(prev, m) {
+			res.Added = append(res.Added, m)
+		}
+	}
+	for k, m := range sent {
+		if cur, ok := current[k]; !ok || !sameMapper(cur, m) {
+			res.Removed = append(res.Removed, m)
+		}
+	}
+	sortMappers(res.Added)
+	sortMappers(res.Removed)
+	return res
+}
+
+// keyedMappers makes map of mappers by route identity, i.e. server, source and destination.
+// identical routes, i.e. provided by multiple providers, get index suffix
+func keyedMappers(mappers []URLMapper) map[string]URLMapper {
+	res := make(map[string]URLMapper, len(mappers))
+	for _, m := range mappers {
+		key := mapperKey(m)
+		for i := 1; ; i++ {
+			if _, ok := res[key]; !ok {
+				break
+			}
+			key = fmt.Sprintf("%s#%d", mapperKey(m), i)
+		}
+		res[key] = m
+	}
+	return res
+}
+
+func mapperKey(m URLMapper) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s", m.ProviderID, m.MatchType, m.Server, m.SrcMatch.String(), m.Dst,
+		m.AssetsWebRoot, m.AssetsLocation)
+}
+
+// sameMapper compares mappers ignoring health and last seen time, compiled regexes compared by their strings
+func sameMapper(a, b URLMapper) bool {
+	if a.SrcMatch.String() != b.SrcMatch.String() || (a.AllowUA == nil) != (b.AllowUA == nil) ||
+		(a.AllowUA != nil && a.AllowUA.String() != b.AllowUA.String()) {
+		return false
+	}
+	a.SrcMatch, b.SrcMatch = regexp.Regexp{}, regexp.Regexp{}
+	a.AllowUA, b.AllowUA = nil, nil
+	a.dead, b.dead = false, false
+	a.LastSeen, b.LastSeen = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+func sortMappers(mappers []URLMapper) {
+	sort.Slice(mappers, func(i, j int) bool { return mapperKey(mappers[i]) < mapperKey(mappers[j]) })
+}
@@ -0,0 +1,137 @@
+package discovery
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Subscribe(t *testing.T) {
+	api := URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", ProviderID: PIDocker}
+	web := URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/web/(.*)"), Dst: "http://127.0.0.2:8080/$1", ProviderID: PIDocker}
+	web2 := web
+	web2.Dst = "http://127.0.0.3:8080/$1"
+	api2 := api
+	api2.Dst = "http://127.0.0.4:8080/$1"
+
+	var lock sync.Mutex
+	mappers := []URLMapper{api, web}
+	events := make(chan ProviderID, 10)
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan ProviderID { return events },
+		ListFunc: func() ([]URLMapper, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return mappers, nil
+		},
+	}
+	reload := func(lst ...URLMapper) {
+		lock.Lock()
+		mappers = lst
+		lock.Unlock()
+		events <- PIDocker
+	}
+
+	svc := NewService([]Provider{p1}, time.Millisecond*10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+
+	recv := func(ch <-chan RouteUpdate) RouteUpdate {
+		select {
+		case upd := <-ch:
+			return upd
+		case <-time.After(time.Second):
+			t.Fatal("no update")
+		}
+		return RouteUpdate{}
+	}
+	dests := func(mappers []URLMapper) (res []string) {
+		for _, m := range mappers {
+			res = append(res, m.Dst)
+		}
+		return res
+	}
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	ch := svc.Subscribe(subCtx)
+	upd := recv(ch)
+	assert.True(t, upd.Full)
+	assert.Empty(t, upd.Added, "nothing loaded yet")
+
+	events <- PIDocker
+	upd = recv(ch)
+	assert.False(t, upd.Full)
+	assert.Equal(t, []string{api.Dst, web.Dst}, dests(upd.Added))
+	assert.Empty(t, upd.Removed)
+
+	slow := svc.Subscribe(ctx)
+	upd = recv(slow)
+	assert.True(t, upd.Full, "current table on subscribe")
+	assert.Equal(t, []string{api.Dst, web.Dst}, dests(upd.Added))
+
+	reload(api, web2) // web destination changed
+	upd = recv(ch)
+	assert.Equal(t, []string{web2.Dst}, dests(upd.Added))
+	assert.Equal(t, []string{web.Dst}, dests(upd.Removed))
+
+	reload(web2) // api removed
+	upd = recv(ch)
+	assert.Empty(t, upd.Added)
+	assert.Equal(t, []string{api.Dst}, dests(upd.Removed))
+
+	reload(api2, web2) // api added back with another destination
+	upd = recv(ch)
+	assert.Equal(t, []string{api2.Dst}, dests(upd.Added))
+	assert.Empty(t, upd.Removed)
+
+	upd = recv(slow) // pending since the first change
+	assert.Equal(t, []string{web2.Dst}, dests(upd.Added))
+	assert.Equal(t, []string{web.Dst}, dests(upd.Removed))
+	upd = recv(slow) // the next two changes coalesced
+	assert.Equal(t, []string{api2.Dst}, dests(upd.Added))
+	assert.Equal(t, []string{api.Dst}, dests(upd.Removed))
+	select {
+	case upd = <-slow:
+		t.Fatalf("unexpected update %+v", upd)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	subCancel()
+	require.Eventually(t, func() bool {
+		_, ok := <-ch
+		return !ok
+	}, time.Second, 10*time.Millisecond, "closed on cancel")
+	svc.subsLock.Lock()
+	assert.Len(t, svc.subs, 1)
+	svc.subsLock.Unlock()
+}
+
+func Test_tableDeltaLastSeen(t *testing.T) {
+	m := URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+		ProviderID: PIDocker, TTL: time.Minute, LastSeen: time.Now()}
+	sent := keyedMappers([]URLMapper{m})
+	m.LastSeen = m.LastSeen.Add(time.Second)
+	upd := tableDelta(sent, keyedMappers([]URLMapper{m}))
+	assert.Empty(t, upd.Added, "route seen again is not a change")
+	assert.Empty(t, upd.Removed)
+}
+
+func Test_tableDeltaAllowUA(t *testing.T) {
+	m := URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+		ProviderID: PIDocker, AllowUA: regexp.MustCompile("^billing/")}
+	sent := keyedMappers([]URLMapper{m})
+	m.AllowUA = regexp.MustCompile("^billing/") // compiled again on the next list
+	upd := tableDelta(sent, keyedMappers([]URLMapper{m}))
+	assert.Empty(t, upd.Added, "same allow-ua regex is not a change")
+
+	m.AllowUA = regexp.MustCompile("^payments/")
+	upd = tableDelta(sent, keyedMappers([]URLMapper{m}))
+	assert.Len(t, upd.Added, 1)
+	assert.Len(t, upd.Removed, 1)
+}
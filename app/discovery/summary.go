@@ -0,0 +1,123 @@
+package discovery
+
+import (
+	"sort"
+	"strings"
+)
+
+// Summary is a machine-readable description of discovered routes, i.e. for docs or api catalog.
+// Like openapi paths, routes keyed by path pattern (source regex), each with all servers it served on.
+// Mappers of the same server and source make a single route with multiple destinations
+type Summary struct {
+	Servers []string                  `json:"servers"`
+	Paths   map[string][]RouteSummary `json:"paths"`
+}
+
+// RouteSummary describes a single route, with label-derived metadata of the route's mappers
+type RouteSummary struct {
+	Server       string   `json:"server"`
+	Type         string   `json:"type"` // proxy or static
+	Providers    []string `json:"providers"`
+	Destinations []string `json:"destinations"`
+	Ping         []string `json:"ping,omitempty"`
+
+	Visibility string            `json:"visibility,omitempty"`
+	Listener   string            `json:"listener,omitempty"`
+	Proto      string            `json:"proto,omitempty"`
+	OnlyFrom   []string          `json:"only_from,omitempty"`
+	Headers    []HeaderCondition `json:"match_headers,omitempty"`
+	Query      []QueryCondition  `json:"match_query,omitempty"`
+	ALPN       string            `json:"alpn,omitempty"`
+	MTLS       bool              `json:"mtls,omitempty"`
+	Groups     []string          `json:"groups,omitempty"`
+	WebSocket  bool              `json:"websocket,omitempty"`
+	Sticky     string            `json:"sticky_cookie,omitempty"`
+	CacheTTL   string            `json:"cache_ttl,omitempty"`
+	MaxConn    int               `json:"max_conn,omitempty"`
+	CatchAll   bool              `json:"catch_all,omitempty"`
+	MetricName string            `json:"metric_name,omitempty"`
+	AssetsSPA  bool              `json:"spa,omitempty"`
+
+	key string // server, type and match conditions of the route
+}
+
+// Summarize makes summary of mappers, i.e. Service.Mappers(). Routes of each path sorted by server,
+// destinations, providers and groups sorted and deduplicated, so the same mappers always make the same document
+func Summarize(mappers []URLMapper) Summary {
+	res := Summary{Servers: []string{}, Paths: map[string][]RouteSummary{}}
+	servers := map[string]bool{}
+	for _, m := range mappers {
+		if !servers[m.Server] {
+			servers[m.Server] = true
+			res.Servers = append(res.Servers, m.Server)
+		}
+		path := m.SrcMatch.String()
+		if m.MatchType == MTStatic && m.AssetsWebRoot != "" {
+			path = m.AssetsWebRoot
+		}
+		key := m.Server + "|" + m.MatchType.String() + "|" + m.ALPN + "|" + m.Listener + "|" + string(m.Visibility)
+		for _, h := range m.MatchHeaders {
+			key += "|" + h.Name + "=" + h.Value + strings.Join(h.Values, ",")
+		}
+		for _, q := range m.MatchQuery {
+			key += "|?" + q.Name + "=" + q.Value
+		}
+
+		routes := res.Paths[path]
+		idx := -1
+		for i := range routes {
+			if routes[i].key == key {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			routes = append(routes, newRouteSummary(m, key))
+			idx = len(routes) - 1
+		}
+		r := &routes[idx]
+		r.Destinations = appendUnique(r.Destinations, m.Dst)
+		r.Providers = appendUnique(r.Providers, string(m.ProviderID))
+		if m.PingURL != "" {
+			r.Ping = appendUnique(r.Ping, m.PingURL)
+		}
+		if m.Group != "" {
+			r.Groups = appendUnique(r.Groups, m.Group)
+		}
+		res.Paths[path] = routes
+	}
+
+	sort.Strings(res.Servers)
+	for path, routes := range res.Paths {
+		for i := range routes {
+			sort.Strings(routes[i].Destinations)
+			sort.Strings(routes[i].Providers)
+			sort.Strings(routes[i].Ping)
+			sort.Strings(routes[i].Groups)
+		}
+		sort.SliceStable(routes, func(i, j int) bool { return routes[i].key < routes[j].key })
+		res.Paths[path] = routes
+	}
+	return res
+}
+
+// newRouteSummary makes route summary with metadata of the first mapper of the route
+func newRouteSummary(m URLMapper, key string) RouteSummary {
+	res := RouteSummary{Server: m.Server, Type: m.MatchType.String(), Visibility: string(m.Visibility),
+		Listener: m.Listener, Proto: string(m.Proto), OnlyFrom: m.OnlyFromIPs, Headers: m.MatchHeaders,
+		Query: m.MatchQuery, ALPN: m.ALPN, MTLS: m.MTLS, WebSocket: m.WebSocket, Sticky: m.StickyCookie,
+		MaxConn: m.MaxConn, CatchAll: m.CatchAll, MetricName: m.MetricName, AssetsSPA: m.AssetsSPA, key: key}
+	if m.CacheTTL > 0 {
+		res.CacheTTL = m.CacheTTL.String()
+	}
+	return res
+}
+
+func appendUnique(lst []string, v string) []string {
+	for _, s := range lst {
+		if s == v {
+			return lst
+		}
+	}
+	return append(lst, v)
+}
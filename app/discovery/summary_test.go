@@ -0,0 +1,54 @@
+package discovery
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarize(t *testing.T) {
+	mappers := []URLMapper{
+		{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://10.0.0.2:8080/$1",
+			ProviderID: PIDocker, PingURL: "http://10.0.0.2:8080/ping", Group: "green", MetricName: "app/api"},
+		{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://10.0.0.1:8080/$1",
+			ProviderID: PIDocker, PingURL: "http://10.0.0.1:8080/ping", Group: "blue", MetricName: "app/api"},
+		{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://10.0.0.3:8080/$1",
+			ProviderID: PIFile, MatchHeaders: []HeaderCondition{{Name: "X-Version", Value: "beta"}}},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://10.0.0.4:8080/$1", ProviderID: PIStatic,
+			MTLS: true, ALPN: "h2", CacheTTL: time.Minute, OnlyFromIPs: []string{"10.0.0.0/8"}},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/web/"), Dst: "/var/www", MatchType: MTStatic,
+			AssetsWebRoot: "/web", AssetsLocation: "/var/www", AssetsSPA: true, ProviderID: PIFile},
+	}
+
+	res := Summarize(mappers)
+	assert.Equal(t, []string{"*", "example.com"}, res.Servers)
+	require.Equal(t, 2, len(res.Paths))
+
+	api := res.Paths["^/api/(.*)"]
+	require.Equal(t, 3, len(api), "two routes of example.com, with and without header condition, and one of *")
+	assert.Equal(t, RouteSummary{Server: "*", Type: "proxy", Providers: []string{"static"},
+		Destinations: []string{"http://10.0.0.4:8080/$1"}, MTLS: true, ALPN: "h2", CacheTTL: "1m0s",
+		OnlyFrom: []string{"10.0.0.0/8"}, key: api[0].key}, api[0])
+	assert.Equal(t, []string{"http://10.0.0.1:8080/$1", "http://10.0.0.2:8080/$1"}, api[1].Destinations)
+	assert.Equal(t, []string{"http://10.0.0.1:8080/ping", "http://10.0.0.2:8080/ping"}, api[1].Ping)
+	assert.Equal(t, []string{"blue", "green"}, api[1].Groups)
+	assert.Equal(t, "app/api", api[1].MetricName)
+	assert.Equal(t, []string{"http://10.0.0.3:8080/$1"}, api[2].Destinations)
+	assert.Equal(t, []HeaderCondition{{Name: "X-Version", Value: "beta"}}, api[2].Headers)
+
+	web := res.Paths["/web"]
+	require.Equal(t, 1, len(web))
+	assert.Equal(t, "static", web[0].Type)
+	assert.True(t, web[0].AssetsSPA)
+
+	data, err := json.Marshal(res)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"match_headers":[{"name":"X-Version","value":"beta"}]`)
+	assert.NotContains(t, string(data), `"key"`)
+
+	assert.Equal(t, Summary{Servers: []string{}, Paths: map[string][]RouteSummary{}}, Summarize(nil))
+}
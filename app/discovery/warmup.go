@@ -0,0 +1,121 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+const (
+	warmupTimeout  = 10 * time.Second // timeout of a single warmup request, cold upstream may respond slowly
+	warmupAttempts = 3                // warmup requests made before the route served without warmup
+)
+
+// warmup is the state of route's warmup url, kept across reloads
+type warmup struct {
+	attempts int  // failed warmup requests
+	running  bool // warmup request in flight
+	done     bool // warmed up or out of attempts, the route servable
+}
+
+// warmServable checks if the mapper's warmup is done, mappers without WarmupURL always servable.
+// should be called under lock
+func (s *Service) warmServable(m URLMapper) bool {
+	if m.WarmupURL == "" {
+		return true
+	}
+	w, ok := s.warmups[m.WarmupURL]
+	return ok && w.done
+}
+
+// updateWarmups drops warmup state of urls not used by mappers anymore, so the recreated container
+// is warmed up again. should be called under lock
+func (s *Service) updateWarmups(mappers []URLMapper) {
+	urls := map[string]bool{}
+	for _, m := range mappers {
+		if m.WarmupURL != "" {
+			urls[m.WarmupURL] = true
+		}
+	}
+	for u := range s.warmups {
+		if !urls[u] {
+			delete(s.warmups, u)
+		}
+	}
+}
+
+// checkWarmups sends warmup requests of ready mappers not warmed up yet, i.e. right after discovery or, with
+// ReadyURL, after the readiness probe passed. Requests made in background, and the route not matched till its
+// warmup done. Failed warmup, error or 5xx response, retried on the next check, and after warmupAttempts
+// failures the route served anyway, warmup is best-effort and can't keep the route out forever
+func (s *Service) checkWarmups(ctx context.Context) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, mappers := range s.mappers {
+		for _, m := range mappers {
+			if m.WarmupURL == "" || !s.readyServable(m) {
+				continue
+			}
+			if s.warmups == nil {
+				s.warmups = map[string]*warmup{}
+			}
+			w, ok := s.warmups[m.WarmupURL]
+			if !ok {
+				w = &warmup{}
+				s.warmups[m.WarmupURL] = w
+			}
+			if w.done || w.running {
+				continue
+			}
+			w.running = true
+			go s.warmupRoute(ctx, m, w)
+		}
+	}
+}
+
+func (s *Service) warmupRoute(ctx context.Context, m URLMapper, w *warmup) {
+	err := m.warmup(ctx)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w.running = false
+	if err == nil {
+		log.Printf("[INFO] route %s %s -> %s warmed up, %s", m.Server, m.SrcMatch.String(), m.Dst, m.WarmupURL)
+		w.done = true
+		return
+	}
+	if w.attempts++; w.attempts >= warmupAttempts {
+		log.Printf("[WARN] route %s %s -> %s served without warmup, %d attempts failed, %v",
+			m.Server, m.SrcMatch.String(), m.Dst, w.attempts, err)
+		w.done = true
+		return
+	}
+	log.Printf("[DEBUG] warmup attempt %d of %s failed, %v", w.attempts, m.WarmupURL, err)
+}
+
+// warmup makes GET request to the mapper's WarmupURL, any response but 5xx means upstream warmed up
+func (m URLMapper) warmup(ctx context.Context) error {
+	client := http.Client{Timeout: warmupTimeout}
+	if m.Socket != "" {
+		client.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", m.Socket)
+		}}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.WarmupURL, http.NoBody)
+	if err != nil {
+		return fmt.Errorf("can't make warmup request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("warmup request failed: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("warmup status %s", resp.Status)
+	}
+	return nil
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +13,7 @@ import (
 	"net/rpc"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -18,6 +22,7 @@ import (
 	log "github.com/go-pkgz/lgr"
 	"github.com/umputun/go-flags"
 	"gopkg.in/natefinch/lumberjack.v2"
+	_ "modernc.org/sqlite" // sqlite driver for sql provider, registered as "sqlite"
 
 	"github.com/umputun/reproxy/app/discovery"
 	"github.com/umputun/reproxy/app/discovery/provider"
@@ -28,16 +33,22 @@ import (
 )
 
 var opts struct {
-	Listen              string   `short:"l" long:"listen" env:"LISTEN" description:"listen on host:port (default: 0.0.0.0:8080/8443 under docker, 127.0.0.1:80/443 without)"`
-	MaxSize             string   `short:"m" long:"max" env:"MAX_SIZE" default:"64K" description:"max request size"`
-	GzipEnabled         bool     `short:"g" long:"gzip" env:"GZIP" description:"enable gz compression"`
-	ProxyHeaders        []string `short:"x" long:"header" description:"outgoing proxy headers to add"` // env HEADER split in code to allow , inside ""
-	DropHeaders         []string `long:"drop-header" env:"DROP_HEADERS" description:"incoming headers to drop" env-delim:","`
-	AuthBasicHtpasswd   string   `long:"basic-htpasswd" env:"BASIC_HTPASSWD" description:"htpasswd file for basic auth"`
-	RemoteLookupHeaders bool     `long:"remote-lookup-headers" env:"REMOTE_LOOKUP_HEADERS" description:"enable remote lookup headers"`
-	LBType              string   `long:"lb-type" env:"LB_TYPE" description:"load balancer type" choice:"random" choice:"failover" choice:"roundrobin" default:"random"` // nolint
-	Insecure            bool     `long:"insecure" env:"INSECURE" description:"skip SSL certificate verification for the destination host"`
-	KeepHost            bool     `long:"keep-host" env:"KEEP_HOST" description:"pass the Host header from the client as-is, instead of rewriting it"`
+	Listen              string            `short:"l" long:"listen" env:"LISTEN" description:"listen on host:port (default: 0.0.0.0:8080/8443 under docker, 127.0.0.1:80/443 without)"`
+	ListenInternal      string            `long:"listen-internal" env:"LISTEN_INTERNAL" description:"internal listener host:port, serves internal and public routes"`
+	Listeners           map[string]string `long:"listener" env:"LISTENERS" env-delim:"," description:"named listener, name:host:port"`
+	MaxSize             string            `short:"m" long:"max" env:"MAX_SIZE" default:"64K" description:"max request size"`
+	GzipEnabled         bool              `short:"g" long:"gzip" env:"GZIP" description:"enable gz compression"`
+	ProxyHeaders        []string          `short:"x" long:"header" description:"outgoing proxy headers to add"` // env HEADER split in code to allow , inside ""
+	DropHeaders         []string          `long:"drop-header" env:"DROP_HEADERS" description:"incoming headers to drop" env-delim:","`
+	AuthBasicHtpasswd   string            `long:"basic-htpasswd" env:"BASIC_HTPASSWD" description:"htpasswd file for basic auth"`
+	RemoteLookupHeaders bool              `long:"remote-lookup-headers" env:"REMOTE_LOOKUP_HEADERS" description:"enable remote lookup headers"`
+	Precedence          []string          `long:"precedence" env:"PRECEDENCE" env-delim:"," description:"providers precedence for conflicting routes, i.e. file,docker"`
+	LBType              string            `long:"lb-type" env:"LB_TYPE" description:"load balancer type" choice:"random" choice:"failover" choice:"roundrobin" default:"random"` // nolint
+	Insecure            bool              `long:"insecure" env:"INSECURE" description:"skip SSL certificate verification for the destination host"`
+	NoRequestID         bool              `long:"no-request-id" env:"NO_REQUEST_ID" description:"disable X-Request-Id for proxied requests"`
+	KeepHost            bool              `long:"keep-host" env:"KEEP_HOST" description:"pass the Host header from the client as-is, instead of rewriting it"`
+	Faults              bool              `long:"faults" env:"FAULTS" description:"enable fault injection of routes, for chaos testing only"`
+	DryRun              bool              `long:"dry-run" env:"DRY_RUN" description:"log routing decisions and respond with 204 instead of proxying"`
 
 	SSL struct {
 		Type          string   `long:"type" env:"TYPE" description:"ssl (auto) support" choice:"none" choice:"static" choice:"auto" default:"none"` // nolint
@@ -47,6 +58,7 @@ var opts struct {
 		ACMEEmail     string   `long:"acme-email" env:"ACME_EMAIL" description:"admin email for certificate notifications"`
 		RedirHTTPPort int      `long:"http-port" env:"HTTP_PORT" description:"http port for redirect to https and acme challenge test (default: 8080 under docker, 80 without)"`
 		FQDNs         []string `long:"fqdn" env:"ACME_FQDN" env-delim:"," description:"FQDN(s) for ACME certificates"`
+		ClientCA      string   `long:"client-ca" env:"CLIENT_CA" description:"path to CA pem file verifying client certificates for mtls routes"`
 	} `group:"ssl" namespace:"ssl" env-namespace:"SSL"`
 
 	Assets struct {
@@ -59,6 +71,7 @@ var opts struct {
 
 	Logger struct {
 		StdOut     bool   `long:"stdout" env:"STDOUT" description:"enable stdout logging"`
+		Upstream   bool   `long:"upstream" env:"UPSTREAM" description:"log upstream destination url"`
 		Enabled    bool   `long:"enabled" env:"ENABLED" description:"enable access and error rotated logs"`
 		FileName   string `long:"file" env:"FILE"  default:"access.log" description:"location of access log"`
 		MaxSize    string `long:"max-size" env:"MAX_SIZE" default:"100M" description:"maximum size before it gets rotated"`
@@ -66,12 +79,34 @@ var opts struct {
 	} `group:"logger" namespace:"logger" env-namespace:"LOGGER"`
 
 	Docker struct {
-		Enabled   bool     `long:"enabled" env:"ENABLED" description:"enable docker provider"`
-		Host      string   `long:"host" env:"HOST" default:"unix:///var/run/docker.sock" description:"docker host"`
-		Network   string   `long:"network" env:"NETWORK" default:"" description:"docker network"`
-		Excluded  []string `long:"exclude" env:"EXCLUDE" description:"excluded containers" env-delim:","`
-		AutoAPI   bool     `long:"auto" env:"AUTO" description:"enable automatic routing (without labels)"`
-		APIPrefix string   `long:"prefix" env:"PREFIX" description:"prefix for docker source routes"`
+		Enabled   bool              `long:"enabled" env:"ENABLED" description:"enable docker provider"`
+		Host      string            `long:"host" env:"HOST" default:"unix:///var/run/docker.sock" description:"docker host"`
+		Network   string            `long:"network" env:"NETWORK" default:"" description:"docker network"`
+		Swarm     bool              `long:"swarm" env:"SWARM" description:"discover swarm services instead of containers"`
+		VIP       bool              `long:"service-vip" env:"SERVICE_VIP" description:"route swarm services to their virtual ip instead of replicas"`
+		APIVer    string            `long:"api-version" env:"API_VERSION" description:"docker api version, i.e. 1.41. v1.24 if not set"`
+		DNSTTL    time.Duration     `long:"dns-ttl" env:"DNS_TTL" description:"cache address of tcp docker host for ttl, 0 - resolve on each connection"`
+		Excluded  []string          `long:"exclude" env:"EXCLUDE" description:"excluded containers" env-delim:","`
+		AutoAPI   bool              `long:"auto" env:"AUTO" description:"enable automatic routing (without labels)"`
+		APIPrefix string            `long:"prefix" env:"PREFIX" description:"prefix for docker source routes"`
+		SrcTmpl   string            `long:"src-template" env:"SRC_TEMPLATE" description:"go template for default source route"`
+		DestTmpl  string            `long:"dest-template" env:"DEST_TEMPLATE" description:"go template for default destination"`
+		MaxRoutes int               `long:"max-routes" env:"MAX_ROUTES" default:"0" description:"max number of docker routes, 0 - unlimited"`
+		Port      int               `long:"require-port" env:"REQUIRE_PORT" default:"0" description:"discover only containers exposing the private port, 0 - any"`
+		Healthy   bool              `long:"require-healthy" env:"REQUIRE_HEALTHY" description:"discover only containers healthy by docker healthcheck"`
+		Vars      map[string]string `long:"var" env:"VARS" env-delim:"," description:"variables for dest labels, name:value"`
+		Up        []string          `long:"up-statuses" env:"UP_STATUSES" env-delim:"," description:"container states served, running by default"`
+		Down      []string          `long:"down-statuses" env:"DOWN_STATUSES" env-delim:"," description:"container states removed from routes, all but up by default"`
+		Published string            `long:"published-host" env:"PUBLISHED_HOST" description:"docker host address for containers with published ports only"`
+		PubPorts  bool              `long:"published-ports" env:"PUBLISHED_PORTS" description:"route all containers via ports published to docker host"`
+		Prefix    string            `long:"label-prefix" env:"LABEL_PREFIX" default:"reproxy" description:"prefix of container labels"`
+		HostNet   bool              `long:"host-network" env:"HOST_NETWORK" description:"route host-network containers to docker host"`
+		HostAddr  string            `long:"host-address" env:"HOST_ADDRESS" description:"docker host address for host-network containers, detected if not set"`
+		Inspect   time.Duration     `long:"inspect-ttl" env:"INSPECT_TTL" default:"1m" description:"how long container inspect results cached"`
+		RouteTTL  time.Duration     `long:"route-ttl" env:"ROUTE_TTL" description:"drop routes not listed again within ttl, 0 - no expiry"`
+		Dispatch  string            `long:"dispatch-prefix" env:"DISPATCH_PREFIX" description:"route /prefix/{name}/... to container with the name"`
+		Lenient   bool              `long:"lenient" env:"LENIENT" description:"skip containers with invalid labels instead of failing all routes"`
+		Images    []string          `long:"image-route" env:"IMAGE_ROUTES" env-delim:";" description:"route containers of image without labels, glob=src template"`
 	} `group:"docker" namespace:"docker" env-namespace:"DOCKER"`
 
 	ConsulCatalog struct {
@@ -87,15 +122,82 @@ var opts struct {
 		Delay         time.Duration `long:"delay" env:"DELAY" default:"500ms" description:"file event delay"`
 	} `group:"file" namespace:"file" env-namespace:"FILE"`
 
+	Remote struct {
+		Enabled       bool          `long:"enabled" env:"ENABLED" description:"enable remote provider"`
+		URL           string        `long:"url" env:"URL" description:"remote rules url"`
+		CheckInterval time.Duration `long:"interval" env:"INTERVAL" default:"10s" description:"remote rules check interval"`
+		Timeout       time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"remote rules request timeout"`
+	} `group:"remote" namespace:"remote" env-namespace:"REMOTE"`
+
+	Etcd struct {
+		Enabled  bool          `long:"enabled" env:"ENABLED" description:"enable etcd provider"`
+		Endpoint string        `long:"endpoint" env:"ENDPOINT" default:"http://127.0.0.1:2379" description:"etcd endpoint"`
+		Prefix   string        `long:"prefix" env:"PREFIX" default:"/reproxy/" description:"etcd keys prefix"`
+		Timeout  time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"etcd request timeout"`
+	} `group:"etcd" namespace:"etcd" env-namespace:"ETCD"`
+
+	Redis struct {
+		Enabled  bool          `long:"enabled" env:"ENABLED" description:"enable redis provider"`
+		Address  string        `long:"address" env:"ADDRESS" default:"127.0.0.1:6379" description:"redis address"`
+		Password string        `long:"password" env:"PASSWORD" description:"redis password"`
+		DB       int           `long:"db" env:"DB" default:"0" description:"redis database"`
+		Key      string        `long:"key" env:"KEY" default:"reproxy:routes" description:"redis hash with rules"`
+		Timeout  time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"redis request timeout"`
+	} `group:"redis" namespace:"redis" env-namespace:"REDIS"`
+
+	Nomad struct {
+		Enabled   bool          `long:"enabled" env:"ENABLED" description:"enable nomad provider"`
+		Endpoint  string        `long:"endpoint" env:"ENDPOINT" default:"http://127.0.0.1:4646" description:"nomad api address"`
+		Token     string        `long:"token" env:"TOKEN" description:"nomad acl token"`
+		Namespace string        `long:"namespace" env:"NAMESPACE" default:"default" description:"nomad namespace, * for all"`
+		Wait      time.Duration `long:"wait" env:"WAIT" default:"30s" description:"nomad blocking query wait time"`
+		Timeout   time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"nomad request timeout"`
+	} `group:"nomad" namespace:"nomad" env-namespace:"NOMAD"`
+
+	ECS struct {
+		Enabled  bool          `long:"enabled" env:"ENABLED" description:"enable ecs provider"`
+		Cluster  string        `long:"cluster" env:"CLUSTER" default:"default" description:"ecs cluster name or arn"`
+		Region   string        `long:"region" env:"REGION" description:"aws region, AWS_REGION if not set"`
+		Endpoint string        `long:"endpoint" env:"ENDPOINT" description:"ecs api endpoint, regional if not set"`
+		Interval time.Duration `long:"interval" env:"INTERVAL" default:"30s" description:"ecs tasks polling interval"`
+		Timeout  time.Duration `long:"timeout" env:"TIMEOUT" default:"10s" description:"ecs request timeout"`
+	} `group:"ecs" namespace:"ecs" env-namespace:"ECS"`
+
+	SQL struct {
+		Enabled       bool          `long:"enabled" env:"ENABLED" description:"enable sql provider"`
+		Driver        string        `long:"driver" env:"DRIVER" default:"sqlite" description:"database/sql driver name"`
+		DSN           string        `long:"dsn" env:"DSN" description:"database connection string, i.e. /srv/routes.db"`
+		Table         string        `long:"table" env:"TABLE" default:"routes" description:"routes table"`
+		CheckInterval time.Duration `long:"interval" env:"INTERVAL" default:"5s" description:"routes table check interval"`
+	} `group:"sql" namespace:"sql" env-namespace:"SQL"`
+
+	K8s struct {
+		Enabled   bool          `long:"enabled" env:"ENABLED" description:"enable kubernetes provider"`
+		Endpoint  string        `long:"endpoint" env:"ENDPOINT" default:"https://kubernetes.default.svc" description:"kubernetes api address"`
+		TokenFile string        `long:"token-file" env:"TOKEN_FILE" default:"/var/run/secrets/kubernetes.io/serviceaccount/token" description:"bearer token file"`
+		CAFile    string        `long:"ca-file" env:"CA_FILE" default:"/var/run/secrets/kubernetes.io/serviceaccount/ca.crt" description:"api server ca certificate"`
+		Namespace string        `long:"namespace" env:"NAMESPACE" description:"kubernetes namespace, all if not set"`
+		ClusterIP bool          `long:"cluster-ip" env:"CLUSTER_IP" description:"route to service cluster ip instead of ready endpoints"`
+		Ingress   bool          `long:"ingress" env:"INGRESS" description:"route ingress rules"`
+		Timeout   time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"kubernetes request timeout"`
+		RouteTTL  time.Duration `long:"route-ttl" env:"ROUTE_TTL" description:"drop last good routes not listed again within ttl, 0 - no expiry"`
+	} `group:"k8s" namespace:"k8s" env-namespace:"K8S"`
+
 	Static struct {
 		Enabled bool     `long:"enabled" env:"ENABLED" description:"enable static provider"`
 		Rules   []string `long:"rule" env:"RULES" description:"routing rules" env-delim:";"`
 	} `group:"static" namespace:"static" env-namespace:"STATIC"`
 
+	Snapshot struct {
+		Load string `long:"load" env:"LOAD" description:"serve routes from snapshot file, all other providers ignored"`
+		Save string `long:"save" env:"SAVE" description:"save routes snapshot to file on each change"`
+	} `group:"snapshot" namespace:"snapshot" env-namespace:"SNAPSHOT"`
+
 	Timeouts struct {
 		ReadHeader     time.Duration `long:"read-header" env:"READ_HEADER" default:"5s"  description:"read header server timeout"`
 		Write          time.Duration `long:"write" env:"WRITE" default:"30s" description:"write server timeout"`
 		Idle           time.Duration `long:"idle" env:"IDLE" default:"30s" description:"idle server timeout"`
+		Shutdown       time.Duration `long:"shutdown" env:"SHUTDOWN" default:"5s" description:"grace period for in-flight requests on shutdown"`
 		Dial           time.Duration `long:"dial" env:"DIAL" default:"30s" description:"dial transport timeout"`
 		KeepAlive      time.Duration `long:"keep-alive" env:"KEEP_ALIVE" default:"30s"  description:"keep-alive transport timeout"`
 		ResponseHeader time.Duration `long:"resp-header" env:"RESP_HEADER" default:"5s"  description:"response header transport timeout"`
@@ -183,6 +285,13 @@ func run() error {
 	}
 
 	svc := discovery.NewService(providers, time.Second)
+	for _, p := range opts.Precedence {
+		pid, e := discovery.ParseProviderID(p)
+		if e != nil {
+			return fmt.Errorf("invalid precedence: %w", e)
+		}
+		svc.Precedence = append(svc.Precedence, pid)
+	}
 	if len(providers) > 0 {
 		go func() {
 			if e := svc.Run(context.Background()); e != nil {
@@ -210,6 +319,30 @@ func run() error {
 		}
 	}()
 
+	if opts.Snapshot.Save != "" {
+		go func() {
+			for range svc.Subscribe(ctx) {
+				if e := saveSnapshot(opts.Snapshot.Save, svc.Mappers()); e != nil {
+					log.Printf("[WARN] can't save routes snapshot, %v", e)
+				}
+			}
+		}()
+	}
+
+	routeLogs := makeRouteLogs()
+	if routeLogs != nil {
+		go func() {
+			for range svc.Subscribe(ctx) {
+				routeLogs.Sync(svc.Mappers()) // close logs of removed routes
+			}
+		}()
+		defer func() {
+			if logErr := routeLogs.Close(); logErr != nil {
+				log.Printf("[WARN] can't close route access logs, %v", logErr)
+			}
+		}()
+	}
+
 	cacheControl, err := proxy.MakeCacheControl(opts.Assets.CacheControl)
 	if err != nil {
 		return fmt.Errorf("failed to make cache control: %w", err)
@@ -238,29 +371,39 @@ func run() error {
 		return fmt.Errorf("failed to load basic auth: %w", baErr)
 	}
 
+	requestIDHeader := "X-Request-Id"
+	if opts.NoRequestID {
+		requestIDHeader = ""
+	}
+
 	px := &proxy.Http{
-		Version:        revision,
-		Matcher:        svc,
-		Address:        addr,
-		MaxBodySize:    int64(maxBodySize),
-		AssetsLocation: opts.Assets.Location,
-		AssetsWebRoot:  opts.Assets.WebRoot,
-		Assets404:      opts.Assets.NotFound,
-		AssetsSPA:      opts.Assets.SPA,
-		CacheControl:   cacheControl,
-		GzEnabled:      opts.GzipEnabled,
-		SSLConfig:      sslConfig,
-		Insecure:       opts.Insecure,
-		ProxyHeaders:   proxyHeaders,
-		DropHeader:     opts.DropHeaders,
-		AccessLog:      accessLog,
-		StdOutEnabled:  opts.Logger.StdOut,
-		Signature:      opts.Signature,
-		LBSelector:     makeLBSelector(),
+		Version:         revision,
+		Matcher:         svc,
+		Address:         addr,
+		InternalAddress: opts.ListenInternal,
+		Listeners:       opts.Listeners,
+		MaxBodySize:     int64(maxBodySize),
+		AssetsLocation:  opts.Assets.Location,
+		AssetsWebRoot:   opts.Assets.WebRoot,
+		Assets404:       opts.Assets.NotFound,
+		AssetsSPA:       opts.Assets.SPA,
+		CacheControl:    cacheControl,
+		GzEnabled:       opts.GzipEnabled,
+		SSLConfig:       sslConfig,
+		Insecure:        opts.Insecure,
+		ProxyHeaders:    proxyHeaders,
+		DropHeader:      opts.DropHeaders,
+		AccessLog:       accessLog,
+		RouteLogs:       routeLogs,
+		StdOutEnabled:   opts.Logger.StdOut,
+		LogUpstream:     opts.Logger.Upstream,
+		Signature:       opts.Signature,
+		LBSelector:      makeLBSelector(),
 		Timeouts: proxy.Timeouts{
 			ReadHeader:     opts.Timeouts.ReadHeader,
 			Write:          opts.Timeouts.Write,
 			Idle:           opts.Timeouts.Idle,
+			Shutdown:       opts.Timeouts.Shutdown,
 			Dial:           opts.Timeouts.Dial,
 			KeepAlive:      opts.Timeouts.KeepAlive,
 			IdleConn:       opts.Timeouts.IdleConn,
@@ -277,6 +420,13 @@ func run() error {
 		BasicAuthAllowed: basicAuthAllowed,
 		KeepHost:         opts.KeepHost,
 		OnlyFrom:         makeOnlyFromMiddleware(),
+		RequestIDHeader:  requestIDHeader,
+		FaultsEnabled:    opts.Faults,
+		DryRun:           opts.DryRun,
+	}
+
+	if opts.DryRun {
+		log.Printf("[WARN] dry-run mode, requests matched and logged, but not proxied")
 	}
 
 	err = px.Run(ctx)
@@ -306,10 +456,15 @@ func makeBasicAuth(htpasswdFile string) ([]string, error) {
 }
 
 // make all providers. the order is matter, defines which provider will have priority in case of conflicting rules
-// static first, file second and docker the last one
+// static first, file second, remote and etcd third and docker after them
 func makeProviders() ([]discovery.Provider, error) {
 	var res []discovery.Provider
 
+	if opts.Snapshot.Load != "" {
+		log.Printf("[INFO] routes loaded from snapshot %s, live discovery disabled", opts.Snapshot.Load)
+		return []discovery.Provider{&provider.Snapshot{FileName: opts.Snapshot.Load}}, nil
+	}
+
 	if opts.Static.Enabled {
 		var msgs []string
 		for _, rule := range opts.Static.Rules {
@@ -327,8 +482,85 @@ func makeProviders() ([]discovery.Provider, error) {
 		})
 	}
 
+	if opts.Remote.Enabled {
+		if opts.Remote.URL == "" {
+			return nil, errors.New("remote provider enabled without url")
+		}
+		res = append(res, &provider.Remote{
+			URL:           opts.Remote.URL,
+			CheckInterval: opts.Remote.CheckInterval,
+			Client:        &http.Client{Timeout: opts.Remote.Timeout},
+		})
+	}
+
+	if opts.Etcd.Enabled {
+		res = append(res, &provider.Etcd{
+			Endpoint:      opts.Etcd.Endpoint,
+			Prefix:        opts.Etcd.Prefix,
+			Timeout:       opts.Etcd.Timeout,
+			RetryInterval: time.Second * 5,
+		})
+	}
+
+	if opts.Redis.Enabled {
+		res = append(res, &provider.Redis{
+			Address:       opts.Redis.Address,
+			Password:      opts.Redis.Password,
+			DB:            opts.Redis.DB,
+			Key:           opts.Redis.Key,
+			Timeout:       opts.Redis.Timeout,
+			RetryInterval: time.Second * 5,
+		})
+	}
+
+	if opts.Nomad.Enabled {
+		res = append(res, &provider.Nomad{
+			Endpoint:      opts.Nomad.Endpoint,
+			Token:         opts.Nomad.Token,
+			Namespace:     opts.Nomad.Namespace,
+			Timeout:       opts.Nomad.Timeout,
+			WaitTime:      opts.Nomad.Wait,
+			RetryInterval: time.Second * 5,
+		})
+	}
+
+	if opts.ECS.Enabled {
+		ep, err := makeECSProvider()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ep)
+	}
+
+	if opts.SQL.Enabled {
+		if opts.SQL.DSN == "" {
+			return nil, errors.New("sql provider enabled without dsn")
+		}
+		db, err := sql.Open(opts.SQL.Driver, opts.SQL.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("can't open %s database for sql provider: %w", opts.SQL.Driver, err)
+		}
+		res = append(res, &provider.SQL{DB: db, Table: opts.SQL.Table, CheckInterval: opts.SQL.CheckInterval})
+	}
+
+	if opts.K8s.Enabled {
+		kp, err := makeK8sProvider()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, kp)
+	}
+
 	if opts.Docker.Enabled {
-		client := provider.NewDockerClient(opts.Docker.Host, opts.Docker.Network)
+		newClient := provider.NewDockerClientVersion
+		if opts.Docker.Swarm {
+			log.Printf("[INFO] swarm mode enabled for docker")
+			newClient = provider.NewSwarmClientVersion
+		}
+		client, err := newClient(opts.Docker.Host, opts.Docker.Network, opts.Docker.APIVer, opts.Docker.DNSTTL)
+		if err != nil {
+			return nil, fmt.Errorf("can't make docker client: %w", err)
+		}
 
 		if opts.Docker.AutoAPI {
 			log.Printf("[INFO] auto-api enabled for docker")
@@ -336,8 +568,39 @@ func makeProviders() ([]discovery.Provider, error) {
 
 		const refreshInterval = time.Second * 10 // seems like a reasonable default
 
-		res = append(res, &provider.Docker{DockerClient: client, Excludes: opts.Docker.Excluded,
-			AutoAPI: opts.Docker.AutoAPI, APIPrefix: opts.Docker.APIPrefix, RefreshInterval: refreshInterval})
+		dp := &provider.Docker{DockerClient: client, Excludes: opts.Docker.Excluded,
+			AutoAPI: opts.Docker.AutoAPI, APIPrefix: opts.Docker.APIPrefix, RefreshInterval: refreshInterval,
+			MaxRoutes: opts.Docker.MaxRoutes, Vars: opts.Docker.Vars, UpStatuses: opts.Docker.Up, DownStatuses: opts.Docker.Down,
+			PublishedHost: opts.Docker.Published, PublishedPorts: opts.Docker.PubPorts, Endpoint: opts.Docker.Host,
+			LabelPrefix: opts.Docker.Prefix,
+			HostNetwork: opts.Docker.HostNet, HostAddress: opts.Docker.HostAddr, InspectTTL: opts.Docker.Inspect,
+			RouteTTL: opts.Docker.RouteTTL, Lenient: opts.Docker.Lenient, RequirePort: opts.Docker.Port,
+			UseServiceVIP: opts.Docker.VIP, RequireHealthy: opts.Docker.Healthy, DispatchPrefix: opts.Docker.Dispatch}
+
+		if opts.Docker.SrcTmpl != "" {
+			if dp.SrcTemplate, err = provider.ParseRouteTemplate("src", opts.Docker.SrcTmpl); err != nil {
+				return nil, err
+			}
+		}
+		if opts.Docker.DestTmpl != "" {
+			if dp.DestTemplate, err = provider.ParseRouteTemplate("dest", opts.Docker.DestTmpl); err != nil {
+				return nil, err
+			}
+		}
+		for _, ir := range opts.Docker.Images {
+			glob, tmpl, ok := strings.Cut(ir, "=")
+			if !ok || glob == "" {
+				return nil, fmt.Errorf("invalid image route %q, should be glob=template", ir)
+			}
+			if _, err = provider.ParseRouteTemplate("image "+glob, tmpl); err != nil {
+				return nil, err
+			}
+			if dp.ImageRoutes == nil {
+				dp.ImageRoutes = map[string]string{}
+			}
+			dp.ImageRoutes[glob] = tmpl
+		}
+		res = append(res, dp)
 	}
 
 	if opts.ConsulCatalog.Enabled {
@@ -351,6 +614,58 @@ func makeProviders() ([]discovery.Provider, error) {
 	return res, nil
 }
 
+// makeECSProvider makes ecs provider with credentials from the standard aws environment, static keys
+// or ecs container credentials endpoint of the task running reproxy
+func makeECSProvider() (*provider.ECS, error) {
+	region := opts.ECS.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return nil, errors.New("ecs provider enabled without region")
+	}
+	ep := &provider.ECS{Cluster: opts.ECS.Cluster, Region: region, Endpoint: opts.ECS.Endpoint,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"), SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"), PollInterval: opts.ECS.Interval, Timeout: opts.ECS.Timeout,
+		Client: &http.Client{}}
+	switch {
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "":
+		ep.CredentialsURL = "http://169.254.170.2" + os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		ep.CredentialsURL = os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+		ep.CredentialsToken = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	}
+	if ep.AccessKey == "" && ep.CredentialsURL == "" {
+		return nil, errors.New("ecs provider enabled without aws credentials")
+	}
+	return ep, nil
+}
+
+// makeK8sProvider makes kubernetes provider. Token and ca files of the service account used if exist,
+// so the same defaults work in the cluster and with the local kubectl proxy
+func makeK8sProvider() (*provider.Kubernetes, error) {
+	kp := &provider.Kubernetes{Endpoint: opts.K8s.Endpoint, Namespace: opts.K8s.Namespace, ClusterIP: opts.K8s.ClusterIP,
+		Ingress: opts.K8s.Ingress, Timeout: opts.K8s.Timeout, RetryInterval: time.Second * 5, Client: &http.Client{},
+		RouteTTL: opts.K8s.RouteTTL}
+	if _, err := os.Stat(opts.K8s.TokenFile); err == nil {
+		kp.TokenFile = opts.K8s.TokenFile
+	}
+	if opts.K8s.CAFile != "" {
+		data, err := os.ReadFile(opts.K8s.CAFile) // nolint gosec
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("can't read kubernetes CA %s: %w", opts.K8s.CAFile, err)
+		}
+		if err == nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in kubernetes CA %s", opts.K8s.CAFile)
+			}
+			kp.Client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}
+		}
+	}
+	return kp, nil
+}
+
 func makePluginConductor(ctx context.Context) proxy.MiddlewareProvider {
 	if !opts.Plugin.Enabled {
 		return nil
@@ -414,9 +729,27 @@ func makeSSLConfig() (config proxy.SSLConfig, err error) {
 	default:
 		return config, fmt.Errorf("invalid value %q for SSL_TYPE, allowed values are: none, static or auto", opts.SSL.Type)
 	}
+	if opts.SSL.ClientCA != "" && config.SSLMode != proxy.SSLNone {
+		if config.ClientCAs, err = loadClientCA(opts.SSL.ClientCA); err != nil {
+			return config, err
+		}
+	}
 	return config, err
 }
 
+// loadClientCA reads pem file with CA certificates used to verify client certificates
+func loadClientCA(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path) // nolint gosec
+	if err != nil {
+		return nil, fmt.Errorf("can't read client CA %s: %w", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client CA %s", path)
+	}
+	return pool, nil
+}
+
 func makeLBSelector() proxy.LBSelector {
 	switch opts.LBType {
 	case "random":
@@ -473,6 +806,46 @@ func makeAccessLogWriter() (accessLog io.WriteCloser, err error) {
 	}, nil
 }
 
+// saveSnapshot writes routes snapshot to the temp file renamed to fileName, so the file never left partially written
+func saveSnapshot(fileName string, mappers []discovery.URLMapper) error {
+	tmp := fileName + ".tmp"
+	fh, err := os.Create(tmp) // nolint
+	if err != nil {
+		return fmt.Errorf("can't create %s: %w", tmp, err)
+	}
+	if err = discovery.WriteSnapshot(fh, mappers); err != nil {
+		_ = fh.Close()
+		return err
+	}
+	if err = fh.Close(); err != nil {
+		return fmt.Errorf("can't close %s: %w", tmp, err)
+	}
+	if err = os.Rename(tmp, fileName); err != nil {
+		return fmt.Errorf("can't rename %s: %w", tmp, err)
+	}
+	log.Printf("[DEBUG] saved %d routes to snapshot %s", len(mappers), fileName)
+	return nil
+}
+
+// makeRouteLogs makes access logs of routes with logfile label, target.log files next to the main access log,
+// rotated with the same settings. Nil if logger disabled, such routes not logged like all others
+func makeRouteLogs() *proxy.RouteLogs {
+	if !opts.Logger.Enabled {
+		return nil
+	}
+	maxSize, err := sizeParse(opts.Logger.MaxSize)
+	if err != nil {
+		return nil // checked by makeAccessLogWriter already
+	}
+	dir := filepath.Dir(opts.Logger.FileName)
+	return &proxy.RouteLogs{Open: func(target string) (io.WriteCloser, error) {
+		fname := filepath.Join(dir, target+".log")
+		log.Printf("[INFO] route access log %s enabled", fname)
+		return &lumberjack.Logger{Filename: fname, MaxSize: int(maxSize / 1048576), MaxBackups: opts.Logger.MaxBackups,
+			Compress: true, LocalTime: true}, nil
+	}}
+}
+
 // listenAddress sets default to 127.0.0.0:8080/80443 and, if detected REPROXY_IN_DOCKER env, to 0.0.0.0:80/443
 func listenAddress(addr, sslType string) string {
 
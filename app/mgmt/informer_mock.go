@@ -15,30 +15,83 @@ var _ Informer = &InformerMock{}
 
 // InformerMock is a mock implementation of Informer.
 //
-// 	func TestSomethingThatUsesInformer(t *testing.T) {
+//	func TestSomethingThatUsesInformer(t *testing.T) {
 //
-// 		// make and configure a mocked Informer
-// 		mockedInformer := &InformerMock{
-// 			MappersFunc: func() []discovery.URLMapper {
-// 				panic("mock out the Mappers method")
-// 			},
-// 		}
+//		// make and configure a mocked Informer
+//		mockedInformer := &InformerMock{
+//			GroupsFunc: func() []discovery.RouteGroups {
+//				panic("mock out the Groups method")
+//			},
+//			MappersFunc: func() []discovery.URLMapper {
+//				panic("mock out the Mappers method")
+//			},
+//			SetActiveGroupFunc: func(server string, route string, group string) error {
+//				panic("mock out the SetActiveGroup method")
+//			},
+//		}
 //
-// 		// use mockedInformer in code that requires Informer
-// 		// and then make assertions.
+//		// use mockedInformer in code that requires Informer
+//		// and then make assertions.
 //
-// 	}
+//	}
 type InformerMock struct {
+	// GroupsFunc mocks the Groups method.
+	GroupsFunc func() []discovery.RouteGroups
+
 	// MappersFunc mocks the Mappers method.
 	MappersFunc func() []discovery.URLMapper
 
+	// SetActiveGroupFunc mocks the SetActiveGroup method.
+	SetActiveGroupFunc func(server string, route string, group string) error
+
 	// calls tracks calls to the methods.
 	calls struct {
+		// Groups holds details about calls to the Groups method.
+		Groups []struct {
+		}
 		// Mappers holds details about calls to the Mappers method.
 		Mappers []struct {
 		}
+		// SetActiveGroup holds details about calls to the SetActiveGroup method.
+		SetActiveGroup []struct {
+			// Server is the server argument value.
+			Server string
+			// Route is the route argument value.
+			Route string
+			// Group is the group argument value.
+			Group string
+		}
 	}
-	lockMappers sync.RWMutex
+	lockGroups         sync.RWMutex
+	lockMappers        sync.RWMutex
+	lockSetActiveGroup sync.RWMutex
+}
+
+// Groups calls GroupsFunc.
+func (mock *InformerMock) Groups() []discovery.RouteGroups {
+	if mock.GroupsFunc == nil {
+		panic("InformerMock.GroupsFunc: method is nil but Informer.Groups was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockGroups.Lock()
+	mock.calls.Groups = append(mock.calls.Groups, callInfo)
+	mock.lockGroups.Unlock()
+	return mock.GroupsFunc()
+}
+
+// GroupsCalls gets all the calls that were made to Groups.
+// Check the length with:
+//
+//	len(mockedInformer.GroupsCalls())
+func (mock *InformerMock) GroupsCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockGroups.RLock()
+	calls = mock.calls.Groups
+	mock.lockGroups.RUnlock()
+	return calls
 }
 
 // Mappers calls MappersFunc.
@@ -56,7 +109,8 @@ func (mock *InformerMock) Mappers() []discovery.URLMapper {
 
 // MappersCalls gets all the calls that were made to Mappers.
 // Check the length with:
-//     len(mockedInformer.MappersCalls())
+//
+//	len(mockedInformer.MappersCalls())
 func (mock *InformerMock) MappersCalls() []struct {
 } {
 	var calls []struct {
@@ -66,3 +120,43 @@ func (mock *InformerMock) MappersCalls() []struct {
 	mock.lockMappers.RUnlock()
 	return calls
 }
+
+// SetActiveGroup calls SetActiveGroupFunc.
+func (mock *InformerMock) SetActiveGroup(server string, route string, group string) error {
+	if mock.SetActiveGroupFunc == nil {
+		panic("InformerMock.SetActiveGroupFunc: method is nil but Informer.SetActiveGroup was just called")
+	}
+	callInfo := struct {
+		Server string
+		Route  string
+		Group  string
+	}{
+		Server: server,
+		Route:  route,
+		Group:  group,
+	}
+	mock.lockSetActiveGroup.Lock()
+	mock.calls.SetActiveGroup = append(mock.calls.SetActiveGroup, callInfo)
+	mock.lockSetActiveGroup.Unlock()
+	return mock.SetActiveGroupFunc(server, route, group)
+}
+
+// SetActiveGroupCalls gets all the calls that were made to SetActiveGroup.
+// Check the length with:
+//
+//	len(mockedInformer.SetActiveGroupCalls())
+func (mock *InformerMock) SetActiveGroupCalls() []struct {
+	Server string
+	Route  string
+	Group  string
+} {
+	var calls []struct {
+		Server string
+		Route  string
+		Group  string
+	}
+	mock.lockSetActiveGroup.RLock()
+	calls = mock.calls.SetActiveGroup
+	mock.lockSetActiveGroup.RUnlock()
+	return calls
+}
@@ -8,15 +8,25 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/umputun/reproxy/app/discovery"
 )
 
+// CtxMatch key used to retrieve matched route from the request context
+const CtxMatch = metricsCtxKey("match")
+
+type metricsCtxKey string
+
 // Metrics provides registration and middleware for prometheus
 type Metrics struct {
 	totalRequests  *prometheus.CounterVec
 	responseStatus *prometheus.CounterVec
 	httpDuration   *prometheus.HistogramVec
+	routeRequests  *prometheus.CounterVec   // per route requests by status, for routes with MetricName
+	routeDuration  *prometheus.HistogramVec // per route latency, for routes with MetricName
 }
 
 // NewMetrics create metrics object with all counters registered
@@ -45,6 +55,20 @@ func NewMetrics() *Metrics {
 		Buckets: []float64{0.01, 0.1, 0.5, 1, 2, 3, 5},
 	}, []string{"path"})
 
+	res.routeRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_route_requests_total",
+			Help: "Number of served requests per route and status.",
+		},
+		[]string{"route", "status"},
+	)
+
+	res.routeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_route_response_time_seconds",
+		Help:    "Duration of HTTP requests per route.",
+		Buckets: []float64{0.01, 0.1, 0.5, 1, 2, 3, 5},
+	}, []string{"route"})
+
 	prometheus.Unregister(prometheus.NewGoCollector()) //nolint
 
 	if err := prometheus.Register(res.totalRequests); err != nil {
@@ -56,6 +80,12 @@ func NewMetrics() *Metrics {
 	if err := prometheus.Register(res.httpDuration); err != nil {
 		log.Printf("[WARN] can't register prometheus httpDuration, %v", err)
 	}
+	if err := prometheus.Register(res.routeRequests); err != nil {
+		log.Printf("[WARN] can't register prometheus routeRequests, %v", err)
+	}
+	if err := prometheus.Register(res.routeDuration); err != nil {
+		log.Printf("[WARN] can't register prometheus routeDuration, %v", err)
+	}
 
 	return res
 }
@@ -70,13 +100,24 @@ func (m *Metrics) Middleware(next http.Handler) http.Handler {
 			server = strings.Split(r.Host, ":")[0]
 		}
 
+		// route label set only for routes with metric name, to keep cardinality under control
+		route := ""
+		if match, ok := r.Context().Value(CtxMatch).(discovery.MatchedRoute); ok {
+			route = match.Mapper.MetricName
+		}
+
 		timer := prometheus.NewTimer(m.httpDuration.WithLabelValues(path))
+		st := time.Now()
 		rw := NewResponseWriter(w)
 		next.ServeHTTP(rw, r)
 
 		statusCode := rw.statusCode
 		m.responseStatus.WithLabelValues(strconv.Itoa(statusCode)).Inc()
 		m.totalRequests.WithLabelValues(server).Inc()
+		if route != "" {
+			m.routeRequests.WithLabelValues(route, strconv.Itoa(statusCode)).Inc()
+			m.routeDuration.WithLabelValues(route).Observe(time.Since(st).Seconds())
+		}
 
 		timer.ObserveDuration()
 	})
@@ -98,6 +139,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap returns the original http.ResponseWriter, used by http.ResponseController for hijacking and deadlines
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // Hijack delegate to the original writer if it implements http.Hijacker
 func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	h, ok := rw.ResponseWriter.(http.Hijacker)
@@ -0,0 +1,62 @@
+package mgmt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestMetrics_MiddlewareRoutes(t *testing.T) {
+	m := NewMetrics()
+	h := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+
+	do := func(path, metricName string) {
+		req := httptest.NewRequest("GET", "http://example.com"+path, http.NoBody)
+		if metricName != "" {
+			req = req.WithContext(context.WithValue(req.Context(), CtxMatch,
+				discovery.MatchedRoute{Mapper: discovery.URLMapper{MetricName: metricName}}))
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	do("/ok", "api")
+	do("/ok", "api")
+	do("/bad", "api")
+	do("/ok", "web")
+	do("/ok", "") // no route metrics
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m.routeRequests, m.routeDuration)
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	counts := map[string]float64{}
+	observed := map[string]uint64{}
+	for _, mf := range mfs {
+		for _, mt := range mf.GetMetric() {
+			labels := ""
+			for _, lp := range mt.GetLabel() {
+				labels += lp.GetName() + "=" + lp.GetValue() + ";"
+			}
+			switch mf.GetName() {
+			case "http_route_requests_total":
+				counts[labels] = mt.GetCounter().GetValue()
+			case "http_route_response_time_seconds":
+				observed[labels] = mt.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"route=api;status=200;": 2, "route=api;status=502;": 1,
+		"route=web;status=200;": 1}, counts)
+	assert.Equal(t, map[string]uint64{"route=api;": 3, "route=web;": 1}, observed)
+}
@@ -3,6 +3,7 @@ package mgmt
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"time"
 
@@ -26,9 +27,11 @@ type Server struct {
 	Metrics        *Metrics
 }
 
-// Informer wraps interface to get info about servers and mappers
+// Informer wraps interface to get info about servers and mappers, and to switch active groups of routes
 type Informer interface {
 	Mappers() (mappers []discovery.URLMapper)
+	Groups() []discovery.RouteGroups
+	SetActiveGroup(server, route, group string) error
 }
 
 // Run the lister and management router, activate rest server
@@ -37,6 +40,8 @@ func (s *Server) Run(ctx context.Context) error {
 
 	handler := http.NewServeMux()
 	handler.HandleFunc("/routes", s.routesCtrl())
+	handler.HandleFunc("/groups", s.groupsCtrl())
+	handler.HandleFunc("/summary", s.summaryCtrl())
 	handler.Handle("/metrics", promhttp.Handler())
 	h := rest.Wrap(handler,
 		rest.Recoverer(log.Default()),
@@ -91,3 +96,46 @@ func (s *Server) routesCtrl() func(w http.ResponseWriter, r *http.Request) {
 		rest.RenderJSON(w, res)
 	}
 }
+
+// summaryCtrl - GET /summary, returns machine-readable summary of all routes with metadata, see discovery.Summary
+func (s *Server) summaryCtrl() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rest.RenderJSON(w, discovery.Summarize(s.Informer.Mappers()))
+	}
+}
+
+// groupsCtrl - GET /groups returns routes with groups and active group of each,
+// POST /groups with {"server": "example.com", "route": "^/api/(.*)", "group": "green"} switches the active group
+func (s *Server) groupsCtrl() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			rest.RenderJSON(w, s.Informer.Groups())
+		case "POST":
+			req := struct {
+				Server string `json:"server"`
+				Route  string `json:"route"`
+				Group  string `json:"group"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't parse request")
+				return
+			}
+			if req.Server == "" {
+				req.Server = "*"
+			}
+			if err := s.Informer.SetActiveGroup(req.Server, req.Route, req.Group); err != nil {
+				rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't set active group")
+				return
+			}
+			log.Printf("[INFO] active group for %s %s switched to %s", req.Server, req.Route, req.Group)
+			rest.RenderJSON(w, rest.JSON{"server": req.Server, "route": req.Route, "active": req.Group})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
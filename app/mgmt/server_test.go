@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -93,6 +94,23 @@ func TestServer_controllers(t *testing.T) {
 		assert.Contains(t, fmt.Sprintf("%v", data["srv1"][0]), `provider:file`, data["srv1"][0])
 		assert.Contains(t, fmt.Sprintf("%v", data["srv1"][0]), `ping:http://example.com/ping`, data["srv1"][0])
 	}
+	{
+		req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+"/summary", http.NoBody)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		data := discovery.Summary{}
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"srv1", "srv2"}, data.Servers)
+		assert.Equal(t, 3, len(data.Paths))
+		require.Equal(t, 1, len(data.Paths["/api/(.*)"]))
+		assert.Equal(t, []string{"/blah/$1"}, data.Paths["/api/(.*)"][0].Destinations)
+		assert.Equal(t, "proxy", data.Paths["/api/(.*)"][0].Type)
+	}
 	{
 		req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+"/metrics", http.NoBody)
 		require.NoError(t, err)
@@ -109,3 +127,59 @@ func TestServer_controllers(t *testing.T) {
 	}
 	<-done
 }
+
+func TestServer_groups(t *testing.T) {
+	inf := &InformerMock{
+		GroupsFunc: func() []discovery.RouteGroups {
+			return []discovery.RouteGroups{{Server: "*", Route: "^/api/(.*)", Groups: []string{"blue", "green"}, Active: "blue"}}
+		},
+		SetActiveGroupFunc: func(server, route, group string) error {
+			if group != "green" {
+				return fmt.Errorf("group %q not found", group)
+			}
+			return nil
+		},
+	}
+
+	port := rand.Intn(10000) + 40000
+	srv := Server{Listen: fmt.Sprintf("127.0.0.1:%d", port), Informer: inf}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		srv.Run(ctx)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/groups")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `[{"server":"*","route":"^/api/(.*)","groups":["blue","green"],"active":"blue"}]`+"\n", string(body))
+
+	resp, err = http.Post("http://127.0.0.1:"+strconv.Itoa(port)+"/groups", "application/json",
+		strings.NewReader(`{"route":"^/api/(.*)","group":"green"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, len(inf.SetActiveGroupCalls()))
+	assert.Equal(t, "*", inf.SetActiveGroupCalls()[0].Server, "default server")
+	assert.Equal(t, "^/api/(.*)", inf.SetActiveGroupCalls()[0].Route)
+
+	resp, err = http.Post("http://127.0.0.1:"+strconv.Itoa(port)+"/groups", "application/json",
+		strings.NewReader(`{"route":"^/api/(.*)","group":"red"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Post("http://127.0.0.1:"+strconv.Itoa(port)+"/groups", "application/json", strings.NewReader(`bad`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	cancel()
+	<-done
+}
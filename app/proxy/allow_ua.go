@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// allowUAHandler rejects requests to routes with AllowUA if User-Agent doesn't match, with 403.
+// Requests without User-Agent checked as empty one. Not a security boundary as the header set by the client,
+// a lightweight guard for internal endpoints in addition to ip restrictions
+func (h *Http) allowUAHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || match.Mapper.AllowUA == nil || match.Mapper.AllowUA.MatchString(r.UserAgent()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("[DEBUG] user agent %q not allowed for %s %s, rejected request from %s",
+			r.UserAgent(), match.Mapper.Server, match.Mapper.SrcMatch.String(), r.RemoteAddr)
+		h.Reporter.Report(w, http.StatusForbidden)
+	})
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_allowUAHandler(t *testing.T) {
+	h := Http{Reporter: &ErrorReporter{}}
+	handler := h.allowUAHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	tbl := []struct {
+		name  string
+		allow string
+		ua    string
+		code  int
+	}{
+		{"no restriction", "", "curl/8.0", http.StatusOK},
+		{"allowed", "^billing-svc/", "billing-svc/1.2", http.StatusOK},
+		{"not allowed", "^billing-svc/", "curl/8.0", http.StatusForbidden},
+		{"no user agent", "^billing-svc/", "", http.StatusForbidden},
+		{"empty allowed", "^$|^billing-svc/", "", http.StatusOK},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/something", http.NoBody)
+			req.Header.Set("User-Agent", tt.ua)
+			m := discovery.MatchedRoute{Mapper: discovery.URLMapper{}}
+			if tt.allow != "" {
+				m.Mapper.AllowUA = regexp.MustCompile(tt.allow)
+			}
+			req = req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.code, rr.Code)
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/not-matched", http.NoBody))
+	assert.Equal(t, http.StatusOK, rr.Code, "no match passed")
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// rewriteBody replaces response body with streaming substitution of the route's rewrites.
+// Only uncompressed text bodies rewritten, binary and encoded responses passed as-is.
+// Body length changes with substitution, so Content-Length dropped and the response sent chunked
+func rewriteBody(resp *http.Response, rules []discovery.BodyRewrite) {
+	if len(rules) == 0 || resp.Body == nil || resp.Body == http.NoBody || !isTextContent(resp.Header) {
+		return
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return
+	}
+	resp.Body = newBodyRewriter(resp.Body, rules)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+}
+
+// isTextContent checks if content type is a text one, i.e. text/html, application/json or image/svg+xml
+func isTextContent(hdr http.Header) bool {
+	mt, _, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mt, "text/") || strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "+xml") {
+		return true
+	}
+	switch mt {
+	case "application/json", "application/javascript", "application/xml", "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// bodyRewriter is a reader applying substitutions to the stream. It keeps the tail shorter than the longest
+// From pending between reads, so a match split across chunks still replaced
+type bodyRewriter struct {
+	src    io.ReadCloser
+	rules  []discovery.BodyRewrite
+	maxLen int
+	buf    []byte // pending input, not checked for matches yet
+	chunk  []byte
+	out    bytes.Buffer
+	eof    bool
+}
+
+func newBodyRewriter(src io.ReadCloser, rules []discovery.BodyRewrite) *bodyRewriter {
+	res := &bodyRewriter{src: src, rules: rules, chunk: make([]byte, 32*1024)}
+	for _, r := range rules {
+		if len(r.From) > res.maxLen {
+			res.maxLen = len(r.From)
+		}
+	}
+	return res
+}
+
+// Read returns rewritten data, reading from the source until some output is ready
+func (b *bodyRewriter) Read(p []byte) (int, error) {
+	for b.out.Len() == 0 && !b.eof {
+		n, err := b.src.Read(b.chunk)
+		b.buf = append(b.buf, b.chunk[:n]...)
+		if err == io.EOF {
+			b.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		b.process()
+	}
+	if b.out.Len() == 0 && b.eof {
+		return 0, io.EOF
+	}
+	return b.out.Read(p)
+}
+
+// Close closes the source body
+func (b *bodyRewriter) Close() error {
+	return b.src.Close()
+}
+
+// process moves pending input to the output, applying the earliest match first. On eof all pending data flushed,
+// otherwise the tail possibly holding a partial match kept for the next read
+func (b *bodyRewriter) process() {
+	pos := 0
+	for {
+		idx, rule := b.nextMatch(b.buf[pos:])
+		if idx < 0 {
+			break
+		}
+		b.out.Write(b.buf[pos : pos+idx])
+		b.out.WriteString(b.rules[rule].To)
+		pos += idx + len(b.rules[rule].From)
+	}
+
+	safe := len(b.buf)
+	if !b.eof {
+		safe = len(b.buf) - b.maxLen + 1 // any match starting before this point fully within the buffer
+	}
+	if safe > pos {
+		b.out.Write(b.buf[pos:safe])
+		pos = safe
+	}
+	b.buf = append(b.buf[:0], b.buf[pos:]...)
+}
+
+// nextMatch returns position and rule index of the leftmost match in data, the first rule wins on the same position
+func (b *bodyRewriter) nextMatch(data []byte) (idx, rule int) {
+	idx, rule = -1, -1
+	for i, r := range b.rules {
+		p := bytes.Index(data, []byte(r.From))
+		if p >= 0 && (idx < 0 || p < idx) {
+			idx, rule = p, i
+		}
+	}
+	return idx, rule
+}
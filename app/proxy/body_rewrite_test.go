@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestBodyRewriter(t *testing.T) {
+	rules := []discovery.BodyRewrite{{From: "http://172.17.0.2:8080", To: "https://example.com"}, {From: "lan", To: "com"}}
+	tbl := []struct {
+		name, inp, res string
+	}{
+		{"no match", "some text", "some text"},
+		{"single", `<a href="http://172.17.0.2:8080/login">`, `<a href="https://example.com/login">`},
+		{"multiple", "http://172.17.0.2:8080/a http://172.17.0.2:8080/b host.lan", "https://example.com/a https://example.com/b host.com"},
+		{"partial at the end", "xx http://172.17.0.2", "xx http://172.17.0.2"},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			// one byte reader makes every match split across reads
+			rd := newBodyRewriter(io.NopCloser(iotest.OneByteReader(strings.NewReader(tt.inp))), rules)
+			res, err := io.ReadAll(rd)
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, string(res))
+
+			rd = newBodyRewriter(io.NopCloser(strings.NewReader(tt.inp)), rules)
+			res, err = io.ReadAll(rd)
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, string(res))
+		})
+	}
+}
+
+func TestRewriteBody(t *testing.T) {
+	rules := []discovery.BodyRewrite{{From: "internal.lan", To: "example.com"}}
+	tbl := []struct {
+		name        string
+		contentType string
+		encoding    string
+		res         string
+	}{
+		{"html", "text/html; charset=utf-8", "", "host example.com"},
+		{"json", "application/json", "", "host example.com"},
+		{"problem json", "application/problem+json", "", "host example.com"},
+		{"binary", "image/png", "", "host internal.lan"},
+		{"no content type", "", "", "host internal.lan"},
+		{"gzipped", "text/html", "gzip", "host internal.lan"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}, ContentLength: 17,
+				Body: io.NopCloser(strings.NewReader("host internal.lan"))}
+			resp.Header.Set("Content-Length", "17")
+			if tt.contentType != "" {
+				resp.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rewriteBody(resp, rules)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, string(body))
+			if tt.res != "host internal.lan" {
+				assert.Equal(t, int64(-1), resp.ContentLength)
+				assert.Equal(t, "", resp.Header.Get("Content-Length"))
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+const (
+	defaultBreakerOpen = 30 * time.Second // circuit open duration if not set by the route
+	maxBreakerHint     = 10 * time.Minute // upstream's Retry-After longer than this capped
+)
+
+// circuitBreaker rejects requests to destinations of routes with Breaker while their circuit is open, with 503
+// and Retry-After of the time left. Open circuit expires to half-open, and a single probe request passed to
+// the destination, closing the circuit on success and opening it again on failure. The circuit opened for
+// the route's Breaker.Open, or for upstream's Retry-After if the failure is 503 with it, capped by maxBreakerHint.
+// Circuits kept for destinations with failures only, successful response drops the destination's circuit
+type circuitBreaker struct {
+	reporter Reporter
+	now      func() time.Time
+
+	lock     sync.Mutex
+	circuits map[string]*circuit // route server and destination -> circuit
+}
+
+type circuit struct {
+	failures  int       // consecutive failures
+	openUntil time.Time // zero for closed circuit
+	probing   bool      // half-open, probe request in flight
+}
+
+func newCircuitBreaker(reporter Reporter) *circuitBreaker {
+	return &circuitBreaker{reporter: reporter, now: time.Now, circuits: map[string]*circuit{}}
+}
+
+// Middleware rejects requests to destinations with open circuit and records results of the passed ones
+func (b *circuitBreaker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || match.Mapper.Breaker.Threshold <= 0 || match.Mapper.Builtin != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// circuit kept per destination, the same upstream of all requests to the route's destination
+		key := fmt.Sprintf("%s|%s", match.Mapper.Server, match.Mapper.Dst)
+		if wait, allowed := b.allow(key); !allowed {
+			log.Printf("[DEBUG] circuit open for %s, rejected request from %s", match.Mapper.Dst, r.RemoteAddr)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			b.report(w, http.StatusServiceUnavailable)
+			return
+		}
+
+		bw := &breakerWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(bw, r)
+		if r.Context().Err() != nil {
+			b.release(key) // canceled by client, says nothing about the destination
+			return
+		}
+		b.record(key, match.Mapper.Breaker, bw.status, bw.retryAfter)
+	})
+}
+
+// allow checks if request to the destination allowed, returns time left otherwise
+func (b *circuitBreaker) allow(key string) (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c, ok := b.circuits[key]
+	if !ok || c.openUntil.IsZero() {
+		return 0, true
+	}
+	if now := b.now(); now.Before(c.openUntil) {
+		return c.openUntil.Sub(now), false
+	}
+	if c.probing {
+		return time.Second, false // half-open, only the probe request passed
+	}
+	c.probing = true
+	return 0, true
+}
+
+// record updates the destination's circuit with the response status. Retry-After is upstream's header value
+func (b *circuitBreaker) record(key string, cfg discovery.Breaker, status int, retryAfter string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if status < http.StatusInternalServerError {
+		delete(b.circuits, key) // closed
+		return
+	}
+	c, ok := b.circuits[key]
+	if !ok {
+		c = &circuit{}
+		b.circuits[key] = c
+	}
+	c.failures++
+	c.probing = false
+	if c.failures < cfg.Threshold && c.openUntil.IsZero() {
+		return
+	}
+
+	now := b.now()
+	open := cfg.Open
+	if open <= 0 {
+		open = defaultBreakerOpen
+	}
+	if hint := parseRetryAfter(retryAfter, now); status == http.StatusServiceUnavailable && hint > 0 {
+		open = min(hint, maxBreakerHint)
+	}
+	c.openUntil = now.Add(open)
+	log.Printf("[WARN] circuit opened for %s for %v, %d failures, last status %d", key, open, c.failures, status)
+}
+
+// release drops the probe mark of the destination, for the probe without result
+func (b *circuitBreaker) release(key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c, ok := b.circuits[key]; ok {
+		c.probing = false
+	}
+}
+
+func (b *circuitBreaker) report(w http.ResponseWriter, code int) {
+	if b.reporter == nil {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	b.reporter.Report(w, code)
+}
+
+// parseRetryAfter returns duration of Retry-After value, either seconds or http date. 0 for empty or invalid value
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// breakerWriter keeps response status and upstream's Retry-After
+type breakerWriter struct {
+	http.ResponseWriter
+	status     int
+	retryAfter string
+}
+
+// WriteHeader stores status code and Retry-After header
+func (bw *breakerWriter) WriteHeader(code int) {
+	bw.status, bw.retryAfter = code, bw.Header().Get("Retry-After")
+	bw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the original http.ResponseWriter
+func (bw *breakerWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestCircuitBreaker_Middleware(t *testing.T) {
+	status, retryAfter, calls := http.StatusInternalServerError, "", 0
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+	})
+	b := newCircuitBreaker(nil)
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	h := b.Middleware(upstream)
+
+	m := discovery.URLMapper{Server: "*", Dst: "http://127.0.0.1:8080/$1", Breaker: discovery.Breaker{Threshold: 2, Open: 10 * time.Second}}
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/api/1", http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: m}))
+		wr := httptest.NewRecorder()
+		h.ServeHTTP(wr, req)
+		return wr
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, do().Code)
+	assert.Equal(t, http.StatusInternalServerError, do().Code, "second failure opens the circuit")
+	wr := do()
+	assert.Equal(t, http.StatusServiceUnavailable, wr.Code, "open circuit")
+	assert.Equal(t, "10", wr.Header().Get("Retry-After"))
+	assert.Equal(t, 2, calls, "rejected request not passed to upstream")
+
+	now = now.Add(4 * time.Second)
+	assert.Equal(t, "6", do().Header().Get("Retry-After"), "time left")
+
+	now = now.Add(6 * time.Second)
+	status, retryAfter = http.StatusServiceUnavailable, "120"
+	assert.Equal(t, http.StatusServiceUnavailable, do().Code, "probe failed")
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, "120", do().Header().Get("Retry-After"), "upstream's retry-after honored")
+	assert.Equal(t, 3, calls)
+
+	now = now.Add(2 * time.Minute)
+	status, retryAfter = http.StatusOK, ""
+	assert.Equal(t, http.StatusOK, do().Code, "probe passed, circuit closed")
+	assert.Equal(t, http.StatusOK, do().Code)
+	assert.Equal(t, 5, calls)
+	b.lock.Lock()
+	assert.Empty(t, b.circuits, "closed circuit dropped")
+	b.lock.Unlock()
+
+	m.Breaker = discovery.Breaker{}
+	status = http.StatusInternalServerError
+	for i := 0; i < 5; i++ {
+		require.Equal(t, http.StatusInternalServerError, do().Code, "no breaker for the route")
+	}
+}
+
+func TestCircuitBreaker_retryAfterCapped(t *testing.T) {
+	b := newCircuitBreaker(nil)
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	cfg := discovery.Breaker{Threshold: 1}
+	b.record("k1", cfg, http.StatusServiceUnavailable, "86400")
+	assert.Equal(t, now.Add(maxBreakerHint), b.circuits["k1"].openUntil)
+
+	b.record("k2", cfg, http.StatusBadGateway, "60")
+	assert.Equal(t, now.Add(defaultBreakerOpen), b.circuits["k2"].openUntil, "retry-after of 503 only")
+
+	b.record("k3", cfg, http.StatusServiceUnavailable, now.Add(time.Minute).Format(http.TimeFormat))
+	assert.Equal(t, now.Add(time.Minute), b.circuits["k3"].openUntil, "http date")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-5", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(now.Add(-time.Hour).Format(http.TimeFormat), now), "in the past")
+}
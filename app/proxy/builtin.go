@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// BuiltinHandlers is a registry of named handlers served by reproxy itself. Routes with Builtin matched and
+// passed through the middlewares like any other proxy route, and the handler named by Builtin called instead
+// of the upstream. Matched route available to the handler from the request context, see MatchedRoute.
+// Default registry has "ping", responding with pong, "status", responding with json status of the route,
+// "notfound", responding with 404, and "maintenance", responding with 503 and Retry-After of the route
+type BuiltinHandlers struct {
+	lock     sync.RWMutex
+	handlers map[string]http.Handler
+}
+
+// NewBuiltinHandlers makes registry with the default handlers
+func NewBuiltinHandlers() *BuiltinHandlers {
+	res := &BuiltinHandlers{handlers: map[string]http.Handler{}}
+	res.Register("ping", http.HandlerFunc(builtinPing))
+	res.Register("status", http.HandlerFunc(builtinStatus))
+	res.Register("notfound", http.HandlerFunc(http.NotFound))
+	res.Register("maintenance", http.HandlerFunc(builtinMaintenance))
+	return res
+}
+
+// Register adds handler with the name, replacing the handler registered before with the same name
+func (b *BuiltinHandlers) Register(name string, h http.Handler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.handlers[name] = h
+}
+
+func (b *BuiltinHandlers) get(name string) (http.Handler, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	h, ok := b.handlers[name]
+	return h, ok
+}
+
+// MatchedRoute returns the route matched for the request, for built-in handlers
+func MatchedRoute(r *http.Request) (discovery.MatchedRoute, bool) {
+	match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+	return match, ok
+}
+
+// serveBuiltin calls built-in handler of the route, 501 if no such handler registered
+func (h *Http) serveBuiltin(w http.ResponseWriter, r *http.Request, name string) {
+	builtins := h.Builtins
+	if builtins == nil {
+		builtins = defaultBuiltins
+	}
+	handler, ok := builtins.get(name)
+	if !ok {
+		log.Printf("[WARN] unknown builtin handler %q for %s", name, r.URL.Path)
+		h.Reporter.Report(w, http.StatusNotImplemented)
+		return
+	}
+	log.Printf("[DEBUG] builtin %s for %s", name, r.URL.Path)
+	handler.ServeHTTP(w, r)
+}
+
+var defaultBuiltins = NewBuiltinHandlers()
+
+func builtinPing(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("pong"))
+}
+
+func builtinStatus(w http.ResponseWriter, r *http.Request) {
+	match, _ := MatchedRoute(r)
+	rest.RenderJSON(w, rest.JSON{"status": "ok", "server": match.Mapper.Server, "route": match.Mapper.SrcMatch.String(),
+		"provider": match.Mapper.ProviderID, "name": match.Mapper.MetricName})
+}
+
+func builtinMaintenance(w http.ResponseWriter, r *http.Request) {
+	match, _ := MatchedRoute(r)
+	w.Header().Set("Retry-After", retryAfter(match.Mapper))
+	http.Error(w, "service is under maintenance", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_serveBuiltin(t *testing.T) {
+	custom := NewBuiltinHandlers()
+	custom.Register("hello", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := MatchedRoute(r)
+		require.True(t, ok)
+		_, _ = w.Write([]byte("hello " + match.Mapper.Server))
+	}))
+
+	do := func(h *Http, builtin string) *httptest.ResponseRecorder {
+		m := discovery.MatchedRoute{Destination: "builtin://" + builtin, Mapper: discovery.URLMapper{Server: "example.com",
+			SrcMatch: *regexp.MustCompile("^/c1/(.*)"), ProviderID: discovery.PIDocker, MetricName: "c1", Builtin: builtin}}
+		req := httptest.NewRequest("GET", "http://example.com/c1/status", http.NoBody)
+		ctx := context.WithValue(req.Context(), ctxMatch, m)
+		ctx = context.WithValue(ctx, ctxMatchType, discovery.MTProxy)
+		rr := httptest.NewRecorder()
+		h.proxyHandler(h.makeTransport()).ServeHTTP(rr, req.WithContext(ctx))
+		return rr
+	}
+
+	h := &Http{Reporter: &ErrorReporter{}}
+	rr := do(h, "ping")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "pong", rr.Body.String())
+
+	rr = do(h, "status")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	res := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Equal(t, map[string]interface{}{"status": "ok", "server": "example.com", "route": "^/c1/(.*)",
+		"provider": "docker", "name": "c1"}, res)
+
+	rr = do(h, "notfound")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = do(h, "maintenance")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+
+	rr = do(h, "hello")
+	assert.Equal(t, http.StatusNotImplemented, rr.Code, "not in the default registry")
+
+	h.Builtins = custom
+	rr = do(h, "hello")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "hello example.com", rr.Body.String())
+	assert.Equal(t, "pong", do(h, "ping").Body.String(), "defaults kept in the custom registry")
+}
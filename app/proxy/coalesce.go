@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// coalescer merges identical concurrent GET and HEAD requests of routes with Coalesce into a single upstream call.
+// The first request (leader) proxied as usual, and requests with the same key arrived while it's in flight wait
+// for its response and get a copy of it. The key is method, host, uri and request headers responses usually
+// vary by, including Authorization and Cookie, so responses never shared across different users.
+// Non-idempotent methods never coalesced. Responses not safe to share, i.e. with Set-Cookie, "Cache-Control: private"
+// or Vary by a header not matching the waiting request, and responses over maxBody, made by waiting requests
+// themselves, the same way as without coalescing
+type coalescer struct {
+	maxBody int
+
+	mu    sync.Mutex
+	calls map[string]*coalesceCall
+}
+
+// coalesceCall is an in-flight leader request, done closed when its response completed
+type coalesceCall struct {
+	done   chan struct{}
+	req    http.Header // leader's request headers, to check Vary of the response
+	status int
+	header http.Header
+	body   []byte
+	shared bool // response can be shared with waiting requests
+}
+
+// coalesceVary lists request headers included in the coalescing key
+var coalesceVary = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie"}
+
+func newCoalescer(maxBody int) *coalescer {
+	return &coalescer{maxBody: maxBody, calls: map[string]*coalesceCall{}}
+}
+
+// Middleware coalesces identical concurrent requests of routes with Coalesce
+func (c *coalescer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || !match.Mapper.Coalesce || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := coalesceKey(r)
+		c.mu.Lock()
+		call, inFlight := c.calls[key]
+		if !inFlight {
+			call = &coalesceCall{done: make(chan struct{}), req: r.Header.Clone()}
+			c.calls[key] = call
+		}
+		c.mu.Unlock()
+
+		if inFlight {
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				return
+			}
+			if !call.shared || !varyMatch(call.header, call.req, r.Header) {
+				next.ServeHTTP(w, r) // not shareable, make own request
+				return
+			}
+			log.Printf("[DEBUG] coalesced %s %s", r.Method, r.URL.Path)
+			for k, v := range call.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(call.status)
+			_, _ = w.Write(call.body)
+			return
+		}
+
+		defer func() {
+			c.mu.Lock()
+			delete(c.calls, key)
+			c.mu.Unlock()
+			close(call.done)
+		}()
+		before := w.Header().Clone() // headers set by outer middlewares, per request and not shared
+		cw := &cacheWriter{ResponseWriter: w, status: http.StatusOK, limit: c.maxBody}
+		next.ServeHTTP(cw, r)
+		hdr := http.Header{}
+		for k, v := range w.Header() {
+			if _, ok := before[k]; !ok {
+				hdr[k] = v
+			}
+		}
+		call.status, call.header, call.body = cw.status, hdr, cw.buf.Bytes()
+		call.shared = !cw.overflow && cacheable(hdr) && r.Context().Err() == nil
+	})
+}
+
+// coalesceKey makes key of the request from method, host, uri and values of coalesceVary headers
+func coalesceKey(r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(r.Method + " " + r.Host + r.URL.RequestURI())
+	for _, h := range coalesceVary {
+		sb.WriteString("|" + strings.Join(r.Header.Values(h), ","))
+	}
+	return sb.String()
+}
+
+// varyMatch checks if request headers listed in the response's Vary are the same for both requests
+func varyMatch(resp, leader, req http.Header) bool {
+	for _, v := range resp.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return false
+			}
+			if name != "" && strings.Join(leader.Values(name), ",") != strings.Join(req.Values(name), ",") {
+				return false
+			}
+		}
+	}
+	return true
+}
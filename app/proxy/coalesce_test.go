@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestCoalescer_Middleware(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		if r.URL.Path == "/cookie" {
+			w.Header().Set("Set-Cookie", "session=123")
+		}
+		w.Header().Set("X-Upstream", "yes")
+		_, _ = w.Write([]byte("response " + r.URL.Path))
+	})
+	h := newCoalescer(1024).Middleware(upstream)
+
+	// run sends n concurrent requests and returns responses after all of them in flight or waiting
+	run := func(n int, method, path string, coalesce bool, hdr http.Header) []*httptest.ResponseRecorder {
+		atomic.StoreInt32(&calls, 0)
+		release = make(chan struct{})
+		res := make([]*httptest.ResponseRecorder, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req := httptest.NewRequest(method, "http://example.com"+path, http.NoBody)
+				for k, v := range hdr {
+					req.Header[k] = v
+				}
+				if i%2 == 1 && hdr != nil {
+					req.Header.Set("Authorization", "other")
+				}
+				m := discovery.MatchedRoute{Mapper: discovery.URLMapper{Coalesce: coalesce}}
+				req = req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+				res[i] = httptest.NewRecorder()
+				h.ServeHTTP(res[i], req)
+			}(i)
+		}
+		time.Sleep(50 * time.Millisecond) // all requests started
+		close(release)
+		wg.Wait()
+		return res
+	}
+
+	res := run(5, http.MethodGet, "/api", true, nil)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "single upstream call")
+	for _, r := range res {
+		assert.Equal(t, http.StatusOK, r.Code)
+		assert.Equal(t, "response /api", r.Body.String())
+		assert.Equal(t, "yes", r.Header().Get("X-Upstream"))
+	}
+
+	run(3, http.MethodGet, "/api", false, nil)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "route without coalesce")
+
+	run(3, http.MethodPost, "/api", true, nil)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "post never coalesced")
+
+	run(4, http.MethodGet, "/api", true, http.Header{"Authorization": []string{"user1"}})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "coalesced per authorization")
+
+	res = run(3, http.MethodGet, "/cookie", true, nil)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls), "response with cookie not shared, waiting requests made their own")
+	for _, r := range res {
+		assert.Equal(t, "response /cookie", r.Body.String())
+	}
+}
+
+func TestCoalescer_varyMatch(t *testing.T) {
+	leader := http.Header{"X-Tenant": []string{"a"}}
+	assert.True(t, varyMatch(http.Header{}, leader, http.Header{"X-Tenant": []string{"b"}}))
+	assert.True(t, varyMatch(http.Header{"Vary": []string{"Accept, X-Tenant"}}, leader, http.Header{"X-Tenant": []string{"a"}}))
+	assert.False(t, varyMatch(http.Header{"Vary": []string{"Accept, X-Tenant"}}, leader, http.Header{"X-Tenant": []string{"b"}}))
+	assert.False(t, varyMatch(http.Header{"Vary": []string{"*"}}, leader, leader))
+}
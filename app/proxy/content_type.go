@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// contentTypeHandler rejects POST and PUT requests to routes with ContentTypes, if request's Content-Type is not
+// one of them, with 415. Media types compared without parameters, i.e. application/json; charset=utf-8 matches
+// application/json. Requests without Content-Type rejected as well
+func (h *Http) contentTypeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || len(match.Mapper.ContentTypes) == 0 || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err == nil && discovery.Contains(mediaType, match.Mapper.ContentTypes) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("[DEBUG] content type %q not allowed for %s %s, rejected request from %s",
+			r.Header.Get("Content-Type"), match.Mapper.Server, match.Mapper.SrcMatch.String(), r.RemoteAddr)
+		h.Reporter.Report(w, http.StatusUnsupportedMediaType)
+	})
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_contentTypeHandler(t *testing.T) {
+	h := Http{Reporter: &ErrorReporter{}}
+	handler := h.contentTypeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	tbl := []struct {
+		name    string
+		allowed []string
+		method  string
+		ct      string
+		code    int
+	}{
+		{"no restriction", nil, "POST", "text/xml", http.StatusOK},
+		{"allowed", []string{"application/json"}, "POST", "application/json", http.StatusOK},
+		{"allowed with charset", []string{"application/json"}, "PUT", "application/json; charset=utf-8", http.StatusOK},
+		{"allowed case insensitive", []string{"application/json"}, "POST", "Application/JSON", http.StatusOK},
+		{"one of allowed", []string{"application/json", "text/plain"}, "POST", "text/plain", http.StatusOK},
+		{"not allowed", []string{"application/json"}, "POST", "text/xml", http.StatusUnsupportedMediaType},
+		{"not allowed put", []string{"application/json"}, "PUT", "text/xml", http.StatusUnsupportedMediaType},
+		{"no content type", []string{"application/json"}, "POST", "", http.StatusUnsupportedMediaType},
+		{"get not checked", []string{"application/json"}, "GET", "text/xml", http.StatusOK},
+		{"delete not checked", []string{"application/json"}, "DELETE", "", http.StatusOK},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/something", http.NoBody)
+			if tt.ct != "" {
+				req.Header.Set("Content-Type", tt.ct)
+			}
+			m := discovery.MatchedRoute{Mapper: discovery.URLMapper{ContentTypes: tt.allowed}}
+			req = req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.code, rr.Code)
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/not-matched", http.NoBody))
+	assert.Equal(t, http.StatusOK, rr.Code, "no match, passed as is")
+}
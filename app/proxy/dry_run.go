@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// dryRun logs the routing decision for matched request and responds with 204 instead of serving it. The request
+// passed through all middlewares as usual, and only the final step, proxy, redirect, assets or built-in handler,
+// skipped. Route's provider and metric name, i.e. compose service or container name, logged with the decision
+func dryRun(l log.L, w http.ResponseWriter, r *http.Request, match discovery.MatchedRoute, matchType discovery.MatchType) {
+	m := match.Mapper
+	action := matchType.String()
+	switch {
+	case matchType == discovery.MTProxy && m.RedirectType != discovery.RTNone:
+		action = fmt.Sprintf("redirect (%d)", m.RedirectType)
+	case matchType == discovery.MTProxy && m.Builtin != "":
+		action = "builtin " + m.Builtin
+	}
+	l.Logf("[INFO] dry-run %s %s%s, %s to %s, route %s %s, provider %s, name %q, alive %t", r.Method,
+		r.Host, r.URL.RequestURI(), action, match.Destination, m.Server, m.SrcMatch.String(), m.ProviderID, m.MetricName,
+		match.Alive)
+	w.WriteHeader(http.StatusNoContent)
+}
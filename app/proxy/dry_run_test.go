@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_proxyHandlerDryRun(t *testing.T) {
+	called := false
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	defer ds.Close()
+
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+				{Destination: ds.URL + "/api/1", Alive: true},
+			}}
+		},
+	}
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}, DryRun: true}
+	handler := h.matchHandler(h.proxyHandler(h.makeTransport()))
+
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, httptest.NewRequest("POST", "http://example.com/api/1", http.NoBody))
+	assert.Equal(t, http.StatusNoContent, wr.Code)
+	assert.False(t, called, "upstream not called")
+}
+
+func Test_dryRun(t *testing.T) {
+	tbl := []struct {
+		mapper discovery.URLMapper
+		res    string
+	}{
+		{discovery.URLMapper{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/(.*)"),
+			ProviderID: discovery.PIDocker, MetricName: "web/api"},
+			`dry-run POST example.com/api/1?k=v, proxy to http://127.0.0.1:8080/1, route example.com ^/api/(.*), ` +
+				`provider docker, name "web/api", alive true`},
+		{discovery.URLMapper{RedirectType: discovery.RTPerm},
+			`dry-run POST example.com/api/1?k=v, redirect (301) to http://127.0.0.1:8080/1, route  , provider , name "", alive true`},
+		{discovery.URLMapper{Builtin: "ping"},
+			`dry-run POST example.com/api/1?k=v, builtin ping to http://127.0.0.1:8080/1, route  , provider , name "", alive true`},
+	}
+	for _, tt := range tbl {
+		var logs []string
+		l := log.Func(func(format string, args ...interface{}) { logs = append(logs, fmt.Sprintf(format, args...)) })
+		wr := httptest.NewRecorder()
+		match := discovery.MatchedRoute{Destination: "http://127.0.0.1:8080/1", Alive: true, Mapper: tt.mapper}
+		dryRun(l, wr, httptest.NewRequest("POST", "http://example.com/api/1?k=v", http.NoBody), match, discovery.MTProxy)
+		assert.Equal(t, http.StatusNoContent, wr.Code)
+		assert.Equal(t, []string{"[INFO] " + tt.res}, logs)
+	}
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// edgeCache caches successful GET responses for routes with CacheTTL, thread-safe.
+// Entries expire after route's ttl, requests with "Cache-Control: no-cache" bypass the cache lookup
+// and refresh the cached response. Entries keyed by request headers responses usually vary by, the same as
+// coalescer does, including Authorization and Cookie, so responses never shared across different users.
+// Cached response with Vary served only to requests with the same values of the listed headers.
+type edgeCache struct {
+	maxEntries int
+	maxBody    int
+
+	mu    sync.Mutex
+	items map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	status  int
+	header  http.Header
+	req     http.Header // request headers of the cached response, to check Vary
+	body    []byte
+	expires time.Time
+}
+
+func newEdgeCache(maxEntries, maxBody int) *edgeCache {
+	return &edgeCache{maxEntries: maxEntries, maxBody: maxBody, items: map[string]cacheEntry{}}
+}
+
+// Middleware serves cached responses for routes with CacheTTL and caches new ones
+func (c *edgeCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || match.Mapper.CacheTTL <= 0 || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := coalesceKey(r) // method, host, uri and coalesceVary headers, i.e. Authorization
+		noCache := strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache")
+		if !noCache {
+			if e, found := c.get(key); found && varyMatch(e.header, e.req, r.Header) {
+				for k, v := range e.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("X-Cache", "HIT")
+				w.WriteHeader(e.status)
+				_, _ = w.Write(e.body)
+				return
+			}
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		before := w.Header().Clone() // headers set by outer middlewares, per request and not cached
+		cw := &cacheWriter{ResponseWriter: w, status: http.StatusOK, limit: c.maxBody}
+		next.ServeHTTP(cw, r)
+		if cw.status != http.StatusOK || cw.overflow || !cacheable(w.Header()) {
+			return
+		}
+		hdr := http.Header{}
+		for k, v := range w.Header() {
+			if _, ok := before[k]; !ok {
+				hdr[k] = v
+			}
+		}
+		if !varyMatch(hdr, r.Header, r.Header) { // Vary: * never matches
+			return
+		}
+		c.set(key, cacheEntry{status: cw.status, header: hdr, req: r.Header.Clone(), body: cw.buf.Bytes(),
+			expires: time.Now().Add(match.Mapper.CacheTTL)})
+	})
+}
+
+func (c *edgeCache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.items, key)
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *edgeCache) set(key string, e cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.items) >= c.maxEntries {
+		// drop expired entries and give up if still full
+		now := time.Now()
+		for k, v := range c.items {
+			if now.After(v.expires) {
+				delete(c.items, k)
+			}
+		}
+		if len(c.items) >= c.maxEntries {
+			log.Printf("[DEBUG] edge cache is full, %d entries", len(c.items))
+			return
+		}
+	}
+	c.items[key] = e
+}
+
+// cacheable checks if upstream allowed response caching
+func cacheable(h http.Header) bool {
+	cc := strings.ToLower(h.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private") && h.Get("Set-Cookie") == ""
+}
+
+// cacheWriter copies response body to the buffer up to the limit
+type cacheWriter struct {
+	http.ResponseWriter
+	status   int
+	limit    int
+	buf      bytes.Buffer
+	overflow bool
+}
+
+// WriteHeader stores status code
+func (cw *cacheWriter) WriteHeader(code int) {
+	cw.status = code
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+// Write copies body to the buffer, stops copying on overflow
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if !cw.overflow {
+		if cw.buf.Len()+len(b) > cw.limit {
+			cw.overflow = true
+			cw.buf.Reset()
+		} else {
+			cw.buf.Write(b)
+		}
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original http.ResponseWriter
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
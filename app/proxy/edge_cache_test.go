@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestEdgeCache_Middleware(t *testing.T) {
+	calls := 0
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private")
+		}
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "response %s %d", r.URL.Path, calls)
+	})
+	c := newEdgeCache(10, 64)
+	h := c.Middleware(upstream)
+
+	do := func(method, path string, ttl time.Duration, hdrs ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+path, http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch,
+			discovery.MatchedRoute{Mapper: discovery.URLMapper{CacheTTL: ttl}}))
+		for i := 0; i+1 < len(hdrs); i += 2 {
+			req.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		wr := httptest.NewRecorder()
+		wr.Header().Set("X-Request-Id", "id-"+path) // set by outer middleware, should not be cached
+		h.ServeHTTP(wr, req)
+		return wr
+	}
+
+	wr := do("GET", "/api", time.Minute)
+	assert.Equal(t, "response /api 1", wr.Body.String())
+	assert.Equal(t, "MISS", wr.Header().Get("X-Cache"))
+
+	wr = do("GET", "/api", time.Minute)
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, "response /api 1", wr.Body.String(), "from cache")
+	assert.Equal(t, "HIT", wr.Header().Get("X-Cache"))
+	assert.Equal(t, "text/plain", wr.Header().Get("Content-Type"))
+	assert.Equal(t, "id-/api", wr.Header().Get("X-Request-Id"))
+
+	wr = do("GET", "/api", time.Minute, "Cache-Control", "no-cache")
+	assert.Equal(t, "response /api 2", wr.Body.String(), "no-cache bypass")
+	wr = do("GET", "/api", time.Minute)
+	assert.Equal(t, "response /api 2", wr.Body.String(), "refreshed by no-cache request")
+
+	wr = do("GET", "/api?q=1", time.Minute)
+	assert.Equal(t, "response /api 3", wr.Body.String(), "different query")
+
+	wr = do("GET", "/no-ttl", 0)
+	assert.Equal(t, "response /no-ttl 4", wr.Body.String())
+	assert.Empty(t, wr.Header().Get("X-Cache"))
+
+	do("POST", "/api", time.Minute)
+	assert.Equal(t, 5, calls, "post not cached")
+
+	do("GET", "/bad", time.Minute)
+	do("GET", "/bad", time.Minute)
+	assert.Equal(t, 7, calls, "error not cached")
+
+	do("GET", "/private", time.Minute)
+	do("GET", "/private", time.Minute)
+	assert.Equal(t, 9, calls, "private not cached")
+
+	do("GET", "/long/path/with/response/larger/than/limit/of/64/bytes/xxxxxxxxxxxxxxxxxxxx", time.Minute)
+	do("GET", "/long/path/with/response/larger/than/limit/of/64/bytes/xxxxxxxxxxxxxxxxxxxx", time.Minute)
+	assert.Equal(t, 11, calls, "large body not cached")
+
+	wr = do("GET", "/short", 10*time.Millisecond)
+	assert.Equal(t, "response /short 12", wr.Body.String())
+	time.Sleep(20 * time.Millisecond)
+	wr = do("GET", "/short", 10*time.Millisecond)
+	assert.Equal(t, "response /short 13", wr.Body.String(), "expired")
+}
+
+func TestEdgeCache_Vary(t *testing.T) {
+	calls := 0
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/lang":
+			w.Header().Set("Vary", "X-Lang")
+		case "/any":
+			w.Header().Set("Vary", "*")
+		}
+		fmt.Fprintf(w, "response %s %s %d", r.Header.Get("Authorization"), r.Header.Get("X-Lang"), calls)
+	})
+	h := newEdgeCache(10, 64).Middleware(upstream)
+
+	do := func(path string, hdrs ...string) string {
+		req := httptest.NewRequest("GET", "http://example.com"+path, http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch,
+			discovery.MatchedRoute{Mapper: discovery.URLMapper{CacheTTL: time.Minute}}))
+		for i := 0; i+1 < len(hdrs); i += 2 {
+			req.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		wr := httptest.NewRecorder()
+		h.ServeHTTP(wr, req)
+		return wr.Body.String()
+	}
+
+	assert.Equal(t, "response Bearer a  1", do("/api", "Authorization", "Bearer a"))
+	assert.Equal(t, "response Bearer b  2", do("/api", "Authorization", "Bearer b"), "other user not served")
+	assert.Equal(t, "response Bearer a  1", do("/api", "Authorization", "Bearer a"), "cached per user")
+	assert.Equal(t, "response   3", do("/api", "Cookie", "session=1"))
+	assert.Equal(t, "response   3", do("/api", "Cookie", "session=1"), "cached per cookie")
+	assert.Equal(t, "response   4", do("/api", "Cookie", "session=2"), "other cookie not served")
+
+	assert.Equal(t, "response  en 5", do("/lang", "X-Lang", "en"))
+	assert.Equal(t, "response  de 6", do("/lang", "X-Lang", "de"), "vary header differs")
+	assert.Equal(t, "response  de 6", do("/lang", "X-Lang", "de"), "vary header matches")
+
+	assert.Equal(t, "response   7", do("/any"))
+	assert.Equal(t, "response   8", do("/any"), "vary * not cached")
+}
+
+func TestEdgeCache_Full(t *testing.T) {
+	c := newEdgeCache(2, 64)
+	c.set("k1", cacheEntry{expires: time.Now().Add(-time.Second)})
+	c.set("k2", cacheEntry{expires: time.Now().Add(time.Minute)})
+	c.set("k3", cacheEntry{expires: time.Now().Add(time.Minute)}) // k1 expired and dropped
+	_, ok := c.get("k3")
+	assert.True(t, ok)
+	c.set("k4", cacheEntry{expires: time.Now().Add(time.Minute)}) // full, not stored
+	_, ok = c.get("k4")
+	assert.False(t, ok)
+}
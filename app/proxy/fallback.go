@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// fallbackMatch returns match of the route's Fallback, for the route with all destinations dead, i.e. failed
+// the last health check. Fallback is either builtin://name, served by the built-in handler, or destination
+// url, with $n of the route's source regex. Destinations of the route share labels, the first one's fallback used.
+// Fallback url is an unrelated upstream, so transport settings of the route, i.e. socket, sni, source ip
+// and h2c proto, not applied to it
+func fallbackMatch(r *http.Request, routes []discovery.MatchedRoute) (discovery.MatchedRoute, bool) {
+	if len(routes) == 0 || routes[0].Mapper.Fallback == "" {
+		return discovery.MatchedRoute{}, false
+	}
+	res := routes[0]
+	if name, ok := strings.CutPrefix(res.Mapper.Fallback, "builtin://"); ok {
+		res.Destination, res.Mapper.Builtin = res.Mapper.Fallback, name
+	} else {
+		res.Destination = res.Mapper.SrcMatch.ReplaceAllString(r.URL.EscapedPath(), res.Mapper.Fallback)
+		res.Mapper.Socket, res.Mapper.SNI, res.Mapper.SourceIP = "", "", ""
+		res.Mapper.Proto = discovery.UPHTTP
+	}
+	res.Alive = true
+	log.Printf("[DEBUG] all destinations of %s %s dead, fallback to %s", res.Mapper.Server, res.Mapper.SrcMatch.String(),
+		res.Destination)
+	return res, true
+}
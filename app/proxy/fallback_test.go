@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_matchHandlerFallback(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "fallback %s", r.URL.Path)
+	}))
+	defer ds.Close()
+
+	var mapper discovery.URLMapper
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+				{Destination: "http://127.0.0.1:1/api/1", Alive: false, Mapper: mapper},
+				{Destination: "http://127.0.0.1:2/api/1", Alive: false, Mapper: mapper},
+			}}
+		},
+	}
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}}
+	handler := h.matchHandler(h.proxyHandler(h.makeTransport()))
+	do := func() *httptest.ResponseRecorder {
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, httptest.NewRequest("GET", "http://example.com/api/1", http.NoBody))
+		return wr
+	}
+
+	src := *regexp.MustCompile("^/api/(.*)")
+	mapper = discovery.URLMapper{SrcMatch: src}
+	assert.Equal(t, http.StatusBadGateway, do().Code, "no fallback, all dead")
+
+	mapper = discovery.URLMapper{SrcMatch: src, Fallback: ds.URL + "/maint/$1"}
+	wr := do()
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, "fallback /maint/1", wr.Body.String())
+
+	mapper = discovery.URLMapper{SrcMatch: src, Fallback: "builtin://maintenance", RetryAfter: 30}
+	wr = do()
+	assert.Equal(t, http.StatusServiceUnavailable, wr.Code)
+	assert.Equal(t, "30", wr.Header().Get("Retry-After"))
+
+	mapper = discovery.URLMapper{SrcMatch: src, Dst: ds.URL, Fallback: "builtin://maintenance"}
+	matcherMock.MatchFunc = func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+		return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+			{Destination: "http://127.0.0.1:1/api/1", Alive: false, Mapper: mapper},
+			{Destination: ds.URL + "/api/1", Alive: true, Mapper: mapper},
+		}}
+	}
+	wr = do()
+	assert.Equal(t, http.StatusOK, wr.Code, "alive destination served, no fallback")
+	assert.Equal(t, "fallback /api/1", wr.Body.String())
+
+	mapper = discovery.URLMapper{SrcMatch: src, Socket: filepath.Join(t.TempDir(), "dead.sock"), SNI: "example.com",
+		Proto: discovery.UPH2C, Fallback: ds.URL + "/maint/$1"}
+	matcherMock.MatchFunc = func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+		return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+			{Destination: "http://c1/api/1", Alive: false, Mapper: mapper},
+		}}
+	}
+	wr = do()
+	assert.Equal(t, http.StatusOK, wr.Code, "fallback of socket route dialed by its url, not the socket")
+	assert.Equal(t, "fallback /maint/1", wr.Body.String())
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// faultHandler injects faults of the route for chaos testing, with FaultsEnabled only. Delayed share of requests
+// waits for Fault.Delay before proxying, aborted share rejected with Fault.AbortStatus without reaching
+// the upstream. Both can apply to the same request, the delay goes first. Without FaultsEnabled route faults ignored
+func (h *Http) faultHandler(next http.Handler) http.Handler {
+	if !h.FaultsEnabled {
+		return next
+	}
+	log.Printf("[WARN] fault injection enabled, routes with faults delay or fail requests")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fault := match.Mapper.Fault
+		if fault.Delay > 0 && faultHit(fault.DelayPercent) {
+			log.Printf("[DEBUG] fault delay %v for %s", fault.Delay, r.URL.Path)
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault.AbortStatus > 0 && faultHit(fault.AbortPercent) {
+			log.Printf("[DEBUG] fault abort %d for %s", fault.AbortStatus, r.URL.Path)
+			h.Reporter.Report(w, fault.AbortStatus)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// faultHit decides if the request gets the fault with the given share in percents
+func faultHit(percent float64) bool {
+	return rand.Float64()*100 < percent //nolint:gosec // no need for crypto/rand here
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_faultHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	send := func(handler http.Handler, fault discovery.Fault) (int, time.Duration) {
+		req := httptest.NewRequest("GET", "/api/something", http.NoBody)
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{Fault: fault}}
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+		rr := httptest.NewRecorder()
+		st := time.Now()
+		handler.ServeHTTP(rr, req)
+		return rr.Code, time.Since(st)
+	}
+
+	h := &Http{Reporter: &ErrorReporter{}, FaultsEnabled: true}
+	enabled := h.faultHandler(ok)
+	code, elapsed := send(enabled, discovery.Fault{Delay: 50 * time.Millisecond, DelayPercent: 100})
+	assert.Equal(t, http.StatusOK, code)
+	assert.GreaterOrEqual(t, elapsed, 50*time.Millisecond, "delayed")
+
+	code, _ = send(enabled, discovery.Fault{AbortStatus: http.StatusServiceUnavailable, AbortPercent: 100})
+	assert.Equal(t, http.StatusServiceUnavailable, code, "aborted")
+
+	code, _ = send(enabled, discovery.Fault{})
+	assert.Equal(t, http.StatusOK, code, "no faults")
+
+	aborted := 0
+	for i := 0; i < 1000; i++ {
+		if code, _ = send(enabled, discovery.Fault{AbortStatus: http.StatusBadGateway, AbortPercent: 20}); code == http.StatusBadGateway {
+			aborted++
+		}
+	}
+	assert.InDelta(t, 200, aborted, 80, "about 20% aborted")
+
+	h = &Http{Reporter: &ErrorReporter{}}
+	disabled := h.faultHandler(ok)
+	code, elapsed = send(disabled, discovery.Fault{Delay: 50 * time.Millisecond, DelayPercent: 100,
+		AbortStatus: http.StatusServiceUnavailable, AbortPercent: 100})
+	assert.Equal(t, http.StatusOK, code, "faults ignored if not enabled")
+	assert.Less(t, elapsed, 50*time.Millisecond)
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+const maxFollowedRedirects = 10
+
+// followRedirects makes request with roundTrip following upstream redirects, for routes with FollowRedirects.
+// Only GET and HEAD requests followed, and only redirects to the same upstream (scheme and host), redirects to
+// other hosts passed to the client as-is. The client gets the final response
+func followRedirects(r *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return roundTrip(r)
+	}
+	req := r
+	for i := 0; ; i++ {
+		resp, err := roundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return resp, nil
+		}
+		loc, err := resp.Location()
+		if err != nil || loc.Scheme != r.URL.Scheme || loc.Host != r.URL.Host {
+			return resp, nil // no location or redirect to another host, client decides
+		}
+		if i >= maxFollowedRedirects {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("stopped after %d redirects of %s", maxFollowedRedirects, r.URL.Path)
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // reuse the connection
+		_ = resp.Body.Close()
+		log.Printf("[DEBUG] follow upstream redirect %d of %s to %s", resp.StatusCode, r.URL.Path, loc.RequestURI())
+		req = r.Clone(r.Context())
+		req.URL = loc
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_followRedirects(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("other"))
+	}))
+	defer other.Close()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/mid?a=1", http.StatusMovedPermanently)
+		case "/mid":
+			http.Redirect(w, r, "/new?"+r.URL.RawQuery, http.StatusTemporaryRedirect)
+		case "/new":
+			_, _ = w.Write([]byte("new " + r.URL.RawQuery))
+		case "/away":
+			http.Redirect(w, r, other.URL+"/x", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		}
+	}))
+	defer ds.Close()
+
+	h := Http{Timeouts: Timeouts{Dial: time.Second, KeepAlive: time.Second}}
+	tr := h.makeTransport()
+	follow := context.WithValue(context.Background(), ctxMatch,
+		discovery.MatchedRoute{Mapper: discovery.URLMapper{FollowRedirects: true}})
+
+	tbl := []struct {
+		name   string
+		ctx    context.Context
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{"followed", follow, "GET", "/old", http.StatusOK, "new a=1"},
+		{"passed through by default", context.WithValue(context.Background(), ctxMatch, discovery.MatchedRoute{}),
+			"GET", "/old", http.StatusMovedPermanently, ""},
+		{"not followed for post", follow, "POST", "/old", http.StatusMovedPermanently, ""},
+		{"other host passed through", follow, "GET", "/away", http.StatusFound, ""},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(tt.ctx, tt.method, ds.URL+tt.path, http.NoBody)
+			require.NoError(t, err)
+			resp, err := tr.RoundTrip(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+			if tt.body != "" {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, tt.body, string(body))
+			}
+		})
+	}
+
+	req, err := http.NewRequestWithContext(follow, "GET", ds.URL+"/loop", http.NoBody)
+	require.NoError(t, err)
+	_, err = tr.RoundTrip(req)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "stopped after 10 redirects"), err.Error())
+}
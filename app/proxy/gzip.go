@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// routeGzip serves request of the route with its own gzip level and min size. Responses smaller than min size,
+// already encoded or flushed before reaching min size sent as-is. Level 0 means default compression level
+func routeGzip(next http.Handler, w http.ResponseWriter, r *http.Request, level, minSize int) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) || r.Header.Get("Upgrade") != "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	r.Header.Del("Accept-Encoding") // compressed here, upstream asked for plain body
+	gw := &gzipWriter{ResponseWriter: w, level: level, minSize: minSize}
+	defer gw.close()
+	next.ServeHTTP(gw, r)
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	for _, enc := range strings.Split(acceptEncoding, ",") {
+		if name, _, _ := strings.Cut(enc, ";"); strings.TrimSpace(name) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter buffers response body till min size reached, and compresses it from there.
+// Headers sent once compression decided
+type gzipWriter struct {
+	http.ResponseWriter
+	level   int
+	minSize int
+
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+	plain  bool // response sent as-is
+}
+
+// WriteHeader keeps the status till compression decided. Responses with known size less than
+// min size, already encoded or without body sent as-is right away
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.status != 0 {
+		return
+	}
+	if code < http.StatusOK { // informational, i.e. 103 Early Hints, passed through
+		g.ResponseWriter.WriteHeader(code)
+		return
+	}
+	g.status = code
+	hdr := g.Header()
+	size, err := strconv.Atoi(hdr.Get("Content-Length"))
+	if hdr.Get("Content-Encoding") != "" || code == http.StatusNoContent || code == http.StatusNotModified ||
+		(err == nil && size < g.minSize) {
+		g.sendPlain()
+	}
+}
+
+// Write buffers body till min size, then starts compression
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case g.plain:
+		return g.ResponseWriter.Write(b)
+	case g.gz != nil:
+		return g.gz.Write(b)
+	}
+	g.buf = append(g.buf, b...)
+	if len(g.buf) >= g.minSize {
+		if err := g.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends buffered body as-is if compression not started yet, streams are not held for min size
+func (g *gzipWriter) Flush() {
+	switch {
+	case g.gz != nil:
+		_ = g.gz.Flush()
+	case !g.plain && g.status != 0:
+		g.sendPlain()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipWriter) startGzip() error {
+	hdr := g.Header()
+	if hdr.Get("Content-Type") == "" {
+		hdr.Set("Content-Type", http.DetectContentType(g.buf))
+	}
+	hdr.Set("Content-Encoding", "gzip")
+	hdr.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz, _ = gzip.NewWriterLevel(g.ResponseWriter, g.level) // level validated by provider
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+func (g *gzipWriter) sendPlain() {
+	g.plain = true
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) > 0 {
+		_, _ = g.ResponseWriter.Write(g.buf)
+		g.buf = nil
+	}
+}
+
+// close completes the response, body smaller than min size sent as-is
+func (g *gzipWriter) close() {
+	switch {
+	case g.gz != nil:
+		_ = g.gz.Close()
+	case !g.plain && g.status != 0:
+		g.sendPlain()
+	}
+}
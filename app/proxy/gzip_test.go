@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func Test_gzipHandlerRoute(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Accept-Encoding"), "upstream asked for plain body")
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		if r.URL.Query().Get("cl") != "" {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < size; i += 100 {
+			_, _ = w.Write([]byte(strings.Repeat("x", min(100, size-i))))
+		}
+	})
+	h := gzipHandler(true)(next)
+
+	tbl := []struct {
+		url        string
+		level, min int
+		encoded    bool
+	}{
+		{"/?size=1000", 0, 0, true},        // default compression, route without settings
+		{"/?size=1000", 1, 0, true},        // route level
+		{"/?size=1000", 9, 500, true},      // above min size
+		{"/?size=100", 0, 500, false},      // below min size
+		{"/?size=100&cl=1", 0, 500, false}, // below min size by content length
+		{"/?size=500", 0, 500, true},       // exactly min size
+		{"/?size=0", 5, 0, false},          // empty body
+	}
+	for i, tt := range tbl {
+		req := httptest.NewRequest("GET", tt.url, http.NoBody)
+		req.Header.Set("Accept-Encoding", "deflate, gzip;q=1.0")
+		mapper := discovery.URLMapper{GzipLevel: tt.level, GzipMin: tt.min}
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: mapper}))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, "case %d", i)
+		assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"), "case %d", i)
+		size, _ := strconv.Atoi(req.URL.Query().Get("size"))
+
+		if !tt.encoded {
+			assert.Empty(t, rr.Header().Get("Content-Encoding"), "case %d", i)
+			assert.Equal(t, size, rr.Body.Len(), "case %d", i)
+			continue
+		}
+		enc := rr.Header().Get("Content-Encoding")
+		if tt.level == 0 && tt.min == 0 {
+			assert.Equal(t, "deflate", enc, "default handler picks the first supported, case %d", i)
+			continue
+		}
+		require.Equal(t, "gzip", enc, "case %d", i)
+		assert.Empty(t, rr.Header().Get("Content-Length"), "case %d", i)
+		gz, err := gzip.NewReader(rr.Body)
+		require.NoError(t, err, "case %d", i)
+		body, err := io.ReadAll(gz)
+		require.NoError(t, err, "case %d", i)
+		assert.Equal(t, strings.Repeat("x", size), string(body), "case %d", i)
+	}
+}
+
+func Test_gzipHandlerRouteNoGzip(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("x", 1000)))
+	})
+	h := gzipHandler(true)(next)
+	req := httptest.NewRequest("GET", "/", http.NoBody)
+	req.Header.Set("Accept-Encoding", "br")
+	req = req.WithContext(context.WithValue(req.Context(), ctxMatch,
+		discovery.MatchedRoute{Mapper: discovery.URLMapper{GzipLevel: 5}}))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, 1000, rr.Body.Len())
+}
+
+func Test_gzipWriterFlush(t *testing.T) {
+	rr := httptest.NewRecorder()
+	gw := &gzipWriter{ResponseWriter: rr, level: gzip.DefaultCompression, minSize: 1000}
+	_, err := gw.Write([]byte("event: 1\n\n"))
+	require.NoError(t, err)
+	gw.Flush()
+	assert.True(t, rr.Flushed)
+	assert.Equal(t, "event: 1\n\n", rr.Body.String(), "flushed before min size sent as-is")
+	_, err = gw.Write([]byte(strings.Repeat("x", 2000)))
+	require.NoError(t, err)
+	gw.close()
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, 2010, rr.Body.Len())
+}
@@ -1,11 +1,17 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/didip/tollbooth/v6"
 	"github.com/didip/tollbooth/v6/libstring"
@@ -67,10 +73,45 @@ func maxReqSizeHandler(maxSize int64) func(next http.Handler) http.Handler {
 	}
 }
 
-func accessLogHandler(wr io.Writer) func(next http.Handler) http.Handler {
+func accessLogHandler(wr io.Writer, upstream bool, routeLogs *RouteLogs) func(next http.Handler) http.Handler {
+	if !upstream && routeLogs == nil {
+		return func(next http.Handler) http.Handler {
+			return handlers.CombinedLoggingHandler(wr, next)
+		}
+	}
 	return func(next http.Handler) http.Handler {
-		return handlers.CombinedLoggingHandler(wr, next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lw := routeLogs.writer(r, wr) // route's own access log if defined
+			if upstream {
+				lw = &upstreamLogWriter{wr: lw, upstream: upstreamURL(r)}
+			}
+			handlers.CombinedLoggingHandler(lw, next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// upstreamLogWriter appends quoted upstream url to each access log line
+type upstreamLogWriter struct {
+	wr       io.Writer
+	upstream string
+}
+
+func (u *upstreamLogWriter) Write(p []byte) (int, error) {
+	line := make([]byte, 0, len(p)+len(u.upstream)+4)
+	line = append(line, bytes.TrimSuffix(p, []byte("\n"))...)
+	line = append(line, fmt.Sprintf(" %q\n", u.upstream)...)
+	if _, err := u.wr.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// upstreamURL returns destination url the request proxied to, after regex substitution. "-" if not proxied
+func upstreamURL(r *http.Request) string {
+	if uu, ok := r.Context().Value(ctxURL).(*url.URL); ok {
+		return uu.String()
 	}
+	return "-"
 }
 
 func stdoutLogHandler(enable bool, lh func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
@@ -99,7 +140,17 @@ func gzipHandler(enabled bool) func(next http.Handler) http.Handler {
 	}
 
 	log.Printf("[DEBUG] gzip enabled")
-	return handlers.CompressHandler
+	return func(next http.Handler) http.Handler {
+		compress := handlers.CompressHandler(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+			if !ok || (match.Mapper.GzipLevel == 0 && match.Mapper.GzipMin == 0) {
+				compress.ServeHTTP(w, r)
+				return
+			}
+			routeGzip(next, w, r, match.Mapper.GzipLevel, match.Mapper.GzipMin) // route with own level or min size
+		})
+	}
 }
 
 func signatureHandler(enabled bool, version string) func(next http.Handler) http.Handler {
@@ -141,8 +192,8 @@ func limiterUserHandler(reqSec int) func(next http.Handler) http.Handler {
 			keys := []string{libstring.RemoteIP(lmt.GetIPLookups(), lmt.GetForwardedForIndexFromBehind(), r)}
 
 			// add dst proxy if matched
-			if r.Context().Value(ctxMatch) != nil { // route match detected by matchHandler
-				match := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+			match, matched := r.Context().Value(ctxMatch).(discovery.MatchedRoute) // route match detected by matchHandler
+			if matched {
 				matchType := r.Context().Value(ctxMatchType).(discovery.MatchType)
 				if matchType == discovery.MTProxy {
 					keys = append(keys, match.Mapper.Dst)
@@ -150,6 +201,9 @@ func limiterUserHandler(reqSec int) func(next http.Handler) http.Handler {
 			}
 
 			if httpError := tollbooth.LimitByKeys(lmt, keys); httpError != nil {
+				if matched {
+					w.Header().Set("Retry-After", retryAfter(match.Mapper))
+				}
 				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 				return
 			}
@@ -210,6 +264,97 @@ func basicAuthHandler(enabled bool, allowed []string) func(next http.Handler) ht
 
 }
 
+// requestIDHandler ensures each proxied request has request id header, defHeader by default or overridden per route.
+// inbound request id preserved, missing one generated. The id also returned to the client with the response.
+// with disabled (empty) defHeader only routes with own header name are handled
+func requestIDHandler(defHeader string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := defHeader
+			if match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute); ok && match.Mapper.RequestIDHeader != "" {
+				header = match.Mapper.RequestIDHeader
+			}
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			id := r.Header.Get(header)
+			if id == "" {
+				id = newRequestID()
+				r.Header.Set(header, id)
+			}
+			w.Header().Set(header, id)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// newRequestID makes a random 128-bit id formatted as hex string
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("[WARN] can't generate request id, %v", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// logBodyHandler logs up to the route's LogBody bytes of the request body. This is a debug feature,
+// bodies may have credentials and personal data. The body teed as the upstream reads it, so forwarding
+// is not affected and only the part actually read is logged, after the request completed
+func logBodyHandler(l log.L) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+			if !ok || match.Mapper.LogBody <= 0 || r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+			body := &bodyCapture{ReadCloser: r.Body, limit: match.Mapper.LogBody}
+			r.Body = body
+			next.ServeHTTP(w, r)
+			l.Logf("[INFO] debug body log for %s %s%s, %d of %d bytes: %q", r.Method, r.Host, r.URL.Path,
+				body.buf.Len(), body.total, body.buf.String())
+		})
+	}
+}
+
+// slowLogHandler logs requests of routes with SlowLog threshold taking longer than the threshold
+func slowLogHandler(l log.L) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+			if !ok || match.Mapper.SlowLog <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			st := time.Now()
+			next.ServeHTTP(w, r)
+			if d := time.Since(st); d > match.Mapper.SlowLog {
+				l.Logf("[WARN] slow request %s %s%s to %s, %s, threshold %s", r.Method, r.Host, r.URL.Path,
+					match.Destination, d.Round(time.Millisecond), match.Mapper.SlowLog)
+			}
+		})
+	}
+}
+
+// bodyCapture keeps the first limit bytes read from the body and counts the total
+type bodyCapture struct {
+	io.ReadCloser
+	limit int
+	total int
+	buf   bytes.Buffer
+}
+
+func (b *bodyCapture) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if left := b.limit - b.buf.Len(); left > 0 {
+		b.buf.Write(p[:min(n, left)])
+	}
+	b.total += n
+	return n, err
+}
+
 func passThroughHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		next.ServeHTTP(w, r)
@@ -3,13 +3,19 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	log "github.com/go-pkgz/lgr"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -245,3 +251,161 @@ func TestHttp_basicAuthHandler(t *testing.T) {
 		})
 	}
 }
+
+func Test_requestIDHandler(t *testing.T) {
+	tbl := []struct {
+		name       string
+		defHeader  string
+		routeHdr   string
+		inbound    string
+		header     string
+		preserved  bool
+		noHeaderID bool
+	}{
+		{name: "generated", defHeader: "X-Request-Id", header: "X-Request-Id"},
+		{name: "preserved", defHeader: "X-Request-Id", inbound: "12345", header: "X-Request-Id", preserved: true},
+		{name: "route override", defHeader: "X-Request-Id", routeHdr: "X-Trace-Id", header: "X-Trace-Id"},
+		{name: "route override, preserved", routeHdr: "X-Trace-Id", inbound: "12345", header: "X-Trace-Id", preserved: true},
+		{name: "disabled", header: "X-Request-Id", noHeaderID: true},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamID string
+			h := requestIDHandler(tt.defHeader)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamID = r.Header.Get(tt.header)
+			}))
+			req := httptest.NewRequest("GET", "/something", http.NoBody)
+			if tt.routeHdr != "" {
+				req = req.WithContext(context.WithValue(req.Context(), ctxMatch,
+					discovery.MatchedRoute{Mapper: discovery.URLMapper{RequestIDHeader: tt.routeHdr}}))
+			}
+			if tt.inbound != "" {
+				req.Header.Set(tt.header, tt.inbound)
+			}
+			wr := httptest.NewRecorder()
+			h.ServeHTTP(wr, req)
+
+			if tt.noHeaderID {
+				assert.Empty(t, upstreamID)
+				assert.Empty(t, wr.Header().Get(tt.header))
+				return
+			}
+			if tt.preserved {
+				assert.Equal(t, tt.inbound, upstreamID)
+			} else {
+				assert.Len(t, upstreamID, 32)
+			}
+			assert.Equal(t, upstreamID, wr.Header().Get(tt.header), "returned to client")
+		})
+	}
+}
+
+func Test_logBodyHandler(t *testing.T) {
+	tbl := []struct {
+		name    string
+		limit   int
+		body    string
+		logged  bool
+		logLine string
+	}{
+		{name: "capped", limit: 4, body: "1234567890", logged: true, logLine: `POST example.com/api, 4 of 10 bytes: "1234"`},
+		{name: "full", limit: 100, body: "12345", logged: true, logLine: `POST example.com/api, 5 of 5 bytes: "12345"`},
+		{name: "disabled", limit: 0, body: "12345"},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var logs []string
+			l := log.Func(func(format string, args ...interface{}) { logs = append(logs, fmt.Sprintf(format, args...)) })
+			var upstreamBody string
+			h := logBodyHandler(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				upstreamBody = string(b)
+			}))
+			req := httptest.NewRequest("POST", "http://example.com/api", strings.NewReader(tt.body))
+			req = req.WithContext(context.WithValue(req.Context(), ctxMatch,
+				discovery.MatchedRoute{Mapper: discovery.URLMapper{LogBody: tt.limit}}))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.body, upstreamBody, "body forwarded intact")
+			if !tt.logged {
+				assert.Empty(t, logs)
+				return
+			}
+			require.Len(t, logs, 1)
+			assert.Contains(t, logs[0], tt.logLine)
+		})
+	}
+}
+
+func Test_slowLogHandler(t *testing.T) {
+	tbl := []struct {
+		name      string
+		threshold time.Duration
+		delay     time.Duration
+		logged    bool
+	}{
+		{name: "slow", threshold: 10 * time.Millisecond, delay: 20 * time.Millisecond, logged: true},
+		{name: "fast", threshold: time.Second, delay: 0},
+		{name: "disabled", threshold: 0, delay: 20 * time.Millisecond},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var logs []string
+			l := log.Func(func(format string, args ...interface{}) { logs = append(logs, fmt.Sprintf(format, args...)) })
+			h := slowLogHandler(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+			}))
+			req := httptest.NewRequest("GET", "http://example.com/api/slow", http.NoBody)
+			req = req.WithContext(context.WithValue(req.Context(), ctxMatch,
+				discovery.MatchedRoute{Destination: "http://127.0.0.1:8080/slow", Mapper: discovery.URLMapper{SlowLog: tt.threshold}}))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !tt.logged {
+				assert.Empty(t, logs)
+				return
+			}
+			require.Len(t, logs, 1)
+			assert.Contains(t, logs[0], "[WARN] slow request GET example.com/api/slow to http://127.0.0.1:8080/slow")
+			assert.Contains(t, logs[0], "threshold 10ms")
+		})
+	}
+}
+
+func Test_accessLogHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("ok")) })
+	withUpstream := func(r *http.Request) *http.Request {
+		uu, err := url.Parse("http://127.0.0.1:8080/users?id=1")
+		require.NoError(t, err)
+		return r.WithContext(context.WithValue(r.Context(), ctxURL, uu))
+	}
+
+	t.Run("no upstream", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		req := withUpstream(httptest.NewRequest("GET", "http://example.com/api/users?id=1", http.NoBody))
+		accessLogHandler(&buf, false, nil)(next).ServeHTTP(httptest.NewRecorder(), req)
+		assert.Contains(t, buf.String(), `"GET http://example.com/api/users?id=1 HTTP/1.1" 200 2`)
+		assert.NotContains(t, buf.String(), "127.0.0.1:8080")
+	})
+
+	t.Run("with upstream", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		req := withUpstream(httptest.NewRequest("GET", "http://example.com/api/users?id=1", http.NoBody))
+		accessLogHandler(&buf, true, nil)(next).ServeHTTP(httptest.NewRecorder(), req)
+		assert.Contains(t, buf.String(), `"GET http://example.com/api/users?id=1 HTTP/1.1" 200 2`)
+		assert.True(t, strings.HasSuffix(buf.String(), `" "http://127.0.0.1:8080/users?id=1"`+"\n"), buf.String())
+	})
+
+	t.Run("not proxied", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		req := httptest.NewRequest("GET", "http://example.com/static/file.txt", http.NoBody)
+		accessLogHandler(&buf, true, nil)(next).ServeHTTP(httptest.NewRecorder(), req)
+		assert.True(t, strings.HasSuffix(buf.String(), `" "-"`+"\n"), buf.String())
+	})
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// listenAndServe is http.Server.ListenAndServe with connections limiting the time of request headers reading
+func (h *Http) listenAndServe(srv *http.Server, limits *headerLimits) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(timedListener{Listener: ln, limit: limits.Load})
+}
+
+// listenAndServeTLS is http.Server.ListenAndServeTLS with connections limiting the time of request headers reading
+func (h *Http) listenAndServeTLS(srv *http.Server, limits *headerLimits, certFile, keyFile string) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServeTLS(timedListener{Listener: ln, limit: limits.Load}, certFile, keyFile)
+}
+
+// headerLimits keeps the longest HeaderTimeout of the routes, zero if any route has no HeaderTimeout.
+// Computed by Sync on routes table updates, as read on the first byte of each request
+type headerLimits struct {
+	limit atomic.Int64
+}
+
+// Sync sets the limit from the routes table
+func (l *headerLimits) Sync(mappers []discovery.URLMapper) {
+	var res time.Duration
+	for _, m := range mappers {
+		if m.HeaderTimeout <= 0 {
+			res = 0
+			break
+		}
+		res = max(res, m.HeaderTimeout)
+	}
+	l.limit.Store(int64(res))
+}
+
+// Load returns the current limit
+func (l *headerLimits) Load() time.Duration { return time.Duration(l.limit.Load()) }
+
+// timedListener wraps accepted connections with timedConn. The route is not known till request headers read,
+// so the read deadline of headers is the longest HeaderTimeout of all routes, counted from the first byte
+// of the request. Slow clients dropped by the deadline with the connection, same as with server's ReadHeaderTimeout,
+// and routes with shorter HeaderTimeout checked by headerTimeoutHandler after the match.
+// The first request of a connection counts from its first byte, so tls handshake is included in headers time
+type timedListener struct {
+	net.Listener
+	limit func() time.Duration // headers read deadline, nil or zero to rely on server's ReadHeaderTimeout only
+}
+
+// Accept wraps accepted connection with timedConn
+func (l timedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{Conn: c, limit: l.limit, waiting: true}, nil
+}
+
+// timedConn records the time of the first read of the request and sets headers read deadline from it.
+// Server's ConnState hook resets it on idle, and the next read starts the next request
+type timedConn struct {
+	net.Conn
+	limit func() time.Duration
+
+	lock      sync.Mutex
+	waiting   bool      // waiting for the first byte of the request
+	start     time.Time // first byte of the request, zero if not known, i.e. for pipelined requests
+	headersDl time.Time // read deadline of the request headers, zero if not set
+	serverDl  time.Time // read deadline set by the server
+}
+
+// Read records the first byte time of the request and sets headers read deadline
+func (c *timedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lock.Lock()
+		if c.waiting {
+			c.start, c.waiting = time.Now(), false
+			if c.limit != nil {
+				if limit := c.limit(); limit > 0 {
+					c.headersDl = c.start.Add(limit)
+					_ = c.applyDeadline()
+				}
+			}
+		}
+		c.lock.Unlock()
+	}
+	return n, err
+}
+
+// SetReadDeadline sets server's read deadline, headers deadline stays in effect if earlier
+func (c *timedConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.serverDl = t
+	return c.applyDeadline()
+}
+
+// SetDeadline sets server's read and write deadlines
+func (c *timedConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+// applyDeadline sets the earliest of server's and headers deadlines, lock must be held
+func (c *timedConn) applyDeadline() error {
+	dl := c.serverDl
+	if !c.headersDl.IsZero() && (dl.IsZero() || c.headersDl.Before(dl)) {
+		dl = c.headersDl
+	}
+	return c.Conn.SetReadDeadline(dl)
+}
+
+// headersRead drops headers deadline, request body and hijacked connections get server's deadline only
+func (c *timedConn) headersRead() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.headersDl.IsZero() {
+		c.headersDl = time.Time{}
+		_ = c.applyDeadline()
+	}
+}
+
+func (c *timedConn) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.start, c.waiting = time.Time{}, true
+	if !c.headersDl.IsZero() {
+		c.headersDl = time.Time{}
+		_ = c.applyDeadline()
+	}
+}
+
+func (c *timedConn) started() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.start
+}
+
+type ctxConnKey struct{}
+
+// headerConnState resets request start time of idle connections, set as http.Server.ConnState
+func headerConnState(c net.Conn, state http.ConnState) {
+	if state != http.StateIdle {
+		return
+	}
+	if tc, ok := timedConnOf(c); ok {
+		tc.reset()
+	}
+}
+
+// headerConnContext passes the connection to handlers, set as http.Server.ConnContext
+func headerConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, ctxConnKey{}, c)
+}
+
+// headersReadHandler drops headers deadline of the connection once request headers read, set as server's handler
+func headersReadHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := r.Context().Value(ctxConnKey{}).(net.Conn); ok {
+			if tc, ok := timedConnOf(c); ok {
+				tc.headersRead()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerTimeoutHandler rejects requests to routes with HeaderTimeout if their headers read slower than the timeout.
+// Requests slower than the longest HeaderTimeout never get here, dropped by timedConn's read deadline
+func headerTimeoutHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || match.Mapper.HeaderTimeout <= 0 || r.ProtoMajor != 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if elapsed, ok := headersTime(r); ok && elapsed > match.Mapper.HeaderTimeout {
+			log.Printf("[WARN] request headers from %s read in %v, over %v of %s %s, rejected", r.RemoteAddr,
+				elapsed.Truncate(time.Millisecond), match.Mapper.HeaderTimeout, match.Mapper.Server, match.Mapper.SrcMatch.String())
+			w.Header().Set("Connection", "close")
+			http.Error(w, http.StatusText(http.StatusRequestTimeout), http.StatusRequestTimeout)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headersTime returns time since the first byte of the request, i.e. time spent reading headers
+func headersTime(r *http.Request) (time.Duration, bool) {
+	c, ok := r.Context().Value(ctxConnKey{}).(net.Conn)
+	if !ok {
+		return 0, false
+	}
+	tc, ok := timedConnOf(c)
+	if !ok {
+		return 0, false
+	}
+	start := tc.started()
+	if start.IsZero() {
+		return 0, false
+	}
+	return time.Since(start), true
+}
+
+func timedConnOf(c net.Conn) (*timedConn, bool) {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	tc, ok := c.(*timedConn)
+	return tc, ok
+}
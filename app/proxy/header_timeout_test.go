@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_headerTimeoutHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{}}
+		if strings.HasPrefix(r.URL.Path, "/strict") {
+			m.Mapper.HeaderTimeout = 100 * time.Millisecond
+		}
+		r = r.WithContext(context.WithValue(r.Context(), ctxMatch, m))
+		headerTimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		})).ServeHTTP(w, r)
+	})
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Listener = timedListener{Listener: ts.Listener}
+	ts.Config.ConnState = headerConnState
+	ts.Config.ConnContext = headerConnContext
+	ts.Start()
+	defer ts.Close()
+
+	// send sends request headers with delay before the final line, returns response status
+	send := func(conn net.Conn, rd *bufio.Reader, path string, delay time.Duration) int {
+		_, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\n", path)
+		require.NoError(t, err)
+		time.Sleep(delay)
+		_, err = fmt.Fprint(conn, "X-Test: 1\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(rd, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	assert.Equal(t, http.StatusOK, send(conn, rd, "/strict", 0))
+	time.Sleep(150 * time.Millisecond) // idle keep-alive time is not counted
+	assert.Equal(t, http.StatusOK, send(conn, rd, "/strict", 0))
+	assert.Equal(t, http.StatusOK, send(conn, rd, "/regular", 150*time.Millisecond), "no limit for the route")
+	assert.Equal(t, http.StatusRequestTimeout, send(conn, rd, "/strict", 150*time.Millisecond))
+	_, err = rd.ReadByte()
+	assert.Equal(t, io.EOF, err, "connection closed")
+}
+
+func TestHttp_headerDeadline(t *testing.T) {
+	ts := httptest.NewUnstartedServer(headersReadHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		_, _ = w.Write(body)
+	})))
+	ts.Listener = timedListener{Listener: ts.Listener, limit: func() time.Duration { return 100 * time.Millisecond }}
+	ts.Config.ConnState = headerConnState
+	ts.Config.ConnContext = headerConnContext
+	ts.Start()
+	defer ts.Close()
+
+	t.Run("slow headers dropped", func(t *testing.T) {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n")
+		require.NoError(t, err)
+		st := time.Now()
+		_, err = bufio.NewReader(conn).ReadByte()
+		assert.Equal(t, io.EOF, err, "connection closed without response")
+		assert.Less(t, time.Since(st), time.Second)
+	})
+
+	t.Run("slow body and idle time not limited", func(t *testing.T) {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		rd := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			_, err = fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\n")
+			require.NoError(t, err)
+			time.Sleep(150 * time.Millisecond)
+			_, err = fmt.Fprint(conn, "body")
+			require.NoError(t, err)
+			resp, err := http.ReadResponse(rd, nil)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "body", string(body))
+			time.Sleep(150 * time.Millisecond)
+		}
+	})
+}
+
+func TestHeaderLimits_Sync(t *testing.T) {
+	tbl := []struct {
+		timeouts []time.Duration
+		res      time.Duration
+	}{
+		{nil, 0},
+		{[]time.Duration{time.Second, 3 * time.Second}, 3 * time.Second},
+		{[]time.Duration{time.Second, 0}, 0},
+	}
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var mappers []discovery.URLMapper
+			for _, d := range tt.timeouts {
+				mappers = append(mappers, discovery.URLMapper{HeaderTimeout: d})
+			}
+			l := headerLimits{}
+			l.Sync([]discovery.URLMapper{{HeaderTimeout: time.Hour}})
+			l.Sync(mappers)
+			assert.Equal(t, tt.res, l.Load())
+		})
+	}
+}
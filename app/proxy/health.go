@@ -27,16 +27,22 @@ func (h *Http) healthHandler(w http.ResponseWriter, _ *http.Request) {
 
 	mappers := h.Mappers()
 	total := 0
+	critical := map[string]bool{} // ping urls of critical routes, shared ping url is critical if any route is
 	for _, m := range mappers {
 		if m.MatchType == discovery.MTProxy {
 			total++
+			critical[m.PingURL] = critical[m.PingURL] || !m.NonCritical
 		}
 	}
 
 	pingErrs := h.CheckHealth()
 
 	var errs []string
-	for _, pingErr := range pingErrs {
+	for pingURL, pingErr := range pingErrs {
+		if !critical[pingURL] {
+			delete(pingErrs, pingURL) // not a part of aggregated health
+			continue
+		}
 		if pingErr != nil {
 			errs = append(errs, pingErr.Error())
 		}
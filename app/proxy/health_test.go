@@ -3,6 +3,7 @@ package proxy
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -123,6 +124,41 @@ func TestHttp_healthHandler(t *testing.T) {
 	assert.Equal(t, 3, count, "3 pings for non-assets routes")
 }
 
+func TestHttp_healthHandlerNonCritical(t *testing.T) {
+	matcher := &MatcherMock{
+		MappersFunc: func() []discovery.URLMapper {
+			return []discovery.URLMapper{
+				{MatchType: discovery.MTProxy, PingURL: "http://10.0.0.1/ping"},
+				{MatchType: discovery.MTProxy, PingURL: "http://10.0.0.2/ping", NonCritical: true},
+				{MatchType: discovery.MTProxy, PingURL: "http://10.0.0.3/ping", NonCritical: true},
+				{MatchType: discovery.MTProxy, PingURL: "http://10.0.0.3/ping"}, // shared with critical route
+			}
+		},
+		CheckHealthFunc: func() map[string]error {
+			return map[string]error{"http://10.0.0.1/ping": nil, "http://10.0.0.2/ping": errors.New("failed 10.0.0.2"),
+				"http://10.0.0.3/ping": nil}
+		},
+	}
+	h := Http{Matcher: matcher}
+	rr := httptest.NewRecorder()
+	h.healthHandler(rr, &http.Request{})
+	assert.Equal(t, http.StatusOK, rr.Code, "non-critical route failure ignored")
+	assert.Equal(t, `{"status": "ok", "services": 4}`, rr.Body.String())
+
+	matcher.CheckHealthFunc = func() map[string]error {
+		return map[string]error{"http://10.0.0.1/ping": nil, "http://10.0.0.2/ping": errors.New("failed 10.0.0.2"),
+			"http://10.0.0.3/ping": errors.New("failed 10.0.0.3")}
+	}
+	rr = httptest.NewRecorder()
+	h.healthHandler(rr, &http.Request{})
+	assert.Equal(t, http.StatusExpectationFailed, rr.Code)
+	res := map[string]interface{}{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&res))
+	assert.Equal(t, 1., res["passed"])
+	assert.Equal(t, 1., res["failed"])
+	assert.Equal(t, []interface{}{"failed 10.0.0.3"}, res["errors"])
+}
+
 func TestHttp_pingHandler(t *testing.T) {
 	port := rand.Intn(10000) + 40000
 	h := Http{Timeouts: Timeouts{ResponseHeader: 200 * time.Millisecond}, Address: fmt.Sprintf("127.0.0.1:%d", port)}
@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // sha256 and sha512 registered for crypto.Hash
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+const (
+	jwtLeeway     = time.Minute      // clock skew allowed checking exp and nbf
+	jwksTTL       = 10 * time.Minute // how long fetched key set reused
+	jwksMinReload = 30 * time.Second // min interval of key set reloads on unknown kid
+)
+
+// jwtValidator rejects requests to routes with JWT without valid bearer token in Authorization header, with 401.
+// Token accepted if its signature verified by the route's key, it is not expired and has all required claims.
+// Claims listed in JWT.Headers forwarded to upstream as request headers, and the same headers sent by the client
+// always dropped. Key sets of JWKS urls fetched on the first use and cached for jwksTTL, token with unknown kid
+// reloads the set, but not more often than jwksMinReload
+type jwtValidator struct {
+	reporter Reporter
+	client   *http.Client
+	now      func() time.Time
+
+	lock sync.Mutex
+	sets map[string]*jwks // url -> key set
+}
+
+// jwks is a json web key set fetched from url
+type jwks struct {
+	lock    sync.Mutex
+	keys    []jwk
+	fetched time.Time // last successful fetch
+	checked time.Time // last fetch attempt, failed fetches retried after jwksMinReload
+}
+
+type jwk struct {
+	kid string
+	key crypto.PublicKey // *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+func newJWTValidator(reporter Reporter) *jwtValidator {
+	return &jwtValidator{reporter: reporter, client: &http.Client{Timeout: 5 * time.Second}, now: time.Now,
+		sets: map[string]*jwks{}}
+}
+
+// Middleware validates bearer token of requests to routes with JWT
+func (v *jwtValidator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || !match.Mapper.JWT.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg := match.Mapper.JWT
+		for _, hdr := range cfg.Headers {
+			r.Header.Del(hdr) // set from the token only, not by the client
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || strings.TrimSpace(token) == "" {
+			log.Printf("[DEBUG] bearer token required for %s %s, rejected request from %s",
+				match.Mapper.Server, match.Mapper.SrcMatch.String(), r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			v.report(w, http.StatusUnauthorized)
+			return
+		}
+		claims, err := v.validate(r.Context(), strings.TrimSpace(token), cfg)
+		if err != nil {
+			log.Printf("[DEBUG] invalid bearer token for %s %s, rejected request from %s, %v",
+				match.Mapper.Server, match.Mapper.SrcMatch.String(), r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			v.report(w, http.StatusUnauthorized)
+			return
+		}
+		for name, hdr := range cfg.Headers {
+			if val, ok := claimValue(claims[name]); ok {
+				r.Header.Set(hdr, val)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validate verifies token signature and claims, returns claims of the valid token
+func (v *jwtValidator) validate(ctx context.Context, token string, cfg discovery.JWT) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if err = v.verify(ctx, header.Alg, header.Kid, parts[0]+"."+parts[1], sig, cfg); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]any{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	now := v.now()
+	if exp, ok := claims["exp"].(json.Number); ok {
+		if ts, err := exp.Float64(); err != nil || now.After(time.Unix(int64(ts), 0).Add(jwtLeeway)) {
+			return nil, errors.New("token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if ts, err := nbf.Float64(); err != nil || now.Add(jwtLeeway).Before(time.Unix(int64(ts), 0)) {
+			return nil, errors.New("token not valid yet")
+		}
+	}
+	for name, want := range cfg.Claims {
+		if !claimMatch(claims[name], want) {
+			return nil, fmt.Errorf("claim %s mismatch", name)
+		}
+	}
+	return claims, nil
+}
+
+// verify checks signature of the signed part. HMAC algorithms accepted with secret only, and RSA and EC ones
+// with key set only, so the token can't pick the key type, i.e. sign HS256 with the public RSA key
+func (v *jwtValidator) verify(ctx context.Context, alg, kid, signed string, sig []byte, cfg discovery.JWT) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 || hashes[alg[2:]] == 0 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hash := hashes[alg[2:]]
+
+	switch alg[:2] {
+	case "HS":
+		if cfg.Secret == "" {
+			return fmt.Errorf("algorithm %s not allowed with key set", alg)
+		}
+		mac := hmac.New(hash.New, []byte(cfg.Secret))
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case "RS", "ES":
+		if cfg.JWKSURL == "" {
+			return fmt.Errorf("algorithm %s not allowed with secret", alg)
+		}
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+		keys, err := v.keys(ctx, cfg.JWKSURL, kid)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if kid != "" && k.kid != kid {
+				continue
+			}
+			switch key := k.key.(type) {
+			case *rsa.PublicKey:
+				if alg[:2] == "RS" && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+					return nil
+				}
+			case *ecdsa.PublicKey:
+				size := (key.Curve.Params().BitSize + 7) / 8
+				if alg[:2] == "ES" && len(sig) == 2*size && ecdsa.Verify(key, digest,
+					new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+					return nil
+				}
+			}
+		}
+		return errors.New("invalid signature")
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// keys returns keys of the set, fetched if not cached or expired, and reloaded if no key with kid
+func (v *jwtValidator) keys(ctx context.Context, url, kid string) ([]jwk, error) {
+	v.lock.Lock()
+	set, ok := v.sets[url]
+	if !ok {
+		set = &jwks{}
+		v.sets[url] = set
+	}
+	v.lock.Unlock()
+
+	set.lock.Lock() // fetch of the set serialized, requests wait for the same fetch
+	defer set.lock.Unlock()
+	now := v.now()
+	hasKid := func() bool {
+		for _, k := range set.keys {
+			if k.kid == kid {
+				return true
+			}
+		}
+		return kid == ""
+	}
+	stale := now.Sub(set.fetched) > jwksTTL || !hasKid()
+	if !stale || now.Sub(set.checked) < jwksMinReload {
+		if len(set.keys) == 0 {
+			return nil, fmt.Errorf("no keys loaded from jwks %s", url)
+		}
+		return set.keys, nil
+	}
+	set.checked = now
+	keys, err := v.fetch(ctx, url)
+	if err != nil {
+		if len(set.keys) > 0 {
+			log.Printf("[WARN] can't reload jwks %s, using cached keys, %v", url, err)
+			return set.keys, nil
+		}
+		return nil, err
+	}
+	log.Printf("[DEBUG] loaded %d keys from jwks %s", len(keys), url)
+	set.keys, set.fetched = keys, now
+	return keys, nil
+}
+
+// fetch loads json web key set, keys of unsupported types skipped
+func (v *jwtValidator) fetch(ctx context.Context, url string) ([]jwk, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("can't make jwks request: %w", err)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't get jwks %s: %w", url, err)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't get jwks %s, status %d", url, resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("can't decode jwks %s: %w", url, err)
+	}
+	curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+	num := func(s string) (*big.Int, bool) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b), err == nil && len(b) > 0
+	}
+	res := []jwk{}
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, okN := num(k.N)
+			e, okE := num(k.E)
+			if okN && okE && e.IsInt64() {
+				res = append(res, jwk{kid: k.Kid, key: &rsa.PublicKey{N: n, E: int(e.Int64())}})
+			}
+		case "EC":
+			x, okX := num(k.X)
+			y, okY := num(k.Y)
+			if curve, ok := curves[k.Crv]; ok && okX && okY {
+				res = append(res, jwk{kid: k.Kid, key: &ecdsa.PublicKey{Curve: curve, X: x, Y: y}})
+			}
+		}
+	}
+	return res, nil
+}
+
+func (v *jwtValidator) report(w http.ResponseWriter, code int) {
+	if v.reporter == nil {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	v.reporter.Report(w, code)
+}
+
+// decodeSegment decodes base64url json segment of the token, numbers kept as json.Number
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// claimMatch checks if claim value, or any element of array claim, equals to want
+func claimMatch(claim any, want string) bool {
+	if arr, ok := claim.([]any); ok {
+		for _, elem := range arr {
+			if val, ok := claimValue(elem); ok && val == want {
+				return true
+			}
+		}
+		return false
+	}
+	val, ok := claimValue(claim)
+	return ok && val == want
+}
+
+// claimValue returns string form of scalar claim, elements of array claim joined with comma
+func claimValue(claim any) (string, bool) {
+	switch val := claim.(type) {
+	case string:
+		return val, true
+	case json.Number:
+		return val.String(), true
+	case bool:
+		return fmt.Sprintf("%t", val), true
+	case []any:
+		elems := make([]string, 0, len(val))
+		for _, elem := range val {
+			if s, ok := claimValue(elem); ok {
+				elems = append(elems, s)
+			}
+		}
+		return strings.Join(elems, ","), len(elems) > 0
+	}
+	return "", false
+}
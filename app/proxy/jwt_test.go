@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestJWTValidator_Secret(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	v := newJWTValidator(nil)
+	v.now = func() time.Time { return now }
+	h := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("user=" + r.Header.Get("X-User") + ";roles=" + r.Header.Get("X-Roles")))
+	}))
+
+	cfg := discovery.JWT{Secret: "secret", Claims: map[string]string{"iss": "auth", "aud": "api"},
+		Headers: map[string]string{"sub": "X-User", "roles": "X-Roles"}}
+	hs := func(secret string, claims map[string]any) string {
+		return signJWT(t, map[string]any{"alg": "HS256"}, claims, func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(signed)
+			return mac.Sum(nil)
+		})
+	}
+	valid := map[string]any{"sub": "user1", "iss": "auth", "aud": []string{"web", "api"}, "roles": []string{"a", "b"},
+		"exp": now.Add(time.Hour).Unix()}
+
+	tbl := []struct {
+		name  string
+		token string
+		code  int
+		body  string
+	}{
+		{name: "valid", token: "Bearer " + hs("secret", valid), code: http.StatusOK, body: "user=user1;roles=a,b"},
+		{name: "no token", code: http.StatusUnauthorized},
+		{name: "not bearer", token: "Basic dXNlcjpwYXNz", code: http.StatusUnauthorized},
+		{name: "malformed", token: "Bearer abc.def", code: http.StatusUnauthorized},
+		{name: "wrong secret", token: "Bearer " + hs("other", valid), code: http.StatusUnauthorized},
+		{name: "expired", token: "Bearer " + hs("secret", map[string]any{"sub": "user1", "iss": "auth", "aud": "api",
+			"exp": now.Add(-2 * time.Minute).Unix()}), code: http.StatusUnauthorized},
+		{name: "expired within leeway", token: "Bearer " + hs("secret", map[string]any{"sub": "user1", "iss": "auth",
+			"aud": "api", "exp": now.Add(-30 * time.Second).Unix()}), code: http.StatusOK, body: "user=user1;roles="},
+		{name: "not valid yet", token: "Bearer " + hs("secret", map[string]any{"iss": "auth", "aud": "api",
+			"nbf": now.Add(time.Hour).Unix()}), code: http.StatusUnauthorized},
+		{name: "claim mismatch", token: "Bearer " + hs("secret", map[string]any{"iss": "other", "aud": "api"}),
+			code: http.StatusUnauthorized},
+		{name: "claim missing", token: "Bearer " + hs("secret", map[string]any{"iss": "auth"}), code: http.StatusUnauthorized},
+		{name: "alg none", token: "Bearer " + signJWT(t, map[string]any{"alg": "none"}, valid,
+			func([]byte) []byte { return nil }), code: http.StatusUnauthorized},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+			req.Header.Set("X-User", "admin") // spoofed, dropped
+			if tt.token != "" {
+				req.Header.Set("Authorization", tt.token)
+			}
+			req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{
+				Mapper: discovery.URLMapper{JWT: cfg}}))
+			wr := httptest.NewRecorder()
+			h.ServeHTTP(wr, req)
+			assert.Equal(t, tt.code, wr.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.body, wr.Body.String())
+				return
+			}
+			assert.Contains(t, wr.Header().Get("WWW-Authenticate"), "Bearer")
+		})
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+	req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{}))
+	wr := httptest.NewRecorder()
+	h.ServeHTTP(wr, req)
+	assert.Equal(t, http.StatusOK, wr.Code, "no jwt for the route")
+}
+
+func TestJWTValidator_JWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	var fetches int32
+	jwksSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))),
+				"y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "oct", "kid": "unsupported", "k": "c2VjcmV0"},
+		}})
+	}))
+	defer jwksSrv.Close()
+
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	v := newJWTValidator(nil)
+	v.now = func() time.Time { return now }
+	h := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cfg := discovery.JWT{JWKSURL: jwksSrv.URL}
+
+	claims := map[string]any{"sub": "user1"}
+	rs := func(kid string) string {
+		return signJWT(t, map[string]any{"alg": "RS256", "kid": kid}, claims, func(signed []byte) []byte {
+			digest := sha256.Sum256(signed)
+			sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+			require.NoError(t, err)
+			return sig
+		})
+	}
+	es := signJWT(t, map[string]any{"alg": "ES256", "kid": "ec1"}, claims, func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		require.NoError(t, err)
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	})
+	hs := signJWT(t, map[string]any{"alg": "HS256"}, claims, func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	})
+
+	do := func(token string) int {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{
+			Mapper: discovery.URLMapper{JWT: cfg}}))
+		wr := httptest.NewRecorder()
+		h.ServeHTTP(wr, req)
+		return wr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, do(rs("rsa1")))
+	assert.Equal(t, http.StatusOK, do(rs("")), "no kid, any key")
+	assert.Equal(t, http.StatusOK, do(es))
+	assert.Equal(t, http.StatusUnauthorized, do(rs("ec1")), "key of other type")
+	assert.Equal(t, http.StatusUnauthorized, do(hs), "hmac not allowed with key set")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "key set cached")
+
+	assert.Equal(t, http.StatusUnauthorized, do(rs("rsa2")))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "unknown kid, reload limited")
+	now = now.Add(time.Minute)
+	assert.Equal(t, http.StatusUnauthorized, do(rs("rsa2")))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches), "unknown kid, key set reloaded")
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, http.StatusOK, do(es))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches), "expired key set reloaded")
+
+	jwksSrv.Close()
+	now = now.Add(time.Hour)
+	assert.Equal(t, http.StatusOK, do(es), "cached keys used if key set can't be reloaded")
+
+	cfg.JWKSURL = jwksSrv.URL + "/other"
+	assert.Equal(t, http.StatusUnauthorized, do(es), "key set can't be loaded")
+}
+
+// signJWT makes token with header and claims signed by sign func
+func signJWT(t *testing.T, header, claims map[string]any, sign func(signed []byte) []byte) string {
+	enc := func(v any) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := fmt.Sprintf("%s.%s", enc(header), enc(claims))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
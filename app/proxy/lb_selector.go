@@ -3,6 +3,8 @@ package proxy
 import (
 	"math/rand"
 	"sync"
+
+	"github.com/umputun/reproxy/app/discovery"
 )
 
 // RoundRobinSelector is a simple round-robin selector, thread-safe
@@ -43,3 +45,26 @@ type LBSelectorFunc func(n int) int
 func (f LBSelectorFunc) Select(n int) int {
 	return f(n)
 }
+
+// selectMatch picks one of alive matches. If destinations have different weights, i.e. one of them is draining,
+// the pick is weighted random, otherwise the selector decides. matches expected to be non-empty
+func selectMatch(matches []discovery.MatchedRoute, picker LBSelector) discovery.MatchedRoute {
+	if len(matches) == 1 {
+		return matches[0]
+	}
+	total, weighted := 0, false
+	for _, m := range matches {
+		total += m.Mapper.EffectiveWeight()
+		weighted = weighted || m.Mapper.EffectiveWeight() != matches[0].Mapper.EffectiveWeight()
+	}
+	if !weighted {
+		return matches[picker.Select(len(matches))]
+	}
+	n := rand.Intn(total) //nolint:gosec // no need for crypto/rand here
+	for _, m := range matches {
+		if n -= m.Mapper.EffectiveWeight(); n < 0 {
+			return m
+		}
+	}
+	return matches[len(matches)-1]
+}
@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
 )
 
 func TestRoundRobinSelector_Select(t *testing.T) {
@@ -119,3 +121,32 @@ func TestLBSelectorFunc_Select(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectMatch(t *testing.T) {
+	mr := func(dst string, weight int) discovery.MatchedRoute {
+		return discovery.MatchedRoute{Destination: dst, Alive: true, Mapper: discovery.URLMapper{Dst: dst, Weight: weight}}
+	}
+
+	t.Run("same weights, selector used", func(t *testing.T) {
+		matches := []discovery.MatchedRoute{mr("a", 0), mr("b", 100), mr("c", 0)}
+		picker := LBSelectorFunc(func(n int) int { return n - 1 })
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, "c", selectMatch(matches, picker).Destination)
+		}
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		matches := []discovery.MatchedRoute{mr("a", 0), mr("b", 10)}
+		picker := LBSelectorFunc(func(int) int { t.Fatal("selector used"); return 0 })
+		counts := map[string]int{}
+		for i := 0; i < 11000; i++ {
+			counts[selectMatch(matches, picker).Destination]++
+		}
+		assert.InDelta(t, 10000, counts["a"], 500)
+		assert.InDelta(t, 1000, counts["b"], 500)
+	})
+
+	t.Run("single", func(t *testing.T) {
+		assert.Equal(t, "a", selectMatch([]discovery.MatchedRoute{mr("a", 1)}, &RandomSelector{}).Destination)
+	})
+}
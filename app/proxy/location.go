@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// rewriteLocation changes Location header pointing to the upstream's internal address (base) to the external path.
+// I.e. for route ^/api/(.*) -> http://172.17.0.2:8080/$1 the upstream's redirect to http://172.17.0.2:8080/login
+// rewritten to /api/login. Locations pointing anywhere else kept as-is
+func rewriteLocation(resp *http.Response, base, prefix string) {
+	loc := resp.Header.Get("Location")
+	if loc == "" || base == "" {
+		return
+	}
+	bu, err := url.Parse(base)
+	if err != nil {
+		return
+	}
+	lu, err := url.Parse(loc)
+	if err != nil || !strings.EqualFold(lu.Host, bu.Host) {
+		return
+	}
+
+	res := url.URL{Path: prefix + lu.Path, RawQuery: lu.RawQuery, Fragment: lu.Fragment}
+	if res.Path == "" {
+		res.Path = "/"
+	}
+	log.Printf("[DEBUG] rewrite location %s to %s", loc, res.String())
+	resp.Header.Set("Location", res.String())
+}
+
+// locationPrefix returns external path prefix of the route, i.e. /api for request /api/foo proxied to /foo.
+// empty if the upstream path is not a suffix of the request path
+func locationPrefix(reqPath, upstreamPath string) string {
+	if !strings.HasSuffix(reqPath, upstreamPath) {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(reqPath, upstreamPath), "/")
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rewriteLocation(t *testing.T) {
+	tbl := []struct {
+		loc, base, prefix, res string
+	}{
+		{"http://172.17.0.2:8080/login", "http://172.17.0.2:8080", "/api", "/api/login"},
+		{"http://172.17.0.2:8080/login?next=/x#top", "http://172.17.0.2:8080", "/api", "/api/login?next=/x#top"},
+		{"http://172.17.0.2:8080", "http://172.17.0.2:8080", "", "/"},
+		{"http://172.17.0.2:8080/", "http://172.17.0.2:8080", "", "/"},
+		{"https://example.com/login", "http://172.17.0.2:8080", "/api", "https://example.com/login"},
+		{"/login", "http://172.17.0.2:8080", "/api", "/login"},
+		{"http://172.17.0.2:8081/login", "http://172.17.0.2:8080", "/api", "http://172.17.0.2:8081/login"},
+		{"http://172.17.0.2:8080/login", "", "/api", "http://172.17.0.2:8080/login"},
+		{"", "http://172.17.0.2:8080", "/api", ""},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.loc, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tt.loc != "" {
+				resp.Header.Set("Location", tt.loc)
+			}
+			rewriteLocation(resp, tt.base, tt.prefix)
+			assert.Equal(t, tt.res, resp.Header.Get("Location"))
+		})
+	}
+}
+
+func Test_locationPrefix(t *testing.T) {
+	assert.Equal(t, "/api", locationPrefix("/api/foo/bar", "/foo/bar"))
+	assert.Equal(t, "/api", locationPrefix("/api/", "/"))
+	assert.Equal(t, "", locationPrefix("/foo", "/foo"))
+	assert.Equal(t, "", locationPrefix("/api/foo", "/bar"))
+}
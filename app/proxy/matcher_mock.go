@@ -25,7 +25,7 @@ var _ Matcher = &MatcherMock{}
 // 			MappersFunc: func() []discovery.URLMapper {
 // 				panic("mock out the Mappers method")
 // 			},
-// 			MatchFunc: func(srv string, src string) discovery.Matches {
+// 			MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
 // 				panic("mock out the Match method")
 // 			},
 // 			ServersFunc: func() []string {
@@ -45,7 +45,7 @@ type MatcherMock struct {
 	MappersFunc func() []discovery.URLMapper
 
 	// MatchFunc mocks the Match method.
-	MatchFunc func(srv string, src string) discovery.Matches
+	MatchFunc func(srv string, src string, info discovery.RequestInfo) discovery.Matches
 
 	// ServersFunc mocks the Servers method.
 	ServersFunc func() []string
@@ -64,6 +64,8 @@ type MatcherMock struct {
 			Srv string
 			// Src is the src argument value.
 			Src string
+			// Info is the info argument value.
+			Info discovery.RequestInfo
 		}
 		// Servers holds details about calls to the Servers method.
 		Servers []struct {
@@ -128,33 +130,37 @@ func (mock *MatcherMock) MappersCalls() []struct {
 }
 
 // Match calls MatchFunc.
-func (mock *MatcherMock) Match(srv string, src string) discovery.Matches {
+func (mock *MatcherMock) Match(srv string, src string, info discovery.RequestInfo) discovery.Matches {
 	if mock.MatchFunc == nil {
 		panic("MatcherMock.MatchFunc: method is nil but Matcher.Match was just called")
 	}
 	callInfo := struct {
-		Srv string
-		Src string
+		Srv  string
+		Src  string
+		Info discovery.RequestInfo
 	}{
-		Srv: srv,
-		Src: src,
+		Srv:  srv,
+		Src:  src,
+		Info: info,
 	}
 	mock.lockMatch.Lock()
 	mock.calls.Match = append(mock.calls.Match, callInfo)
 	mock.lockMatch.Unlock()
-	return mock.MatchFunc(srv, src)
+	return mock.MatchFunc(srv, src, info)
 }
 
 // MatchCalls gets all the calls that were made to Match.
 // Check the length with:
 //     len(mockedMatcher.MatchCalls())
 func (mock *MatcherMock) MatchCalls() []struct {
-	Srv string
-	Src string
+	Srv  string
+	Src  string
+	Info discovery.RequestInfo
 } {
 	var calls []struct {
-		Srv string
-		Src string
+		Srv  string
+		Src  string
+		Info discovery.RequestInfo
 	}
 	mock.lockMatch.RLock()
 	calls = mock.calls.Match
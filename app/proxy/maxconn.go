@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// connLimiter limits in-flight requests per route with MaxConn set. Excess requests rejected with 503 right away,
+// or, if the route has MaxConnWait, queued up to MaxConnWait and rejected only if no slot freed in time
+type connLimiter struct {
+	reporter Reporter
+	sema     sync.Map // route key -> chan struct{} with MaxConn capacity
+}
+
+func newConnLimiter(reporter Reporter) *connLimiter {
+	return &connLimiter{reporter: reporter}
+}
+
+// Middleware limits concurrent requests for routes with MaxConn
+func (c *connLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || match.Mapper.MaxConn <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v, _ := c.sema.LoadOrStore(connKey(match.Mapper), make(chan struct{}, match.Mapper.MaxConn))
+		sema := v.(chan struct{})
+
+		if !c.acquire(r, sema, match.Mapper.MaxConnWait) {
+			log.Printf("[WARN] max connections %d reached for %s", match.Mapper.MaxConn, match.Mapper.Dst)
+			w.Header().Set("Retry-After", retryAfter(match.Mapper))
+			c.report(w, http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-sema }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Sync drops semaphores of routes not in mappers anymore, i.e. of removed containers and changed limits.
+// Requests in flight keep their semaphore till done
+func (c *connLimiter) Sync(mappers []discovery.URLMapper) {
+	used := map[string]bool{}
+	for _, m := range mappers {
+		if m.MaxConn > 0 {
+			used[connKey(m)] = true
+		}
+	}
+	c.sema.Range(func(key, _ any) bool {
+		if !used[key.(string)] {
+			c.sema.Delete(key)
+		}
+		return true
+	})
+}
+
+// connKey is a semaphore key of the route. Limit applied per destination, and the key includes the limit
+// to start a new semaphore on the limit change
+func connKey(m discovery.URLMapper) string {
+	return fmt.Sprintf("%s|%s|%d", m.Server, m.Dst, m.MaxConn)
+}
+
+// ipConnLimiter limits in-flight requests per client ip for routes with MaxConnPerIP. Excess requests rejected
+// with 429. Counters kept for clients with requests in flight only, the counter dropped with the last request done
+type ipConnLimiter struct {
+	reporter Reporter
+	clientIP func(r *http.Request) string
+
+	lock  sync.Mutex
+	conns map[string]int // route key and client ip -> in-flight requests
+}
+
+func newIPConnLimiter(reporter Reporter, clientIP func(r *http.Request) string) *ipConnLimiter {
+	return &ipConnLimiter{reporter: reporter, clientIP: clientIP, conns: map[string]int{}}
+}
+
+// Middleware limits concurrent requests of a client ip for routes with MaxConnPerIP
+func (c *ipConnLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || match.Mapper.MaxConnPerIP <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// limit applied per route, all destinations of the route share the client's limit
+		ip := c.clientIP(r)
+		key := fmt.Sprintf("%s|%s|%s", match.Mapper.Server, match.Mapper.SrcMatch.String(), ip)
+		if !c.acquire(key, match.Mapper.MaxConnPerIP) {
+			log.Printf("[WARN] max connections per ip %d reached for %s from %s", match.Mapper.MaxConnPerIP,
+				match.Mapper.Dst, ip)
+			w.Header().Set("Retry-After", retryAfter(match.Mapper))
+			c.report(w, http.StatusTooManyRequests)
+			return
+		}
+		defer c.release(key)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *ipConnLimiter) acquire(key string, limit int) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conns[key] >= limit {
+		return false
+	}
+	c.conns[key]++
+	return true
+}
+
+func (c *ipConnLimiter) release(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conns[key]--; c.conns[key] <= 0 {
+		delete(c.conns, key) // no requests in flight, nothing to keep for idle client
+	}
+}
+
+func (c *ipConnLimiter) report(w http.ResponseWriter, code int) {
+	if c.reporter == nil {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	c.reporter.Report(w, code)
+}
+
+func (c *connLimiter) acquire(r *http.Request, sema chan struct{}, wait time.Duration) bool {
+	select {
+	case sema <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case sema <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// retryAfter returns Retry-After value for rejected requests of the route, 1s if not set by the route
+func retryAfter(m discovery.URLMapper) string {
+	if m.RetryAfter > 0 {
+		return strconv.Itoa(m.RetryAfter)
+	}
+	return "1"
+}
+
+func (c *connLimiter) report(w http.ResponseWriter, code int) {
+	if c.reporter == nil {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	c.reporter.Report(w, code)
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestConnLimiter_Middleware(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	h := newConnLimiter(nil).Middleware(upstream)
+
+	do := func(m discovery.URLMapper) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: m}))
+		wr := httptest.NewRecorder()
+		h.ServeHTTP(wr, req)
+		return wr
+	}
+
+	reject := discovery.URLMapper{Dst: "http://127.0.0.1:8080/a", MaxConn: 2}
+	queue := discovery.URLMapper{Dst: "http://127.0.0.1:8080/b", MaxConn: 1, MaxConnWait: time.Second}
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for _, m := range []discovery.URLMapper{reject, reject, queue} {
+		wg.Add(1)
+		go func(m discovery.URLMapper) {
+			defer wg.Done()
+			codes <- do(m).Code
+		}(m)
+		<-started
+	}
+
+	wr := do(reject)
+	assert.Equal(t, http.StatusServiceUnavailable, wr.Code, "over the limit, rejected right away")
+	assert.Equal(t, "1", wr.Header().Get("Retry-After"))
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		codes <- do(queue).Code // waits for the slot
+	}()
+	time.Sleep(50 * time.Millisecond)
+	release <- struct{}{} // free one of the in-flight requests
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for c := range codes {
+		assert.Equal(t, http.StatusOK, c)
+	}
+
+	t.Run("queue timeout", func(t *testing.T) {
+		m := discovery.URLMapper{Dst: "http://127.0.0.1:8080/c", MaxConn: 1, MaxConnWait: 50 * time.Millisecond, RetryAfter: 30}
+		block := make(chan struct{})
+		hh := newConnLimiter(nil).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-block }))
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: m}))
+		done := make(chan struct{})
+		go func() { hh.ServeHTTP(httptest.NewRecorder(), req); close(done) }()
+		time.Sleep(20 * time.Millisecond)
+
+		wr := httptest.NewRecorder()
+		st := time.Now()
+		hh.ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusServiceUnavailable, wr.Code)
+		assert.Equal(t, "30", wr.Header().Get("Retry-After"), "route retry-after")
+		assert.True(t, time.Since(st) >= 50*time.Millisecond)
+		close(block)
+		<-done
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		hh := newConnLimiter(nil).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		wr := httptest.NewRecorder()
+		hh.ServeHTTP(wr, httptest.NewRequest("GET", "http://example.com/api", http.NoBody))
+		assert.Equal(t, http.StatusOK, wr.Code)
+	})
+}
+
+func TestConnLimiter_Sync(t *testing.T) {
+	c := newConnLimiter(nil)
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m1 := discovery.URLMapper{Server: "*", Dst: "http://127.0.0.1:8080/$1", MaxConn: 1}
+	m2 := discovery.URLMapper{Server: "*", Dst: "http://127.0.0.2:8080/$1", MaxConn: 2}
+	for _, m := range []discovery.URLMapper{m1, m2} {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: m}))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	keys := func() (res []string) {
+		c.sema.Range(func(key, _ any) bool {
+			res = append(res, key.(string))
+			return true
+		})
+		sort.Strings(res)
+		return res
+	}
+	assert.Equal(t, []string{connKey(m1), connKey(m2)}, keys())
+
+	m2.MaxConn = 3 // limit changed, old semaphore not used anymore
+	c.Sync([]discovery.URLMapper{m1, m2, {Dst: "http://127.0.0.3:8080/$1"}})
+	assert.Equal(t, []string{connKey(m1)}, keys())
+	c.Sync(nil)
+	assert.Empty(t, keys())
+}
+
+func TestIPConnLimiter_Middleware(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	h := Http{OnlyFrom: NewOnlyFrom(OFForwarded, OFRemoteAddr)}
+	limiter := newIPConnLimiter(nil, h.clientIP)
+	handler := limiter.Middleware(upstream)
+
+	m := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+		MaxConnPerIP: 1, RetryAfter: 5}
+	do := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/api/1", http.NoBody)
+		req.Header.Set("X-Forwarded-For", ip)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: m}))
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, req)
+		return wr
+	}
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			codes <- do(ip).Code
+		}(ip)
+		<-started
+	}
+
+	wr := do("1.1.1.1")
+	assert.Equal(t, http.StatusTooManyRequests, wr.Code, "second request from the same ip rejected")
+	assert.Equal(t, "5", wr.Header().Get("Retry-After"))
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	limiter.lock.Lock()
+	assert.Empty(t, limiter.conns, "counters of idle clients dropped")
+	limiter.lock.Unlock()
+	assert.Equal(t, http.StatusOK, do("1.1.1.1").Code, "allowed again")
+}
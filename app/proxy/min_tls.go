@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// minTLSHandler rejects requests to routes with MinTLS negotiated with lower tls version, or made without tls,
+// with 403. Like mtls, the version can't be enforced on handshake of the shared listener and checked after match
+func (h *Http) minTLSHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || match.Mapper.MinTLS == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.TLS == nil || r.TLS.Version < match.Mapper.MinTLS {
+			version := "none"
+			if r.TLS != nil {
+				version = tls.VersionName(r.TLS.Version)
+			}
+			log.Printf("[DEBUG] %s required for %s %s, rejected request from %s with %s",
+				tls.VersionName(match.Mapper.MinTLS), match.Mapper.Server, match.Mapper.SrcMatch.String(), r.RemoteAddr, version)
+			h.Reporter.Report(w, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
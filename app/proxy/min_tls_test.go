@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_minTLSHandler(t *testing.T) {
+	h := Http{Reporter: &ErrorReporter{}}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{}}
+		if r.URL.Path == "/strict" {
+			m.Mapper.MinTLS = tls.VersionTLS13
+		}
+		r = r.WithContext(context.WithValue(r.Context(), ctxMatch, m))
+		h.minTLSHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		})).ServeHTTP(w, r)
+	})
+	ts := httptest.NewTLSServer(handler)
+	defer ts.Close()
+
+	client := func(maxVersion uint16) *http.Client {
+		cfg := &tls.Config{InsecureSkipVerify: true, MaxVersion: maxVersion} //nolint:gosec // test server with self-signed cert
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}, Timeout: time.Second}
+	}
+
+	tbl := []struct {
+		name       string
+		maxVersion uint16
+		path       string
+		status     int
+	}{
+		{"tls1.3 strict route", tls.VersionTLS13, "/strict", http.StatusOK},
+		{"tls1.2 strict route", tls.VersionTLS12, "/strict", http.StatusForbidden},
+		{"tls1.2 regular route", tls.VersionTLS12, "/regular", http.StatusOK},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client(tt.maxVersion).Get(ts.URL + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+		})
+	}
+
+	t.Run("plain http", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/strict", http.NoBody))
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+}
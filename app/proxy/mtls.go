@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// mtlsHandler rejects requests to routes with MTLS without verified client certificate.
+// The tls listener is shared by all routes, and the route is not known on handshake, so the certificate
+// verified on handshake if presented, and required per route here, after the route matched
+func (h *Http) mtlsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || !match.Mapper.MTLS {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			log.Printf("[DEBUG] client certificate required for %s %s, rejected request from %s",
+				match.Mapper.Server, match.Mapper.SrcMatch.String(), r.RemoteAddr)
+			h.Reporter.Report(w, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
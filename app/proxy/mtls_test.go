@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_mtlsHandler(t *testing.T) {
+	caCert, caKey := makeTestCert(t, "test ca", nil, nil)
+	clientCert, clientKey := makeTestCert(t, "client", caCert, caKey)
+	otherCA, otherKey := makeTestCert(t, "other ca", nil, nil)
+	untrustedCert, untrustedKey := makeTestCert(t, "untrusted", otherCA, otherKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	h := Http{SSLConfig: SSLConfig{ClientCAs: pool}, Reporter: &ErrorReporter{}}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{MTLS: r.URL.Path == "/mtls"}}
+		r = r.WithContext(context.WithValue(r.Context(), ctxMatch, m))
+		h.mtlsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		})).ServeHTTP(w, r)
+	})
+	ts := httptest.NewUnstartedServer(handler)
+	ts.TLS = h.makeTLSConfig()
+	ts.StartTLS()
+	defer ts.Close()
+	assert.Equal(t, tls.VerifyClientCertIfGiven, ts.TLS.ClientAuth)
+
+	client := func(cert *x509.Certificate, key *ecdsa.PrivateKey) *http.Client {
+		cfg := &tls.Config{InsecureSkipVerify: true} //nolint:gosec // test server with self-signed cert
+		if cert != nil {
+			// sent even if not signed by acceptable ca, to check verification on the server side
+			cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, nil
+			}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}, Timeout: time.Second}
+	}
+
+	tbl := []struct {
+		name   string
+		client *http.Client
+		path   string
+		code   int
+		err    bool
+	}{
+		{"no cert, regular route", client(nil, nil), "/api", http.StatusOK, false},
+		{"no cert, mtls route", client(nil, nil), "/mtls", http.StatusForbidden, false},
+		{"valid cert, mtls route", client(clientCert, clientKey), "/mtls", http.StatusOK, false},
+		{"valid cert, regular route", client(clientCert, clientKey), "/api", http.StatusOK, false},
+		{"untrusted cert", client(untrustedCert, untrustedKey), "/api", 0, true}, // rejected on handshake
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.client.Get(ts.URL + tt.path)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+		})
+	}
+
+	t.Run("plain http", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/mtls", http.NoBody)
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusForbidden, wr.Code)
+	})
+}
+
+// makeTestCert makes certificate signed by parent, or self-signed ca if parent is nil
+func makeTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
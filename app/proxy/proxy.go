@@ -3,7 +3,7 @@ package proxy
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -13,8 +13,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -22,6 +24,7 @@ import (
 	"github.com/go-pkgz/rest/logger"
 
 	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/mgmt"
 	"github.com/umputun/reproxy/app/plugin"
 )
 
@@ -29,6 +32,8 @@ import (
 type Http struct { // nolint golint
 	Matcher
 	Address          string
+	InternalAddress  string
+	Listeners        map[string]string // named listeners, name to host:port, serve plain http
 	AssetsLocation   string
 	AssetsWebRoot    string
 	Assets404        string
@@ -41,7 +46,10 @@ type Http struct { // nolint golint
 	Insecure         bool
 	Version          string
 	AccessLog        io.Writer
+	RouteLogs        *RouteLogs       // access logs of routes with LogFile, used instead of AccessLog for them
+	Builtins         *BuiltinHandlers // handlers of routes with Builtin, default ones if nil
 	StdOutEnabled    bool
+	LogUpstream      bool // log upstream destination url in access and stdout logs
 	Signature        bool
 	Timeouts         Timeouts
 	CacheControl     MiddlewareProvider
@@ -57,17 +65,27 @@ type Http struct { // nolint golint
 	ThrottleUser   int
 
 	KeepHost bool
+
+	RequestIDHeader string // request id header set for all proxied requests, empty to disable
+
+	FaultsEnabled bool // apply faults of routes, for chaos testing only. Route faults ignored if not set
+	DryRun        bool // log routing decisions of matched requests and respond with 204, not serving them
 }
 
 // Matcher source info (server and route) to the destination url
 // If no match found return ok=false
 type Matcher interface {
-	Match(srv, src string) (res discovery.Matches)
+	Match(srv, src string, info discovery.RequestInfo) (res discovery.Matches)
 	Servers() (servers []string)
 	Mappers() (mappers []discovery.URLMapper)
 	CheckHealth() (pingResult map[string]error)
 }
 
+// RoutesSubscriber is an optional Matcher capability, streaming routes table updates
+type RoutesSubscriber interface {
+	Subscribe(ctx context.Context) <-chan discovery.RouteUpdate
+}
+
 // MiddlewareProvider interface defines http middleware handler
 type MiddlewareProvider interface {
 	Middleware(next http.Handler) http.Handler
@@ -89,6 +107,7 @@ type Timeouts struct {
 	ReadHeader time.Duration
 	Write      time.Duration
 	Idle       time.Duration
+	Shutdown   time.Duration // grace period for in-flight requests on shutdown, servers closed immediately if 0
 	// transport timeouts
 	Dial           time.Duration
 	KeepAlive      time.Duration
@@ -112,23 +131,48 @@ func (h *Http) Run(ctx context.Context) error {
 		h.LBSelector = &RandomSelector{}
 	}
 
-	var httpServer, httpsServer *http.Server
+	var httpServer, httpsServer, internalServer *http.Server
+	var listenerServers []*http.Server
 
-	go func() {
-		<-ctx.Done()
-		if httpServer != nil {
-			if err := httpServer.Close(); err != nil {
-				log.Printf("[ERROR] failed to close proxy http server, %v", err)
-			}
+	// servers stopped on context cancellation, and Run waits for in-flight requests drained before return.
+	// stopOnDone called once all servers are made, so the shutdown goroutine never sees them half-constructed
+	drained := make(chan struct{})
+	allServers := func() []*http.Server {
+		return append(listenerServers, internalServer, httpServer, httpsServer)
+	}
+	stopOnDone := func() {
+		servers := allServers()
+		go func() {
+			<-ctx.Done()
+			h.shutdown(servers...)
+			close(drained)
+		}()
+	}
+	waitDrained := func(err error) error {
+		if errors.Is(err, http.ErrServerClosed) {
+			<-drained
 		}
-		if httpsServer != nil {
-			if err := httpsServer.Close(); err != nil {
-				log.Printf("[ERROR] failed to close proxy https server, %v", err)
+		return err
+	}
+
+	// upstream transports and connection limits of routes gone dropped on routes table updates,
+	// and headers read limit recomputed for the new routes
+	transport, connLimiter, hdrLimits := h.makeTransport(), newConnLimiter(h.Reporter), &headerLimits{}
+	if h.Matcher != nil {
+		hdrLimits.Sync(h.Matcher.Mappers())
+	}
+	if sub, ok := h.Matcher.(RoutesSubscriber); ok {
+		go func() {
+			for range sub.Subscribe(ctx) {
+				mappers := h.Matcher.Mappers()
+				transport.Sync(mappers)
+				connLimiter.Sync(mappers)
+				hdrLimits.Sync(mappers)
 			}
-		}
-	}()
+		}()
+	}
 
-	handler := R.Wrap(h.proxyHandler(),
+	handler := R.Wrap(h.proxyHandler(transport),
 		R.Recoverer(log.Default()),                               // recover on errors
 		signatureHandler(h.Signature, h.Version),                 // send app signature
 		h.pingHandler,                                            // respond to /ping
@@ -136,17 +180,64 @@ func (h *Http) Run(ctx context.Context) error {
 		h.healthMiddleware,                                       // respond to /health
 		h.matchHandler,                                           // set matched routes to context
 		h.OnlyFrom.Handler,                                       // limit source (remote) IPs if defined
+		h.mtlsHandler,                                            // require client certificate for mtls routes
+		h.minTLSHandler,                                          // reject requests below tls version required by route
+		h.requireHeadersHandler,                                  // reject requests without headers required by route
+		h.contentTypeHandler,                                     // reject requests with content type not allowed by route
+		newJWTValidator(h.Reporter).Middleware,                   // reject requests without valid bearer token for jwt routes
+		h.allowUAHandler,                                         // reject requests with user agent not allowed by route
+		headerTimeoutHandler,                                     // reject requests with headers slower than route limit
+		requestIDHandler(h.RequestIDHeader),                      // set or forward request id
 		limiterSystemHandler(h.ThrottleSystem),                   // limit total requests/sec
 		limiterUserHandler(h.ThrottleUser),                       // req/seq per user/route match
+		connLimiter.Middleware,                                   // limit concurrent requests per route
+		newIPConnLimiter(h.Reporter, h.clientIP).Middleware,      // limit concurrent requests per client ip and route
+		newRateLimiter(h.Reporter).Middleware,                    // limit requests/sec per route or route group
+		newCircuitBreaker(h.Reporter).Middleware,                 // reject requests to destinations with open circuit
+		rawBypass(slowLogHandler(log.Default())),                 // log requests slower than the route's threshold
 		h.mgmtHandler(),                                          // handles /metrics and /routes for prometheus
 		h.pluginHandler(),                                        // prc to external plugins
 		headersHandler(h.ProxyHeaders, h.DropHeader),             // add response headers and delete some request headers
-		accessLogHandler(h.AccessLog),                            // apache-format log file
-		stdoutLogHandler(h.StdOutEnabled, logger.New(logger.Log(log.Default()), logger.Prefix("[INFO]")).Handler),
-		maxReqSizeHandler(h.MaxBodySize), // limit request max size
-		gzipHandler(h.GzEnabled),         // gzip response
+		// apache-format log file, routes with LogFile logged to their own files
+		rawBypass(accessLogHandler(h.AccessLog, h.LogUpstream, h.RouteLogs)),
+		rawBypass(stdoutLogHandler(h.StdOutEnabled, h.stdoutLogger().Handler)),
+		rawBypass(maxReqSizeHandler(h.MaxBodySize)),          // limit request max size
+		rawBypass(logBodyHandler(log.Default())),             // log request body for debugging, routes with logbody only
+		rawBypass(gzipHandler(h.GzEnabled)),                  // gzip response
+		rawBypass(newEdgeCache(10000, 1024*1024).Middleware), // cache responses for routes with cache ttl
+		rawBypass(newCoalescer(1024*1024).Middleware),        // share responses of identical concurrent GETs for coalesce routes
+		// inject route faults for chaos testing, with faults enabled only
+		h.faultHandler,
 	)
 
+	// internal listener always serves plain http, it is expected to be bound to a private interface
+	if h.InternalAddress != "" {
+		internalServer = h.makeHTTPServer(h.InternalAddress, h.internalHandler(handler))
+		internalServer.ErrorLog = log.ToStdLogger(log.Default(), "WARN")
+		go func() {
+			log.Printf("[INFO] activate internal http server on %s", h.InternalAddress)
+			err := h.listenAndServe(internalServer, hdrLimits)
+			log.Printf("[WARN] internal http server terminated, %s", err)
+		}()
+	}
+
+	// named listeners serve plain http, routes bound to the listener served on it only
+	names := make([]string, 0, len(h.Listeners))
+	for name := range h.Listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		srv := h.makeHTTPServer(h.Listeners[name], h.listenerHandler(name, handler))
+		srv.ErrorLog = log.ToStdLogger(log.Default(), "WARN")
+		listenerServers = append(listenerServers, srv)
+		go func(name string) {
+			log.Printf("[INFO] activate %s listener http server on %s", name, srv.Addr)
+			err := h.listenAndServe(srv, hdrLimits)
+			log.Printf("[WARN] %s listener http server terminated, %s", name, err)
+		}(name)
+	}
+
 	// no FQDNs defined, use the list of discovered servers
 	if len(h.SSLConfig.FQDNs) == 0 && h.SSLConfig.SSLMode == SSLAuto {
 		h.SSLConfig.FQDNs = h.discoveredServers(ctx, 50*time.Millisecond)
@@ -157,7 +248,8 @@ func (h *Http) Run(ctx context.Context) error {
 		log.Printf("[INFO] activate http proxy server on %s", h.Address)
 		httpServer = h.makeHTTPServer(h.Address, handler)
 		httpServer.ErrorLog = log.ToStdLogger(log.Default(), "WARN")
-		return httpServer.ListenAndServe()
+		stopOnDone()
+		return waitDrained(h.listenAndServe(httpServer, hdrLimits))
 	case SSLStatic:
 		log.Printf("[INFO] activate https server in 'static' mode on %s", h.Address)
 
@@ -167,12 +259,13 @@ func (h *Http) Run(ctx context.Context) error {
 		httpServer = h.makeHTTPServer(h.toHTTP(h.Address, h.SSLConfig.RedirHTTPPort), h.httpToHTTPSRouter())
 		httpServer.ErrorLog = log.ToStdLogger(log.Default(), "WARN")
 
+		stopOnDone()
 		go func() {
 			log.Printf("[INFO] activate http redirect server on %s", h.toHTTP(h.Address, h.SSLConfig.RedirHTTPPort))
-			err := httpServer.ListenAndServe()
+			err := h.listenAndServe(httpServer, hdrLimits)
 			log.Printf("[WARN] http redirect server terminated, %s", err)
 		}()
-		return httpsServer.ListenAndServeTLS(h.SSLConfig.Cert, h.SSLConfig.Key)
+		return waitDrained(h.listenAndServeTLS(httpsServer, hdrLimits, h.SSLConfig.Cert, h.SSLConfig.Key))
 	case SSLAuto:
 		log.Printf("[INFO] activate https server in 'auto' mode on %s", h.Address)
 		log.Printf("[DEBUG] FQDNs %v", h.SSLConfig.FQDNs)
@@ -184,17 +277,55 @@ func (h *Http) Run(ctx context.Context) error {
 		httpServer = h.makeHTTPServer(h.toHTTP(h.Address, h.SSLConfig.RedirHTTPPort), h.httpChallengeRouter(m))
 		httpServer.ErrorLog = log.ToStdLogger(log.Default(), "WARN")
 
+		stopOnDone()
 		go func() {
 			log.Printf("[INFO] activate http challenge server on port %s", h.toHTTP(h.Address, h.SSLConfig.RedirHTTPPort))
-			err := httpServer.ListenAndServe()
+			err := h.listenAndServe(httpServer, hdrLimits)
 			log.Printf("[WARN] http challenge server terminated, %s", err)
 		}()
 
-		return httpsServer.ListenAndServeTLS("", "")
+		return waitDrained(h.listenAndServeTLS(httpsServer, hdrLimits, "", ""))
 	}
+	h.shutdown(allServers()...) // internal and named listeners already started
 	return fmt.Errorf("unknown SSL type %v", h.SSLConfig.SSLMode)
 }
 
+// shutdown stops servers. With Timeouts.Shutdown servers stop accepting new connections, close idle ones and wait
+// for in-flight requests up to the grace period. Servers not drained in time, and all servers without grace period,
+// closed immediately. Hijacked connections, i.e. websockets, are not waited for
+func (h *Http) shutdown(servers ...*http.Server) {
+	if h.Timeouts.Shutdown <= 0 {
+		for _, srv := range servers {
+			if srv == nil {
+				continue
+			}
+			if err := srv.Close(); err != nil {
+				log.Printf("[ERROR] failed to close proxy server %s, %v", srv.Addr, err)
+			}
+		}
+		return
+	}
+
+	log.Printf("[INFO] draining proxy servers, grace period %s", h.Timeouts.Shutdown)
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeouts.Shutdown)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		if srv == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("[WARN] proxy server %s not drained in %s, closing, %v", srv.Addr, h.Timeouts.Shutdown, err)
+				_ = srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
 type contextKey string
 
 const (
@@ -202,47 +333,69 @@ const (
 	ctxMatchType = contextKey("type")
 	ctxMatch     = contextKey("match")
 	ctxKeepHost  = contextKey("keepHost")
+	ctxInternal  = contextKey("internal")
+	ctxLocation  = contextKey("location")
+	ctxListener  = contextKey("listener")
+	ctxIdleTimer = contextKey("idleTimer")
+	ctxStartTime = contextKey("startTime")
 )
 
-func (h *Http) proxyHandler() http.HandlerFunc {
+func (h *Http) proxyHandler(transport http.RoundTripper) http.HandlerFunc {
 
 	reverseProxy := &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
 			ctx := r.Context()
 			uu := ctx.Value(ctxURL).(*url.URL)
 			keepHost := ctx.Value(ctxKeepHost).(bool)
-			r.Header.Add("X-Forwarded-Host", r.Host)
-			scheme := "http"
-			if h.SSLConfig.SSLMode == SSLAuto || h.SSLConfig.SSLMode == SSLStatic {
-				h.setHeaderIfNotExists(r, "X-Forwarded-Proto", "https")
-				h.setHeaderIfNotExists(r, "X-Forwarded-Port", "443")
-				scheme = "https"
-			}
-			r.Header.Set("X-Forwarded-URL", fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.String()))
+			match, hasMatch := ctx.Value(ctxMatch).(discovery.MatchedRoute)
+			h.setXRealIP(r, match.Mapper.Forwarded) // before the route's policy drops client provided headers
+			h.setForwarded(r, match.Mapper.Forwarded)
 			r.URL.Path = uu.Path
+			if hasMatch && match.Mapper.RewritePath != "" {
+				r.URL.Path, r.URL.RawPath = match.Mapper.RewritePath, "" // fixed path, regardless of the request's one
+			}
 			r.URL.Host = uu.Host
 			r.URL.Scheme = uu.Scheme
 			log.Printf("[DEBUG] keep host is %t", keepHost)
 			if !keepHost {
 				r.Host = uu.Host
 			}
-			h.setXRealIP(r)
+			if hasMatch {
+				for _, hdr := range match.Mapper.StripReqHeaders {
+					r.Header.Del(hdr) // header names canonicalized, i.e. matched case-insensitive
+				}
+				if len(match.Mapper.ResponseRewrite) > 0 {
+					r.Header.Del("Accept-Encoding") // ask for plain body, compressed one can't be rewritten
+				}
+			}
 		},
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: h.Timeouts.ResponseHeader,
-			DialContext: (&net.Dialer{
-				Timeout:   h.Timeouts.Dial,
-				KeepAlive: h.Timeouts.KeepAlive,
-			}).DialContext,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       h.Timeouts.IdleConn,
-			TLSHandshakeTimeout:   h.Timeouts.TLSHandshake,
-			ExpectContinueTimeout: h.Timeouts.ExpectContinue,
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: h.Insecure}, //nolint:gosec // G402: User defined option to disable verification for self-signed certificates
+		ModifyResponse: func(resp *http.Response) error {
+			if match, ok := resp.Request.Context().Value(ctxMatch).(discovery.MatchedRoute); ok {
+				for _, hdr := range match.Mapper.StripRespHeaders {
+					resp.Header.Del(hdr)
+				}
+				if prefix, ok := resp.Request.Context().Value(ctxLocation).(string); ok {
+					rewriteLocation(resp, match.Mapper.RewriteLocation, prefix)
+				}
+				rewriteBody(resp, match.Mapper.ResponseRewrite)
+				if match.Mapper.TimingHeader {
+					setTimingHeader(resp)
+				}
+				setStatusHeaders(resp, match.Mapper.StatusHeaders) // conditioned on the upstream status, before rewrite
+				rewriteStatus(resp, match.Mapper.StatusMap)
+			}
+			idleResponse(resp)
+			return nil
 		},
-		ErrorLog: log.ToStdLogger(log.Default(), "WARN"),
+		Transport: transport,
+		ErrorLog:  log.ToStdLogger(log.Default(), "WARN"),
 	}
+	// stream proxy flushes immediately, with no response buffering. Used for websocket and unbuffered routes.
+	// Connection upgrade itself (Connection and Upgrade headers) handled by ReverseProxy,
+	// and hijacked connections are not limited by server's timeouts
+	streamProxy := *reverseProxy
+	streamProxy.FlushInterval = -1
+
 	assetsHandler := h.assetsHandler()
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -259,13 +412,34 @@ func (h *Http) proxyHandler() http.HandlerFunc {
 
 		match := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
 		matchType := r.Context().Value(ctxMatchType).(discovery.MatchType)
+		if h.DryRun {
+			dryRun(log.Default(), w, r, match, matchType)
+			return
+		}
 
 		switch matchType {
 		case discovery.MTProxy:
 			switch match.Mapper.RedirectType {
 			case discovery.RTNone:
+				if match.Mapper.Builtin != "" {
+					h.serveBuiltin(w, r, match.Mapper.Builtin)
+					return
+				}
 				uu := r.Context().Value(ctxURL).(*url.URL)
 				log.Printf("[DEBUG] proxy to %s", uu)
+				if match.Mapper.RewriteLocation != "" {
+					r = r.WithContext(context.WithValue(r.Context(), ctxLocation, locationPrefix(r.URL.Path, uu.Path)))
+				}
+				var cancel context.CancelFunc
+				r, cancel = withRouteTimeouts(r, match.Mapper)
+				defer cancel()
+				if match.Mapper.TimingHeader {
+					r = withUpstreamStart(r)
+				}
+				if match.Mapper.WebSocket || match.Mapper.Unbuffered {
+					streamProxy.ServeHTTP(w, r)
+					return
+				}
 				reverseProxy.ServeHTTP(w, r)
 			case discovery.RTPerm:
 				log.Printf("[DEBUG] redirect (301) to %s", match.Destination)
@@ -298,7 +472,7 @@ func (h *Http) proxyHandler() http.HandlerFunc {
 // and if match found sets it to the request context. Context used by proxy handler as well as by plugin conductor
 func (h *Http) matchHandler(next http.Handler) http.Handler {
 
-	getMatch := func(mm discovery.Matches, picker LBSelector) (m discovery.MatchedRoute, ok bool) {
+	getMatch := func(w http.ResponseWriter, r *http.Request, mm discovery.Matches, picker LBSelector) (m discovery.MatchedRoute, ok bool) {
 		if len(mm.Routes) == 0 {
 			return m, false
 		}
@@ -309,14 +483,13 @@ func (h *Http) matchHandler(next http.Handler) http.Handler {
 				matches = append(matches, m)
 			}
 		}
-		switch len(matches) {
-		case 0:
-			return m, false
-		case 1:
-			return matches[0], true
-		default:
-			return matches[picker.Select(len(matches))], true
+		if len(matches) > 0 && matches[0].Mapper.StickyCookie != "" {
+			return stickyMatch(w, r, matches[0].Mapper.StickyCookie, matches, picker), true
+		}
+		if len(matches) == 0 {
+			return fallbackMatch(r, mm.Routes)
 		}
+		return selectMatch(matches, picker), true
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -324,12 +497,20 @@ func (h *Http) matchHandler(next http.Handler) http.Handler {
 		if server == "" {
 			server = strings.Split(r.Host, ":")[0] // drop port
 		}
-		matches := h.Match(server, r.URL.EscapedPath()) // get all matches for the server:path pair
-		match, ok := getMatch(matches, h.LBSelector)
+		info := discovery.RequestInfo{Internal: r.Context().Value(ctxInternal) != nil}
+		info.Listener, _ = r.Context().Value(ctxListener).(string)
+		info.Header = r.Header
+		info.Query = r.URL.Query()
+		if r.TLS != nil {
+			info.ALPN = r.TLS.NegotiatedProtocol
+		}
+		matches := h.Match(server, r.URL.EscapedPath(), info) // get all matches for the server:path pair
+		match, ok := getMatch(w, r, matches, h.LBSelector)
 		if ok {
 			ctx := context.WithValue(r.Context(), ctxMatch, match)        // set match info
 			ctx = context.WithValue(ctx, ctxMatchType, matches.MatchType) // set match type
 			ctx = context.WithValue(ctx, plugin.CtxMatch, match)          // set match info for plugin conductor
+			ctx = context.WithValue(ctx, mgmt.CtxMatch, match)            // set match info for per-route metrics
 
 			if matches.MatchType == discovery.MTProxy {
 				uu, err := url.Parse(match.Destination)
@@ -353,6 +534,31 @@ func (h *Http) matchHandler(next http.Handler) http.Handler {
 	})
 }
 
+// internalHandler marks requests received on the internal listener. Used by matchHandler to allow internal routes
+func (h *Http) internalHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxInternal, true)))
+	})
+}
+
+// stdoutLogger makes stdout logger, with upstream url logged as a subject if LogUpstream enabled
+func (h *Http) stdoutLogger() *logger.Middleware {
+	opts := []logger.Option{logger.Log(log.Default()), logger.Prefix("[INFO]")}
+	if h.LogUpstream {
+		opts = append(opts, logger.SubjFn(func(r *http.Request) (string, error) {
+			return "upstream " + upstreamURL(r), nil
+		}))
+	}
+	return logger.New(opts...)
+}
+
+// listenerHandler marks requests received on the named listener. Used by matchHandler to allow routes bound to it
+func (h *Http) listenerHandler(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxListener, name)))
+	})
+}
+
 func (h *Http) assetsHandler() http.HandlerFunc {
 	if h.AssetsLocation == "" || h.AssetsWebRoot == "" {
 		return func(_ http.ResponseWriter, _ *http.Request) {}
@@ -421,27 +627,72 @@ func (h *Http) mgmtHandler() func(next http.Handler) http.Handler {
 func (h *Http) makeHTTPServer(addr string, router http.Handler) *http.Server {
 	return &http.Server{
 		Addr:              addr,
-		Handler:           router,
+		Handler:           headersReadHandler(router),
 		ReadHeaderTimeout: h.Timeouts.ReadHeader,
 		WriteTimeout:      h.Timeouts.Write,
 		IdleTimeout:       h.Timeouts.Idle,
+		ConnState:         headerConnState,
+		ConnContext:       headerConnContext,
 	}
 }
 
-func (h *Http) setXRealIP(r *http.Request) {
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		// use the left-most non-private client IP address
-		// if there is no any non-private IP address, use the left-most address
-		r.Header.Set("X-Real-IP", preferPublicIP(strings.Split(forwarded, ",")))
+// forwardedHeaders are X-Forwarded-* headers set by reproxy
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Port",
+	"X-Forwarded-URL"}
+
+// setForwarded sets X-Forwarded-* headers of the proxied request according to the route's policy.
+// X-Forwarded-For itself added by ReverseProxy after director, with the client ip appended to the existing value
+func (h *Http) setForwarded(r *http.Request, policy discovery.ForwardedPolicy) {
+	switch policy {
+	case discovery.ForwardedStrip:
+		for _, hdr := range forwardedHeaders {
+			r.Header.Del(hdr)
+		}
+		r.Header["X-Forwarded-For"] = nil // nil value prevents ReverseProxy from adding the header
 		return
+	case discovery.ForwardedAppend: // keep client provided values
+	default:
+		for _, hdr := range forwardedHeaders {
+			r.Header.Del(hdr) // client can't be trusted, only values set by reproxy sent to upstream
+		}
 	}
 
+	r.Header.Add("X-Forwarded-Host", r.Host)
+	scheme := "http"
+	if h.SSLConfig.SSLMode == SSLAuto || h.SSLConfig.SSLMode == SSLStatic {
+		h.setHeaderIfNotExists(r, "X-Forwarded-Proto", "https")
+		h.setHeaderIfNotExists(r, "X-Forwarded-Port", "443")
+		scheme = "https"
+	}
+	r.Header.Set("X-Forwarded-URL", fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.String()))
+}
+
+// clientIP returns ip of the client, looked up in headers the same way as for OnlyFrom, if headers trusted
+func (h *Http) clientIP(r *http.Request) string {
+	if h.OnlyFrom != nil {
+		if ip := h.OnlyFrom.realIP(h.OnlyFrom.lookups, r); ip != "" {
+			return strings.TrimSpace(ip)
+		}
+	}
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// setXRealIP sets X-Real-IP of the proxied request. Client provided X-Forwarded-For trusted with append policy only,
+// for other policies the ip is the client ip by trusted lookups, i.e. --remote-lookup-headers, or remote address
+func (h *Http) setXRealIP(r *http.Request, policy discovery.ForwardedPolicy) {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && policy == discovery.ForwardedAppend {
+		// use the left-most non-private client IP address
+		// if there is no any non-private IP address, use the left-most address
+		r.Header.Set("X-Real-IP", preferPublicIP(strings.Split(forwarded, ",")))
 		return
 	}
-	userIP := net.ParseIP(ip)
-	if userIP == nil {
+
+	ip := h.clientIP(r)
+	if net.ParseIP(ip) == nil {
 		return
 	}
 	r.Header.Set("X-Real-IP", ip)
@@ -1,12 +1,14 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -976,7 +978,7 @@ func TestHttp_matchHandler(t *testing.T) {
 
 	var count int32
 	matcherMock := &MatcherMock{
-		MatchFunc: func(srv string, src string) discovery.Matches {
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
 			return tbl[atomic.LoadInt32(&count)].matches
 		},
 	}
@@ -1009,6 +1011,370 @@ func TestHttp_matchHandler(t *testing.T) {
 	}
 }
 
+func TestHttp_matchHandlerListener(t *testing.T) {
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+				{Destination: "http://127.0.0.1:8080/" + info.Listener, Alive: true},
+			}}
+		},
+	}
+
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Context().Value(ctxURL).(*url.URL).String()))
+	})
+
+	wr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://example.com/admin", http.NoBody)
+	h.listenerHandler("admin", h.matchHandler(next)).ServeHTTP(wr, req)
+	assert.Equal(t, "http://127.0.0.1:8080/admin", wr.Body.String())
+
+	wr = httptest.NewRecorder()
+	h.matchHandler(next).ServeHTTP(wr, req)
+	assert.Equal(t, "http://127.0.0.1:8080/", wr.Body.String())
+
+	require.Equal(t, 2, len(matcherMock.MatchCalls()))
+	assert.Equal(t, "admin", matcherMock.MatchCalls()[0].Info.Listener)
+	assert.Equal(t, "", matcherMock.MatchCalls()[1].Info.Listener)
+}
+
+func TestHttp_matchHandlerALPN(t *testing.T) {
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			return discovery.Matches{}
+		},
+	}
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest("GET", "https://example.com/api", http.NoBody)
+	req.TLS = &tls.ConnectionState{NegotiatedProtocol: "h2"}
+	req.Header.Set("X-Version", "beta")
+	h.matchHandler(next).ServeHTTP(httptest.NewRecorder(), req)
+	h.matchHandler(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/api", http.NoBody))
+
+	require.Equal(t, 2, len(matcherMock.MatchCalls()))
+	assert.Equal(t, "h2", matcherMock.MatchCalls()[0].Info.ALPN)
+	assert.Equal(t, "beta", matcherMock.MatchCalls()[0].Info.Header.Get("X-Version"))
+	assert.Equal(t, "", matcherMock.MatchCalls()[1].Info.ALPN, "plain http")
+}
+
+func TestHttp_matchHandlerInternal(t *testing.T) {
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			if !info.Internal {
+				return discovery.Matches{MatchType: discovery.MTProxy}
+			}
+			return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+				{Destination: "http://127.0.0.1:8080/internal", Alive: true,
+					Mapper: discovery.URLMapper{Visibility: discovery.VisibilityInternal}},
+			}}
+		},
+	}
+
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Context().Value(ctxURL)
+		if v == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(v.(*url.URL).String()))
+	})
+
+	t.Run("public listener", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://example.com/admin", http.NoBody)
+		h.matchHandler(next).ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusNotFound, wr.Code)
+	})
+
+	t.Run("internal listener", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://example.com/admin", http.NoBody)
+		h.internalHandler(h.matchHandler(next)).ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "http://127.0.0.1:8080/internal", wr.Body.String())
+	})
+
+	require.Equal(t, 2, len(matcherMock.MatchCalls()))
+	assert.False(t, matcherMock.MatchCalls()[0].Info.Internal)
+	assert.True(t, matcherMock.MatchCalls()[1].Info.Internal)
+}
+
+func TestHttp_proxyHandlerStripHeaders(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("X-Internal-Token"))
+		assert.Equal(t, "v1", r.Header.Get("X-Keep"))
+		w.Header().Set("Server", "upstream/1.0")
+		w.Header().Set("X-Powered-By", "something")
+		w.Header().Set("X-Keep", "v2")
+		fmt.Fprintf(w, "response %s", r.URL.String())
+	}))
+	defer ds.Close()
+
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+				{Destination: ds.URL + "/api", Alive: true, Mapper: discovery.URLMapper{
+					StripReqHeaders: []string{"x-internal-token"}, StripRespHeaders: []string{"server", "X-POWERED-BY"}}},
+			}}
+		},
+	}
+
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}}
+	handler := h.matchHandler(h.proxyHandler(h.makeTransport()))
+
+	req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+	req.Header.Set("X-Internal-Token", "secret")
+	req.Header.Set("X-Keep", "v1")
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, req)
+
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, "response /api", wr.Body.String())
+	assert.Empty(t, wr.Header().Get("Server"))
+	assert.Empty(t, wr.Header().Get("X-Powered-By"))
+	assert.Equal(t, "v2", wr.Header().Get("X-Keep"))
+}
+
+func TestHttp_proxyHandlerRewritePath(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "response %s", r.URL.String())
+	}))
+	defer ds.Close()
+
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+				{Destination: ds.URL + "/webhook/github", Alive: true, Mapper: discovery.URLMapper{RewritePath: "/ingest"}},
+			}}
+		},
+	}
+
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}}
+	handler := h.matchHandler(h.proxyHandler(h.makeTransport()))
+
+	req := httptest.NewRequest("POST", "http://example.com/webhook/github?id=1", http.NoBody)
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, req)
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, "response /ingest?id=1", wr.Body.String(), "path replaced, query kept")
+}
+
+func TestHttp_proxyHandlerRewriteLocation(t *testing.T) {
+	var ds *httptest.Server
+	ds = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, ds.URL+"/login?next=1", http.StatusFound)
+	}))
+	defer ds.Close()
+
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+				{Destination: ds.URL + "/secret", Alive: true, Mapper: discovery.URLMapper{RewriteLocation: ds.URL}},
+			}}
+		},
+	}
+
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}}
+	handler := h.matchHandler(h.proxyHandler(h.makeTransport()))
+
+	req := httptest.NewRequest("GET", "http://example.com/api/secret", http.NoBody)
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, req)
+	assert.Equal(t, http.StatusFound, wr.Code)
+	assert.Equal(t, "/api/login?next=1", wr.Header().Get("Location"))
+}
+
+func TestHttp_proxyHandlerForwarded(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, hdr := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"} {
+			fmt.Fprintf(w, "%s=%s;", hdr, r.Header.Get(hdr))
+		}
+	}))
+	defer ds.Close()
+
+	tbl := []struct {
+		policy discovery.ForwardedPolicy
+		res    string
+	}{
+		{discovery.ForwardedSet, "X-Forwarded-For=192.0.2.1;X-Forwarded-Host=example.com;X-Forwarded-Proto=;X-Real-Ip=192.0.2.1;"},
+		{discovery.ForwardedAppend,
+			"X-Forwarded-For=1.2.3.4, 192.0.2.1;X-Forwarded-Host=evil.com;X-Forwarded-Proto=https;X-Real-Ip=1.2.3.4;"},
+		{discovery.ForwardedStrip, "X-Forwarded-For=;X-Forwarded-Host=;X-Forwarded-Proto=;X-Real-Ip=192.0.2.1;"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			matcherMock := &MatcherMock{
+				MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+					return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+						{Destination: ds.URL + "/api", Alive: true, Mapper: discovery.URLMapper{Forwarded: tt.policy}},
+					}}
+				},
+			}
+			h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}}
+			handler := h.matchHandler(h.proxyHandler(h.makeTransport()))
+
+			req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+			req.Header.Set("X-Forwarded-For", "1.2.3.4") // client provided
+			req.Header.Set("X-Forwarded-Host", "evil.com")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			wr := httptest.NewRecorder()
+			handler.ServeHTTP(wr, req)
+			assert.Equal(t, http.StatusOK, wr.Code)
+			assert.Equal(t, tt.res, wr.Body.String())
+		})
+	}
+}
+
+func TestHttp_proxyHandlerRealIP(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Real-Ip"))
+	}))
+	defer ds.Close()
+
+	tbl := []struct {
+		name     string
+		policy   discovery.ForwardedPolicy
+		onlyFrom *OnlyFrom
+		res      string
+	}{
+		{"forged X-Forwarded-For ignored by default", discovery.ForwardedSet, nil, "10.0.0.2"},
+		{"forged X-Forwarded-For ignored with strip", discovery.ForwardedStrip, nil, "10.0.0.2"},
+		{"trusted lookup behind load balancer", discovery.ForwardedSet, NewOnlyFrom(OFForwarded, OFRemoteAddr), "1.2.3.4"},
+		{"client X-Forwarded-For with append", discovery.ForwardedAppend, nil, "1.2.3.4"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			matcherMock := &MatcherMock{
+				MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+					return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+						{Destination: ds.URL + "/api", Alive: true, Mapper: discovery.URLMapper{Forwarded: tt.policy}},
+					}}
+				},
+			}
+			h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}, OnlyFrom: tt.onlyFrom}
+			handler := h.matchHandler(h.proxyHandler(h.makeTransport()))
+
+			req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+			req.RemoteAddr = "10.0.0.2:12345"
+			req.Header.Set("X-Forwarded-For", "10.0.0.1, 1.2.3.4")
+			wr := httptest.NewRecorder()
+			handler.ServeHTTP(wr, req)
+			assert.Equal(t, http.StatusOK, wr.Code)
+			assert.Equal(t, tt.res, wr.Body.String())
+		})
+	}
+}
+
+func TestHttp_proxyHandlerUnbuffered(t *testing.T) {
+	release := make(chan struct{})
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10") // known length, not detected as streaming by ReverseProxy
+		_, _ = w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("world"))
+	}))
+	defer ds.Close()
+
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+				{Destination: ds.URL + "/file", Alive: true, Mapper: discovery.URLMapper{Unbuffered: true}},
+			}}
+		},
+	}
+
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}}
+	ps := httptest.NewServer(h.matchHandler(h.proxyHandler(h.makeTransport())))
+	defer ps.Close()
+
+	type result struct {
+		resp  *http.Response
+		chunk string
+	}
+	got := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(ps.URL + "/file")
+		if err != nil {
+			got <- result{}
+			return
+		}
+		buf := make([]byte, 5)
+		_, _ = io.ReadFull(resp.Body, buf)
+		got <- result{resp: resp, chunk: string(buf)}
+	}()
+
+	var res result
+	select {
+	case res = <-got:
+	case <-time.After(time.Second):
+	}
+	close(release) // let upstream complete the response
+	require.NotNil(t, res.resp, "the first chunk not received, response buffered")
+	defer res.resp.Body.Close()
+	assert.Equal(t, "hello", res.chunk, "the first chunk received before the upstream completed")
+	rest, err := io.ReadAll(res.resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(rest))
+}
+
+func TestHttp_proxyHandlerWebSocket(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "no upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		_ = brw.Flush()
+		line, err := brw.ReadString('\n') // echo a single line back
+		require.NoError(t, err)
+		_, _ = brw.WriteString("echo " + line)
+		_ = brw.Flush()
+	}))
+	defer ds.Close()
+
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+				{Destination: ds.URL + "/ws", Alive: true, Mapper: discovery.URLMapper{WebSocket: true}},
+			}}
+		},
+	}
+
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}}
+	ps := httptest.NewUnstartedServer(h.matchHandler(h.proxyHandler(h.makeTransport())))
+	ps.Config.WriteTimeout = 100 * time.Millisecond // should not affect websocket connection
+	ps.Start()
+	defer ps.Close()
+
+	conn, err := net.Dial("tcp", ps.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	require.NoError(t, err)
+
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+
+	time.Sleep(200 * time.Millisecond) // longer than server's write timeout
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := rd.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo hello\n", line)
+}
+
 func TestHttp_discoveredServers(t *testing.T) {
 	calls := 0
 	m := &MatcherMock{ServersFunc: func() []string {
@@ -1031,3 +1397,71 @@ func TestHttp_discoveredServers(t *testing.T) {
 	res := h.discoveredServers(context.Background(), time.Millisecond)
 	assert.Equal(t, []string{"s1", "s2", "s3"}, res)
 }
+
+func TestHttp_RunUnknownSSLType(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{Address: "127.0.0.1:0", InternalAddress: fmt.Sprintf("127.0.0.1:%d", port),
+		SSLConfig: SSLConfig{SSLMode: sslMode(100)}, AccessLog: io.Discard, Reporter: &ErrorReporter{}}
+	err := h.Run(context.Background())
+	require.EqualError(t, err, "unknown SSL type 100")
+
+	time.Sleep(50 * time.Millisecond)
+	_, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/ping", port))
+	require.Error(t, err, "internal server closed")
+}
+
+func TestHttp_RunShutdownDrain(t *testing.T) {
+	release := make(chan struct{})
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprintf(w, "response %s", r.URL.String())
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{"*,^/api/(.*)," + ds.URL + "/$1,"}},
+	}, time.Millisecond*10)
+	go func() { _ = svc.Run(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+
+	run := func(grace time.Duration) (code int, reqErr error, runDone <-chan error) {
+		port := rand.Intn(10000) + 40000
+		h := Http{Timeouts: Timeouts{Shutdown: grace}, Address: fmt.Sprintf("127.0.0.1:%d", port),
+			AccessLog: io.Discard, Reporter: &ErrorReporter{}, Matcher: svc}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- h.Run(ctx) }()
+		time.Sleep(20 * time.Millisecond)
+
+		go func() {
+			time.Sleep(50 * time.Millisecond) // request in-flight
+			cancel()
+			time.Sleep(100 * time.Millisecond)
+			release <- struct{}{}
+		}()
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/api/something", port))
+		if err != nil {
+			return 0, err, done
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode, nil, done
+	}
+
+	t.Run("drained", func(t *testing.T) {
+		code, err, done := run(time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, code)
+		select {
+		case err = <-done:
+			assert.ErrorIs(t, err, http.ErrServerClosed)
+		case <-time.After(time.Second):
+			t.Fatal("run not completed")
+		}
+	})
+
+	t.Run("closed without grace", func(t *testing.T) {
+		_, err, done := run(0)
+		require.Error(t, err, "in-flight request cut")
+		<-done
+	})
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/didip/tollbooth/v6"
+	"github.com/didip/tollbooth/v6/limiter"
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// rateLimiter limits requests per second for routes with RateLimit, excess requests rejected with 429.
+// Routes with RateLimitGroup share a single bucket of the group, i.e. multiple containers of the same api,
+// all other routes limited separately. Group members have the same limit, aligned by discovery
+type rateLimiter struct {
+	reporter Reporter
+	limiters sync.Map // limit -> *limiter.Limiter, buckets of routes and groups with this limit
+}
+
+func newRateLimiter(reporter Reporter) *rateLimiter {
+	return &rateLimiter{reporter: reporter}
+}
+
+// Middleware limits requests/sec for routes with RateLimit
+func (l *rateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || match.Mapper.RateLimit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		lmt := l.limiter(match.Mapper.RateLimit)
+		key := "route:" + match.Mapper.Server + "|" + match.Mapper.SrcMatch.String()
+		if match.Mapper.RateLimitGroup != "" {
+			key = "group:" + match.Mapper.RateLimitGroup
+		}
+
+		if httpError := tollbooth.LimitByKeys(lmt, []string{key}); httpError != nil {
+			log.Printf("[DEBUG] rate limit %d/s reached for %s", match.Mapper.RateLimit, rateLimitName(match.Mapper))
+			w.Header().Set("Retry-After", retryAfter(match.Mapper))
+			l.report(w, http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limiter returns limiter of the limit, made on the first use. Buckets are per limiter, so the limit change
+// of the route starts a new bucket
+func (l *rateLimiter) limiter(limit int) *limiter.Limiter {
+	if v, ok := l.limiters.Load(limit); ok {
+		return v.(*limiter.Limiter)
+	}
+	v, _ := l.limiters.LoadOrStore(limit, tollbooth.NewLimiter(float64(limit), nil))
+	return v.(*limiter.Limiter)
+}
+
+func rateLimitName(m discovery.URLMapper) string {
+	if m.RateLimitGroup != "" {
+		return fmt.Sprintf("group %s", m.RateLimitGroup)
+	}
+	return fmt.Sprintf("%s %s", m.Server, m.SrcMatch.String())
+}
+
+func (l *rateLimiter) report(w http.ResponseWriter, code int) {
+	if l.reporter == nil {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	l.reporter.Report(w, code)
+}
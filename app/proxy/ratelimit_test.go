@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestRateLimiter_Middleware(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := newRateLimiter(nil).Middleware(upstream)
+
+	do := func(m discovery.URLMapper) int {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: m}))
+		wr := httptest.NewRecorder()
+		h.ServeHTTP(wr, req)
+		return wr.Code
+	}
+	route := func(src string, limit int, group string) discovery.URLMapper {
+		return discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile(src), RateLimit: limit, RateLimitGroup: group}
+	}
+
+	r1, r2 := route("^/a/(.*)", 2, ""), route("^/b/(.*)", 2, "")
+	assert.Equal(t, http.StatusOK, do(r1))
+	assert.Equal(t, http.StatusOK, do(r1))
+	assert.Equal(t, http.StatusTooManyRequests, do(r1), "over the route limit")
+	assert.Equal(t, http.StatusOK, do(r2), "other route limited separately")
+
+	g1, g2 := route("^/g1/(.*)", 3, "api"), route("^/g2/(.*)", 3, "api")
+	assert.Equal(t, http.StatusOK, do(g1))
+	assert.Equal(t, http.StatusOK, do(g2))
+	assert.Equal(t, http.StatusOK, do(g1))
+	assert.Equal(t, http.StatusTooManyRequests, do(g2), "group bucket shared")
+	assert.Equal(t, http.StatusTooManyRequests, do(g1))
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, do(route("^/free/(.*)", 0, "api")), "no limit")
+	}
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// rawBypass skips the middleware for raw routes, the request passed to the next handler as-is.
+// Used for logging, body limit, gzip and caching middlewares, raw routes still authorized and limited
+func rawBypass(mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute); ok && match.Mapper.Raw {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestRawBypass(t *testing.T) {
+	mw := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "called")
+			next.ServeHTTP(w, r)
+		})
+	}
+	handler := rawBypass(mw)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	tbl := []struct {
+		name    string
+		match   *discovery.MatchedRoute
+		applied bool
+	}{
+		{"no match", nil, true},
+		{"regular route", &discovery.MatchedRoute{Mapper: discovery.URLMapper{}}, true},
+		{"raw route", &discovery.MatchedRoute{Mapper: discovery.URLMapper{Raw: true}}, false},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ws/something", http.NoBody)
+			if tt.match != nil {
+				req = req.WithContext(context.WithValue(req.Context(), ctxMatch, *tt.match))
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "ok", rr.Body.String())
+			assert.Equal(t, tt.applied, rr.Header().Get("X-Middleware") == "called")
+		})
+	}
+}
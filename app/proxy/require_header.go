@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// requireHeadersHandler rejects requests to routes with RequireHeaders missing any of the required headers,
+// with 400. Only presence checked, header names matched case-insensitive
+func (h *Http) requireHeadersHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, hdr := range match.Mapper.RequireHeaders {
+			if len(r.Header.Values(hdr)) == 0 {
+				log.Printf("[DEBUG] required header %s missing for %s %s, rejected request from %s",
+					hdr, match.Mapper.Server, match.Mapper.SrcMatch.String(), r.RemoteAddr)
+				h.Reporter.Report(w, http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_requireHeadersHandler(t *testing.T) {
+	h := Http{Reporter: &ErrorReporter{}}
+	handler := h.requireHeadersHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	tbl := []struct {
+		name    string
+		require []string
+		headers map[string]string
+		code    int
+	}{
+		{"no required headers", nil, nil, http.StatusOK},
+		{"present", []string{"X-Api-Key"}, map[string]string{"X-Api-Key": "123"}, http.StatusOK},
+		{"case insensitive", []string{"x-api-key", "AUTHORIZATION"},
+			map[string]string{"X-API-KEY": "123", "authorization": "Bearer 123"}, http.StatusOK},
+		{"empty value present", []string{"X-Api-Key"}, map[string]string{"X-Api-Key": ""}, http.StatusOK},
+		{"missing", []string{"X-Api-Key"}, nil, http.StatusBadRequest},
+		{"one of missing", []string{"X-Api-Key", "X-Tenant"}, map[string]string{"X-Api-Key": "123"}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/something", http.NoBody)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			m := discovery.MatchedRoute{Mapper: discovery.URLMapper{RequireHeaders: tt.require}}
+			req = req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.code, rr.Code)
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/not-matched", http.NoBody))
+	assert.Equal(t, http.StatusOK, rr.Code, "no match, passed as is")
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// RouteLogs keeps access log writers of routes with LogFile target, one writer per target shared by all
+// routes logged to it. Writer opened on the first request of the target and reused for the next ones.
+// Writers of targets not used by any route anymore closed by Sync, and reopened if the target comes back
+type RouteLogs struct {
+	Open func(target string) (io.WriteCloser, error) // makes writer of the target, i.e. rotated file
+
+	lock    sync.Mutex
+	writers map[string]io.WriteCloser
+}
+
+// writer returns access log writer of the matched route, def for requests without route log target
+func (l *RouteLogs) writer(r *http.Request, def io.Writer) io.Writer {
+	if l == nil {
+		return def
+	}
+	match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+	if !ok || match.Mapper.LogFile == "" {
+		return def
+	}
+	target := match.Mapper.LogFile
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if wr, ok := l.writers[target]; ok {
+		return wr
+	}
+	wr, err := l.Open(target)
+	if err != nil {
+		log.Printf("[WARN] can't open access log %s, logged to the main log, %v", target, err)
+		return def
+	}
+	if l.writers == nil {
+		l.writers = map[string]io.WriteCloser{}
+	}
+	l.writers[target] = wr
+	return wr
+}
+
+// Sync closes writers of targets not used by any of mappers, i.e. after the last route of the target removed
+func (l *RouteLogs) Sync(mappers []discovery.URLMapper) {
+	used := map[string]bool{}
+	for _, m := range mappers {
+		if m.LogFile != "" {
+			used[m.LogFile] = true
+		}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for target, wr := range l.writers {
+		if used[target] {
+			continue
+		}
+		if err := wr.Close(); err != nil {
+			log.Printf("[WARN] can't close access log %s, %v", target, err)
+		}
+		delete(l.writers, target)
+		log.Printf("[DEBUG] access log %s closed, no routes use it", target)
+	}
+}
+
+// Close all open writers
+func (l *RouteLogs) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var errs []error
+	for target, wr := range l.writers {
+		if err := wr.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(l.writers, target)
+	}
+	return errors.Join(errs...)
+}
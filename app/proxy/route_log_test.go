@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+type bufCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufCloser) Close() error { b.closed = true; return nil }
+
+func TestRouteLogs(t *testing.T) {
+	opened := map[string][]*bufCloser{}
+	rl := &RouteLogs{Open: func(target string) (io.WriteCloser, error) {
+		if target == "bad" {
+			return nil, errors.New("can't open")
+		}
+		b := &bufCloser{}
+		opened[target] = append(opened[target], b)
+		return b, nil
+	}}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("ok")) })
+	mapper := func(target string) discovery.URLMapper {
+		return discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/" + target + "/(.*)"), LogFile: target}
+	}
+	request := func(path string, m discovery.URLMapper) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.com"+path, http.NoBody)
+		return req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: m}))
+	}
+
+	main := bytes.Buffer{}
+	h := accessLogHandler(&main, false, rl)(next)
+	h.ServeHTTP(httptest.NewRecorder(), request("/t1/a", mapper("t1")))
+	h.ServeHTTP(httptest.NewRecorder(), request("/t1/b", mapper("t1")))
+	h.ServeHTTP(httptest.NewRecorder(), request("/t2/a", mapper("t2")))
+	h.ServeHTTP(httptest.NewRecorder(), request("/other", mapper("")))
+	h.ServeHTTP(httptest.NewRecorder(), request("/bad/a", mapper("bad")))
+
+	require.Len(t, opened["t1"], 1, "writer reused")
+	require.Len(t, opened["t2"], 1)
+	assert.Contains(t, opened["t1"][0].String(), "example.com/t1/a")
+	assert.Contains(t, opened["t1"][0].String(), "example.com/t1/b")
+	assert.NotContains(t, opened["t1"][0].String(), "/t2/a")
+	assert.Contains(t, opened["t2"][0].String(), "example.com/t2/a")
+	assert.Contains(t, main.String(), "example.com/other")
+	assert.Contains(t, main.String(), "example.com/bad/a", "logged to the main log if target can't be opened")
+	assert.NotContains(t, main.String(), "/t1/")
+
+	rl.Sync([]discovery.URLMapper{mapper("t1"), mapper("")})
+	assert.False(t, opened["t1"][0].closed)
+	assert.True(t, opened["t2"][0].closed, "no routes of t2")
+
+	h.ServeHTTP(httptest.NewRecorder(), request("/t2/c", mapper("t2")))
+	require.Len(t, opened["t2"], 2, "reopened on route back")
+	assert.Contains(t, opened["t2"][1].String(), "example.com/t2/c")
+
+	require.NoError(t, rl.Close())
+	assert.True(t, opened["t1"][0].closed)
+	assert.True(t, opened["t2"][1].closed)
+}
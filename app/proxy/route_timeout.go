@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// idleTimer cancels the upstream request of the route with IdleTimeout when nothing read from upstream for too long
+type idleTimer struct {
+	timer *time.Timer
+	idle  time.Duration
+}
+
+// withRouteTimeouts limits upstream request of the route by its Timeout and IdleTimeout. Total timeout limits
+// the whole request, including reading of the response body. Idle timeout cancels the request if upstream
+// sent nothing for the duration, first waiting for response headers and after that between body reads,
+// so long-lived streams stay open while upstream keeps sending. Returned cancel should be called after the request
+func withRouteTimeouts(r *http.Request, m discovery.URLMapper) (*http.Request, context.CancelFunc) {
+	if m.Timeout <= 0 && m.IdleTimeout <= 0 {
+		return r, func() {}
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if m.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(r.Context(), m.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(r.Context())
+	}
+	if m.IdleTimeout <= 0 {
+		return r.WithContext(ctx), cancel
+	}
+
+	it := &idleTimer{timer: time.AfterFunc(m.IdleTimeout, cancel), idle: m.IdleTimeout}
+	ctx = context.WithValue(ctx, ctxIdleTimer, it)
+	return r.WithContext(ctx), func() {
+		it.timer.Stop()
+		cancel()
+	}
+}
+
+// idleResponse makes response body of the route with IdleTimeout to restart the idle timer on each read.
+// Upgraded (i.e. websocket) connections not limited by idle timeout, as their body can't be wrapped
+func idleResponse(resp *http.Response) {
+	it, ok := resp.Request.Context().Value(ctxIdleTimer).(*idleTimer)
+	if !ok {
+		return
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		it.timer.Stop()
+		return
+	}
+	it.timer.Reset(it.idle)
+	resp.Body = &idleBody{ReadCloser: resp.Body, it: it}
+}
+
+type idleBody struct {
+	io.ReadCloser
+	it *idleTimer
+}
+
+// Read reads from upstream body and restarts the idle timer
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.it.timer.Reset(b.it.idle)
+	}
+	return n, err
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_proxyHandlerRouteTimeouts(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var delay time.Duration
+		switch r.URL.Path {
+		case "/stream": // sends a chunk every 20ms for 200ms
+			delay = 20 * time.Millisecond
+		case "/stall": // sends a chunk and stalls
+			delay = time.Second
+		}
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(w, "%d", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer ds.Close()
+
+	tbl := []struct {
+		name, path    string
+		timeout, idle time.Duration
+		full          bool // full body received, not cut off
+		min, max      time.Duration
+	}{
+		{"stream, idle timeout", "/stream", 0, 100 * time.Millisecond, true, 180 * time.Millisecond, 2 * time.Second},
+		{"stream, total timeout", "/stream", 100 * time.Millisecond, 0, false, 90 * time.Millisecond, 150 * time.Millisecond},
+		{"stall, idle timeout", "/stall", 0, 100 * time.Millisecond, false, 90 * time.Millisecond, 500 * time.Millisecond},
+		{"stream, both", "/stream", time.Second, 100 * time.Millisecond, true, 180 * time.Millisecond, time.Second},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			matcherMock := &MatcherMock{
+				MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+					return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+						{Destination: ds.URL + tt.path, Alive: true,
+							Mapper: discovery.URLMapper{Timeout: tt.timeout, IdleTimeout: tt.idle, Unbuffered: true}},
+					}}
+				},
+			}
+			h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}}
+			ts := httptest.NewServer(h.matchHandler(h.proxyHandler(h.makeTransport())))
+			defer ts.Close()
+
+			st := time.Now()
+			resp, err := http.Get(ts.URL + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body) // cut off body ends with error
+			took := time.Since(st)
+			if tt.full {
+				assert.Equal(t, "0123456789", string(body))
+			} else {
+				assert.True(t, len(body) > 0 && len(body) < 10, "cut off, %q", string(body))
+			}
+			assert.True(t, took >= tt.min && took < tt.max, "took %s", took)
+		})
+	}
+}
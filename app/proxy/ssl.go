@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"strings"
@@ -35,6 +36,10 @@ type SSLConfig struct {
 	ACMEEmail     string
 	FQDNs         []string
 	RedirHTTPPort int
+
+	// ClientCAs verifies client certificates, if set. Certificates requested but not required on handshake,
+	// as the listener is shared by all routes. Routes with MTLS reject requests without verified certificate
+	ClientCAs *x509.CertPool
 }
 
 // httpToHTTPSRouter creates new router which does redirect from http to https server
@@ -92,7 +97,7 @@ func (h *Http) makeHTTPSServer(address string, router http.Handler) *http.Server
 }
 
 func (h *Http) makeTLSConfig() *tls.Config {
-	return &tls.Config{
+	cfg := &tls.Config{
 		PreferServerCipherSuites: true,
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
@@ -107,4 +112,9 @@ func (h *Http) makeTLSConfig() *tls.Config {
 			tls.CurveP384,
 		},
 	}
+	if h.SSLConfig.ClientCAs != nil {
+		cfg.ClientCAs = h.SSLConfig.ClientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
 }
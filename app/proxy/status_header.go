@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// setStatusHeaders sets response headers of the route conditioned on the upstream status, i.e. Cache-Control
+// for 5xx. Header with multiple matching conditions set by the most specific one, 503 wins over 5xx, and by the
+// first listed of the same specificity. Header set this way replaces the upstream one
+func setStatusHeaders(resp *http.Response, hdrs []discovery.StatusHeader) {
+	best := map[string]discovery.StatusHeader{}
+	for _, sh := range hdrs {
+		if resp.StatusCode < sh.From || resp.StatusCode > sh.To {
+			continue
+		}
+		if prev, ok := best[sh.Name]; ok && prev.To-prev.From <= sh.To-sh.From {
+			continue
+		}
+		best[sh.Name] = sh
+	}
+	for name, sh := range best {
+		resp.Header.Set(name, sh.Value)
+	}
+}
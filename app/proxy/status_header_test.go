@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func Test_setStatusHeaders(t *testing.T) {
+	hdrs := []discovery.StatusHeader{
+		{From: 500, To: 599, Name: "Cache-Control", Value: "no-store"},
+		{From: 503, To: 503, Name: "Cache-Control", Value: "no-cache"},
+		{From: 500, To: 599, Name: "Cache-Control", Value: "private"},
+		{From: 400, To: 599, Name: "X-Error", Value: "true"},
+		{From: 404, To: 404, Name: "X-Missing", Value: "1"},
+	}
+	tbl := []struct {
+		code int
+		res  map[string]string
+	}{
+		{200, map[string]string{"Cache-Control": "max-age=60"}},
+		{404, map[string]string{"Cache-Control": "max-age=60", "X-Error": "true", "X-Missing": "1"}},
+		{500, map[string]string{"Cache-Control": "no-store", "X-Error": "true"}},
+		{503, map[string]string{"Cache-Control": "no-cache", "X-Error": "true"}},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(http.StatusText(tt.code), func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.code, Header: http.Header{"Cache-Control": []string{"max-age=60"}},
+				Request: httptest.NewRequest("GET", "/ping", http.NoBody)}
+			setStatusHeaders(resp, hdrs)
+			res := map[string]string{}
+			for k := range resp.Header {
+				res[k] = resp.Header.Get(k)
+			}
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// rewriteStatus changes upstream response status by the route's status map, i.e. 404 to 200 for a probe endpoint.
+// Headers and body of the response kept as-is
+func rewriteStatus(resp *http.Response, statusMap map[int]int) {
+	to, ok := statusMap[resp.StatusCode]
+	if !ok {
+		return
+	}
+	log.Printf("[DEBUG] rewrite status %d to %d for %s", resp.StatusCode, to, resp.Request.URL.Path)
+	resp.StatusCode = to
+	resp.Status = fmt.Sprintf("%d %s", to, http.StatusText(to))
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rewriteStatus(t *testing.T) {
+	tbl := []struct {
+		code      int
+		statusMap map[int]int
+		res       int
+		status    string
+	}{
+		{404, map[int]int{404: 200}, 200, "200 OK"},
+		{502, map[int]int{404: 200, 502: 503}, 503, "503 Service Unavailable"},
+		{500, map[int]int{404: 200}, 500, "500 Internal Server Error"},
+		{404, nil, 404, "404 Not Found"},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(http.StatusText(tt.code), func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.code, Status: fmt.Sprintf("%d %s", tt.code, http.StatusText(tt.code)),
+				Request: httptest.NewRequest("GET", "/ping", http.NoBody)}
+			rewriteStatus(resp, tt.statusMap)
+			assert.Equal(t, tt.res, resp.StatusCode)
+			assert.Equal(t, tt.status, resp.Status)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// stickyMatch picks the destination pinned by sticky cookie. If the cookie is missing or the pinned destination
+// is gone (dead or removed), picks a new one with selectMatch and re-pins the client to it.
+// matches expected to be alive and non-empty.
+func stickyMatch(w http.ResponseWriter, r *http.Request, name string, matches []discovery.MatchedRoute,
+	picker LBSelector) discovery.MatchedRoute {
+
+	if c, err := r.Cookie(name); err == nil {
+		for _, m := range matches {
+			if stickyID(m) == c.Value {
+				return m
+			}
+		}
+	}
+
+	m := selectMatch(matches, picker)
+	http.SetCookie(w, &http.Cookie{Name: name, Value: stickyID(m), Path: "/", HttpOnly: true})
+	return m
+}
+
+// stickyID makes an opaque id of the destination, stable across refreshes and not exposing upstream address
+func stickyID(m discovery.MatchedRoute) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(m.Mapper.Server + "|" + m.Mapper.Dst + "|" + m.Mapper.Socket))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestStickyMatch(t *testing.T) {
+	matches := []discovery.MatchedRoute{
+		{Destination: "http://127.0.0.1:8081/api", Alive: true, Mapper: discovery.URLMapper{Dst: "http://127.0.0.1:8081/$1"}},
+		{Destination: "http://127.0.0.2:8081/api", Alive: true, Mapper: discovery.URLMapper{Dst: "http://127.0.0.2:8081/$1"}},
+		{Destination: "http://127.0.0.3:8081/api", Alive: true, Mapper: discovery.URLMapper{Dst: "http://127.0.0.3:8081/$1"}},
+	}
+	assert.NotEqual(t, stickyID(matches[0]), stickyID(matches[1]))
+
+	picker := LBSelectorFunc(func(n int) int { return n - 1 }) // always the last one
+
+	t.Run("no cookie, pin to selected", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		wr := httptest.NewRecorder()
+		m := stickyMatch(wr, req, "sticky", matches, picker)
+		assert.Equal(t, "http://127.0.0.3:8081/api", m.Destination)
+		cookies := wr.Result().Cookies()
+		require.Equal(t, 1, len(cookies))
+		assert.Equal(t, "sticky", cookies[0].Name)
+		assert.Equal(t, stickyID(matches[2]), cookies[0].Value)
+	})
+
+	t.Run("cookie pinned to alive destination", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "sticky", Value: stickyID(matches[1])})
+		wr := httptest.NewRecorder()
+		m := stickyMatch(wr, req, "sticky", matches, picker)
+		assert.Equal(t, "http://127.0.0.2:8081/api", m.Destination)
+		assert.Empty(t, wr.Result().Cookies(), "cookie not changed")
+	})
+
+	t.Run("pinned destination gone, re-pin", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "sticky", Value: stickyID(matches[1])})
+		wr := httptest.NewRecorder()
+		m := stickyMatch(wr, req, "sticky", []discovery.MatchedRoute{matches[0]}, picker)
+		assert.Equal(t, "http://127.0.0.1:8081/api", m.Destination)
+		cookies := wr.Result().Cookies()
+		require.Equal(t, 1, len(cookies))
+		assert.Equal(t, stickyID(matches[0]), cookies[0].Value)
+	})
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const timingHeader = "X-Upstream-Time"
+
+// withUpstreamStart marks start of the upstream request, for routes with TimingHeader
+func withUpstreamStart(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxStartTime, time.Now()))
+}
+
+// setTimingHeader sets X-Upstream-Time response header to the time passed since the upstream request start,
+// i.e. 12.345ms. Called on upstream response headers, before the body read, so the time measured is the upstream
+// round-trip to the first byte of the response. For streamed and large responses the body transfer is not included
+func setTimingHeader(resp *http.Response) {
+	start, ok := resp.Request.Context().Value(ctxStartTime).(time.Time)
+	if !ok {
+		return
+	}
+	resp.Header.Set(timingHeader, time.Since(start).Round(time.Microsecond).String())
+}
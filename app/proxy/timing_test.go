@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_proxyHandlerTimingHeader(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond) // body transfer, not included
+		_, _ = w.Write([]byte("response"))
+	}))
+	defer ds.Close()
+
+	var mapper discovery.URLMapper
+	matcherMock := &MatcherMock{
+		MatchFunc: func(srv string, src string, info discovery.RequestInfo) discovery.Matches {
+			return discovery.Matches{MatchType: discovery.MTProxy, Routes: []discovery.MatchedRoute{
+				{Destination: ds.URL + "/api", Alive: true, Mapper: mapper},
+			}}
+		},
+	}
+	h := Http{Matcher: matcherMock, LBSelector: &FailoverSelector{}, Reporter: &ErrorReporter{}}
+	handler := h.matchHandler(h.proxyHandler(h.makeTransport()))
+
+	for _, unbuffered := range []bool{false, true} {
+		mapper = discovery.URLMapper{TimingHeader: true, Unbuffered: unbuffered}
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, httptest.NewRequest("GET", "http://example.com/api", http.NoBody))
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "response", wr.Body.String())
+		d, err := time.ParseDuration(wr.Header().Get(timingHeader))
+		require.NoError(t, err, "unbuffered %v", unbuffered)
+		assert.GreaterOrEqual(t, d, 50*time.Millisecond, "unbuffered %v", unbuffered)
+		assert.Less(t, d, 250*time.Millisecond, "time to the first byte, unbuffered %v", unbuffered)
+	}
+
+	mapper = discovery.URLMapper{}
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, httptest.NewRequest("GET", "http://example.com/api", http.NoBody))
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Empty(t, wr.Header().Get(timingHeader), "no timing header for the route")
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// routeTransport selects the upstream transport by the matched route, i.e. h2c for routes with UPH2C proto,
+// http/1.x only for UPHTTP11 and UPHTTP10 protos, unix socket transport for routes with Socket and tls transport
+// with overridden server name for routes with SNI. Routes with SourceIP served by transport dialing from the local
+// address, with the route's SNI if set. Requests without matched route served by the default transport.
+type routeTransport struct {
+	def    http.RoundTripper
+	h2c    http.RoundTripper
+	h1     http.RoundTripper // http/1.x only, for routes with UPHTTP11 and UPHTTP10 proto
+	unix   func(socket string) http.RoundTripper
+	sni    func(serverName string) http.RoundTripper
+	source func(sourceIP, serverName string) http.RoundTripper
+
+	sockets sync.Map // socket path -> http.RoundTripper, each socket has its own connections pool
+	servers sync.Map // sni server name -> http.RoundTripper, tls connections can't be shared between server names
+	sources sync.Map // source ip and sni server name -> http.RoundTripper, connections bound to the local address
+}
+
+// RoundTrip implements http.RoundTripper. Routes with NoKeepAlive use the same transports, but the request
+// marked to close connection, so the transport sends "Connection: close" and never returns the connection
+// to the idle pool. This way no extra per-route transports (and pools) made for such routes.
+func (t *routeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+	if !ok {
+		return t.def.RoundTrip(r)
+	}
+	if match.Mapper.FollowRedirects {
+		return followRedirects(r, func(req *http.Request) (*http.Response, error) { return t.routeRoundTrip(req, match) })
+	}
+	return t.routeRoundTrip(r, match)
+}
+
+func (t *routeTransport) routeRoundTrip(r *http.Request, match discovery.MatchedRoute) (*http.Response, error) {
+	if match.Mapper.Proto == discovery.UPHTTP10 {
+		var err error
+		if r, err = downgradeHTTP10(r); err != nil {
+			return nil, err
+		}
+	}
+	if match.Mapper.NoKeepAlive && !r.Close {
+		r = r.Clone(r.Context()) // round tripper should not modify the request
+		r.Close = true
+	}
+	if match.Mapper.Socket != "" {
+		tr, found := t.sockets.Load(match.Mapper.Socket)
+		if !found {
+			tr, _ = t.sockets.LoadOrStore(match.Mapper.Socket, t.unix(match.Mapper.Socket))
+		}
+		return tr.(http.RoundTripper).RoundTrip(r)
+	}
+	if match.Mapper.SourceIP != "" {
+		key := sourceKey(match.Mapper.SourceIP, match.Mapper.SNI)
+		tr, found := t.sources.Load(key)
+		if !found {
+			tr, _ = t.sources.LoadOrStore(key, t.source(match.Mapper.SourceIP, match.Mapper.SNI))
+		}
+		return tr.(http.RoundTripper).RoundTrip(r)
+	}
+	if match.Mapper.SNI != "" {
+		tr, found := t.servers.Load(match.Mapper.SNI)
+		if !found {
+			tr, _ = t.servers.LoadOrStore(match.Mapper.SNI, t.sni(match.Mapper.SNI))
+		}
+		return tr.(http.RoundTripper).RoundTrip(r)
+	}
+	switch {
+	case match.Mapper.Proto == discovery.UPH2C && !match.Mapper.WebSocket: // websocket upgrade needs http/1.1
+		return t.h2c.RoundTrip(r)
+	case match.Mapper.Proto == discovery.UPHTTP11, match.Mapper.Proto == discovery.UPHTTP10:
+		return t.h1.RoundTrip(r)
+	}
+	return t.def.RoundTrip(r)
+}
+
+// Sync drops transports of sockets, sni server names and source ips not used by any of mappers anymore,
+// with their idle connections closed. Called on routes table updates, so the pools don't grow with routes gone
+func (t *routeTransport) Sync(mappers []discovery.URLMapper) {
+	sockets, servers, sources := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, m := range mappers {
+		switch {
+		case m.Socket != "":
+			sockets[m.Socket] = true
+		case m.SourceIP != "":
+			sources[sourceKey(m.SourceIP, m.SNI)] = true
+		case m.SNI != "":
+			servers[m.SNI] = true
+		}
+	}
+
+	drop := func(pool *sync.Map, used map[string]bool) {
+		pool.Range(func(key, tr any) bool {
+			if used[key.(string)] {
+				return true
+			}
+			pool.Delete(key)
+			if ci, ok := tr.(interface{ CloseIdleConnections() }); ok {
+				ci.CloseIdleConnections()
+			}
+			return true
+		})
+	}
+	drop(&t.sockets, sockets)
+	drop(&t.servers, servers)
+	drop(&t.sources, sources)
+}
+
+// sourceKey is a key of source ip transport, connections bound to the local address and made for sni server name
+func sourceKey(sourceIP, serverName string) string {
+	return sourceIP + "|" + serverName
+}
+
+// downgradeHTTP10 makes request compatible with http/1.0 upstream. Body of unknown length buffered, as http/1.0
+// has no chunked encoding, and the connection closed after the response, as there is no keep-alive by default.
+// The request line stays HTTP/1.1, go client always sends it, but nothing 1.0 server can't handle used.
+func downgradeHTTP10(r *http.Request) (*http.Request, error) {
+	res := r.Clone(r.Context()) // round tripper should not modify the request
+	res.Close = true
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength > 0 { // zero length with body means unknown
+		return res, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("can't read request body for http/1.0 upstream: %w", err)
+	}
+	res.ContentLength = int64(len(body))
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	res.TransferEncoding = nil
+	return res, nil
+}
+
+// makeTransport creates upstream transport, default http one, h2c (http/2 with prior knowledge), unix socket, sni
+// and source ip ones
+func (h *Http) makeTransport() *routeTransport {
+	dialer := &net.Dialer{Timeout: h.Timeouts.Dial, KeepAlive: h.Timeouts.KeepAlive}
+	makeHTTPTransport := func(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+		return &http.Transport{
+			ResponseHeaderTimeout: h.Timeouts.ResponseHeader,
+			DialContext:           dial,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       h.Timeouts.IdleConn,
+			TLSHandshakeTimeout:   h.Timeouts.TLSHandshake,
+			ExpectContinueTimeout: h.Timeouts.ExpectContinue,
+			TLSClientConfig:       &tls.Config{InsecureSkipVerify: h.Insecure}, //nolint:gosec // G402: User defined option to disable verification for self-signed certificates
+		}
+	}
+
+	return &routeTransport{
+		def: makeHTTPTransport(dialer.DialContext),
+		unix: func(socket string) http.RoundTripper {
+			// destination's host ignored, always dial the socket
+			return makeHTTPTransport(func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			})
+		},
+		sni: func(serverName string) http.RoundTripper {
+			tr := makeHTTPTransport(dialer.DialContext)
+			tr.TLSClientConfig.ServerName = serverName // handshake and cert verification with sni instead of dst host
+			return tr
+		},
+		source: func(sourceIP, serverName string) http.RoundTripper {
+			d := *dialer
+			d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(sourceIP)} // any local port
+			tr := makeHTTPTransport(d.DialContext)
+			tr.TLSClientConfig.ServerName = serverName
+			return tr
+		},
+		h1: func() http.RoundTripper {
+			tr := makeHTTPTransport(dialer.DialContext)
+			tr.ForceAttemptHTTP2 = false
+			tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{} // disables http/2
+			return tr
+		}(),
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			// h2c doesn't use tls, dial plain tcp connection for http:// destinations
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			ReadIdleTimeout: h.Timeouts.KeepAlive,
+		},
+	}
+}
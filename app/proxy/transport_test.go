@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_makeTransport(t *testing.T) {
+	ds := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer ds.Close()
+
+	h := Http{Timeouts: Timeouts{Dial: time.Second, KeepAlive: time.Second}}
+	tr := h.makeTransport()
+
+	tbl := []struct {
+		name  string
+		ctx   context.Context
+		proto string
+	}{
+		{"no match", context.Background(), "HTTP/1.1"},
+		{"http", context.WithValue(context.Background(), ctxMatch,
+			discovery.MatchedRoute{Mapper: discovery.URLMapper{Proto: discovery.UPHTTP}}), "HTTP/1.1"},
+		{"h2c", context.WithValue(context.Background(), ctxMatch,
+			discovery.MatchedRoute{Mapper: discovery.URLMapper{Proto: discovery.UPH2C}}), "HTTP/2.0"},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(tt.ctx, "GET", ds.URL+"/something", http.NoBody)
+			require.NoError(t, err)
+			resp, err := tr.RoundTrip(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.proto, string(body))
+		})
+	}
+}
+
+func TestHttp_makeTransportUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "upstream.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	ds := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("socket " + r.URL.Path))
+	}))
+	ds.Listener = l
+	ds.Start()
+	defer ds.Close()
+
+	h := Http{Timeouts: Timeouts{Dial: time.Second, KeepAlive: time.Second}}
+	tr := h.makeTransport()
+
+	ctx := context.WithValue(context.Background(), ctxMatch,
+		discovery.MatchedRoute{Mapper: discovery.URLMapper{Socket: socket}})
+	for i := 0; i < 2; i++ { // second call uses cached transport
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://c1/something", http.NoBody)
+		require.NoError(t, err)
+		resp, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "socket /something", string(body))
+	}
+
+	cached := func() (res []string) {
+		tr.sockets.Range(func(key, _ any) bool {
+			res = append(res, key.(string))
+			return true
+		})
+		return res
+	}
+	tr.Sync([]discovery.URLMapper{{Socket: socket}, {SNI: "example.com"}})
+	assert.Equal(t, []string{socket}, cached(), "socket still used")
+	tr.Sync([]discovery.URLMapper{{SNI: "example.com"}})
+	assert.Empty(t, cached(), "socket transport dropped")
+}
+
+func TestHttp_makeTransportSNI(t *testing.T) {
+	ds := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("sni " + r.TLS.ServerName))
+	}))
+	defer ds.Close()
+
+	h := Http{Timeouts: Timeouts{Dial: time.Second, KeepAlive: time.Second}, Insecure: true}
+	tr := h.makeTransport()
+
+	tbl := []struct {
+		sni, res string
+	}{
+		{"", "sni "}, // ip address destination, no sni sent
+		{"svc1.internal", "sni svc1.internal"},
+		{"svc2.internal", "sni svc2.internal"},
+		{"svc1.internal", "sni svc1.internal"}, // cached transport
+	}
+	for _, tt := range tbl {
+		ctx := context.WithValue(context.Background(), ctxMatch,
+			discovery.MatchedRoute{Mapper: discovery.URLMapper{SNI: tt.sni}})
+		req, err := http.NewRequestWithContext(ctx, "GET", ds.URL+"/something", http.NoBody)
+		require.NoError(t, err)
+		resp, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tt.res, string(body))
+	}
+}
+
+func TestHttp_makeTransportSourceIP(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		_, _ = w.Write([]byte("from " + host))
+	}))
+	defer ds.Close()
+
+	h := Http{Timeouts: Timeouts{Dial: time.Second, KeepAlive: time.Second}}
+	tr := h.makeTransport()
+
+	tbl := []struct {
+		sourceIP, res string
+	}{
+		{"", "from 127.0.0.1"},
+		{"127.0.0.2", "from 127.0.0.2"},
+		{"127.0.0.3", "from 127.0.0.3"},
+		{"127.0.0.2", "from 127.0.0.2"}, // cached transport
+	}
+	for _, tt := range tbl {
+		ctx := context.WithValue(context.Background(), ctxMatch,
+			discovery.MatchedRoute{Mapper: discovery.URLMapper{SourceIP: tt.sourceIP}})
+		req, err := http.NewRequestWithContext(ctx, "GET", ds.URL+"/something", http.NoBody)
+		require.NoError(t, err)
+		resp, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tt.res, string(body))
+	}
+
+	// address not assigned to the host can't be bound
+	ctx := context.WithValue(context.Background(), ctxMatch,
+		discovery.MatchedRoute{Mapper: discovery.URLMapper{SourceIP: "192.0.2.1"}})
+	req, err := http.NewRequestWithContext(ctx, "GET", ds.URL+"/something", http.NoBody)
+	require.NoError(t, err)
+	_, err = tr.RoundTrip(req) // nolint:bodyclose // error expected
+	assert.Error(t, err)
+}
+
+func TestHttp_makeTransportNoKeepAlive(t *testing.T) {
+	var conns int32
+	ds := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(fmt.Sprintf("close %t", r.Close)))
+	}))
+	ds.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ds.Start()
+	defer ds.Close()
+
+	h := Http{Timeouts: Timeouts{Dial: time.Second, KeepAlive: time.Second}}
+	tr := h.makeTransport()
+
+	call := func(noKeepAlive bool) string {
+		ctx := context.WithValue(context.Background(), ctxMatch,
+			discovery.MatchedRoute{Mapper: discovery.URLMapper{NoKeepAlive: noKeepAlive}})
+		req, err := http.NewRequestWithContext(ctx, "GET", ds.URL+"/something", http.NoBody)
+		require.NoError(t, err)
+		resp, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.False(t, req.Close, "original request not modified")
+		return string(body)
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "close false", call(false))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns), "connection reused")
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "close true", call(true))
+	}
+	// the first one reuses idle connection and closes it after the response
+	assert.Equal(t, int32(3), atomic.LoadInt32(&conns), "connection not reused")
+}
+
+func TestHttp_makeTransportHTTP1(t *testing.T) {
+	ds := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(fmt.Sprintf("%s len=%d te=%v close=%t body=%s", r.Proto, r.ContentLength,
+			r.TransferEncoding, r.Close, body)))
+	}))
+	ds.EnableHTTP2 = true
+	ds.StartTLS()
+	defer ds.Close()
+
+	h := Http{Timeouts: Timeouts{Dial: time.Second, KeepAlive: time.Second}, Insecure: true}
+	tr := h.makeTransport()
+
+	tbl := []struct {
+		name  string
+		proto discovery.UpstreamProto
+		res   string
+	}{
+		{"default", discovery.UPHTTP, "HTTP/2.0 len=-1 te=[] close=false body=data"},
+		{"http1.1", discovery.UPHTTP11, "HTTP/1.1 len=-1 te=[chunked] close=false body=data"},
+		{"http1.0", discovery.UPHTTP10, "HTTP/1.1 len=4 te=[] close=true body=data"},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), ctxMatch,
+				discovery.MatchedRoute{Mapper: discovery.URLMapper{Proto: tt.proto}})
+			// body of unknown length, sent chunked to http/1.1 upstream
+			req, err := http.NewRequestWithContext(ctx, "POST", ds.URL+"/something", io.NopCloser(strings.NewReader("data")))
+			require.NoError(t, err)
+			resp, err := tr.RoundTrip(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, string(body))
+		})
+	}
+}